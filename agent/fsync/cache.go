@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// evictChunks removes the least recently used chunks of chunksDir until they
+// take at most maxSize bytes. The chunks of the manifest are marked as used
+// and never evicted, so the limit is exceeded if they are larger. The
+// modification time of a chunk records its last use, it survives the agent.
+func evictChunks(chunksDir string, m *Manifest, maxSize int64) error {
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	needed := make(map[string]bool, len(m.Chunks))
+	for _, c := range m.Chunks {
+		needed[c.Hash] = true
+	}
+
+	type cachedChunk struct {
+		name    string
+		size    int64
+		lastUse time.Time
+	}
+	var stale []cachedChunk
+	var total int64
+	now := time.Now()
+	for _, e := range entries {
+		// the chunks being downloaded are not in the cache yet
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		if needed[e.Name()] {
+			if err := os.Chtimes(filepath.Join(chunksDir, e.Name()), now, now); err != nil {
+				klog.V(2).Infof("Failed to mark chunk %s as used: %v", e.Name(), err)
+			}
+			continue
+		}
+		stale = append(stale, cachedChunk{name: e.Name(), size: info.Size(), lastUse: info.ModTime()})
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].lastUse.Before(stale[j].lastUse) })
+	evicted := 0
+	for _, c := range stale {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(chunksDir, c.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= c.size
+		evicted++
+	}
+	if evicted > 0 {
+		klog.Infof("Evicted %d chunks from the cache, %d bytes cached", evicted, total)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aojea/krun/pkg/cdc"
+)
+
+func TestEvictChunks(t *testing.T) {
+	// stale-0 is the least recently used, the manifest chunks are the oldest
+	stale := []string{"stale-0", "stale-1", "stale-2", "stale-3", "stale-4"}
+	needed := []string{"needed-0", "needed-1"}
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		want    []string
+	}{
+		{name: "under the limit", maxSize: 1000, want: append(slices.Clone(stale), needed...)},
+		{name: "at the limit", maxSize: 700, want: append(slices.Clone(stale), needed...)},
+		{name: "over the limit", maxSize: 400, want: append([]string{"stale-3", "stale-4"}, needed...)},
+		{name: "manifest over the limit", maxSize: 50, want: needed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunksDir := t.TempDir()
+			now := time.Now()
+			write := func(name string, lastUse time.Time) {
+				path := filepath.Join(chunksDir, name)
+				if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0644); err != nil {
+					t.Fatalf("Failed to write chunk: %v", err)
+				}
+				if err := os.Chtimes(path, lastUse, lastUse); err != nil {
+					t.Fatalf("Failed to set chunk times: %v", err)
+				}
+			}
+			for i, name := range stale {
+				write(name, now.Add(time.Duration(i-len(stale))*time.Hour))
+			}
+			m := &Manifest{}
+			for _, name := range needed {
+				write(name, now.Add(-24*time.Hour))
+				m.Chunks = append(m.Chunks, ChunkInfo{Hash: name, Size: 100})
+			}
+			// a chunk being downloaded is not evicted
+			write("download.tmp", now.Add(-48*time.Hour))
+
+			if err := evictChunks(chunksDir, m, tt.maxSize); err != nil {
+				t.Fatalf("evictChunks failed: %v", err)
+			}
+
+			entries, err := os.ReadDir(chunksDir)
+			if err != nil {
+				t.Fatalf("Failed to read chunks dir: %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			want := append(slices.Clone(tt.want), "download.tmp")
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Expected chunks %v, got %v", want, got)
+			}
+			for _, name := range needed {
+				info, err := os.Stat(filepath.Join(chunksDir, name))
+				if err != nil {
+					t.Fatalf("Failed to stat chunk: %v", err)
+				}
+				if now.Sub(info.ModTime()) > time.Hour {
+					t.Errorf("Expected the manifest chunk %s to be marked as used, last use %v", name, info.ModTime())
+				}
+			}
+		})
+	}
+
+	if err := evictChunks(filepath.Join(t.TempDir(), "missing"), &Manifest{}, 1); err != nil {
+		t.Errorf("Expected no error without chunks dir, got %v", err)
+	}
+}
+
+// TestRunPeerChunkCacheSize syncs different versions to a peer keeping the
+// chunks, the chunks of the old versions are evicted past the limit.
+func TestRunPeerChunkCacheSize(t *testing.T) {
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{}))
+	defer ts.Close()
+
+	peerDir := t.TempDir()
+	peerChunksDir := filepath.Join(peerDir, ChunksDir)
+	if err := os.MkdirAll(peerChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+
+	const version = 64 * 1024
+	// the chunks of the stream hold the tar headers besides the data
+	const maxSize = 3 * (version + 4096)
+	var manifests []cdc.Manifest
+	for i := 0; i < 5; i++ {
+		srcDir := t.TempDir()
+		content := make([]byte, version)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatalf("Failed to generate data: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), content, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		localChunksDir := t.TempDir()
+		m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+		if err != nil {
+			t.Fatalf("GenerateManifest failed: %v", err)
+		}
+		manifests = append(manifests, m)
+		if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+			t.Fatalf("runIngest failed: %v", err)
+		}
+		if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{chunkCacheSize: maxSize}); err != nil {
+			t.Fatalf("runPeer %d failed: %v", i, err)
+		}
+		// the last use is recorded with the modification time, make it differ
+		for _, c := range m.Chunks {
+			past := time.Now().Add(time.Duration(i-10) * time.Minute)
+			if err := os.Chtimes(filepath.Join(peerChunksDir, c.Hash), past, past); err != nil {
+				t.Fatalf("Failed to set chunk times: %v", err)
+			}
+		}
+	}
+
+	var total int64
+	entries, err := os.ReadDir(peerChunksDir)
+	if err != nil {
+		t.Fatalf("Failed to read peer chunks dir: %v", err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatalf("Failed to stat chunk: %v", err)
+		}
+		total += info.Size()
+	}
+	if total > maxSize {
+		t.Errorf("Expected at most %d bytes of chunks, got %d", maxSize, total)
+	}
+	for i, m := range manifests {
+		for _, c := range m.Chunks {
+			_, err := os.Stat(filepath.Join(peerChunksDir, c.Hash))
+			// the last versions fit in the cache
+			if kept := i >= len(manifests)-3; kept != (err == nil) {
+				t.Errorf("Expected chunk %s of version %d kept %v, got %v", c.Hash, i, kept, err)
+			}
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(peerDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read synced file: %v", err)
+	}
+	if len(got) != version {
+		t.Errorf("Expected the last version synced, got %d bytes", len(got))
+	}
+}
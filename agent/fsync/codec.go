@@ -0,0 +1,26 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Chunk codecs (sync with pkg/cdc/codec.go)
+const (
+	CodecGzip = "gzip"
+	// codecPAXRecord carries the chunk codec in the ingest tar stream
+	codecPAXRecord = "KRUN.codec"
+)
+
+// decodeChunk returns a reader with the uncompressed content of a chunk stored with codec
+func decodeChunk(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return io.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported chunk codec %q", codec)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// Delta encoding of a chunk against a similar base chunk: the target size
+// followed by operations copying ranges of the base or inserting new bytes,
+// all the integers are uvarints.
+const (
+	// deltaOpCopy is followed by the offset and the length in the base
+	deltaOpCopy byte = 0
+	// deltaOpInsert is followed by the length and the bytes
+	deltaOpInsert byte = 1
+
+	// deltaBlockSize is the size of the base blocks matched in the target
+	deltaBlockSize = 32
+	// deltaHashPrime is the multiplier of the rolling hash of the blocks
+	deltaHashPrime = 16777619
+
+	// deltaBaseParam is the query parameter naming the base chunk of the peer
+	deltaBaseParam = "base"
+	// deltaBaseHeader is set in the responses with a delta, to the base it applies to
+	deltaBaseHeader = "X-Krun-Delta-Base"
+)
+
+// encodeDelta returns the delta reconstructing target from base
+func encodeDelta(base, target []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(target)))
+	if len(base) < deltaBlockSize || len(target) < deltaBlockSize {
+		return appendDeltaInsert(out, target)
+	}
+
+	// index the aligned blocks of the base by their hash, the first one wins
+	index := make(map[uint32]int, len(base)/deltaBlockSize)
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		h := blockHash(base[off : off+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	// pow is deltaHashPrime^(deltaBlockSize-1) to remove the first byte of the window
+	pow := uint32(1)
+	for i := 0; i < deltaBlockSize-1; i++ {
+		pow *= deltaHashPrime
+	}
+
+	literal := 0
+	i := 0
+	h := blockHash(target[:deltaBlockSize])
+	for i+deltaBlockSize <= len(target) {
+		off, ok := index[h]
+		if ok && bytes.Equal(base[off:off+deltaBlockSize], target[i:i+deltaBlockSize]) {
+			// extend the match backwards into the pending literal and forwards
+			start := i
+			for start > literal && off > 0 && base[off-1] == target[start-1] {
+				start--
+				off--
+			}
+			end := i + deltaBlockSize
+			for end < len(target) && off+end-start < len(base) && base[off+end-start] == target[end] {
+				end++
+			}
+			out = appendDeltaInsert(out, target[literal:start])
+			out = appendDeltaCopy(out, off, end-start)
+			literal, i = end, end
+			if i+deltaBlockSize <= len(target) {
+				h = blockHash(target[i : i+deltaBlockSize])
+			}
+			continue
+		}
+		if i+deltaBlockSize < len(target) {
+			h = (h-uint32(target[i])*pow)*deltaHashPrime + uint32(target[i+deltaBlockSize])
+		}
+		i++
+	}
+	return appendDeltaInsert(out, target[literal:])
+}
+
+// blockHash is the polynomial hash of the block, rolled over the target in encodeDelta
+func blockHash(block []byte) uint32 {
+	var h uint32
+	for _, b := range block {
+		h = h*deltaHashPrime + uint32(b)
+	}
+	return h
+}
+
+func appendDeltaInsert(out, data []byte) []byte {
+	if len(data) == 0 {
+		return out
+	}
+	out = append(out, deltaOpInsert)
+	out = binary.AppendUvarint(out, uint64(len(data)))
+	return append(out, data...)
+}
+
+func appendDeltaCopy(out []byte, offset, length int) []byte {
+	out = append(out, deltaOpCopy)
+	out = binary.AppendUvarint(out, uint64(offset))
+	return binary.AppendUvarint(out, uint64(length))
+}
+
+// applyDelta reconstructs the target encoded by encodeDelta from the base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delta size: %v", err)
+	}
+	// the copies can not produce more than the base for every operation
+	if size > uint64(len(base)+1)*uint64(len(delta)) {
+		return nil, fmt.Errorf("invalid delta size %d", size)
+	}
+	out := make([]byte, 0, min(size, uint64(len(base)+len(delta))))
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delta copy: %v", err)
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delta copy: %v", err)
+			}
+			if offset > uint64(len(base)) || length > uint64(len(base))-offset {
+				return nil, fmt.Errorf("delta copy [%d, +%d) out of the base of %d bytes", offset, length, len(base))
+			}
+			out = append(out, base[offset:offset+length]...)
+		case deltaOpInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delta insert: %v", err)
+			}
+			if length > uint64(r.Len()) {
+				return nil, fmt.Errorf("delta insert of %d bytes, %d left", length, r.Len())
+			}
+			start := len(out)
+			out = append(out, make([]byte, length)...)
+			_, _ = io.ReadFull(r, out[start:])
+		default:
+			return nil, fmt.Errorf("invalid delta operation %d", op)
+		}
+		if uint64(len(out)) > size {
+			return nil, fmt.Errorf("delta produces more than %d bytes", size)
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, fmt.Errorf("delta produced %d bytes, expected %d", len(out), size)
+	}
+	return out, nil
+}
+
+// newDeltaHandler serves the chunk requested with a base as a delta against
+// the base, the chunks are served whole by next if the delta is not smaller or
+// the hub does not have the base. Only the uncompressed chunks have deltas.
+func newDeltaHandler(chunksDir string, codecs *chunkVerifier, verify bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		baseHash := r.URL.Query().Get(deltaBaseParam)
+		hash := filepath.Base(r.URL.Path)
+		if baseHash == "" || !validChunkName(baseHash) || !validChunkName(hash) || baseHash == hash {
+			next.ServeHTTP(w, r)
+			return
+		}
+		delta, err := chunkDelta(chunksDir, codecs, verify, baseHash, hash)
+		if err != nil {
+			klog.V(2).Infof("Serving chunk %s without delta: %v", hash, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(deltaBaseHeader, baseHash)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(delta)))
+		_, _ = w.Write(delta)
+	})
+}
+
+// errDeltaNotSmaller is returned when the chunk is cheaper to send whole
+var errDeltaNotSmaller = errors.New("delta is not smaller than the chunk")
+
+// chunkDelta returns the delta of the chunk against the base, both uncompressed
+func chunkDelta(chunksDir string, codecs *chunkVerifier, verify bool, baseHash, hash string) ([]byte, error) {
+	for _, h := range []string{baseHash, hash} {
+		codec, err := codecs.codec(h)
+		if err != nil {
+			return nil, err
+		}
+		if codec != "" {
+			return nil, fmt.Errorf("chunk %s is stored with codec %s", h, codec)
+		}
+	}
+	if verify {
+		if err := codecs.verify(hash); err != nil {
+			return nil, err
+		}
+	}
+	base, err := os.ReadFile(filepath.Join(chunksDir, baseHash))
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.ReadFile(filepath.Join(chunksDir, hash))
+	if err != nil {
+		return nil, err
+	}
+	delta := encodeDelta(base, target)
+	if len(delta) >= len(target) {
+		return nil, errDeltaNotSmaller
+	}
+	return delta, nil
+}
+
+// validChunkName reports whether the name can only be a file in the chunks directory
+func validChunkName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// deltaBases returns for the chunks missing in chunksDir the chunk of the
+// previous manifest starting at the same offset of the stream, if it is on
+// disk. It is usually the previous version of a modified chunk, as the chunks
+// before it did not change. Only the uncompressed chunks have deltas.
+func deltaBases(chunksDir string, prev, m *Manifest) map[string]string {
+	if prev == nil || normalizeAlgorithm(prev.Algorithm) != normalizeAlgorithm(m.Algorithm) {
+		return nil
+	}
+	// offsets of the previous chunks, in increasing order
+	starts := make([]uint64, len(prev.Chunks))
+	var offset uint64
+	for i, c := range prev.Chunks {
+		starts[i] = offset
+		offset += uint64(c.Size)
+	}
+
+	bases := make(map[string]string)
+	offset = 0
+	for _, c := range m.Chunks {
+		start := offset
+		offset += uint64(c.Size)
+		if c.Codec != "" || bases[c.Hash] != "" {
+			continue
+		}
+		i := sort.Search(len(starts), func(i int) bool { return starts[i] >= start })
+		if i == len(starts) || starts[i] != start {
+			continue
+		}
+		base := prev.Chunks[i]
+		if base.Codec != "" || base.Hash == c.Hash {
+			continue
+		}
+		if hasChunk(chunksDir, c) || !hasChunk(chunksDir, base) {
+			continue
+		}
+		bases[c.Hash] = base.Hash
+	}
+	return bases
+}
+
+// downloadChunkDelta requests the chunk as a delta against the base on disk,
+// the hub may answer with the whole chunk. The result is verified against the hash.
+func downloadChunkDelta(client *http.Client, baseURL string, chunk ChunkInfo, baseHash, dest, algorithm string) error {
+	resp, err := client.Get(baseURL + "/chunks/" + chunk.Hash + "?" + deltaBaseParam + "=" + baseHash)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.Header.Get(deltaBaseHeader) != baseHash {
+		return saveChunk(resp.Body, chunk.Hash, dest, algorithm, chunk.Codec)
+	}
+
+	delta, err := io.ReadAll(io.LimitReader(resp.Body, int64(chunk.Size)+1))
+	if err != nil {
+		return err
+	}
+	base, err := os.ReadFile(filepath.Join(filepath.Dir(dest), baseHash))
+	if err != nil {
+		return fmt.Errorf("failed to read delta base: %v", err)
+	}
+	data, err := applyDelta(base, delta)
+	if err != nil {
+		return err
+	}
+	return saveChunk(bytes.NewReader(data), chunk.Hash, dest, algorithm, "")
+}
+
+// readManifest reads the manifest file
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// keepDeltaBases keeps the manifest and its chunks in dir for the next sync,
+// the other chunks are removed
+func keepDeltaBases(dir string) {
+	m, err := readManifest(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		klog.Infof("Hub cleaning up artifacts, no manifest to keep: %v", err)
+		_ = os.RemoveAll(filepath.Join(dir, ChunksDir))
+		return
+	}
+	klog.Info("Hub keeping the chunks of the manifest as delta bases...")
+	pruneChunks(filepath.Join(dir, ChunksDir), m)
+}
+
+// pruneChunks removes the chunks not referenced by the manifest, the chunks
+// of the previous syncs are not needed as delta bases anymore
+func pruneChunks(chunksDir string, m *Manifest) {
+	keep := make(map[string]bool, len(m.Chunks))
+	for _, c := range m.Chunks {
+		keep[c.Hash] = true
+	}
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil {
+		klog.V(2).Infof("Failed to prune chunks: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			_ = os.Remove(filepath.Join(chunksDir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aojea/krun/pkg/cdc"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := make([]byte, 64*1024)
+	if _, err := rand.Read(base); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	modified := bytes.Clone(base)
+	copy(modified[1000:], "modified in place")
+	inserted := append(append(bytes.Clone(base[:5000]), "inserted bytes"...), base[5000:]...)
+	random := make([]byte, len(base))
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+		// maxSize of the delta, unchecked if 0
+		maxSize int
+	}{
+		{name: "identical", base: base, target: base, maxSize: 16},
+		{name: "modified in place", base: base, target: modified, maxSize: 128},
+		{name: "inserted", base: base, target: inserted, maxSize: 128},
+		{name: "appended", base: base, target: append(bytes.Clone(base), "appended"...), maxSize: 64},
+		{name: "truncated", base: base, target: base[:len(base)/2], maxSize: 16},
+		{name: "unrelated", base: base, target: random},
+		{name: "empty base", base: nil, target: base[:100]},
+		{name: "empty target", base: base, target: []byte{}},
+		{name: "small", base: []byte("abc"), target: []byte("abd")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := encodeDelta(tt.base, tt.target)
+			if tt.maxSize > 0 && len(delta) > tt.maxSize {
+				t.Errorf("Expected a delta of at most %d bytes, got %d", tt.maxSize, len(delta))
+			}
+			got, err := applyDelta(tt.base, delta)
+			if err != nil {
+				t.Fatalf("applyDelta failed: %v", err)
+			}
+			if !bytes.Equal(got, tt.target) {
+				t.Errorf("Reconstructed data mismatch")
+			}
+		})
+	}
+}
+
+func TestApplyDeltaCorrupted(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 8))
+	valid := encodeDelta(base, append(bytes.Clone(base), "tail"...))
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{name: "empty", delta: nil},
+		{name: "truncated", delta: valid[:len(valid)-1]},
+		{name: "copy out of the base", delta: appendDeltaCopy([]byte{10}, len(base)-5, 10)},
+		{name: "insert beyond the delta", delta: []byte{10, deltaOpInsert, 20, 'a'}},
+		{name: "unknown operation", delta: []byte{1, 7}},
+		{name: "larger than the size", delta: appendDeltaInsert([]byte{1}, []byte("ab"))},
+		{name: "smaller than the size", delta: appendDeltaInsert([]byte{3}, []byte("ab"))},
+		{name: "huge size", delta: appendDeltaInsert([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, []byte("ab"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := applyDelta(base, tt.delta); err == nil {
+				t.Errorf("Expected the corrupted delta to fail")
+			}
+		})
+	}
+}
+
+// TestSyncDelta syncs a near-duplicate of the synced file to two peers, with
+// and without deltas, and compares the bytes served by the hub.
+func TestSyncDelta(t *testing.T) {
+	v1 := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(v1); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	v2 := bytes.Clone(v1)
+	copy(v2[100:], "modified at the start")
+	v2 = append(v2, "appended at the end"...)
+
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	ingest := func(content []byte) cdc.Manifest {
+		srcDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), content, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		localChunksDir := t.TempDir()
+		m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+		if err != nil {
+			t.Fatalf("GenerateManifest failed: %v", err)
+		}
+		if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+			t.Fatalf("runIngest failed: %v", err)
+		}
+		return m
+	}
+
+	var served atomic.Int64
+	hub := newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: HashSHA256, delta: true})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeHTTP(&countingWriter{ResponseWriter: w, n: &served}, r)
+	}))
+	defer ts.Close()
+
+	// both peers keep the first version as delta bases
+	ingest(v1)
+	peers := map[bool]string{true: t.TempDir(), false: t.TempDir()}
+	for _, dir := range peers {
+		if err := os.MkdirAll(filepath.Join(dir, ChunksDir), 0755); err != nil {
+			t.Fatalf("Failed to create peer chunks dir: %v", err)
+		}
+		if err := runPeer(context.Background(), dir, []string{ts.URL}, syncOptions{cleanup: true, delta: true}); err != nil {
+			t.Fatalf("runPeer failed: %v", err)
+		}
+	}
+
+	m2 := ingest(v2)
+	transferred := map[bool]int64{}
+	for _, delta := range []bool{false, true} {
+		served.Store(0)
+		if err := runPeer(context.Background(), peers[delta], []string{ts.URL}, syncOptions{cleanup: true, delta: delta}); err != nil {
+			t.Fatalf("runPeer with delta %v failed: %v", delta, err)
+		}
+		transferred[delta] = served.Load()
+
+		got, err := os.ReadFile(filepath.Join(peers[delta], "data.bin"))
+		if err != nil {
+			t.Fatalf("Failed to read synced file: %v", err)
+		}
+		if !bytes.Equal(got, v2) {
+			t.Errorf("Synced content mismatch with delta %v", delta)
+		}
+	}
+	t.Logf("Bytes transferred: %d without deltas, %d with deltas", transferred[false], transferred[true])
+	if transferred[false] < 512*1024 {
+		t.Fatalf("Expected the modified chunks to be transferred whole without deltas, got %d bytes", transferred[false])
+	}
+	if transferred[true]*10 > transferred[false] {
+		t.Errorf("Expected the deltas to transfer less than 10%% of %d bytes, got %d", transferred[false], transferred[true])
+	}
+
+	// only the chunks of the last manifest are kept as bases
+	entries, err := os.ReadDir(filepath.Join(peers[true], ChunksDir))
+	if err != nil {
+		t.Fatalf("Failed to read peer chunks dir: %v", err)
+	}
+	want := map[string]bool{}
+	for _, c := range m2.Chunks {
+		want[c.Hash] = true
+	}
+	for _, e := range entries {
+		if !want[e.Name()] {
+			t.Errorf("Unexpected chunk %s kept after the sync", e.Name())
+		}
+	}
+	if len(entries) != len(want) {
+		t.Errorf("Expected %d chunks kept, got %d", len(want), len(entries))
+	}
+}
+
+func TestDeltaHandlerFallback(t *testing.T) {
+	hubDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(hubDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	data := []byte(strings.Repeat("chunk content ", 100))
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(hubDir, ChunksDir, hash), data, 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{delta: true}))
+	defer ts.Close()
+
+	// the base is not on the hub, the chunk is served whole
+	dest := filepath.Join(t.TempDir(), hash)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dest), "missing"), []byte("unused"), 0644); err != nil {
+		t.Fatalf("Failed to write base: %v", err)
+	}
+	chunk := ChunkInfo{Hash: hash, Size: uint(len(data))}
+	if err := downloadChunkDelta(http.DefaultClient, ts.URL, chunk, "missing", dest, HashSHA256); err != nil {
+		t.Fatalf("downloadChunkDelta failed: %v", err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Failed to read chunk: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Downloaded chunk mismatch")
+	}
+}
+
+// countingWriter counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// TestSyncDeltaToggleCompression syncs the same data with and without
+// compression keeping the chunks, the chunks kept with the other codec are
+// reported missing and transferred again.
+func TestSyncDeltaToggleCompression(t *testing.T) {
+	srcDir := t.TempDir()
+	content := bytes.Repeat([]byte("compressible data "), 200000)
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), content, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: HashSHA256, delta: true}))
+	defer ts.Close()
+
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+
+	for i, compress := range []bool{false, true, false} {
+		localChunksDir := t.TempDir()
+		m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Compress: compress})
+		if err != nil {
+			t.Fatalf("GenerateManifest failed: %v", err)
+		}
+		if compress && m.Chunks[0].Codec == "" {
+			t.Fatalf("Expected the chunks to be compressed")
+		}
+
+		// the leader only receives the chunks reported missing
+		manifestBytes, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("Failed to marshal manifest: %v", err)
+		}
+		var out bytes.Buffer
+		if err := runCheck(bytes.NewReader(manifestBytes), &out, leaderChunksDir); err != nil {
+			t.Fatalf("runCheck failed: %v", err)
+		}
+		var missing []string
+		if err := json.Unmarshal(out.Bytes(), &missing); err != nil {
+			t.Fatalf("Failed to decode missing chunks: %v", err)
+		}
+		if len(missing) == 0 {
+			t.Fatalf("Expected the chunks stored with another codec to be missing in sync %d", i)
+		}
+		sent := m
+		sent.Chunks = nil
+		for _, c := range m.Chunks {
+			if slices.Contains(missing, c.Hash) {
+				sent.Chunks = append(sent.Chunks, c)
+			}
+		}
+		var buf bytes.Buffer
+		tr := tar.NewReader(ingestTar(t, localChunksDir, sent))
+		tw := tar.NewWriter(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read tar: %v", err)
+			}
+			data := manifestBytes
+			if hdr.Name != ManifestFile {
+				if data, err = io.ReadAll(tr); err != nil {
+					t.Fatalf("Failed to read tar entry: %v", err)
+				}
+			}
+			hdr.Size = int64(len(data))
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		if err := runIngest(&buf, leaderDir, leaderChunksDir, HashSHA256, syncOptions{cleanup: true, delta: true}); err != nil {
+			t.Fatalf("runIngest %d failed: %v", i, err)
+		}
+
+		if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{cleanup: true, delta: true}); err != nil {
+			t.Fatalf("runPeer %d failed: %v", i, err)
+		}
+		got, err := os.ReadFile(filepath.Join(peerDir, "data.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read synced file: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Synced content mismatch in sync %d", i)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DigestFile records in the destination the digest of the last manifest applied
+// (sync with pkg/cdc/digest.go)
+const DigestFile = ".krun-manifest.sha256"
+
+// digestResult reports the digest of the manifest applied in the destination,
+// empty if there is none or a sync did not complete.
+type digestResult struct {
+	Digest string `json:"digest"`
+}
+
+// runDigest writes the digest of the manifest applied in dir as JSON
+func runDigest(w io.Writer, dir string) error {
+	var result digestResult
+	data, err := os.ReadFile(filepath.Join(dir, DigestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read manifest digest: %v", err)
+	}
+	result.Digest = strings.TrimSpace(string(data))
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return fmt.Errorf("failed to write manifest digest: %v", err)
+	}
+	return nil
+}
+
+// clearDigest forgets the applied manifest, the destination is going to change
+func clearDigest(dir string) error {
+	if err := os.Remove(filepath.Join(dir, DigestFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove manifest digest: %v", err)
+	}
+	return nil
+}
+
+// recordDigest stores the digest of the manifest applied in dir, if known
+func recordDigest(dir, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(dir, DigestFile), []byte(digest+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record manifest digest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// errNoSpace is returned when the destination disk is full, retrying on
+// another tracker does not help.
+var errNoSpace = errors.New("out of disk space")
+
+// createFile creates the files written by the agent, it allows failing the
+// writes in tests
+var createFile = func(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// diskError wraps the write errors caused by a full disk with errNoSpace
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return fmt.Errorf("%w: %v", errNoSpace, err)
+	}
+	return err
+}
+
+// writeFileAtomic writes the file through a temporary file renamed into
+// place, a failed write does not leave a partial file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	out, err := createFile(tmp)
+	if err != nil {
+		return diskError(err)
+	}
+	if _, err := out.Write(data); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return diskError(err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return diskError(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/aojea/krun/pkg/cdc"
+)
+
+// fullDiskWriter fails with ENOSPC once limit bytes are written, or on close
+type fullDiskWriter struct {
+	f       *os.File
+	limit   int
+	onClose bool
+}
+
+func (w *fullDiskWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && len(p) > w.limit {
+		n, _ := w.f.Write(p[:w.limit])
+		w.limit = 0
+		return n, &os.PathError{Op: "write", Path: w.f.Name(), Err: syscall.ENOSPC}
+	}
+	if w.limit >= 0 {
+		w.limit -= len(p)
+	}
+	return w.f.Write(p)
+}
+
+func (w *fullDiskWriter) Close() error {
+	err := w.f.Close()
+	if w.onClose {
+		return &os.PathError{Op: "close", Path: w.f.Name(), Err: syscall.ENOSPC}
+	}
+	return err
+}
+
+// fillDisk makes the files created after the first skip ones fail as a full disk
+func fillDisk(t *testing.T, skip int, limit int, onClose bool) {
+	t.Helper()
+	original := createFile
+	t.Cleanup(func() { createFile = original })
+	var created atomic.Int32
+	createFile = func(name string) (io.WriteCloser, error) {
+		f, err := os.Create(name)
+		if err != nil || int(created.Add(1)) <= skip {
+			return f, err
+		}
+		return &fullDiskWriter{f: f, limit: limit, onClose: onClose}, nil
+	}
+}
+
+// tmpFiles returns the temporary files left in dir
+func tmpFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatalf("Failed to list temporary files: %v", err)
+	}
+	return matches
+}
+
+func TestSaveChunkNoSpace(t *testing.T) {
+	data := bytes.Repeat([]byte("chunk data "), 1000)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		limit   int
+		onClose bool
+	}{
+		{name: "mid chunk", limit: 1024},
+		{name: "empty disk", limit: 0},
+		{name: "on close", limit: -1, onClose: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fillDisk(t, 0, tt.limit, tt.onClose)
+			dir := t.TempDir()
+			dest := filepath.Join(dir, hash)
+			err := saveChunk(bytes.NewReader(data), hash, dest, HashSHA256, "")
+			if !errors.Is(err, errNoSpace) || !strings.Contains(err.Error(), "out of disk space") {
+				t.Fatalf("Expected an out of disk space error, got %v", err)
+			}
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("Expected no chunk saved, got %v", err)
+			}
+			if tmp := tmpFiles(t, dir); len(tmp) > 0 {
+				t.Errorf("Expected the temporary file to be removed, got %v", tmp)
+			}
+		})
+	}
+}
+
+func TestRunIngestNoSpace(t *testing.T) {
+	srcDir := t.TempDir()
+	content := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if len(m.Chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(m.Chunks))
+	}
+
+	// the manifest is sent before the chunks, it must not be written either
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tr := tar.NewReader(ingestTar(t, localChunksDir, m))
+	var entries []*tar.Header
+	var contents [][]byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read tar entry: %v", err)
+		}
+		entries = append([]*tar.Header{hdr}, entries...)
+		contents = append([][]byte{data}, contents...)
+	}
+	for i, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if _, err := tw.Write(contents[i]); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+
+	dataDir := t.TempDir()
+	chunksDir := filepath.Join(dataDir, ChunksDir)
+	if err := os.MkdirAll(chunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	// the second chunk fills the disk
+	fillDisk(t, 1, 4096, false)
+	err = runIngest(&buf, dataDir, chunksDir, HashSHA256, syncOptions{})
+	if err == nil || !strings.Contains(err.Error(), "out of disk space") {
+		t.Fatalf("Expected an out of disk space error, got %v", err)
+	}
+	for _, name := range []string{ManifestFile, "data.bin"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s after the failed ingest, got %v", name, err)
+		}
+	}
+	if tmp := append(tmpFiles(t, dataDir), tmpFiles(t, chunksDir)...); len(tmp) > 0 {
+		t.Errorf("Expected the temporary files to be removed, got %v", tmp)
+	}
+}
+
+func TestRunPeerNoSpace(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), bytes.Repeat([]byte("data"), 10000), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	hub := newHubHandler(leaderDir, hubOptions{})
+	first := httptest.NewServer(hub)
+	defer first.Close()
+	var fallbackChunks atomic.Int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chunks") {
+			fallbackChunks.Add(1)
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer fallback.Close()
+
+	peerDir := t.TempDir()
+	peerChunksDir := filepath.Join(peerDir, ChunksDir)
+	if err := os.MkdirAll(peerChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	fillDisk(t, 0, 100, false)
+	err = runPeer(context.Background(), peerDir, []string{first.URL, fallback.URL}, syncOptions{})
+	if err == nil || !strings.Contains(err.Error(), "out of disk space") {
+		t.Fatalf("Expected an out of disk space error, got %v", err)
+	}
+	if n := fallbackChunks.Load(); n > 0 {
+		t.Errorf("Expected no chunk requested to the other tracker, got %d", n)
+	}
+	if tmp := tmpFiles(t, peerChunksDir); len(tmp) > 0 {
+		t.Errorf("Expected the temporary files to be removed, got %v", tmp)
+	}
+	if _, err := os.Stat(filepath.Join(peerDir, ManifestFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no manifest after the failed sync, got %v", err)
+	}
+}
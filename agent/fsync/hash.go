@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// Supported chunk hash algorithms (sync with pkg/cdc/hash.go)
+const (
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+)
+
+// normalizeAlgorithm returns the algorithm name, manifests without algorithm use SHA-256
+func normalizeAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return HashSHA256
+	}
+	return algorithm
+}
+
+// newHasher returns the hash used to address the chunks
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch normalizeAlgorithm(algorithm) {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
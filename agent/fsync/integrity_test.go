@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -38,14 +39,14 @@ func TestIntegrityCheck(t *testing.T) {
 	}
 
 	// Serve
-	ts := httptest.NewServer(newHubHandler(hubDir))
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
 	defer ts.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	// Run Peer - Should fail
-	err = runPeer(ctx, peerDir, ts.URL, false, false)
+	err = runPeer(ctx, peerDir, []string{ts.URL}, syncOptions{})
 	if err == nil {
 		t.Fatal("Expected integrity check failure, got nil")
 	}
@@ -56,3 +57,51 @@ func TestIntegrityCheck(t *testing.T) {
 		t.Error("Corrupted chunk should not exist on disk")
 	}
 }
+
+func TestHubIntegrityCheck(t *testing.T) {
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+
+	goodHash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	if err := os.WriteFile(filepath.Join(hubChunksDir, goodHash), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	badHash := "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7" // sha256("world")
+	if err := os.WriteFile(filepath.Join(hubChunksDir, badHash), []byte("EVIL DATA"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupted chunk: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		verifyChunks bool
+		hash         string
+		wantStatus   int
+	}{
+		{name: "valid chunk", verifyChunks: true, hash: goodHash, wantStatus: http.StatusOK},
+		{name: "corrupted chunk", verifyChunks: true, hash: badHash, wantStatus: http.StatusInternalServerError},
+		{name: "missing chunk", verifyChunks: true, hash: "missing", wantStatus: http.StatusNotFound},
+		{name: "corrupted chunk without verification", verifyChunks: false, hash: badHash, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{verifyChunks: tt.verifyChunks}))
+			defer ts.Close()
+
+			// Request twice to exercise the verification cache
+			for i := 0; i < 2; i++ {
+				resp, err := http.Get(ts.URL + "/chunks/" + tt.hash)
+				if err != nil {
+					t.Fatalf("Failed to get chunk: %v", err)
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("Got status %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,7 +17,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,41 +34,114 @@ const (
 	ChunksDir    = "krun-chunks"
 )
 
+const (
+	// defaultPollInterval is the initial delay between peer polls of the manifest
+	defaultPollInterval = 500 * time.Millisecond
+	// maxPollInterval caps the exponential backoff between peer polls
+	maxPollInterval = 10 * time.Second
+	// downloadConcurrency is the number of chunks a peer downloads in parallel
+	downloadConcurrency = 5
+	// defaultBatchSize is the number of chunks a peer requests at once to the hub
+	defaultBatchSize = 64
+	// maxBatchSize caps the number of chunks served in a single batch
+	maxBatchSize = 1024
+)
+
 func main() {
 	klog.InitFlags(nil)
 	var (
-		mode        = flag.String("mode", "peer", "Mode: hub | peer | check | ingest")
-		dataDir     = flag.String("dir", "/app", "Data directory")
-		trackerURL  = flag.String("tracker", "", "Tracker URL (for peers)")
-		trackerPort = flag.Int("tracker-port", 8000, "Tracker port (for hub)")
-		cleanup     = flag.Bool("cleanup", false, "Cleanup artifacts after sync")
-		mirror      = flag.Bool("mirror", true, "Mirror destination (delete extraneous files)")
+		mode         = flag.String("mode", "peer", "Mode: hub | peer | check | ingest | verify | statfs | digest")
+		dataDir      = flag.String("dir", "/app", "Data directory")
+		trackerURL   = flag.String("tracker", "", "Comma separated tracker URLs, tried in order on failure (for peers)")
+		trackerPort  = flag.Int("tracker-port", 8000, "Tracker port (for hub)")
+		cleanup      = flag.Bool("cleanup", false, "Cleanup artifacts after sync")
+		mirror       = flag.Bool("mirror", true, "Mirror destination (delete extraneous files)")
+		dryRun       = flag.Bool("dry-run", false, "Only log the extraneous files that mirroring would delete")
+		force        = flag.Bool("force", false, "Allow mirroring an empty source, deleting everything in the destination")
+		verifyChunks = flag.Bool("verify-chunks", false, "Verify chunk hashes before serving them (for hub)")
+		hashAlgo     = flag.String("hash", HashSHA256, "Chunk hash algorithm: sha256 | blake3 (for hub and ingest)")
+		manifest     = flag.String("manifest", "", "Manifest to verify against, '-' reads it from stdin (defaults to the local manifest)")
+		pollInterval = flag.Duration("poll-interval", defaultPollInterval, "Initial interval between manifest polls, doubled on every failure (for peers)")
+		waitTimeout  = flag.Duration("wait-timeout", 0, "Maximum time to wait for the manifest, 0 waits forever (for peers)")
+		metrics      = flag.Bool("metrics", false, "Expose Prometheus metrics on /metrics (for hub)")
+		digest       = flag.String("manifest-digest", "", "Digest of the manifest recorded in the destination once applied (for peer and ingest)")
+		batchSize    = flag.Int("batch-size", defaultBatchSize, "Number of chunks requested at once to the hub, 1 downloads them one by one (for peers)")
+		serve        = flag.Bool("serve", false, "Serve the synced files as a hub on -tracker-port until stdin is closed (for peers)")
+		cacheSize    = flag.Int64("chunk-cache-size", 0, "Maximum size in bytes of the chunks kept between syncs, the least recently used ones are evicted first, 0 is unlimited (for peers and ingest)")
+		statsJSON    = flag.Bool("stats-json", false, "Print the transfer statistics of the sync as JSON on stdout (for peers)")
+		maxConns     = flag.Int("max-connections", 0, "Maximum number of chunk requests served at once, the others are queued, 0 is unlimited (for hub)")
+		delta        = flag.Bool("delta", false, "Keep the chunks as bases of the next sync and transfer the modified chunks as deltas against them (for hub and peers)")
 	)
+	var mirrorExclude patterns
+	flag.Var(&mirrorExclude, "mirror-exclude", "Regex of the destination paths never deleted by mirroring, can be repeated")
 	flag.Parse()
 	defer klog.Flush()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	chunksPath := filepath.Join(*dataDir, ChunksDir)
+
+	// verify is read-only, it must not create the data directories
+	if *mode == "verify" {
+		if err := verify(*dataDir, chunksPath, *manifest); err != nil {
+			klog.Exit(err)
+		}
+		return
+	}
+	if *mode == "digest" {
+		// Report the manifest applied so the client can skip syncing it again
+		if err := runDigest(os.Stdout, *dataDir); err != nil {
+			klog.Exit(err)
+		}
+		return
+	}
+
+	if _, err := newHasher(*hashAlgo); err != nil {
+		klog.Exit(err)
+	}
+
 	if err := os.MkdirAll(*dataDir, 0755); err != nil {
 		klog.Exitf("Failed to create data dir %s: %v", *dataDir, err)
 	}
 
-	chunksPath := filepath.Join(*dataDir, ChunksDir)
 	if err := os.MkdirAll(chunksPath, 0755); err != nil {
 		klog.Exitf("Failed to create chunks dir: %v", err)
 	}
 
+	opts := syncOptions{
+		cleanup:        *cleanup,
+		mirror:         *mirror,
+		dryRun:         *dryRun,
+		force:          *force,
+		pollInterval:   *pollInterval,
+		waitTimeout:    *waitTimeout,
+		digest:         *digest,
+		batchSize:      *batchSize,
+		mirrorExclude:  mirrorExclude,
+		serve:          *serve,
+		delta:          *delta,
+		chunkCacheSize: *cacheSize,
+	}
+	if *statsJSON {
+		opts.statsOutput = os.Stdout
+	}
+	hubOpts := hubOptions{verifyChunks: *verifyChunks, algorithm: *hashAlgo, metrics: *metrics, delta: *delta, maxConnections: *maxConns}
+
 	switch *mode {
 	case "hub":
-		runHub(ctx, *dataDir, *trackerPort)
+		runHub(ctx, *dataDir, *trackerPort, hubOpts)
 	case "peer":
 		if *trackerURL == "" {
 			klog.Exit("Tracker URL is required for peer mode")
 		}
-		if err := runPeer(ctx, *dataDir, *trackerURL, *cleanup, *mirror); err != nil {
+		if err := runPeer(ctx, *dataDir, strings.Split(*trackerURL, ","), opts); err != nil {
 			klog.Exit(err)
 		}
+		if *serve {
+			// Other peers download the files from this one, it cleans up on exit
+			runHub(ctx, *dataDir, *trackerPort, hubOpts)
+		}
 	case "check":
 		// Step 1 of Sync: Read Manifest from Stdin, Print missing hashes to Stdout
 		if err := runCheck(os.Stdin, os.Stdout, chunksPath); err != nil {
@@ -69,7 +149,12 @@ func main() {
 		}
 	case "ingest":
 		// Step 2 of Sync: Read Tar from Stdin, Save to disk, Update Manifest
-		if err := runIngest(os.Stdin, *dataDir, chunksPath, *cleanup, *mirror); err != nil {
+		if err := runIngest(os.Stdin, *dataDir, chunksPath, *hashAlgo, opts); err != nil {
+			klog.Exit(err)
+		}
+	case "statfs":
+		// Report the free space so the client can pick a leader able to hold the data
+		if err := runStatfs(os.Stdout, *dataDir); err != nil {
 			klog.Exit(err)
 		}
 	default:
@@ -77,23 +162,154 @@ func main() {
 	}
 }
 
+// verify opens the manifest to compare with the destination and runs the verification
+func verify(dataDir, chunksDir, manifestPath string) error {
+	if manifestPath == "-" {
+		return runVerify(os.Stdin, os.Stdout, dataDir, chunksDir)
+	}
+	if manifestPath == "" {
+		manifestPath = filepath.Join(dataDir, ManifestFile)
+	}
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	return runVerify(f, os.Stdout, dataDir, chunksDir)
+}
+
 // Manifest represents the ordered list of chunks
 type Manifest struct {
-	Chunks []ChunkInfo `json:"chunks"`
+	// Algorithm used to hash the chunks, empty means sha256
+	Algorithm string `json:"algorithm,omitempty"`
+	// Chunker used to split the data, reconstruction only concatenates the chunks
+	Chunker *ChunkerConfig `json:"chunker,omitempty"`
+	Chunks  []ChunkInfo    `json:"chunks"`
+}
+
+// ChunkerConfig (sync with pkg/cdc/chunker.go)
+type ChunkerConfig struct {
+	Polynomial  uint64 `json:"polynomial"`
+	MinSize     uint   `json:"minSize"`
+	MaxSize     uint   `json:"maxSize"`
+	AverageBits int    `json:"averageBits"`
+}
+
+// validate checks the manifest is internally consistent, a hash referenced
+// more than once must always describe the same chunk.
+func (m *Manifest) validate() error {
+	seen := make(map[string]ChunkInfo, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		prev, ok := seen[chunk.Hash]
+		if !ok {
+			seen[chunk.Hash] = chunk
+			continue
+		}
+		if prev.Size != chunk.Size || prev.Codec != chunk.Codec || prev.StoredSize != chunk.StoredSize {
+			return fmt.Errorf("chunk %d with hash %s conflicts with a previous reference: size %d (stored %d, codec %q) vs size %d (stored %d, codec %q)",
+				i, chunk.Hash, chunk.Size, chunk.StoredSize, chunk.Codec, prev.Size, prev.StoredSize, prev.Codec)
+		}
+	}
+	return nil
 }
 
 type ChunkInfo struct {
+	// Hash and Size always refer to the uncompressed content
 	Hash string `json:"hash"`
 	Size uint   `json:"size"`
+	// Codec used to store the chunk, empty means uncompressed
+	Codec      string `json:"codec,omitempty"`
+	StoredSize uint   `json:"storedSize,omitempty"`
+}
+
+// storedSize is the size of the chunk file on disk
+func (c ChunkInfo) storedSize() uint {
+	if c.Codec != "" {
+		return c.StoredSize
+	}
+	return c.Size
+}
+
+// syncOptions configures how ingest and peers reconcile the destination with the manifest
+type syncOptions struct {
+	// cleanup removes the chunks and the manifest after the sync
+	cleanup bool
+	// mirror deletes the files in the destination that are not in the manifest
+	mirror bool
+	// dryRun only logs the files that mirroring would delete
+	dryRun bool
+	// force allows mirroring a manifest without entries, clearing the destination
+	force bool
+	// pollInterval is the initial delay between manifest polls, defaults to defaultPollInterval
+	pollInterval time.Duration
+	// waitTimeout bounds the time a peer waits for the manifest, zero waits forever
+	waitTimeout time.Duration
+	// digest of the manifest recorded in the destination once it is applied
+	digest string
+	// mirrorExclude protects from mirroring the destination paths matching any pattern
+	mirrorExclude patterns
+	// serve keeps the chunks and writes the manifest after a peer sync, so the
+	// peer can serve the files as a hub
+	serve bool
+	// client used by peers to poll the manifest and download the chunks,
+	// defaults to newPeerClient
+	client *http.Client
+	// batchSize is the number of chunks a peer requests at once, the chunks
+	// are downloaded one by one if it is lower than 2
+	batchSize int
+	// delta keeps the manifest and its chunks on cleanup as bases of the next
+	// sync, the modified chunks are downloaded by peers as deltas against them
+	delta bool
+	// statsOutput receives the transfer statistics of a peer sync as JSON, disabled if nil
+	statsOutput io.Writer
+	// chunkCacheSize bounds the bytes of the chunks kept after a sync, the
+	// least recently used chunks not in the manifest are evicted. 0 is unlimited.
+	chunkCacheSize int64
+}
+
+// newPeerClient returns a client keeping alive a connection per parallel
+// download, so the chunks do not pay a new connection each.
+func newPeerClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = downloadConcurrency
+	return &http.Client{Transport: transport}
+}
+
+// closeBody drains the response body so the connection can be reused
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// hubOptions configures the Hub HTTP handler
+type hubOptions struct {
+	// verifyChunks checks that a chunk content matches its hash before serving it,
+	// so a corrupt chunk is detected once on the Hub instead of on every Peer.
+	verifyChunks bool
+	// algorithm used to hash the chunks
+	algorithm string
+	// metrics exposes the Hub counters on /metrics
+	metrics bool
+	// maxConnections bounds the chunk requests served at once, the others are
+	// queued. 0 is unlimited.
+	maxConnections int
+	// delta serves the chunks requested with a base as deltas against it,
+	// the chunks of the manifest are kept on exit as bases of the next sync
+	delta bool
 }
 
 // runHub serves the files to Peers (Read-Only)
-func runHub(ctx context.Context, dir string, port int) {
+func runHub(ctx context.Context, dir string, port int, opts hubOptions) {
 	ctx, cancel := context.WithCancel(ctx)
-	mux := newHubHandler(dir)
+	mux := newHubHandler(dir, opts)
 
 	// Cleanup on exit
 	defer func() {
+		if opts.delta {
+			keepDeltaBases(dir)
+			return
+		}
 		klog.Info("Hub cleaning up artifacts...")
 		_ = os.RemoveAll(filepath.Join(dir, ChunksDir))
 		_ = os.Remove(filepath.Join(dir, ManifestFile))
@@ -132,23 +348,363 @@ func runHub(ctx context.Context, dir string, port int) {
 	_ = server.Shutdown(context.Background())
 }
 
-func newHubHandler(dir string) http.Handler {
+func newHubHandler(dir string, opts hubOptions) http.Handler {
 	mux := http.NewServeMux()
 	chunksPath := filepath.Join(dir, ChunksDir)
 	manifestPath := filepath.Join(dir, ManifestFile)
 
 	// Serve Manifest from Disk
-	mux.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	manifestSrv := &manifestServer{path: manifestPath}
+	manifest := manifestSrv.ServeHTTP
+
+	// Serve Chunks from Disk
+	var chunks http.Handler = http.FileServer(http.Dir(chunksPath))
+	var verifier *chunkVerifier
+	if opts.verifyChunks {
+		verifier = newChunkVerifier(chunksPath, manifestPath, opts.algorithm, chunks)
+		chunks = verifier
+	}
+	if opts.delta {
+		codecs := verifier
+		if codecs == nil {
+			codecs = newChunkVerifier(chunksPath, manifestPath, opts.algorithm, nil)
+		}
+		chunks = newDeltaHandler(chunksPath, codecs, opts.verifyChunks, chunks)
+	}
+
+	var metrics *hubMetrics
+	if opts.metrics {
+		metrics = newHubMetrics()
+		manifest = metrics.instrumentManifest(manifest)
+		chunks = metrics.instrumentChunks(chunks)
+		mux.Handle("/metrics", metrics.handler())
+	}
+
+	var batch http.Handler = newChunkBatchHandler(chunksPath, verifier, metrics)
+	if opts.maxConnections > 0 {
+		// the chunk requests share the limit, the manifest polls are cheap
+		sem := make(chan struct{}, opts.maxConnections)
+		chunks = limitConcurrency(sem, chunks)
+		batch = limitConcurrency(sem, batch)
+	}
+
+	mux.HandleFunc("/healthz", manifestSrv.healthz)
+	mux.HandleFunc("/manifest", manifest)
+	mux.Handle("/chunks/", http.StripPrefix("/chunks/", chunks))
+	mux.Handle("/chunks-batch", batch)
+	return mux
+}
+
+// limitConcurrency serves at most cap(sem) requests at once, the others wait
+// for a slot until the client goes away
+func limitConcurrency(sem chan struct{}, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		case <-r.Context().Done():
 			return
 		}
-		http.ServeFile(w, r, manifestPath)
+		defer func() { <-sem }()
+		next.ServeHTTP(w, r)
 	})
+}
 
-	// Serve Chunks from Disk
-	mux.Handle("/chunks/", http.StripPrefix("/chunks/", http.FileServer(http.Dir(chunksPath))))
-	return mux
+// manifestServer serves the manifest file, gzip encoded for the clients
+// accepting it. The encoded manifest is cached until the file changes, the
+// peers poll it repeatedly and it can be many MB for large trees.
+type manifestServer struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	gzipped []byte
+	// the manifest file was valid when it had this modification time and size
+	validModTime time.Time
+	validSize    int64
+}
+
+func (s *manifestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		http.ServeFile(w, r, s.path)
+		return
+	}
+	data, err := s.gzip()
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		klog.Errorf("Failed to encode manifest: %v", err)
+		http.Error(w, "failed to encode manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	_, _ = w.Write(data)
+}
+
+// healthz answers 200 once the manifest is written and valid, the peers wait
+// for it before downloading the chunks.
+func (s *manifestServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(); err != nil {
+		klog.V(4).Infof("Hub not ready: %v", err)
+		http.Error(w, "manifest not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// ready checks the manifest file is valid JSON, the result is cached until the file changes
+func (s *manifestServer) ready() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if !s.validModTime.IsZero() && fi.ModTime().Equal(s.validModTime) && fi.Size() == s.validSize {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("invalid manifest %s", s.path)
+	}
+	s.validModTime, s.validSize = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// gzip returns the encoded manifest, encoding it again if the file changed
+func (s *manifestServer) gzip() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.gzipped != nil && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.gzipped, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	s.gzipped, s.modTime, s.size = buf.Bytes(), fi.ModTime(), fi.Size()
+	return s.gzipped, nil
+}
+
+// acceptsGzip reports whether the request accepts a gzip encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		// gzip;q=0 refuses the encoding
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// newChunkBatchHandler serves the chunks whose hashes are posted as a JSON list
+// in a single tar stream, with an entry named after the hash of each chunk.
+// The chunks missing or failing the verification are left out of the stream.
+func newChunkBatchHandler(chunksDir string, verifier *chunkVerifier, metrics *hubMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var hashes []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hashes); err != nil {
+			http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(hashes) > maxBatchSize {
+			http.Error(w, fmt.Sprintf("batch of %d chunks is larger than %d", len(hashes), maxBatchSize), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		tw := tar.NewWriter(w)
+		for _, hash := range hashes {
+			f, size, err := openBatchChunk(chunksDir, hash, verifier)
+			if err != nil {
+				if os.IsNotExist(err) {
+					metrics.chunkNotFound()
+				} else {
+					klog.Errorf("Refusing to serve chunk %s: %v", hash, err)
+				}
+				continue
+			}
+			err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: hash, Mode: 0644, Size: size})
+			if err == nil {
+				_, err = io.Copy(tw, f)
+			}
+			_ = f.Close()
+			if err != nil {
+				klog.V(2).Infof("Failed to write chunk batch: %v", err)
+				return
+			}
+			metrics.chunkServed(size)
+		}
+		_ = tw.Close()
+	}
+}
+
+// openBatchChunk opens a chunk requested in a batch once verified
+func openBatchChunk(chunksDir, hash string, verifier *chunkVerifier) (*os.File, int64, error) {
+	// the hashes come from the request, they must not name other files
+	if !validChunkName(hash) {
+		return nil, 0, os.ErrNotExist
+	}
+	if verifier != nil {
+		if err := verifier.verify(hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	f, err := os.Open(filepath.Join(chunksDir, hash))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, 0, os.ErrNotExist
+	}
+	return f, fi.Size(), nil
+}
+
+// chunkVerifier validates the chunk content against its hash before serving it.
+// Chunks are content addressed, so the result is cached after the first check.
+type chunkVerifier struct {
+	chunksDir    string
+	manifestPath string
+	algorithm    string
+	next         http.Handler
+
+	mu       sync.Mutex
+	verified map[string]bool
+	// codecs of the compressed chunks, loaded from the manifest on first use
+	codecs map[string]string
+}
+
+func newChunkVerifier(chunksDir, manifestPath, algorithm string, next http.Handler) *chunkVerifier {
+	return &chunkVerifier{
+		chunksDir:    chunksDir,
+		manifestPath: manifestPath,
+		algorithm:    algorithm,
+		next:         next,
+		verified:     make(map[string]bool),
+	}
+}
+
+// codec returns the codec the chunk was stored with according to the manifest
+func (v *chunkVerifier) codec(hash string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.codecs == nil {
+		data, err := os.ReadFile(v.manifestPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// without manifest all chunks are assumed uncompressed
+				return "", nil
+			}
+			return "", fmt.Errorf("failed to read manifest: %v", err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return "", fmt.Errorf("failed to decode manifest: %v", err)
+		}
+		v.codecs = make(map[string]string)
+		for _, c := range m.Chunks {
+			if c.Codec != "" {
+				v.codecs[c.Hash] = c.Codec
+			}
+		}
+	}
+	return v.codecs[hash], nil
+}
+
+func (v *chunkVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := filepath.Base(r.URL.Path)
+	if err := v.verify(hash); err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		klog.Errorf("Refusing to serve chunk %s: %v", hash, err)
+		http.Error(w, "chunk integrity check failed", http.StatusInternalServerError)
+		return
+	}
+	v.next.ServeHTTP(w, r)
+}
+
+func (v *chunkVerifier) verify(hash string) error {
+	v.mu.Lock()
+	ok := v.verified[hash]
+	v.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(v.chunksDir, hash))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	codec, err := v.codec(hash)
+	if err != nil {
+		return err
+	}
+	dec, err := decodeChunk(f, codec)
+	if err != nil {
+		return fmt.Errorf("failed to decode chunk: %v", err)
+	}
+	defer func() { _ = dec.Close() }()
+
+	hasher, err := newHasher(v.algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, dec); err != nil {
+		return fmt.Errorf("failed to read chunk: %v", err)
+	}
+	if calculatedHash := hex.EncodeToString(hasher.Sum(nil)); calculatedHash != hash {
+		return fmt.Errorf("expected %s, got %s", hash, calculatedHash)
+	}
+
+	v.mu.Lock()
+	v.verified[hash] = true
+	v.mu.Unlock()
+	return nil
 }
 
 // runCheck reads a JSON manifest from Stdin and writes missing chunks to Stdout
@@ -157,11 +713,13 @@ func runCheck(r io.Reader, w io.Writer, chunksDir string) error {
 	if err := json.NewDecoder(r).Decode(&m); err != nil {
 		return fmt.Errorf("failed to decode manifest from stdin: %v", err)
 	}
+	if err := m.validate(); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
 
 	var missing []string
 	for _, chunk := range m.Chunks {
-		p := filepath.Join(chunksDir, chunk.Hash)
-		if _, err := os.Stat(p); os.IsNotExist(err) {
+		if !hasChunk(chunksDir, chunk) {
 			missing = append(missing, chunk.Hash)
 		}
 	}
@@ -172,8 +730,37 @@ func runCheck(r io.Reader, w io.Writer, chunksDir string) error {
 	return nil
 }
 
+// statfsResult reports the space available in the data directory
+type statfsResult struct {
+	Free uint64 `json:"free"`
+}
+
+// runStatfs writes the bytes available to unprivileged users in dir as JSON
+func runStatfs(w io.Writer, dir string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %v", dir, err)
+	}
+	result := statfsResult{Free: uint64(st.Bavail) * uint64(st.Bsize)}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return fmt.Errorf("failed to write statfs result: %v", err)
+	}
+	return nil
+}
+
 // runIngest reads a TAR stream from Stdin containing chunks and optionally the manifest
-func runIngest(r io.Reader, dataDir, chunksDir string, cleanup, mirror bool) error {
+// Chunks are verified against their name using the given hash algorithm.
+func runIngest(r io.Reader, dataDir, chunksDir, algorithm string, opts syncOptions) error {
+	if _, err := newHasher(algorithm); err != nil {
+		return err
+	}
+	if err := clearDigest(dataDir); err != nil {
+		return err
+	}
+
+	// The manifest is written once all the chunks are stored, a failed ingest
+	// must not leave a manifest referencing missing chunks
+	var manifestData []byte
 	tr := tar.NewReader(r)
 	for {
 		header, err := tr.Next()
@@ -191,28 +778,43 @@ func runIngest(r io.Reader, dataDir, chunksDir string, cleanup, mirror bool) err
 		}
 
 		// Identify destination
-		var target string
 		if header.Name == ManifestFile {
-			target = filepath.Join(dataDir, ManifestFile)
-		} else {
-			// Assume it's a chunk
-			target = filepath.Join(chunksDir, filepath.Base(header.Name))
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("failed to read manifest: %v", err)
+			}
+			var m Manifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("failed to decode manifest: %v", err)
+			}
+			if err := m.validate(); err != nil {
+				return fmt.Errorf("invalid manifest: %v", err)
+			}
+			// Reject manifests hashed with a different algorithm than the ingested chunks
+			if normalizeAlgorithm(m.Algorithm) != normalizeAlgorithm(algorithm) {
+				return fmt.Errorf("manifest hash algorithm %q does not match ingest algorithm %q", normalizeAlgorithm(m.Algorithm), normalizeAlgorithm(algorithm))
+			}
+			manifestData = data
+			continue
 		}
 
-		f, err := os.Create(target)
-		if err != nil {
-			return fmt.Errorf("failed to create file %s: %v", target, err)
+		// Assume it's a chunk, verified against its name
+		hash := filepath.Base(header.Name)
+		codec := header.PAXRecords[codecPAXRecord]
+		if err := saveChunk(tr, hash, filepath.Join(chunksDir, hash), algorithm, codec); err != nil {
+			return fmt.Errorf("failed to ingest chunk %s: %v", hash, err)
 		}
-		if _, err := io.Copy(f, tr); err != nil {
-			_ = f.Close()
-			return fmt.Errorf("failed to write file %s: %v", target, err)
+	}
+
+	manifestPath := filepath.Join(dataDir, ManifestFile)
+	if manifestData != nil {
+		if err := writeFileAtomic(manifestPath, manifestData); err != nil {
+			return fmt.Errorf("failed to write file %s: %v", manifestPath, err)
 		}
-		_ = f.Close()
 	}
 
 	// Always Apply Manifest (reconstruct files)
 	klog.Info("Ingest: applying manifest...")
-	manifestPath := filepath.Join(dataDir, ManifestFile)
 	f, err := os.Open(manifestPath)
 	if err != nil {
 		return fmt.Errorf("failed to open manifest for apply: %v", err)
@@ -230,140 +832,494 @@ func runIngest(r io.Reader, dataDir, chunksDir string, cleanup, mirror bool) err
 	}
 
 	// cleanup extraneous files (miroring)
-	if mirror {
-		if err := cleanupExtraneousFiles(dataDir, created); err != nil {
-			klog.Warningf("Failed to cleanup extraneous files: %v", err)
-			// Don't fail the sync just because cleanup failed
+	if opts.mirror {
+		if err := mirrorDestination(dataDir, created, opts); err != nil {
+			return err
 		}
 	}
 
-	if cleanup {
+	if opts.cleanup && opts.delta {
+		klog.Info("Keeping the chunks of the manifest as delta bases...")
+		pruneChunks(chunksDir, &m)
+	} else if opts.cleanup {
 		klog.Info("Cleaning up artifacts...")
 		_ = os.RemoveAll(chunksDir)
 		_ = os.Remove(filepath.Join(dataDir, ManifestFile))
 	}
+	if opts.chunkCacheSize > 0 {
+		if err := evictChunks(chunksDir, &m, opts.chunkCacheSize); err != nil {
+			klog.Warningf("Failed to evict chunks: %v", err)
+		}
+	}
+
+	if err := recordDigest(dataDir, opts.digest); err != nil {
+		return err
+	}
 
 	klog.Info("Ingest completed successfully")
 	return nil
 }
 
-// runPeer logic remains largely the same, relying on polling /manifest
-func runPeer(ctx context.Context, dir, trackerURL string, cleanup, mirror bool) error {
-	chunksDir := filepath.Join(dir, ChunksDir)
-	var manifest Manifest
-
-	// Poll for Manifest
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+// waitForManifest polls the trackers until one serves the manifest, backing off
+// exponentially between attempts up to maxPollInterval. A zero timeout waits forever.
+func waitForManifest(ctx context.Context, client *http.Client, trackers []string, interval, timeout time.Duration) (Manifest, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	pollCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	klog.Infof("Peer waiting for manifest from %s...", trackerURL)
-Loop:
 	for {
+		manifest, err := fetchManifestFromTrackers(pollCtx, client, trackers)
+		if err == nil {
+			return manifest, nil
+		}
+		klog.V(2).Infof("Manifest not available, retrying in %v: %v", interval, err)
+
+		timer := time.NewTimer(interval)
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			resp, err := http.Get(trackerURL + "/manifest")
-			if err == nil && resp.StatusCode == http.StatusOK {
-				if err := json.NewDecoder(resp.Body).Decode(&manifest); err == nil {
-					_ = resp.Body.Close()
-					break Loop
-				}
-				_ = resp.Body.Close()
+		case <-pollCtx.Done():
+			timer.Stop()
+			if ctx.Err() != nil {
+				return Manifest{}, ctx.Err()
 			}
+			return Manifest{}, fmt.Errorf("timed out after %v waiting for manifest from %s: %v", timeout, strings.Join(trackers, ","), err)
+		case <-timer.C:
 		}
+		interval = max(min(interval*2, maxPollInterval), interval)
 	}
+}
 
-	klog.Infof("Manifest received with %d chunks. Syncing...", len(manifest.Chunks))
-
-	// Download missing chunks
-	concurrency := 5
-	sem := make(chan struct{}, concurrency)
-	var wg sync.WaitGroup
-	errCh := make(chan error, 1)
-
-	for _, chunk := range manifest.Chunks {
-		// Check for previous errors
-		select {
-		case err := <-errCh:
-			return err
-		default:
-		}
-
-		chunkPath := filepath.Join(chunksDir, chunk.Hash)
-		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(c ChunkInfo) {
-				defer wg.Done()
-				defer func() { <-sem }()
-
-				if err := downloadChunk(trackerURL, c.Hash, chunkPath); err != nil {
-					// Try to report the first error
-					select {
-					case errCh <- fmt.Errorf("failed to download chunk %s: %v", c.Hash, err):
-					default:
-					}
-				}
-			}(chunk)
+// fetchManifestFromTrackers returns the manifest from the first tracker serving it
+func fetchManifestFromTrackers(ctx context.Context, client *http.Client, trackers []string) (Manifest, error) {
+	var errs []error
+	for _, tracker := range trackers {
+		if err := checkReady(ctx, client, tracker); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", tracker, err))
+			continue
 		}
+		manifest, err := fetchManifest(ctx, client, tracker)
+		if err == nil {
+			return manifest, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", tracker, err))
 	}
-	wg.Wait()
-	close(errCh)
-	if err := <-errCh; err != nil {
-		return err
-	}
+	return Manifest{}, errors.Join(errs...)
+}
 
-	created, err := applyManifest(chunksDir, dir, &manifest)
+// checkReady returns an error until the tracker reports the manifest is ready,
+// the trackers without /healthz are always ready.
+func checkReady(ctx context.Context, client *http.Client, trackerURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL+"/healthz", nil)
 	if err != nil {
-		return fmt.Errorf("failed to apply manifest: %v", err)
+		return err
 	}
-
-	// cleanup extraneous files (miroring)
-	if mirror {
-		if err := cleanupExtraneousFiles(dir, created); err != nil {
-			klog.Warningf("Failed to cleanup extraneous files: %v", err)
-		}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
-
-	// Always cleanup on peer check/sync success
-	if cleanup {
-		klog.Info("Peer cleaning up artifacts...")
-		_ = os.RemoveAll(chunksDir)
-		_ = os.Remove(filepath.Join(dir, ManifestFile))
+	defer closeBody(resp)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("hub not ready: status %d", resp.StatusCode)
 	}
-
-	klog.Info("Peer sync finished successfully.")
-	return nil
 }
 
-func downloadChunk(baseURL, hash, dest string) error {
-	resp, err := http.Get(baseURL + "/chunks/" + hash)
+// fetchManifest gets and decodes the manifest served by the tracker
+func fetchManifest(ctx context.Context, client *http.Client, trackerURL string) (Manifest, error) {
+	var manifest Manifest
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL+"/manifest", nil)
 	if err != nil {
-		return err
+		return manifest, err
 	}
-	defer func() { _ = resp.Body.Close() }()
+	// the manifest of large trees compresses well, older hubs ignore the header
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return manifest, err
+	}
+	defer closeBody(resp)
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("status %d", resp.StatusCode)
+		return manifest, fmt.Errorf("status %d", resp.StatusCode)
 	}
-
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to decompress manifest: %v", err)
+		}
+		defer func() { _ = zr.Close() }()
+		body = zr
+	}
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// runPeer logic remains largely the same, relying on polling /manifest
+func runPeer(ctx context.Context, dir string, trackers []string, opts syncOptions) error {
+	chunksDir := filepath.Join(dir, ChunksDir)
+	if err := clearDigest(dir); err != nil {
+		return err
+	}
+
+	client := opts.client
+	if client == nil {
+		client = newPeerClient()
+	}
+	client, transferred := withTransferCounter(client)
+	defer client.CloseIdleConnections()
+
+	klog.Infof("Peer waiting for manifest from %s...", strings.Join(trackers, ","))
+	manifest, err := waitForManifest(ctx, client, trackers, opts.pollInterval, opts.waitTimeout)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Manifest received with %d chunks. Syncing...", len(manifest.Chunks))
+	start := time.Now()
+	if _, err := newHasher(manifest.Algorithm); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+	if err := manifest.validate(); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	// Download the missing chunks in the manifest order while the files are
+	// reconstructed, each chunk is consumed as soon as it is on disk.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	downloads := newChunkDownloads(chunksDir, &manifest)
+	if opts.delta {
+		prev, err := readManifest(filepath.Join(dir, ManifestFile))
+		if err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Ignoring the previous manifest: %v", err)
+		}
+		downloads.bases = deltaBases(chunksDir, prev, &manifest)
+		klog.V(2).Infof("Downloading %d chunks as deltas", len(downloads.bases))
+	}
+	go downloads.run(ctx, client, trackers, manifest.Algorithm, opts.batchSize)
+
+	created, err := applyManifestWhenReady(chunksDir, dir, &manifest, func(c ChunkInfo) error {
+		return downloads.wait(ctx, c.Hash)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply manifest: %v", err)
+	}
+
+	// cleanup extraneous files (miroring)
+	if opts.mirror {
+		if err := mirrorDestination(dir, created, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.serve || opts.delta {
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %v", err)
+		}
+		target := filepath.Join(dir, ManifestFile)
+		if err := writeFileAtomic(target, data); err != nil {
+			return fmt.Errorf("failed to write file %s: %v", target, err)
+		}
+		// the hub serving the files prunes the chunks on exit
+		if opts.delta && opts.cleanup && !opts.serve {
+			pruneChunks(chunksDir, &manifest)
+		}
+	} else if opts.cleanup {
+		// Always cleanup on peer check/sync success
+		klog.Info("Peer cleaning up artifacts...")
+		_ = os.RemoveAll(chunksDir)
+		_ = os.Remove(filepath.Join(dir, ManifestFile))
+	}
+	if opts.chunkCacheSize > 0 {
+		// The cache is an optimization, failing to evict does not fail the sync
+		if err := evictChunks(chunksDir, &manifest, opts.chunkCacheSize); err != nil {
+			klog.Warningf("Failed to evict chunks: %v", err)
+		}
+	}
+
+	if err := recordDigest(dir, opts.digest); err != nil {
+		return err
+	}
+
+	stats := peerStats{
+		Downloaded:     len(downloads.missing),
+		Skipped:        downloads.present,
+		Bytes:          transferred.bytes.Load(),
+		ElapsedSeconds: time.Since(start).Seconds(),
+	}
+	klog.Infof("Peer sync finished successfully: %s", stats)
+	if opts.statsOutput != nil {
+		return writeStats(opts.statsOutput, stats)
+	}
+	return nil
+}
+
+// chunkDownloads tracks the download of the chunks missing on disk
+type chunkDownloads struct {
+	chunksDir string
+	// missing chunks in the manifest order
+	missing []ChunkInfo
+	// done is closed once the chunk is downloaded or failed
+	done map[string]chan struct{}
+	mu   sync.Mutex
+	errs map[string]error
+	// batchUnsupported is set once the tracker rejects the batch downloads
+	batchUnsupported atomic.Bool
+	// bases of the chunks downloaded as deltas, see deltaBases
+	bases map[string]string
+	// present is the number of chunks already on disk
+	present int
+}
+
+func newChunkDownloads(chunksDir string, m *Manifest) *chunkDownloads {
+	d := &chunkDownloads{
+		chunksDir: chunksDir,
+		done:      make(map[string]chan struct{}),
+		errs:      make(map[string]error),
+	}
+	seen := make(map[string]bool, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+		if !hasChunk(chunksDir, chunk) {
+			d.done[chunk.Hash] = make(chan struct{})
+			d.missing = append(d.missing, chunk)
+		} else {
+			d.present++
+		}
+	}
+	return d
+}
+
+// run downloads the missing chunks in batches of batchSize chunks with a
+// bounded concurrency until ctx is done
+func (d *chunkDownloads) run(ctx context.Context, client *http.Client, trackers []string, algorithm string, batchSize int) {
+	batchSize = min(max(batchSize, 1), maxBatchSize)
+	sem := make(chan struct{}, downloadConcurrency)
+	for i := 0; i < len(d.missing); i += batchSize {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			// release the chunks not downloaded
+			for _, c := range d.missing {
+				d.finish(c.Hash, ctx.Err())
+			}
+			return
+		}
+		go func(batch []ChunkInfo) {
+			defer func() { <-sem }()
+			d.download(client, trackers, batch, algorithm)
+		}(d.missing[i:min(i+batchSize, len(d.missing))])
+	}
+}
+
+// download requests the batch to the first tracker, the chunks not saved from
+// the batch are downloaded one by one from any of the trackers.
+func (d *chunkDownloads) download(client *http.Client, trackers []string, batch []ChunkInfo, algorithm string) {
+	saved := make(map[string]bool, len(batch))
+	// the chunks with a base are requested one by one as deltas
+	whole := batch
+	if len(d.bases) > 0 {
+		whole = nil
+		for _, c := range batch {
+			if _, ok := d.bases[c.Hash]; !ok {
+				whole = append(whole, c)
+			}
+		}
+	}
+	if len(whole) > 1 && !d.batchUnsupported.Load() {
+		err := downloadBatch(client, trackers[0], whole, d.chunksDir, algorithm, func(hash string) {
+			saved[hash] = true
+			d.finish(hash, nil)
+		})
+		if errors.Is(err, errBatchUnsupported) {
+			if !d.batchUnsupported.Swap(true) {
+				klog.Infof("Tracker %s does not support batch downloads, downloading the chunks one by one", trackers[0])
+			}
+		} else if err != nil {
+			klog.V(2).Infof("Failed to download batch from %s: %v", trackers[0], err)
+		}
+	}
+	for _, c := range batch {
+		if saved[c.Hash] {
+			continue
+		}
+		if base, ok := d.bases[c.Hash]; ok {
+			err := downloadChunkDelta(client, trackers[0], c, base, filepath.Join(d.chunksDir, c.Hash), algorithm)
+			if err == nil {
+				d.finish(c.Hash, nil)
+				continue
+			}
+			klog.V(2).Infof("Failed to download chunk %s as a delta, downloading it whole: %v", c.Hash, err)
+		}
+		err := downloadChunkFromTrackers(client, trackers, c, filepath.Join(d.chunksDir, c.Hash), algorithm)
+		if err != nil {
+			err = fmt.Errorf("failed to download chunk %s: %v", c.Hash, err)
+		}
+		d.finish(c.Hash, err)
+	}
+}
+
+// finish records the result of the download, only the first one counts
+func (d *chunkDownloads) finish(hash string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.done[hash]:
+		return
+	default:
+	}
+	d.errs[hash] = err
+	close(d.done[hash])
+}
+
+// wait blocks until the chunk is on disk, chunks not being downloaded are already there
+func (d *chunkDownloads) wait(ctx context.Context, hash string) error {
+	done, ok := d.done[hash]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.errs[hash]
+}
+
+// downloadChunkFromTrackers tries the trackers in order until one serves a valid chunk.
+// Chunks are verified against their hash, so any tracker is a trusted source.
+func downloadChunkFromTrackers(client *http.Client, trackers []string, chunk ChunkInfo, dest, algorithm string) error {
+	var errs []error
+	for _, tracker := range trackers {
+		err := downloadChunk(client, tracker, chunk, dest, algorithm)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errNoSpace) {
+			// the other trackers can not help
+			return err
+		}
+		klog.V(2).Infof("Failed to download chunk %s from %s: %v", chunk.Hash, tracker, err)
+		errs = append(errs, fmt.Errorf("%s: %v", tracker, err))
+	}
+	return errors.Join(errs...)
+}
+
+func downloadChunk(client *http.Client, baseURL string, chunk ChunkInfo, dest, algorithm string) error {
+	resp, err := client.Get(baseURL + "/chunks/" + chunk.Hash)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return saveChunk(resp.Body, chunk.Hash, dest, algorithm, chunk.Codec)
+}
+
+// errBatchUnsupported is returned by the trackers without the batch endpoint
+var errBatchUnsupported = errors.New("batch downloads not supported")
+
+// downloadBatch requests the chunks to the tracker batch endpoint and saves
+// them as they are extracted, calling saved for every chunk matching its hash.
+// The chunks left out or corrupted in the stream are not reported as errors.
+func downloadBatch(client *http.Client, baseURL string, batch []ChunkInfo, chunksDir, algorithm string, saved func(hash string)) error {
+	hashes := make([]string, 0, len(batch))
+	pending := make(map[string]ChunkInfo, len(batch))
+	for _, c := range batch {
+		hashes = append(hashes, c.Hash)
+		pending[c.Hash] = c
+	}
+	body, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(baseURL+"/chunks-batch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return errBatchUnsupported
+	default:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	tr := tar.NewReader(resp.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c, ok := pending[header.Name]
+		if !ok {
+			return fmt.Errorf("unexpected chunk %q in batch", header.Name)
+		}
+		delete(pending, header.Name)
+		if err := saveChunk(tr, c.Hash, filepath.Join(chunksDir, c.Hash), algorithm, c.Codec); err != nil {
+			klog.V(2).Infof("Failed to save chunk %s from batch: %v", c.Hash, err)
+			continue
+		}
+		saved(c.Hash)
+	}
+}
+
+// saveChunk writes the chunk atomically to dest as received, verifying its
+// uncompressed content matches the hash.
+func saveChunk(r io.Reader, hash, dest, algorithm, codec string) error {
+	hasher, err := newHasher(algorithm)
+	if err != nil {
+		return err
+	}
+
 	// Write to temporary file first
 	tmpDest := dest + ".tmp"
-	out, err := os.Create(tmpDest)
+	out, err := createFile(tmpDest)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+		return fmt.Errorf("failed to create temp file: %w", diskError(err))
 	}
 
-	// TeeReader to verify hash while writing
-	hasher := sha256.New()
-	reader := io.TeeReader(resp.Body, hasher)
-
-	if _, err = io.Copy(out, reader); err != nil {
+	// TeeReader to store the encoded chunk while the decoded content is hashed
+	reader := io.TeeReader(r, out)
+	dec, err := decodeChunk(reader, codec)
+	if err == nil {
+		_, err = io.Copy(hasher, dec)
+		_ = dec.Close()
+	}
+	if err == nil {
+		// consume any trailing data so the stored chunk is complete
+		_, err = io.Copy(io.Discard, reader)
+	}
+	if err != nil {
 		_ = out.Close()
 		_ = os.Remove(tmpDest)
-		return fmt.Errorf("failed to write chunk: %v", err)
+		return fmt.Errorf("failed to write chunk: %w", diskError(err))
+	}
+	// the filesystem may only report the full disk on close
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmpDest)
+		return fmt.Errorf("failed to write chunk: %w", diskError(err))
 	}
-	_ = out.Close()
 
 	// Verify Hash
 	calculatedHash := hex.EncodeToString(hasher.Sum(nil))
@@ -380,58 +1336,328 @@ func downloadChunk(baseURL, hash, dest string) error {
 	return nil
 }
 
-func applyManifest(chunksDir, targetDir string, m *Manifest) ([]string, error) {
+// walkManifest reconstructs the tar stream from the chunks referenced by the manifest
+// and calls fn for every entry, the reader is only valid during the callback.
+func walkManifest(chunksDir string, m *Manifest, fn func(header *tar.Header, r io.Reader) error) error {
+	return walkManifestWhenReady(chunksDir, m, nil, fn)
+}
+
+// walkManifestWhenReady is walkManifest calling ready before reading each chunk,
+// so the stream can be reconstructed while the chunks are still being written.
+func walkManifestWhenReady(chunksDir string, m *Manifest, ready func(ChunkInfo) error, fn func(header *tar.Header, r io.Reader) error) error {
 	// Reconstruct stream and pipe to tar extraction
 	pr, pw := io.Pipe()
+	defer func() { _ = pr.Close() }()
 	go func() {
 		defer func() { _ = pw.Close() }()
 		for _, chunk := range m.Chunks {
-			data, err := os.ReadFile(filepath.Join(chunksDir, chunk.Hash))
-			if err != nil {
-				pw.CloseWithError(err)
-				return
+			if ready != nil {
+				if err := ready(chunk); err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
 			}
-			if _, err := pw.Write(data); err != nil {
+			if err := copyChunk(pw, filepath.Join(chunksDir, chunk.Hash), chunk.Codec); err != nil {
 				_ = pw.CloseWithError(err)
 				return
 			}
 		}
 	}()
 
-	var created []string
 	tr := tar.NewReader(pr)
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
 		}
+	}
+}
 
-		target := filepath.Join(targetDir, header.Name)
+// copyChunk streams the uncompressed content of the chunk stored in path to w,
+// the memory used is bounded regardless of the chunk size.
+func copyChunk(w io.Writer, path, codec string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	dec, err := decodeChunk(f, codec)
+	if err != nil {
+		return fmt.Errorf("failed to decode chunk %s: %v", filepath.Base(path), err)
+	}
+	defer func() { _ = dec.Close() }()
+	_, err = io.Copy(w, dec)
+	return err
+}
+
+// targetPath resolves the tar entry name inside targetDir,
+// entries escaping it (absolute paths or ../) are rejected.
+func targetPath(targetDir, name string) (string, error) {
+	target := filepath.Join(targetDir, filepath.Clean(name))
+	rel, err := filepath.Rel(targetDir, target)
+	if err != nil || filepath.IsAbs(name) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %q escapes the destination %s", name, targetDir)
+	}
+	return target, nil
+}
+
+// hasChunk reports whether the chunk is on disk as the manifest stores it, a
+// chunk kept from a previous sync with another codec has a different size
+// and must be transferred again.
+func hasChunk(chunksDir string, chunk ChunkInfo) bool {
+	info, err := os.Stat(filepath.Join(chunksDir, chunk.Hash))
+	return err == nil && uint(info.Size()) == chunk.storedSize()
+}
+
+// checkChunkSizes verifies the chunks referenced by the manifest have the expected size on disk
+func checkChunkSizes(chunksDir string, m *Manifest) error {
+	checked := make(map[string]bool, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		if checked[chunk.Hash] {
+			continue
+		}
+		checked[chunk.Hash] = true
+		info, err := os.Stat(filepath.Join(chunksDir, chunk.Hash))
+		if err != nil {
+			return err
+		}
+		if uint(info.Size()) != chunk.storedSize() {
+			return fmt.Errorf("chunk %s has %d bytes on disk, manifest expects %d", chunk.Hash, info.Size(), chunk.storedSize())
+		}
+	}
+	return nil
+}
+
+// applyManifest writes the entries of the manifest in targetDir and returns their paths
+func applyManifest(chunksDir, targetDir string, m *Manifest) ([]string, error) {
+	if err := checkChunkSizes(chunksDir, m); err != nil {
+		return nil, err
+	}
+	return applyManifestWhenReady(chunksDir, targetDir, m, nil)
+}
+
+// applyManifestWhenReady is applyManifest waiting for each chunk with ready before reading it,
+// the size of the chunks is checked once they are ready.
+func applyManifestWhenReady(chunksDir, targetDir string, m *Manifest, ready func(ChunkInfo) error) ([]string, error) {
+	if ready != nil {
+		checked := make(map[string]bool, len(m.Chunks))
+		wait := ready
+		ready = func(c ChunkInfo) error {
+			if err := wait(c); err != nil {
+				return err
+			}
+			if checked[c.Hash] {
+				return nil
+			}
+			checked[c.Hash] = true
+			return checkChunkSizes(chunksDir, &Manifest{Chunks: []ChunkInfo{c}})
+		}
+	}
+	var created []string
+	err := walkManifestWhenReady(chunksDir, m, ready, func(header *tar.Header, r io.Reader) error {
+		target, err := targetPath(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
 		created = append(created, target)
 
 		if header.Typeflag == tar.TypeDir {
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return nil, err
+			return os.MkdirAll(target, 0755)
+		}
+		return writeEntry(target, header, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// writeEntry writes the content of the entry to a temporary file renamed into
+// place once complete, the chunks may still be downloading and a failed sync
+// must not leave a truncated file in the destination.
+func writeEntry(target string, header *tar.Header, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(header.FileInfo().Mode().Perm()); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), target); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// verifyResult is the difference between the destination and the manifest,
+// paths are relative to the destination directory.
+type verifyResult struct {
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+	Modified []string `json:"modified"`
+}
+
+func (v verifyResult) matches() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Modified) == 0
+}
+
+// runVerify compares the destination directory with the file set described by the manifest
+// and writes the differences as JSON. It never modifies the destination.
+func runVerify(r io.Reader, w io.Writer, dataDir, chunksDir string) error {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	if err := m.validate(); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	result := verifyResult{}
+	expected := make(map[string]bool)
+	err := walkManifest(chunksDir, &m, func(header *tar.Header, r io.Reader) error {
+		target, err := targetPath(dataDir, header.Name)
+		if err != nil {
+			return err
+		}
+		expected[target] = true
+		// Also expect the parent directories of the entry
+		for dir := filepath.Dir(target); dir != dataDir && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			expected[dir] = true
+		}
+
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			result.Missing = append(result.Missing, header.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if !info.IsDir() {
+				result.Modified = append(result.Modified, header.Name)
 			}
-			continue
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() != header.Size {
+			result.Modified = append(result.Modified, header.Name)
+			return nil
 		}
-		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
+		same, err := sameContent(target, r)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if _, err := io.Copy(f, tr); err != nil {
-			_ = f.Close()
-			return nil, err
+		if !same {
+			result.Modified = append(result.Modified, header.Name)
 		}
-		_ = f.Close()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reconstruct manifest: %v", err)
 	}
-	return created, nil
+
+	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dataDir || path == filepath.Join(dataDir, ManifestFile) || path == filepath.Join(dataDir, DigestFile) {
+			return nil
+		}
+		if info.IsDir() && path == chunksDir {
+			return filepath.SkipDir
+		}
+		if expected[path] {
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+		result.Extra = append(result.Extra, rel)
+		// Report an extraneous directory once, not every file inside it
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk destination: %v", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return fmt.Errorf("failed to write verify result: %v", err)
+	}
+	if !result.matches() {
+		return fmt.Errorf("destination %s does not match manifest: %d missing, %d extra, %d modified",
+			dataDir, len(result.Missing), len(result.Extra), len(result.Modified))
+	}
+	return nil
+}
+
+// sameContent compares the hash of the file on disk with the hash of the expected content
+func sameContent(path string, expected io.Reader) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	actualHasher := sha256.New()
+	if _, err := io.Copy(actualHasher, f); err != nil {
+		return false, err
+	}
+	expectedHasher := sha256.New()
+	if _, err := io.Copy(expectedHasher, expected); err != nil {
+		return false, err
+	}
+	return bytes.Equal(actualHasher.Sum(nil), expectedHasher.Sum(nil)), nil
 }
 
-func cleanupExtraneousFiles(targetDir string, keep []string) error {
+// mirrorDestination deletes the files in targetDir that were not created from the manifest.
+// A manifest without entries comes from an empty source and would wipe the destination,
+// that is refused unless force is set. Failures deleting the files do not fail the sync.
+func mirrorDestination(targetDir string, created []string, opts syncOptions) error {
+	if len(created) == 0 && !opts.force && !opts.dryRun {
+		entries, err := os.ReadDir(targetDir)
+		if err != nil {
+			return fmt.Errorf("failed to read destination %s: %v", targetDir, err)
+		}
+		for _, e := range entries {
+			if e.Name() != ChunksDir && e.Name() != ManifestFile && e.Name() != DigestFile && !opts.mirrorExclude.match(e.Name()) {
+				return fmt.Errorf("refusing to mirror an empty source into %s, it would delete all its content: use -force to clear it", targetDir)
+			}
+		}
+	}
+
+	if _, err := cleanupExtraneousFiles(targetDir, created, opts.mirrorExclude, opts.dryRun); err != nil {
+		klog.Warningf("Failed to cleanup extraneous files: %v", err)
+	}
+	return nil
+}
+
+// cleanupExtraneousFiles deletes the files and directories in targetDir not present in keep
+// and returns them. The paths relative to targetDir matching exclude are never deleted, nor
+// the directories containing them. If dryRun is set it only logs and returns the paths it would delete.
+func cleanupExtraneousFiles(targetDir string, keep []string, exclude patterns, dryRun bool) ([]string, error) {
 	keepMap := make(map[string]bool)
 	for _, p := range keep {
 		keepMap[p] = true
@@ -439,6 +1665,7 @@ func cleanupExtraneousFiles(targetDir string, keep []string) error {
 	// Always keep internal structures
 	keepMap[filepath.Join(targetDir, ChunksDir)] = true
 	keepMap[filepath.Join(targetDir, ManifestFile)] = true
+	keepMap[filepath.Join(targetDir, DigestFile)] = true
 
 	// Also keep parent directories of kept files
 	for _, p := range keep {
@@ -456,7 +1683,8 @@ func cleanupExtraneousFiles(targetDir string, keep []string) error {
 	// If a directory is NOT in keepMap, it means NO file inside it is kept. So we can RemoveAll it.
 	// However, we must be careful not to RemoveAll a directory that IS in keepMap (which implies some child is kept).
 
-	return filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+	var removed []string
+	err := filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -476,9 +1704,29 @@ func cleanupExtraneousFiles(targetDir string, keep []string) error {
 			return nil
 		}
 
+		rel, err := filepath.Rel(targetDir, path)
+		if err != nil {
+			return err
+		}
+		if exclude.match(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// The directory is walked to delete its content but the excluded paths
+		if info.IsDir() && containsExcluded(path, targetDir, exclude) {
+			return nil
+		}
+
 		// If it's a directory and NOT in keepMap, it implies no children are kept (because we added parents of all kept files).
 		// So we can safely RemoveAll it.
+		removed = append(removed, path)
 		if info.IsDir() {
+			if dryRun {
+				klog.Infof("Dry run: would remove extraneous directory: %s", path)
+				return filepath.SkipDir
+			}
 			klog.Infof("Removing extraneous directory: %s", path)
 			if err := os.RemoveAll(path); err != nil {
 				return err
@@ -486,7 +1734,62 @@ func cleanupExtraneousFiles(targetDir string, keep []string) error {
 			return filepath.SkipDir // No need to walk deleted dir
 		}
 
+		if dryRun {
+			klog.Infof("Dry run: would remove extraneous file: %s", path)
+			return nil
+		}
 		klog.Infof("Removing extraneous file: %s", path)
 		return os.Remove(path)
 	})
+	return removed, err
+}
+
+// containsExcluded reports whether any path inside dir matches the exclude patterns
+func containsExcluded(dir, targetDir string, exclude patterns) bool {
+	if len(exclude) == 0 {
+		return false
+	}
+	found := false
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(targetDir, path)
+		if err == nil && exclude.match(filepath.ToSlash(rel)) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// patterns is a repeatable flag of regular expressions
+type patterns []*regexp.Regexp
+
+func (p *patterns) String() string {
+	exprs := make([]string, 0, len(*p))
+	for _, re := range *p {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ",")
+}
+
+func (p *patterns) Set(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, re)
+	return nil
+}
+
+// match reports whether any of the patterns matches s
+func (p patterns) match(s string) bool {
+	for _, re := range p {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
 }
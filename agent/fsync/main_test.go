@@ -3,17 +3,25 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -91,8 +99,9 @@ func TestRunIngest(t *testing.T) {
 	}
 
 	// Add a Chunk
-	chunkName := "chunk123"
 	chunkData := []byte("some data")
+	sum := sha256.Sum256(chunkData)
+	chunkName := hex.EncodeToString(sum[:])
 	hdr = &tar.Header{
 		Name: chunkName,
 		Mode: 0644,
@@ -110,7 +119,7 @@ func TestRunIngest(t *testing.T) {
 	}
 
 	// Run Ingest
-	err = runIngest(&buf, dataDir, chunksDir, false, false)
+	err = runIngest(&buf, dataDir, chunksDir, HashSHA256, syncOptions{})
 	if err != nil {
 		t.Fatalf("runIngest failed: %v", err)
 	}
@@ -174,7 +183,7 @@ func TestRunHubAndPeerIntegration(t *testing.T) {
 	}
 
 	// Use httptest Server for Hub
-	ts := httptest.NewServer(newHubHandler(hubDir))
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
 	defer ts.Close()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -182,7 +191,7 @@ func TestRunHubAndPeerIntegration(t *testing.T) {
 
 	// Start Peer
 	// Peer runs until it syncs or context cancelled.
-	if err := runPeer(ctx, peerDir, ts.URL, true, false); err != nil {
+	if err := runPeer(ctx, peerDir, []string{ts.URL}, syncOptions{cleanup: true}); err != nil {
 		t.Fatalf("runPeer failed: %v", err)
 	}
 
@@ -230,7 +239,7 @@ func TestExhaustiveSync(t *testing.T) {
 
 	// Helper to generate chunks using CDC
 	generateAndWrite := func(src string) Manifest {
-		m, err := cdc.GenerateManifest(src, nil, hubChunksDir)
+		m, err := cdc.GenerateManifest(src, hubChunksDir, cdc.Options{})
 		if err != nil {
 			t.Fatalf("GenerateManifest failed: %v", err)
 		}
@@ -258,7 +267,7 @@ func TestExhaustiveSync(t *testing.T) {
 
 	requestCounts := make(map[string]int)
 	var mu sync.Mutex
-	h := newHubHandler(hubDir)
+	h := newHubHandler(hubDir, hubOptions{})
 	wrapper := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		requestCounts[r.URL.Path]++
@@ -272,7 +281,7 @@ func TestExhaustiveSync(t *testing.T) {
 	ctx := context.Background()
 
 	start := time.Now()
-	if err := runPeer(ctx, peerDir, ts.URL, false, false); err != nil {
+	if err := runPeer(ctx, peerDir, []string{ts.URL}, syncOptions{}); err != nil {
 		t.Fatalf("Initial sync failed: %v", err)
 	}
 	t.Logf("Initial sync of %d files took %v", numFiles, time.Since(start))
@@ -302,7 +311,7 @@ func TestExhaustiveSync(t *testing.T) {
 
 	// Sync again
 	start = time.Now()
-	if err := runPeer(ctx, peerDir, ts.URL, false, false); err != nil {
+	if err := runPeer(ctx, peerDir, []string{ts.URL}, syncOptions{}); err != nil {
 		t.Fatalf("Incremental sync failed: %v", err)
 	}
 	t.Logf("Incremental sync took %v", time.Since(start))
@@ -375,7 +384,7 @@ func TestMirroring(t *testing.T) {
 	// 3. Generate Manifest from Source
 	// We need a temp dir for chunks on the "hub" side (simulated)
 	hubChunksDir := t.TempDir()
-	cdcManifest, err := cdc.GenerateManifest(srcDir, nil, hubChunksDir)
+	cdcManifest, err := cdc.GenerateManifest(srcDir, hubChunksDir, cdc.Options{})
 	if err != nil {
 		t.Fatalf("GenerateManifest failed: %v", err)
 	}
@@ -405,7 +414,7 @@ func TestMirroring(t *testing.T) {
 	}
 
 	// cleanup extraneous files (mirroring)
-	if err := cleanupExtraneousFiles(dstDir, created); err != nil {
+	if _, err := cleanupExtraneousFiles(dstDir, created, nil, false); err != nil {
 		t.Fatalf("cleanupExtraneousFiles failed: %v", err)
 	}
 
@@ -424,3 +433,1589 @@ func TestMirroring(t *testing.T) {
 		t.Errorf("Extra dir %s was NOT deleted", extraDir)
 	}
 }
+
+func TestRunVerify(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	dstChunksDir := filepath.Join(dstDir, ChunksDir)
+
+	for name, content := range map[string]string{
+		"keep.txt":        "keep me",
+		"modify.txt":      "original",
+		"delete.txt":      "delete me",
+		"subdir/file.txt": "nested",
+	} {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(dstChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create dst chunks dir: %v", err)
+	}
+	cdcManifest, err := cdc.GenerateManifest(srcDir, dstChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	manifestBytes, err := json.Marshal(cdcManifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		t.Fatalf("Failed to unmarshal manifest: %v", err)
+	}
+
+	if _, err := applyManifest(dstChunksDir, dstDir, &manifest); err != nil {
+		t.Fatalf("applyManifest failed: %v", err)
+	}
+
+	// A freshly applied destination matches
+	var out bytes.Buffer
+	if err := runVerify(bytes.NewReader(manifestBytes), &out, dstDir, dstChunksDir); err != nil {
+		t.Fatalf("runVerify failed on a synced destination: %v (output: %s)", err, out.String())
+	}
+
+	// Diverge the destination
+	if err := os.WriteFile(filepath.Join(dstDir, "modify.txt"), []byte("modified"), 0644); err != nil {
+		t.Fatalf("Failed to modify file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dstDir, "delete.txt")); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	extraFile := filepath.Join(dstDir, "extra.txt")
+	if err := os.WriteFile(extraFile, []byte("extra"), 0644); err != nil {
+		t.Fatalf("Failed to create extra file: %v", err)
+	}
+
+	out.Reset()
+	if err := runVerify(bytes.NewReader(manifestBytes), &out, dstDir, dstChunksDir); err == nil {
+		t.Fatal("Expected runVerify to fail on a diverged destination")
+	}
+
+	var result verifyResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal verify output %q: %v", out.String(), err)
+	}
+	want := verifyResult{
+		Missing:  []string{"delete.txt"},
+		Extra:    []string{"extra.txt"},
+		Modified: []string{"modify.txt"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Got verify result %+v, want %+v", result, want)
+	}
+
+	// Verify must not modify the destination
+	if _, err := os.Stat(extraFile); err != nil {
+		t.Errorf("Extra file was removed by verify: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dstDir, "modify.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read modified file: %v", err)
+	}
+	if string(content) != "modified" {
+		t.Errorf("Modified file was rewritten by verify: %s", content)
+	}
+}
+
+// ingestTar builds the stream sent by the client on ingest: the chunks followed by the manifest
+func ingestTar(t *testing.T, chunksDir string, m cdc.Manifest) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name, codec string, data []byte) {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}
+		if codec != "" {
+			header.PAXRecords = map[string]string{codecPAXRecord: codec}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+	for _, chunk := range m.Chunks {
+		data, err := os.ReadFile(filepath.Join(chunksDir, chunk.Hash))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		write(chunk.Hash, chunk.Codec, data)
+	}
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	write(ManifestFile, "", manifestBytes)
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	return &buf
+}
+
+func TestSyncHashAlgorithms(t *testing.T) {
+	srcDir := t.TempDir()
+	fileContent := bytes.Repeat([]byte("hash algorithms "), 10000)
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), fileContent, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	for _, tt := range []struct {
+		algorithm      string
+		otherAlgorithm string
+	}{
+		{algorithm: HashSHA256, otherAlgorithm: HashBLAKE3},
+		{algorithm: HashBLAKE3, otherAlgorithm: HashSHA256},
+	} {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			localChunksDir := t.TempDir()
+			leaderDir := t.TempDir()
+			peerDir := t.TempDir()
+			leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+			if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+				t.Fatalf("Failed to create leader chunks dir: %v", err)
+			}
+			if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+				t.Fatalf("Failed to create peer chunks dir: %v", err)
+			}
+
+			m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Algorithm: tt.algorithm})
+			if err != nil {
+				t.Fatalf("GenerateManifest failed: %v", err)
+			}
+			if m.Algorithm != tt.algorithm {
+				t.Fatalf("Manifest algorithm %q, want %q", m.Algorithm, tt.algorithm)
+			}
+
+			// A manifest hashed with another algorithm is rejected
+			err = runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, tt.otherAlgorithm, syncOptions{})
+			if err == nil {
+				t.Fatalf("Expected ingest with algorithm %s to fail", tt.otherAlgorithm)
+			}
+
+			// Client -> Leader
+			if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, tt.algorithm, syncOptions{}); err != nil {
+				t.Fatalf("runIngest failed: %v", err)
+			}
+
+			// Leader -> Peer
+			ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: tt.algorithm}))
+			defer ts.Close()
+			if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{}); err != nil {
+				t.Fatalf("runPeer failed: %v", err)
+			}
+
+			for _, dir := range []string{leaderDir, peerDir} {
+				content, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+				if err != nil {
+					t.Fatalf("Failed to read synced file: %v", err)
+				}
+				if !bytes.Equal(content, fileContent) {
+					t.Errorf("Synced content mismatch in %s", dir)
+				}
+			}
+		})
+	}
+}
+
+func TestRunStatfs(t *testing.T) {
+	var out bytes.Buffer
+	if err := runStatfs(&out, t.TempDir()); err != nil {
+		t.Fatalf("runStatfs failed: %v", err)
+	}
+	var result statfsResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal output %q: %v", out.String(), err)
+	}
+	if result.Free == 0 {
+		t.Errorf("Expected free space in the temporary directory, got 0")
+	}
+}
+
+func TestMirroringDryRun(t *testing.T) {
+	dstDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dstDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create dst chunks dir: %v", err)
+	}
+
+	keepFile := filepath.Join(dstDir, "keep.txt")
+	extraFile := filepath.Join(dstDir, "extra.txt")
+	extraDir := filepath.Join(dstDir, "extraDir")
+	if err := os.MkdirAll(extraDir, 0755); err != nil {
+		t.Fatalf("Failed to create extra dir: %v", err)
+	}
+	for _, f := range []string{keepFile, extraFile, filepath.Join(extraDir, "file.txt")} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file %s: %v", f, err)
+		}
+	}
+
+	want := []string{extraFile, extraDir}
+
+	// Dry run reports the paths but does not delete anything
+	removed, err := cleanupExtraneousFiles(dstDir, []string{keepFile}, nil, true)
+	if err != nil {
+		t.Fatalf("cleanupExtraneousFiles dry run failed: %v", err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("Dry run reported %v, want %v", removed, want)
+	}
+	for _, p := range []string{keepFile, extraFile, extraDir, filepath.Join(extraDir, "file.txt")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Dry run removed %s: %v", p, err)
+		}
+	}
+
+	// A real run deletes the same paths
+	removed, err = cleanupExtraneousFiles(dstDir, []string{keepFile}, nil, false)
+	if err != nil {
+		t.Fatalf("cleanupExtraneousFiles failed: %v", err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("Removed %v, want %v", removed, want)
+	}
+	for _, p := range want {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", p)
+		}
+	}
+	if _, err := os.Stat(keepFile); err != nil {
+		t.Errorf("Keep file was removed: %v", err)
+	}
+}
+
+func TestSyncCompressedChunks(t *testing.T) {
+	// Mix compressible text with incompressible random data
+	srcDir := t.TempDir()
+	textContent := bytes.Repeat([]byte("compressible text "), 200000)
+	randomContent := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(randomContent); err != nil {
+		t.Fatalf("Failed to generate random data: %v", err)
+	}
+	srcFiles := map[string][]byte{
+		"text.txt":   textContent,
+		"random.bin": randomContent,
+	}
+	for name, content := range srcFiles {
+		if err := os.WriteFile(filepath.Join(srcDir, name), content, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+	}
+
+	localChunksDir := t.TempDir()
+	leaderDir := t.TempDir()
+	peerDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	for _, dir := range []string{leaderChunksDir, filepath.Join(peerDir, ChunksDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create chunks dir: %v", err)
+		}
+	}
+
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Compress: true})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	var compressed, uncompressed int
+	for _, c := range m.Chunks {
+		if c.Codec == CodecGzip {
+			compressed++
+		} else {
+			uncompressed++
+		}
+	}
+	if compressed == 0 || uncompressed == 0 {
+		t.Fatalf("Expected a mix of compressed and uncompressed chunks, got %d compressed and %d uncompressed", compressed, uncompressed)
+	}
+
+	// Client -> Leader
+	if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+
+	// Leader -> Peer, the hub verifies the decoded chunks
+	ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: HashSHA256}))
+	defer ts.Close()
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{}); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+
+	for _, dir := range []string{leaderDir, peerDir} {
+		for name, want := range srcFiles {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("Failed to read synced file: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Synced content mismatch for %s in %s", name, dir)
+			}
+		}
+	}
+
+	// A compressed chunk ingested without its codec fails the integrity check
+	for _, c := range m.Chunks {
+		if c.Codec == "" {
+			continue
+		}
+		c.Codec = ""
+		err := runIngest(ingestTar(t, localChunksDir, cdc.Manifest{Chunks: []cdc.ChunkInfo{c}}), t.TempDir(), t.TempDir(), HashSHA256, syncOptions{})
+		if err == nil {
+			t.Errorf("Expected ingest of chunk %s without codec to fail", c.Hash)
+		}
+		break
+	}
+}
+
+func TestRunPeerWaitTimeout(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	opts := syncOptions{pollInterval: 10 * time.Millisecond, waitTimeout: 300 * time.Millisecond}
+	start := time.Now()
+	err := runPeer(context.Background(), t.TempDir(), []string{ts.URL}, opts)
+	if err == nil {
+		t.Fatal("Expected runPeer to fail when the manifest never appears")
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runPeer took %v to give up, expected around %v", elapsed, opts.waitTimeout)
+	}
+
+	// Exponential backoff polls far less than a fixed interval would
+	mu.Lock()
+	defer mu.Unlock()
+	if requests == 0 || requests >= int(opts.waitTimeout/opts.pollInterval) {
+		t.Errorf("Unexpected number of manifest polls %d", requests)
+	}
+}
+
+func TestMirroringEmptySource(t *testing.T) {
+	// An empty source directory still produces a manifest, without entries
+	srcDir := t.TempDir()
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed for an empty source: %v", err)
+	}
+
+	newDestination := func(t *testing.T) (string, string) {
+		dstDir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dstDir, ChunksDir), 0755); err != nil {
+			t.Fatalf("Failed to create dst chunks dir: %v", err)
+		}
+		existing := filepath.Join(dstDir, "existing.txt")
+		if err := os.WriteFile(existing, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create existing file: %v", err)
+		}
+		return dstDir, existing
+	}
+
+	tests := []struct {
+		name       string
+		opts       syncOptions
+		wantErr    bool
+		wantExists bool
+	}{
+		{name: "mirror is refused", opts: syncOptions{mirror: true}, wantErr: true, wantExists: true},
+		{name: "dry run does not delete", opts: syncOptions{mirror: true, dryRun: true}, wantExists: true},
+		{name: "force clears the destination", opts: syncOptions{mirror: true, force: true}, wantExists: false},
+		{name: "no mirror keeps the destination", opts: syncOptions{}, wantExists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dstDir, existing := newDestination(t)
+			err := runIngest(ingestTar(t, localChunksDir, m), dstDir, filepath.Join(dstDir, ChunksDir), HashSHA256, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runIngest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, err = os.Stat(existing)
+			if exists := err == nil; exists != tt.wantExists {
+				t.Errorf("Existing file exists = %v, want %v", exists, tt.wantExists)
+			}
+		})
+	}
+
+	// An empty destination is not an error
+	dstDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dstDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create dst chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), dstDir, filepath.Join(dstDir, ChunksDir), HashSHA256, syncOptions{mirror: true}); err != nil {
+		t.Errorf("runIngest into an empty destination failed: %v", err)
+	}
+}
+
+func TestApplyManifestPathTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{name: "parent", entry: "../evil"},
+		{name: "nested parent", entry: "dir/../../evil"},
+		{name: "absolute", entry: "/evil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Craft a chunk with a malicious tar entry
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			content := []byte("evil")
+			if err := tw.WriteHeader(&tar.Header{Name: tt.entry, Mode: 0644, Size: int64(len(content))}); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			if _, err := tw.Write(content); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Failed to close tar writer: %v", err)
+			}
+
+			root := t.TempDir()
+			targetDir := filepath.Join(root, "dst")
+			chunksDir := filepath.Join(targetDir, ChunksDir)
+			if err := os.MkdirAll(chunksDir, 0755); err != nil {
+				t.Fatalf("Failed to create chunks dir: %v", err)
+			}
+			sum := sha256.Sum256(buf.Bytes())
+			hash := hex.EncodeToString(sum[:])
+			if err := os.WriteFile(filepath.Join(chunksDir, hash), buf.Bytes(), 0644); err != nil {
+				t.Fatalf("Failed to write chunk: %v", err)
+			}
+
+			m := &Manifest{Chunks: []ChunkInfo{{Hash: hash, Size: uint(buf.Len())}}}
+			if _, err := applyManifest(chunksDir, targetDir, m); err == nil {
+				t.Fatal("Expected applyManifest to reject the entry")
+			}
+			for _, p := range []string{filepath.Join(root, "evil"), "/evil"} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("Entry was written outside the destination: %s", p)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestConsistency(t *testing.T) {
+	chunksDir := t.TempDir()
+	content := []byte("hello")
+	hash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	if err := os.WriteFile(filepath.Join(chunksDir, hash), content, 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+
+	// A hash referenced with conflicting sizes is rejected on load
+	conflicting := Manifest{Chunks: []ChunkInfo{{Hash: hash, Size: 5}, {Hash: hash, Size: 6}}}
+	data, err := json.Marshal(conflicting)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	var out bytes.Buffer
+	if err := runCheck(bytes.NewReader(data), &out, chunksDir); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("Expected runCheck to reject the conflicting manifest, got %v", err)
+	}
+	if err := runVerify(bytes.NewReader(data), &out, t.TempDir(), chunksDir); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("Expected runVerify to reject the conflicting manifest, got %v", err)
+	}
+
+	// A chunk whose size on disk differs from the manifest is detected before applying it
+	wrongSize := &Manifest{Chunks: []ChunkInfo{{Hash: hash, Size: 4}}}
+	if _, err := applyManifest(chunksDir, t.TempDir(), wrongSize); err == nil || !strings.Contains(err.Error(), "expects 4") {
+		t.Errorf("Expected applyManifest to detect the size mismatch, got %v", err)
+	}
+}
+
+func TestApplyManifestLargeChunk(t *testing.T) {
+	// A single chunk far bigger than the chunker produces, holding one large file
+	fileContent := bytes.Repeat([]byte("0123456789abcdef"), 2*1024*1024) // 32MiB
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "model.bin", Mode: 0644, Size: int64(len(fileContent))}); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	if _, err := tw.Write(fileContent); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+
+	chunksDir := t.TempDir()
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(chunksDir, hash), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	chunkSize := buf.Len()
+	buf.Reset()
+
+	targetDir := t.TempDir()
+	m := &Manifest{Chunks: []ChunkInfo{{Hash: hash, Size: uint(chunkSize)}}}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if _, err := applyManifest(chunksDir, targetDir, m); err != nil {
+		t.Fatalf("applyManifest failed: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	got, err := os.ReadFile(filepath.Join(targetDir, "model.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read reconstructed file: %v", err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Errorf("Reconstructed file does not match the original content")
+	}
+
+	// The chunk is streamed, it must never be loaded whole in memory
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(chunkSize)/4 {
+		t.Errorf("applyManifest allocated %d bytes for a chunk of %d bytes", allocated, chunkSize)
+	}
+}
+
+func TestRunPeerTrackerFallback(t *testing.T) {
+	srcDir := t.TempDir()
+	fileContent := bytes.Repeat([]byte("fallback "), 1000)
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), fileContent, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	hub := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
+	defer hub.Close()
+
+	// A tracker that is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	// A tracker that dies after serving the manifest
+	dying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			return
+		case "/manifest":
+			_ = json.NewEncoder(w).Encode(m)
+			return
+		}
+		http.Error(w, "hub gone", http.StatusServiceUnavailable)
+	}))
+	defer dying.Close()
+
+	tests := []struct {
+		name     string
+		trackers []string
+	}{
+		{name: "first tracker down", trackers: []string{down.URL, hub.URL}},
+		{name: "first tracker fails serving chunks", trackers: []string{dying.URL, hub.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peerDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+				t.Fatalf("Failed to create peer chunks dir: %v", err)
+			}
+			opts := syncOptions{pollInterval: 10 * time.Millisecond, waitTimeout: 5 * time.Second}
+			if err := runPeer(context.Background(), peerDir, tt.trackers, opts); err != nil {
+				t.Fatalf("runPeer failed: %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(peerDir, "data.txt"))
+			if err != nil {
+				t.Fatalf("Failed to read synced file: %v", err)
+			}
+			if !bytes.Equal(content, fileContent) {
+				t.Errorf("Synced content mismatch")
+			}
+		})
+	}
+
+	// All trackers failing is an error
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	if err := runPeer(context.Background(), peerDir, []string{dying.URL, down.URL}, syncOptions{}); err == nil {
+		t.Error("Expected runPeer to fail when no tracker serves the chunks")
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("digest"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	readDigest := func(dir string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := runDigest(&out, dir); err != nil {
+			t.Fatalf("runDigest failed: %v", err)
+		}
+		var result digestResult
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to decode digest: %v", err)
+		}
+		return result.Digest
+	}
+
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	if got := readDigest(leaderDir); got != "" {
+		t.Fatalf("Expected no digest before syncing, got %q", got)
+	}
+	opts := syncOptions{mirror: true, digest: "abc"}
+	if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, opts); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	// Mirroring keeps the digest
+	if got := readDigest(leaderDir); got != "abc" {
+		t.Errorf("Expected digest %q after ingest, got %q", "abc", got)
+	}
+
+	ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: HashSHA256}))
+	defer ts.Close()
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, opts); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	if got := readDigest(peerDir); got != "abc" {
+		t.Errorf("Expected digest %q after peer sync, got %q", "abc", got)
+	}
+
+	// A failed sync forgets the digest
+	err = runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashBLAKE3, syncOptions{digest: "def"})
+	if err == nil {
+		t.Fatal("Expected ingest with a mismatched algorithm to fail")
+	}
+	if got := readDigest(leaderDir); got != "" {
+		t.Errorf("Expected no digest after a failed sync, got %q", got)
+	}
+}
+
+func TestRunPeerPipelined(t *testing.T) {
+	srcDir := t.TempDir()
+	first := []byte("first file")
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), first, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	big := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(big); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "b.bin"), big, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	small, err := cdc.ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Chunker: small})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if len(m.Chunks) < 10 {
+		t.Fatalf("Expected many chunks, got %d", len(m.Chunks))
+	}
+
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+
+	// The last chunk is only served once the first file is reconstructed
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	last := m.Chunks[len(m.Chunks)-1].Hash
+	var pipelined atomic.Bool
+	hub := newHubHandler(hubDir, hubOptions{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunks/"+last {
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				if got, err := os.ReadFile(filepath.Join(peerDir, "a.txt")); err == nil && bytes.Equal(got, first) {
+					pipelined.Store(true)
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{mirror: true}); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	if !pipelined.Load() {
+		t.Error("Expected the files to be reconstructed while the chunks are downloaded")
+	}
+	for name, want := range map[string][]byte{"a.txt": first, "b.bin": big} {
+		got, err := os.ReadFile(filepath.Join(peerDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read synced file: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Synced content of %s mismatch", name)
+		}
+	}
+}
+
+// TestRunPeerFailedDownload checks a failed chunk download leaves the files of
+// the destination as they were, the pipelined apply writes temporary files.
+func TestRunPeerFailedDownload(t *testing.T) {
+	srcDir := t.TempDir()
+	big := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(big); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "b.bin"), big, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	small, err := cdc.ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Chunker: small})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	// the last chunk of the file can not be downloaded
+	if err := os.Remove(filepath.Join(hubChunksDir, m.Chunks[len(m.Chunks)-2].Hash)); err != nil {
+		t.Fatalf("Failed to remove chunk: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
+	defer ts.Close()
+
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	previous := []byte("previous version")
+	if err := os.WriteFile(filepath.Join(peerDir, "b.bin"), previous, 0644); err != nil {
+		t.Fatalf("Failed to write previous file: %v", err)
+	}
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{}); err == nil {
+		t.Fatal("Expected the sync to fail")
+	}
+	got, err := os.ReadFile(filepath.Join(peerDir, "b.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read previous file: %v", err)
+	}
+	if !bytes.Equal(got, previous) {
+		t.Errorf("Expected the previous file to be kept, got %d bytes", len(got))
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(peerDir, ".*.tmp-*")); len(tmp) > 0 {
+		t.Errorf("Expected the temporary files to be removed, got %v", tmp)
+	}
+}
+
+func TestRunPeerReusesConnections(t *testing.T) {
+	srcDir := t.TempDir()
+	data := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	small, err := cdc.ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Chunker: small})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if len(m.Chunks) < 4*downloadConcurrency {
+		t.Fatalf("Expected many chunks, got %d", len(m.Chunks))
+	}
+
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	// slow down the chunks so the downloads overlap
+	hub := newHubHandler(hubDir, hubOptions{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chunks/") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+
+	// count the connections opened by the peer
+	client := newPeerClient()
+	transport := client.Transport.(*http.Transport)
+	var dials atomic.Int32
+	dialer := &net.Dialer{}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{client: client}); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(peerDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read synced file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Synced content mismatch")
+	}
+	// one connection per parallel download, shared by the manifest poll
+	if n := dials.Load(); n > downloadConcurrency {
+		t.Errorf("Expected at most %d connections for %d chunks, got %d", downloadConcurrency, len(m.Chunks), n)
+	}
+}
+
+func TestHubChunkBatch(t *testing.T) {
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	goodHash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	if err := os.WriteFile(filepath.Join(hubChunksDir, goodHash), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	badHash := "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7" // sha256("world")
+	if err := os.WriteFile(filepath.Join(hubChunksDir, badHash), []byte("EVIL DATA"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupted chunk: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(hubDir, ManifestFile), []byte("{}"), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		verifyChunks bool
+		hashes       []string
+		want         map[string]string
+	}{
+		{
+			name:         "valid chunks",
+			verifyChunks: true,
+			hashes:       []string{goodHash},
+			want:         map[string]string{goodHash: "hello"},
+		},
+		{
+			name:         "missing and corrupted chunks are left out",
+			verifyChunks: true,
+			hashes:       []string{"missing", badHash, goodHash},
+			want:         map[string]string{goodHash: "hello"},
+		},
+		{
+			name:         "corrupted chunk without verification",
+			verifyChunks: false,
+			hashes:       []string{badHash, goodHash},
+			want:         map[string]string{badHash: "EVIL DATA", goodHash: "hello"},
+		},
+		{
+			name:   "paths outside the chunks are refused",
+			hashes: []string{"../" + ManifestFile, "..", ".", ""},
+			want:   map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{verifyChunks: tt.verifyChunks}))
+			defer ts.Close()
+
+			body, err := json.Marshal(tt.hashes)
+			if err != nil {
+				t.Fatalf("Failed to marshal hashes: %v", err)
+			}
+			resp, err := http.Post(ts.URL+"/chunks-batch", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Failed to post batch: %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			got := map[string]string{}
+			tr := tar.NewReader(resp.Body)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to read batch: %v", err)
+				}
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("Failed to read chunk %s: %v", header.Name, err)
+				}
+				got[header.Name] = string(data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got chunks %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/chunks-batch")
+	if err != nil {
+		t.Fatalf("Failed to get batch: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Got status %d for GET, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	tooLarge, err := json.Marshal(make([]string, maxBatchSize+1))
+	if err != nil {
+		t.Fatalf("Failed to marshal hashes: %v", err)
+	}
+	resp, err = http.Post(ts.URL+"/chunks-batch", "application/json", bytes.NewReader(tooLarge))
+	if err != nil {
+		t.Fatalf("Failed to post batch: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %d for a batch too large, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestRunPeerBatch(t *testing.T) {
+	srcDir := t.TempDir()
+	data := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	small, err := cdc.ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{Chunker: small, Compress: true})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if len(m.Chunks) < 10 {
+		t.Fatalf("Expected many chunks, got %d", len(m.Chunks))
+	}
+
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	// one chunk is missing in the batches and downloaded on its own
+	leftOut := m.Chunks[len(m.Chunks)/2].Hash
+
+	tests := []struct {
+		name           string
+		batchSize      int
+		batchSupported bool
+		wantBatches    bool
+	}{
+		{name: "batches", batchSize: 4, batchSupported: true, wantBatches: true},
+		{name: "hub without batches", batchSize: 4, batchSupported: false},
+		{name: "batches disabled", batchSize: 1, batchSupported: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches atomic.Int32
+			var mu sync.Mutex
+			var gets []string
+			hub := newHubHandler(hubDir, hubOptions{verifyChunks: true, algorithm: HashSHA256})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/chunks-batch":
+					if !tt.batchSupported {
+						http.NotFound(w, r)
+						return
+					}
+					batches.Add(1)
+					var hashes []string
+					if err := json.NewDecoder(r.Body).Decode(&hashes); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					var kept []string
+					for _, h := range hashes {
+						if h != leftOut {
+							kept = append(kept, h)
+						}
+					}
+					body, _ := json.Marshal(kept)
+					r.Body = io.NopCloser(bytes.NewReader(body))
+				case strings.HasPrefix(r.URL.Path, "/chunks/"):
+					mu.Lock()
+					gets = append(gets, strings.TrimPrefix(r.URL.Path, "/chunks/"))
+					mu.Unlock()
+				}
+				hub.ServeHTTP(w, r)
+			}))
+			defer ts.Close()
+
+			peerDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+				t.Fatalf("Failed to create peer chunks dir: %v", err)
+			}
+			if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{batchSize: tt.batchSize}); err != nil {
+				t.Fatalf("runPeer failed: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(peerDir, "data.bin"))
+			if err != nil {
+				t.Fatalf("Failed to read synced file: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("Synced content mismatch")
+			}
+
+			if tt.wantBatches {
+				if batches.Load() == 0 {
+					t.Error("Expected the chunks to be downloaded in batches")
+				}
+				// only the chunk left out of the batches is requested alone, and
+				// the last batch if it has a single chunk
+				if len(gets) > 2 || !slices.Contains(gets, leftOut) {
+					t.Errorf("Expected only chunk %s downloaded alone, got %v", leftOut, gets)
+				}
+				return
+			}
+			if batches.Load() != 0 {
+				t.Errorf("Expected no batches, got %d", batches.Load())
+			}
+			if n := len(gets); n < len(m.Chunks)/2 {
+				t.Errorf("Expected the chunks to be downloaded one by one, got %d requests for %d chunks", n, len(m.Chunks))
+			}
+		})
+	}
+}
+
+func TestHubManifestGzip(t *testing.T) {
+	hubDir := t.TempDir()
+	var m Manifest
+	for i := 0; i < 1000; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		m.Chunks = append(m.Chunks, ChunkInfo{Hash: hex.EncodeToString(sum[:]), Size: uint(i)})
+	}
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(hubDir, ManifestFile), manifestBytes, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
+	defer ts.Close()
+
+	// the transport does not decompress the responses when the header is set explicitly
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "gzip", acceptEncoding: "gzip", wantGzip: true},
+		{name: "gzip among other encodings", acceptEncoding: "br, gzip;q=0.8", wantGzip: true},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0"},
+		{name: "identity", acceptEncoding: "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/manifest", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			// request twice to exercise the cache of the encoded manifest
+			for i := 0; i < 2; i++ {
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Failed to get manifest: %v", err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Fatalf("Failed to read manifest: %v", err)
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("Got status %d, want %d", resp.StatusCode, http.StatusOK)
+				}
+
+				gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+				if gzipped != tt.wantGzip {
+					t.Fatalf("Got gzip encoding %v, want %v", gzipped, tt.wantGzip)
+				}
+				if gzipped {
+					if len(body) >= len(manifestBytes) {
+						t.Errorf("Expected the gzipped manifest to be smaller than %d bytes, got %d", len(manifestBytes), len(body))
+					}
+					zr, err := gzip.NewReader(bytes.NewReader(body))
+					if err != nil {
+						t.Fatalf("Failed to decompress manifest: %v", err)
+					}
+					if body, err = io.ReadAll(zr); err != nil {
+						t.Fatalf("Failed to decompress manifest: %v", err)
+					}
+				}
+				if !bytes.Equal(body, manifestBytes) {
+					t.Errorf("Manifest content mismatch")
+				}
+			}
+		})
+	}
+
+	// the peer decompresses the manifest transparently
+	got, err := fetchManifest(context.Background(), newPeerClient(), ts.URL)
+	if err != nil {
+		t.Fatalf("fetchManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Fetched manifest mismatch")
+	}
+
+	// a changed manifest is encoded again
+	m.Chunks = m.Chunks[:10]
+	if manifestBytes, err = json.Marshal(m); err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(hubDir, ManifestFile), manifestBytes, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if got, err = fetchManifest(context.Background(), newPeerClient(), ts.URL); err != nil {
+		t.Fatalf("fetchManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Fetched manifest mismatch after the update")
+	}
+}
+
+func TestMirrorExclude(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "keep.txt"), []byte("keep me"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	dstDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dstDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	strays := map[string]bool{
+		"cache/data.bin":     true,  // excluded directory
+		"stray/file.txt":     false, // not excluded directory
+		"logs/app.sock":      true,  // excluded file in a directory
+		"logs/old.log":       false, // not excluded file next to it
+		"extra.txt":          false,
+		"nested/cache/a.txt": false, // the directory pattern is anchored to the root
+	}
+	for name := range strays {
+		path := filepath.Join(dstDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("stray"), 0644); err != nil {
+			t.Fatalf("Failed to write stray file: %v", err)
+		}
+	}
+
+	var exclude patterns
+	for _, expr := range []string{`^cache$`, `\.sock$`} {
+		if err := exclude.Set(expr); err != nil {
+			t.Fatalf("Invalid pattern %q: %v", expr, err)
+		}
+	}
+	opts := syncOptions{mirror: true, mirrorExclude: exclude}
+	if err := runIngest(ingestTar(t, localChunksDir, m), dstDir, filepath.Join(dstDir, ChunksDir), HashSHA256, opts); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dstDir, "keep.txt")); err != nil {
+		t.Errorf("Synced file missing: %v", err)
+	}
+	for name, survives := range strays {
+		_, err := os.Stat(filepath.Join(dstDir, name))
+		if survives && err != nil {
+			t.Errorf("Excluded path %s was deleted: %v", name, err)
+		}
+		if !survives && !os.IsNotExist(err) {
+			t.Errorf("Extraneous path %s was not deleted", name)
+		}
+	}
+	for _, dir := range []string{"stray", "nested"} {
+		if _, err := os.Stat(filepath.Join(dstDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("Extraneous directory %s was not deleted", dir)
+		}
+	}
+}
+
+func TestRunPeerServe(t *testing.T) {
+	srcDir := t.TempDir()
+	srcFiles := map[string][]byte{"a.txt": []byte("first file"), "dir/b.txt": []byte("second file")}
+	for name, content := range srcFiles {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	leader := httptest.NewServer(newHubHandler(leaderDir, hubOptions{verifyChunks: true, algorithm: HashSHA256}))
+	defer leader.Close()
+
+	// the serving peer keeps the chunks and the manifest even with cleanup
+	servingDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(servingDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	if err := runPeer(context.Background(), servingDir, []string{leader.URL}, syncOptions{serve: true, cleanup: true, mirror: true}); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	for _, path := range []string{ManifestFile, ChunksDir} {
+		if _, err := os.Stat(filepath.Join(servingDir, path)); err != nil {
+			t.Fatalf("Expected the serving peer to keep %s: %v", path, err)
+		}
+	}
+	leader.Close()
+
+	// the next peer downloads from the serving peer only
+	hub := httptest.NewServer(newHubHandler(servingDir, hubOptions{verifyChunks: true, algorithm: HashSHA256}))
+	defer hub.Close()
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	if err := runPeer(context.Background(), peerDir, []string{hub.URL}, syncOptions{cleanup: true, mirror: true}); err != nil {
+		t.Fatalf("runPeer from the serving peer failed: %v", err)
+	}
+	for _, dir := range []string{servingDir, peerDir} {
+		for name, want := range srcFiles {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("Failed to read synced file: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Synced content mismatch for %s in %s", name, dir)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(peerDir, ManifestFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the peer to cleanup the manifest, got %v", err)
+	}
+}
+
+func TestHubMaxConnections(t *testing.T) {
+	const limit = 2
+	var inFlight, maxInFlight, served atomic.Int32
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		served.Add(1)
+	})
+	sem := make(chan struct{}, limit)
+	ts := httptest.NewServer(limitConcurrency(sem, slow))
+	defer ts.Close()
+
+	const requests = 10
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			closeBody(resp)
+		}()
+	}
+	// the requests beyond the limit wait for a slot
+	deadline := time.Now().Add(5 * time.Second)
+	for inFlight.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := inFlight.Load(); n != limit {
+		t.Errorf("Expected %d requests in flight, got %d", limit, n)
+	}
+	close(release)
+	wg.Wait()
+	if n := maxInFlight.Load(); n > limit {
+		t.Errorf("Expected at most %d requests at once, got %d", limit, n)
+	}
+	if n := served.Load(); n != requests {
+		t.Errorf("Expected %d requests served, got %d", requests, n)
+	}
+
+	// a queued request is dropped once the client goes away
+	sem <- struct{}{}
+	sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		closeBody(resp)
+		t.Errorf("Expected the queued request to time out")
+	}
+	if n := served.Load(); n != requests {
+		t.Errorf("Expected the queued request not to be served, got %d served", n)
+	}
+}
+
+func TestHubMaxConnectionsChunks(t *testing.T) {
+	hubDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(hubDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	data := []byte("chunk content")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(hubDir, ChunksDir, hash), data, 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{maxConnections: 1}))
+	defer ts.Close()
+
+	// the chunks are served one at a time, sequential requests never wait
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(ts.URL + "/chunks/" + hash)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		closeBody(resp)
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+			t.Fatalf("Expected the chunk served, got status %d: %v", resp.StatusCode, err)
+		}
+	}
+}
+
+func TestHubHealthz(t *testing.T) {
+	hubDir := t.TempDir()
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{}))
+	defer ts.Close()
+
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/healthz")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		closeBody(resp)
+		return resp.StatusCode
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without manifest, got %d", got)
+	}
+	manifestPath := filepath.Join(hubDir, ManifestFile)
+	if err := os.WriteFile(manifestPath, []byte(`{"chunks": [`), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with a partial manifest, got %d", got)
+	}
+	data, err := json.Marshal(Manifest{Algorithm: HashSHA256})
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if got := status(); got != http.StatusOK {
+		t.Errorf("Expected 200 with the manifest, got %d", got)
+	}
+	if err := os.Remove(manifestPath); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the manifest is removed, got %d", got)
+	}
+}
+
+func TestCheckReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "ready", status: http.StatusOK},
+		{name: "not ready", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "hub without healthz", status: http.StatusNotFound},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+			err := checkReady(context.Background(), http.DefaultClient, ts.URL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkReady() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(paths) != 1 || paths[0] != "/healthz" {
+				t.Errorf("Expected a request to /healthz, got %v", paths)
+			}
+		})
+	}
+}
+
+// TestRunPeerWaitsHubReady starts the peer before the hub has the manifest,
+// the peer does not request it until /healthz reports the hub is ready.
+func TestRunPeerWaitsHubReady(t *testing.T) {
+	srcDir := t.TempDir()
+	fileContent := []byte("ready")
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), fileContent, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	hubDir := t.TempDir()
+	var manifestRequests atomic.Int32
+	hub := newHubHandler(hubDir, hubOptions{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest" {
+			manifestRequests.Add(1)
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	peerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(peerDir, ChunksDir), 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		opts := syncOptions{pollInterval: 10 * time.Millisecond, waitTimeout: 10 * time.Second}
+		errCh <- runPeer(context.Background(), peerDir, []string{ts.URL}, opts)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := manifestRequests.Load(); n > 0 {
+		t.Errorf("Expected no manifest request before the hub is ready, got %d", n)
+	}
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), hubDir, hubChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(peerDir, "data.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read synced file: %v", err)
+	}
+	if !bytes.Equal(content, fileContent) {
+		t.Errorf("Synced content mismatch")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// hubMetrics counts the requests served by the Hub.
+// It uses its own registry so every handler exposes only its own counters.
+type hubMetrics struct {
+	registry         *prometheus.Registry
+	chunksServed     prometheus.Counter
+	bytesServed      prometheus.Counter
+	manifestRequests prometheus.Counter
+	chunksNotFound   prometheus.Counter
+}
+
+func newHubMetrics() *hubMetrics {
+	m := &hubMetrics{
+		registry: prometheus.NewRegistry(),
+		chunksServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "krun_hub_chunks_served_total",
+			Help: "Number of chunks served to peers.",
+		}),
+		bytesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "krun_hub_chunk_bytes_served_total",
+			Help: "Number of chunk bytes served to peers.",
+		}),
+		manifestRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "krun_hub_manifest_requests_total",
+			Help: "Number of manifest requests.",
+		}),
+		chunksNotFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "krun_hub_chunks_not_found_total",
+			Help: "Number of chunk requests answered with 404.",
+		}),
+	}
+	m.registry.MustRegister(m.chunksServed, m.bytesServed, m.manifestRequests, m.chunksNotFound)
+	return m
+}
+
+// handler exposes the metrics in the Prometheus text format
+func (m *hubMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrumentManifest counts the requests to the manifest handler
+func (m *hubMetrics) instrumentManifest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.manifestRequests.Inc()
+		next(w, r)
+	}
+}
+
+// instrumentChunks counts the chunks and bytes served and the missing chunks
+func (m *hubMetrics) instrumentChunks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		switch rec.status {
+		case http.StatusOK:
+			m.chunksServed.Inc()
+			m.bytesServed.Add(float64(rec.bytes))
+		case http.StatusNotFound:
+			m.chunksNotFound.Inc()
+		}
+	})
+}
+
+// chunkServed counts a chunk served in a batch, the metrics may be disabled
+func (m *hubMetrics) chunkServed(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.chunksServed.Inc()
+	m.bytesServed.Add(float64(bytes))
+}
+
+// chunkNotFound counts a chunk missing in a batch, the metrics may be disabled
+func (m *hubMetrics) chunkNotFound() {
+	if m == nil {
+		return
+	}
+	m.chunksNotFound.Inc()
+}
+
+// responseRecorder records the status code and the bytes written in the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
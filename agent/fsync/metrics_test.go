@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHubMetrics(t *testing.T) {
+	hubDir := t.TempDir()
+	hubChunksDir := filepath.Join(hubDir, ChunksDir)
+	if err := os.MkdirAll(hubChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create hub chunks dir: %v", err)
+	}
+
+	hash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	if err := os.WriteFile(filepath.Join(hubChunksDir, hash), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(hubDir, ManifestFile), []byte(`{"chunks":[]}`), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	ts := httptest.NewServer(newHubHandler(hubDir, hubOptions{verifyChunks: true, metrics: true}))
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get("/chunks/" + hash); status != http.StatusOK {
+		t.Fatalf("Expected chunk to be served, got %d", status)
+	}
+	if status, _ := get("/chunks/" + hash); status != http.StatusOK {
+		t.Fatalf("Expected chunk to be served, got %d", status)
+	}
+	if status, _ := get("/chunks/missing"); status != http.StatusNotFound {
+		t.Fatalf("Expected missing chunk to return 404, got %d", status)
+	}
+	if status, _ := get("/manifest"); status != http.StatusOK {
+		t.Fatalf("Expected manifest to be served, got %d", status)
+	}
+
+	status, metrics := get("/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("Expected metrics to be served, got %d", status)
+	}
+	for _, want := range []string{
+		"krun_hub_chunks_served_total 2",
+		"krun_hub_chunk_bytes_served_total 10",
+		"krun_hub_chunks_not_found_total 1",
+		"krun_hub_manifest_requests_total 1",
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestHubMetricsDisabled(t *testing.T) {
+	ts := httptest.NewServer(newHubHandler(t.TempDir(), hubOptions{}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected /metrics to be disabled by default, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// peerStats summarizes the transfer of a peer sync, the chunks already on disk
+// are not downloaded again.
+type peerStats struct {
+	// Downloaded is the number of chunks downloaded from the trackers
+	Downloaded int `json:"downloaded"`
+	// Skipped is the number of chunks of the manifest already on disk
+	Skipped int `json:"skipped"`
+	// Bytes received from the trackers for the chunks, compressed or as deltas
+	Bytes int64 `json:"bytes"`
+	// ElapsedSeconds since the manifest was received
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+}
+
+func (s peerStats) String() string {
+	return fmt.Sprintf("%d chunks downloaded, %d already present, %d bytes transferred in %v",
+		s.Downloaded, s.Skipped, s.Bytes, time.Duration(s.ElapsedSeconds*float64(time.Second)).Round(time.Millisecond))
+}
+
+// writeStats writes the stats as a JSON line
+func writeStats(w io.Writer, s peerStats) error {
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("failed to write transfer statistics: %v", err)
+	}
+	return nil
+}
+
+// countingTransport counts the bytes of the chunk responses read by the client
+type countingTransport struct {
+	next  http.RoundTripper
+	bytes atomic.Int64
+}
+
+// withTransferCounter returns a copy of the client counting the chunk bytes received
+func withTransferCounter(client *http.Client) (*http.Client, *countingTransport) {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	counter := &countingTransport{next: next}
+	c := *client
+	c.Transport = counter
+	return &c, counter
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !strings.HasPrefix(req.URL.Path, "/chunks") {
+		return resp, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, n: &t.bytes}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (t *countingTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
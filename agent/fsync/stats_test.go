@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aojea/krun/pkg/cdc"
+)
+
+func TestRunPeerStats(t *testing.T) {
+	srcDir := t.TempDir()
+	content := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "data.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	localChunksDir := t.TempDir()
+	m, err := cdc.GenerateManifest(srcDir, localChunksDir, cdc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if len(m.Chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(m.Chunks))
+	}
+
+	leaderDir := t.TempDir()
+	leaderChunksDir := filepath.Join(leaderDir, ChunksDir)
+	if err := os.MkdirAll(leaderChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create leader chunks dir: %v", err)
+	}
+	if err := runIngest(ingestTar(t, localChunksDir, m), leaderDir, leaderChunksDir, HashSHA256, syncOptions{}); err != nil {
+		t.Fatalf("runIngest failed: %v", err)
+	}
+	ts := httptest.NewServer(newHubHandler(leaderDir, hubOptions{}))
+	defer ts.Close()
+
+	// the peer has the first half of the chunks from a previous sync
+	peerDir := t.TempDir()
+	peerChunksDir := filepath.Join(peerDir, ChunksDir)
+	if err := os.MkdirAll(peerChunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create peer chunks dir: %v", err)
+	}
+	cached := len(m.Chunks) / 2
+	var missingBytes int64
+	for i, c := range m.Chunks {
+		data, err := os.ReadFile(filepath.Join(localChunksDir, c.Hash))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		if i >= cached {
+			missingBytes += int64(len(data))
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(peerChunksDir, c.Hash), data, 0644); err != nil {
+			t.Fatalf("Failed to write chunk: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := runPeer(context.Background(), peerDir, []string{ts.URL}, syncOptions{statsOutput: &out}); err != nil {
+		t.Fatalf("runPeer failed: %v", err)
+	}
+	var stats peerStats
+	if err := json.Unmarshal(out.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats %q: %v", out.String(), err)
+	}
+	if stats.Downloaded != len(m.Chunks)-cached {
+		t.Errorf("Expected %d chunks downloaded, got %d", len(m.Chunks)-cached, stats.Downloaded)
+	}
+	if stats.Skipped != cached {
+		t.Errorf("Expected %d chunks skipped, got %d", cached, stats.Skipped)
+	}
+	if stats.Bytes != missingBytes {
+		t.Errorf("Expected %d bytes transferred, got %d", missingBytes, stats.Bytes)
+	}
+	if stats.ElapsedSeconds <= 0 {
+		t.Errorf("Expected the elapsed time, got %v", stats.ElapsedSeconds)
+	}
+
+	got, err := os.ReadFile(filepath.Join(peerDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read synced file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Synced content mismatch")
+	}
+}
@@ -1,7 +1,10 @@
 package jobset
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -12,8 +15,13 @@ type AcceleratorType string
 const (
 	AcceleratorTypeTPU AcceleratorType = "TPU"
 	AcceleratorTypeGPU AcceleratorType = "GPU"
+	// AcceleratorTypeCPU runs on nodes without accelerators
+	AcceleratorTypeCPU AcceleratorType = "CPU"
 )
 
+// cpuDeviceTypePrefix selects a CPU-only machine type, e.g. cpu-n2-standard-8
+const cpuDeviceTypePrefix = "cpu-"
+
 // AcceleratorCharacteristics holds resource and label information for an accelerator type.
 type AcceleratorCharacteristics struct {
 	ResourceType     string
@@ -32,19 +40,22 @@ var acceleratorTypeToCharacteristics = map[AcceleratorType]AcceleratorCharacteri
 		AcceleratorLabel: "cloud.google.com/gke-accelerator",
 		MachineLabel:     "cloud.google.com/gce-machine-type",
 	},
+	AcceleratorTypeCPU: {
+		MachineLabel: "cloud.google.com/gce-machine-type",
+	},
 }
 
 // SystemCharacteristics contains the defining characteristics of a specific accelerator system.
 type SystemCharacteristics struct {
-	Topology               string
-	VMsPerSlice            int
-	GKEAccelerator         string
-	GCEMachineType         string
-	ChipsPerVM             int
-	AcceleratorType        AcceleratorType
-	DeviceType             string
-	SupportsSubSlicing     bool
-	RequiresWorkloadPolicy bool
+	Topology               string          `json:"topology"`
+	VMsPerSlice            int             `json:"vmsPerSlice"`
+	GKEAccelerator         string          `json:"gkeAccelerator,omitempty"`
+	GCEMachineType         string          `json:"gceMachineType"`
+	ChipsPerVM             int             `json:"chipsPerVM"`
+	AcceleratorType        AcceleratorType `json:"acceleratorType"`
+	DeviceType             string          `json:"deviceType"`
+	SupportsSubSlicing     bool            `json:"supportsSubSlicing"`
+	RequiresWorkloadPolicy bool            `json:"requiresWorkloadPolicy"`
 }
 
 // userFacingNameToSystemCharacteristics maps user-facing names to their system characteristics.
@@ -368,9 +379,171 @@ func getTopologyProduct(topology string) int {
 }
 
 // GetSystemCharacteristics returns the system characteristics for a given device type.
+// The cpu-<machineType> device types are CPU-only machines of the given type.
 func GetSystemCharacteristics(deviceType string) (*SystemCharacteristics, error) {
 	if val, ok := userFacingNameToSystemCharacteristics[deviceType]; ok {
 		return &val, nil
 	}
+	if machineType, ok := strings.CutPrefix(deviceType, cpuDeviceTypePrefix); ok {
+		if machineType == "" {
+			return nil, fmt.Errorf("missing machine type in device type %s, e.g. cpu-n2-standard-8", deviceType)
+		}
+		return &SystemCharacteristics{
+			Topology:        "N/A",
+			VMsPerSlice:     1,
+			GCEMachineType:  machineType,
+			AcceleratorType: AcceleratorTypeCPU,
+			DeviceType:      deviceType,
+		}, nil
+	}
 	return nil, fmt.Errorf("unknown device type: %s", deviceType)
 }
+
+// GetSubSliceCharacteristics returns the system characteristics of a sub-slice
+// with the given topology inside a slice of the system.
+func GetSubSliceCharacteristics(system *SystemCharacteristics, topology string) (*SystemCharacteristics, error) {
+	if !system.SupportsSubSlicing {
+		return nil, fmt.Errorf("device type %s does not support sub-slicing", system.DeviceType)
+	}
+	prefix := system.DeviceType[:strings.LastIndex(system.DeviceType, "-")]
+	sub, err := GetSystemCharacteristics(prefix + "-" + topology)
+	if err != nil || !sub.SupportsSubSlicing {
+		return nil, fmt.Errorf("unsupported sub-slice topology %s for device type %s", topology, system.DeviceType)
+	}
+	dims := strings.Split(system.Topology, "x")
+	subDims := strings.Split(sub.Topology, "x")
+	if len(dims) != len(subDims) || getTopologyProduct(sub.Topology) >= getTopologyProduct(system.Topology) {
+		return nil, fmt.Errorf("sub-slice topology %s must be smaller than the topology %s of device type %s", topology, system.Topology, system.DeviceType)
+	}
+	for i := range dims {
+		size, _ := strconv.Atoi(dims[i])
+		subSize, _ := strconv.Atoi(subDims[i])
+		if subSize > size || size%subSize != 0 {
+			return nil, fmt.Errorf("sub-slice topology %s does not fit in the topology %s of device type %s", topology, system.Topology, system.DeviceType)
+		}
+	}
+	return sub, nil
+}
+
+// ValidateTopology checks that the topology is supported by the TPU family
+// (e.g. tpu-v5p), the error suggests the nearest valid topology.
+func ValidateTopology(family, topology string) error {
+	var valid []string
+	for key, system := range userFacingNameToSystemCharacteristics {
+		if system.AcceleratorType == AcceleratorTypeTPU && key == family+"-"+system.Topology {
+			valid = append(valid, system.Topology)
+		}
+	}
+	if len(valid) == 0 {
+		return fmt.Errorf("unknown device family: %s", family)
+	}
+	if slices.Contains(valid, topology) {
+		return nil
+	}
+
+	dims, err := parseTopology(topology)
+	if err != nil {
+		return fmt.Errorf("invalid topology %s for %s: %w", topology, family, err)
+	}
+	numDims := len(strings.Split(valid[0], "x"))
+	if len(dims) != numDims {
+		return fmt.Errorf("invalid topology %s for %s: %s topologies have %d dimensions, e.g. %s", topology, family, family, numDims, nearestTopology(valid, nil))
+	}
+	nearest := nearestTopology(valid, dims)
+	if numDims == 3 {
+		for _, d := range dims {
+			if d > 4 && d%4 != 0 {
+				return fmt.Errorf("invalid topology %s for %s: the dimensions larger than 4 must be multiples of 4, the nearest valid topology is %s", topology, family, nearest)
+			}
+		}
+	}
+	return fmt.Errorf("unsupported topology %s for %s, the nearest valid topology is %s", topology, family, nearest)
+}
+
+// parseTopology returns the dimensions of a topology like 4x4x8
+func parseTopology(topology string) ([]int, error) {
+	var dims []int
+	for _, part := range strings.Split(topology, "x") {
+		d, err := strconv.Atoi(part)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("the dimensions must be positive integers separated by x, e.g. 2x2x1")
+		}
+		dims = append(dims, d)
+	}
+	return dims, nil
+}
+
+// nearestTopology returns the valid topology with the smallest distance to the
+// dimensions, preferring the smaller one on ties. The smallest topology is
+// returned if there are no dimensions.
+func nearestTopology(valid []string, dims []int) string {
+	best, bestDistance, bestProduct := "", -1, 0
+	for _, topology := range valid {
+		candidate, err := parseTopology(topology)
+		if err != nil {
+			continue
+		}
+		distance := 0
+		if len(candidate) == len(dims) {
+			for i := range dims {
+				distance += max(dims[i]-candidate[i], candidate[i]-dims[i])
+			}
+		}
+		product := getTopologyProduct(topology)
+		if bestDistance < 0 || distance < bestDistance ||
+			(distance == bestDistance && (product < bestProduct || (product == bestProduct && topology < best))) {
+			best, bestDistance, bestProduct = topology, distance, product
+		}
+	}
+	return best
+}
+
+// TotalChips returns the number of accelerator chips used by numSlices slices
+// of the device type, 0 for CPU-only device types.
+func TotalChips(deviceType string, numSlices int) (int, error) {
+	system, err := GetSystemCharacteristics(deviceType)
+	if err != nil {
+		return 0, err
+	}
+	if numSlices < 1 {
+		return 0, fmt.Errorf("the number of slices must be at least 1")
+	}
+	switch system.AcceleratorType {
+	case AcceleratorTypeTPU:
+		return getTopologyProduct(system.Topology) * numSlices, nil
+	case AcceleratorTypeGPU:
+		return system.ChipsPerVM * system.VMsPerSlice * numSlices, nil
+	default:
+		return 0, nil
+	}
+}
+
+// NodeCount returns the number of nodes used by numSlices slices of the device type.
+func NodeCount(deviceType string, numSlices int) (int, error) {
+	system, err := GetSystemCharacteristics(deviceType)
+	if err != nil {
+		return 0, err
+	}
+	if numSlices < 1 {
+		return 0, fmt.Errorf("the number of slices must be at least 1")
+	}
+	return system.VMsPerSlice * numSlices, nil
+}
+
+// DeviceTypesForMachineType returns the sorted device types that run on the GCE machine type.
+func DeviceTypesForMachineType(machineType string) []string {
+	var deviceTypes []string
+	for name, system := range userFacingNameToSystemCharacteristics {
+		if system.GCEMachineType == machineType {
+			deviceTypes = append(deviceTypes, name)
+		}
+	}
+	sort.Strings(deviceTypes)
+	return deviceTypes
+}
+
+// MarshalCharacteristics returns the characteristics of all the supported
+// device types as a JSON object indexed by device type.
+func MarshalCharacteristics() ([]byte, error) {
+	return json.MarshalIndent(userFacingNameToSystemCharacteristics, "", "  ")
+}
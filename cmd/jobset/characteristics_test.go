@@ -1,6 +1,9 @@
 package jobset
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -100,3 +103,118 @@ func TestComputeChipsPerVM(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateTopology(t *testing.T) {
+	tests := []struct {
+		family   string
+		topology string
+		wantErr  string
+	}{
+		{family: "tpu-v5p", topology: "8x8x24"},
+		{family: "tpu-v5p", topology: "2x2x1"},
+		{family: "tpu-v6e", topology: "4x8"},
+		{family: "tpu-v5p", topology: "8x8x10", wantErr: "invalid topology 8x8x10 for tpu-v5p: the dimensions larger than 4 must be multiples of 4, the nearest valid topology is 8x8x8"},
+		{family: "tpu-v5p", topology: "4x4", wantErr: "invalid topology 4x4 for tpu-v5p: tpu-v5p topologies have 3 dimensions, e.g. 2x2x1"},
+		{family: "tpu-v6e", topology: "4x4x4", wantErr: "invalid topology 4x4x4 for tpu-v6e: tpu-v6e topologies have 2 dimensions, e.g. 1x1"},
+		{family: "tpu-v5p", topology: "8x4x8", wantErr: "unsupported topology 8x4x8 for tpu-v5p, the nearest valid topology is 4x4x8"},
+		{family: "tpu-v6e", topology: "32x32", wantErr: "unsupported topology 32x32 for tpu-v6e, the nearest valid topology is 16x16"},
+		{family: "tpu-v5p", topology: "4xax4", wantErr: "invalid topology 4xax4 for tpu-v5p: the dimensions must be positive integers separated by x, e.g. 2x2x1"},
+		{family: "tpu-v9", topology: "2x2x1", wantErr: "unknown device family: tpu-v9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.family+"-"+tt.topology, func(t *testing.T) {
+			err := ValidateTopology(tt.family, tt.topology)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateTopology() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ValidateTopology() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTotalChipsAndNodeCount(t *testing.T) {
+	tests := []struct {
+		deviceType string
+		numSlices  int
+		wantChips  int
+		wantNodes  int
+		wantErr    bool
+	}{
+		{deviceType: "tpu-v5p-8", numSlices: 1, wantChips: 4, wantNodes: 1},
+		{deviceType: "tpu-v5p-4x4x4", numSlices: 2, wantChips: 128, wantNodes: 32},
+		{deviceType: "tpu-v6e-1x1", numSlices: 3, wantChips: 3, wantNodes: 3},
+		{deviceType: "tpu-v6e-16x16", numSlices: 1, wantChips: 256, wantNodes: 64},
+		{deviceType: "gpu-l4-4", numSlices: 2, wantChips: 8, wantNodes: 2},
+		{deviceType: "gpu-h100-80gb-8", numSlices: 4, wantChips: 32, wantNodes: 4},
+		{deviceType: "cpu-n2-standard-8", numSlices: 2, wantChips: 0, wantNodes: 2},
+		{deviceType: "tpu-v5p-8", numSlices: 0, wantErr: true},
+		{deviceType: "unknown-device", numSlices: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.deviceType, func(t *testing.T) {
+			chips, err := TotalChips(tt.deviceType, tt.numSlices)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TotalChips() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			nodes, err := NodeCount(tt.deviceType, tt.numSlices)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NodeCount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if chips != tt.wantChips || nodes != tt.wantNodes {
+				t.Errorf("got %d chips on %d nodes, want %d chips on %d nodes", chips, nodes, tt.wantChips, tt.wantNodes)
+			}
+		})
+	}
+}
+
+func TestDeviceTypesForMachineType(t *testing.T) {
+	tests := []struct {
+		machineType string
+		want        []string
+	}{
+		{machineType: "a3-highgpu-8g", want: []string{"gpu-h100-80gb-8"}},
+		{machineType: "g2-standard-48", want: []string{"gpu-l4-4"}},
+		{machineType: "ct6e-standard-1t", want: []string{"tpu-v6e-1", "tpu-v6e-1x1"}},
+		{machineType: "n2-standard-8", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.machineType, func(t *testing.T) {
+			if got := DeviceTypesForMachineType(tt.machineType); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DeviceTypesForMachineType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalCharacteristics(t *testing.T) {
+	data, err := MarshalCharacteristics()
+	if err != nil {
+		t.Fatalf("MarshalCharacteristics failed: %v", err)
+	}
+	for _, s := range []string{`"acceleratorType": "TPU"`, `"gceMachineType": "a3-highgpu-8g"`, `"vmsPerSlice": 64`} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("Expected %s in the JSON output", s)
+		}
+	}
+
+	var got map[string]SystemCharacteristics
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+	if len(got) != len(userFacingNameToSystemCharacteristics) {
+		t.Errorf("Expected %d device types, got %d", len(userFacingNameToSystemCharacteristics), len(got))
+	}
+	for _, deviceType := range []string{"gpu-h100-80gb-8", "tpu-v6e-256", "tpu-v5p-2x2x1"} {
+		if got[deviceType] != userFacingNameToSystemCharacteristics[deviceType] {
+			t.Errorf("Device type %s = %+v, want %+v", deviceType, got[deviceType], userFacingNameToSystemCharacteristics[deviceType])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package jobset
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+	jobsetclient "sigs.k8s.io/jobset/client-go/clientset/versioned"
+)
+
+// deletePollInterval is the period to check if the JobSet is gone with --wait
+const deletePollInterval = 2 * time.Second
+
+var (
+	waitDeleted    bool
+	ignoreNotFound bool
+)
+
+var DeleteSubcmd = &cobra.Command{
+	Use:   "delete [flags]",
+	Short: "Delete a jobset",
+	Example: `  # Delete a JobSet
+  krun jobset delete --name=stoelinga
+
+  # Delete a JobSet and wait for its jobs and pods to be gone
+  krun jobset delete --name=stoelinga --wait`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if name == "" {
+			return fmt.Errorf("you must provide a --name to select the JobSet")
+		}
+		client, jsClient, err := newClients(kubeconfig, kubeContext)
+		if err != nil {
+			return err
+		}
+		return deleteJobSet(cmd.Context(), client, jsClient, namespace, name, deleteOptions{
+			wait:           waitDeleted,
+			ignoreNotFound: ignoreNotFound,
+			pollInterval:   deletePollInterval,
+		})
+	},
+}
+
+type deleteOptions struct {
+	// wait until the JobSet, its jobs and pods are gone
+	wait bool
+	// ignoreNotFound does not fail if the JobSet does not exist
+	ignoreNotFound bool
+	pollInterval   time.Duration
+}
+
+// deleteJobSet deletes the JobSet and its children in the background
+func deleteJobSet(ctx context.Context, client kubernetes.Interface, jsClient jobsetclient.Interface, namespace, name string, opts deleteOptions) error {
+	klog.Infof("Deleting JobSet %q in namespace %q...", name, namespace)
+	propagation := metav1.DeletePropagationBackground
+	err := jsClient.JobsetV1alpha2().JobSets(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if apierrors.IsNotFound(err) {
+		if opts.ignoreNotFound {
+			klog.Infof("JobSet %q not found", name)
+			return nil
+		}
+		return fmt.Errorf("jobset %q not found in namespace %q", name, namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete jobset: %w", err)
+	}
+	if !opts.wait {
+		klog.Infof("JobSet %q deleted.", name)
+		return nil
+	}
+
+	selector := metav1.ListOptions{LabelSelector: jobsetapi.JobSetNameKey + "=" + name}
+	err = wait.PollUntilContextCancel(ctx, opts.pollInterval, true, func(ctx context.Context) (bool, error) {
+		_, err := jsClient.JobsetV1alpha2().JobSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			return false, nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+		jobs, err := client.BatchV1().Jobs(namespace).List(ctx, selector)
+		if err != nil {
+			return false, err
+		}
+		pods, err := client.CoreV1().Pods(namespace).List(ctx, selector)
+		if err != nil {
+			return false, err
+		}
+		klog.V(2).Infof("Waiting for %d jobs and %d pods of JobSet %q to be deleted", len(jobs.Items), len(pods.Items), name)
+		return len(jobs.Items) == 0 && len(pods.Items) == 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for jobset %q to be deleted: %w", name, err)
+	}
+	klog.Infof("JobSet %q deleted.", name)
+	return nil
+}
+
+func init() {
+	JobSetCmd.AddCommand(DeleteSubcmd)
+	DeleteSubcmd.Flags().BoolVar(&waitDeleted, "wait", false, "Wait for the jobs and pods of the JobSet to be gone")
+	DeleteSubcmd.Flags().BoolVar(&ignoreNotFound, "ignore-not-found", false, "Do not fail if the JobSet does not exist")
+}
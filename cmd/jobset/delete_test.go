@@ -0,0 +1,87 @@
+package jobset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	jobsetfake "sigs.k8s.io/jobset/client-go/clientset/versioned/fake"
+)
+
+func TestDeleteJobSet(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		opts    deleteOptions
+		wantErr bool
+	}{
+		{name: "existing", objects: []runtime.Object{js}},
+		{name: "existing and wait", objects: []runtime.Object{js}, opts: deleteOptions{wait: true}},
+		{name: "not found", wantErr: true},
+		{name: "not found ignored", opts: deleteOptions{ignoreNotFound: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			jsClient := jobsetfake.NewClientset(tt.objects...)
+			tt.opts.pollInterval = 10 * time.Millisecond
+
+			err := deleteJobSet(context.Background(), client, jsClient, "default", "stoelinga", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deleteJobSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var deleted bool
+			for _, action := range jsClient.Actions() {
+				if action.Matches("delete", "jobsets") {
+					deleted = action.(k8stesting.DeleteAction).GetName() == "stoelinga"
+				}
+			}
+			if !deleted {
+				t.Errorf("Expected a delete call for jobset stoelinga, got %v", jsClient.Actions())
+			}
+			if _, err := jsClient.JobsetV1alpha2().JobSets("default").Get(context.Background(), "stoelinga", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("Expected the jobset to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteJobSetWaitPods(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	client := fake.NewClientset(newPod("stoelinga-j-0-0", corev1.PodRunning, true))
+	jsClient := jobsetfake.NewClientset(js)
+
+	// the pod is deleted some time after the jobset
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = client.CoreV1().Pods("default").Delete(context.Background(), "stoelinga-j-0-0", metav1.DeleteOptions{})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := deleteJobSet(ctx, client, jsClient, "default", "stoelinga", deleteOptions{wait: true, pollInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("deleteJobSet failed: %v", err)
+	}
+	pods, err := client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list pods: %v", err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("Expected to wait for the pods to be deleted, got %d", len(pods.Items))
+	}
+}
@@ -0,0 +1,108 @@
+package jobset
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var devicesOutput string
+
+var DevicesSubcmd = &cobra.Command{
+	Use:   "devices [flags]",
+	Short: "List the supported device types",
+	Example: `  # List the device types supported by launch
+  krun jobset devices
+
+  # List the device types as JSON
+  krun jobset devices --output=json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch devicesOutput {
+		case "text":
+			return printDeviceTypes(os.Stdout)
+		case "json":
+			return printDeviceTypesJSON(os.Stdout)
+		default:
+			return fmt.Errorf("unsupported output format %q, must be text or json", devicesOutput)
+		}
+	},
+}
+
+// DeviceType is a supported device type and its characteristics
+type DeviceType struct {
+	Name            string          `json:"name"`
+	AcceleratorType AcceleratorType `json:"acceleratorType"`
+	Topology        string          `json:"topology"`
+	ChipsPerVM      int             `json:"chipsPerVM"`
+	VMsPerSlice     int             `json:"vmsPerSlice"`
+	MachineType     string          `json:"machineType"`
+}
+
+// ListDeviceTypes returns the supported device types grouped by accelerator
+// type, and sorted by family and number of chips.
+func ListDeviceTypes() []DeviceType {
+	devices := make([]DeviceType, 0, len(userFacingNameToSystemCharacteristics))
+	for name, sys := range userFacingNameToSystemCharacteristics {
+		devices = append(devices, DeviceType{
+			Name:            name,
+			AcceleratorType: sys.AcceleratorType,
+			Topology:        sys.Topology,
+			ChipsPerVM:      sys.ChipsPerVM,
+			VMsPerSlice:     sys.VMsPerSlice,
+			MachineType:     sys.GCEMachineType,
+		})
+	}
+	family := func(name string) string {
+		return name[:strings.LastIndex(name, "-")]
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if a.AcceleratorType != b.AcceleratorType {
+			return a.AcceleratorType < b.AcceleratorType
+		}
+		if family(a.Name) != family(b.Name) {
+			return family(a.Name) < family(b.Name)
+		}
+		if chipsA, chipsB := a.ChipsPerVM*a.VMsPerSlice, b.ChipsPerVM*b.VMsPerSlice; chipsA != chipsB {
+			return chipsA < chipsB
+		}
+		return a.Name < b.Name
+	})
+	return devices
+}
+
+// printDeviceTypes writes a table of the device types per accelerator type
+func printDeviceTypes(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var current AcceleratorType
+	for _, d := range ListDeviceTypes() {
+		if d.AcceleratorType != current {
+			if current != "" {
+				_, _ = fmt.Fprintln(tw)
+			}
+			current = d.AcceleratorType
+			_, _ = fmt.Fprintf(tw, "%s\n", current)
+			_, _ = fmt.Fprintln(tw, "DEVICE TYPE\tTOPOLOGY\tCHIPS/VM\tVMS\tMACHINE TYPE")
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", d.Name, d.Topology, d.ChipsPerVM, d.VMsPerSlice, d.MachineType)
+	}
+	return tw.Flush()
+}
+
+// printDeviceTypesJSON writes the device types as a JSON array
+func printDeviceTypesJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ListDeviceTypes())
+}
+
+func init() {
+	JobSetCmd.AddCommand(DevicesSubcmd)
+	DevicesSubcmd.Flags().StringVarP(&devicesOutput, "output", "o", "text", "Format of the output, text or json")
+}
@@ -0,0 +1,55 @@
+package jobset
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestListDeviceTypes(t *testing.T) {
+	devices := ListDeviceTypes()
+	if len(devices) != len(userFacingNameToSystemCharacteristics) {
+		t.Fatalf("Expected %d device types, got %d", len(userFacingNameToSystemCharacteristics), len(devices))
+	}
+	byName := map[string]DeviceType{}
+	for i, d := range devices {
+		byName[d.Name] = d
+		// the GPUs are listed before the TPUs
+		if i > 0 && devices[i-1].AcceleratorType > d.AcceleratorType {
+			t.Errorf("Device type %s is not grouped by accelerator type", d.Name)
+		}
+	}
+	want := map[string]DeviceType{
+		"gpu-l4-1":    {Name: "gpu-l4-1", AcceleratorType: AcceleratorTypeGPU, Topology: "N/A", ChipsPerVM: 1, VMsPerSlice: 1, MachineType: "g2-standard-12"},
+		"tpu-v6e-256": {Name: "tpu-v6e-256", AcceleratorType: AcceleratorTypeTPU, Topology: "16x16", ChipsPerVM: 4, VMsPerSlice: 64, MachineType: "ct6e-standard-4t"},
+	}
+	for name, w := range want {
+		if got, ok := byName[name]; !ok || got != w {
+			t.Errorf("Device type %s = %+v, want %+v", name, got, w)
+		}
+	}
+}
+
+func TestPrintDeviceTypes(t *testing.T) {
+	var text strings.Builder
+	if err := printDeviceTypes(&text); err != nil {
+		t.Fatalf("printDeviceTypes failed: %v", err)
+	}
+	for _, s := range []string{"GPU\n", "TPU\n", "gpu-l4-1 ", "tpu-v6e-256 ", "ct6e-standard-4t"} {
+		if !strings.Contains(text.String(), s) {
+			t.Errorf("Expected %q in the device types:\n%s", s, text.String())
+		}
+	}
+
+	var data strings.Builder
+	if err := printDeviceTypesJSON(&data); err != nil {
+		t.Fatalf("printDeviceTypesJSON failed: %v", err)
+	}
+	var devices []DeviceType
+	if err := json.Unmarshal([]byte(data.String()), &devices); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+	if len(devices) != len(userFacingNameToSystemCharacteristics) {
+		t.Errorf("Expected %d device types in the JSON output, got %d", len(userFacingNameToSystemCharacteristics), len(devices))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/aojea/krun/cmd/run"
+	"github.com/aojea/krun/pkg/cdc"
 	"github.com/aojea/krun/pkg/clientset"
 	"github.com/aojea/krun/pkg/exec"
 	"github.com/spf13/cobra"
@@ -14,6 +15,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog/v2"
 
 	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
@@ -23,25 +25,87 @@ import (
 
 const (
 	DefaultExclude = `(^|/)\.`
+
+	// subSliceTopologyAnnotation requests the workers of a slice to be placed on a
+	// sub-slice of a larger TPU node pool
+	subSliceTopologyAnnotation = "kueue.x-k8s.io/podset-required-topology"
+	// nodePoolTopologyKey places each slice exclusively on a node pool
+	nodePoolTopologyKey = "cloud.google.com/gke-nodepool"
+	// spotNodeKey labels and taints the GKE spot nodes
+	spotNodeKey = "cloud.google.com/gke-spot"
+	// workloadContainer is the container of the workers with the accelerators
+	workloadContainer = "workload"
+	// defaultContainerAnnotation selects the container of kubectl and krun run
+	defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
 )
 
+// DefaultCommand keeps the workers running to execute commands on them
+var DefaultCommand = []string{"sleep", "infinity"}
+
 // Global variables for flags
 var (
-	kubeconfig string
-	namespace  string
-	name       string
+	kubeconfig  string
+	kubeContext string
+	qps         float32
+	burst       int
+	asUser      string
+	asGroups    []string
+	namespace   string
+	name        string
 	// run subcommand flags
-	uploadSrc      string
-	uploadDest     string
-	timeout        time.Duration
-	excludePattern string
-	useShell       bool
+	uploadSrc       string
+	uploadDest      string
+	timeout         time.Duration
+	perPodTimeout   time.Duration
+	output          string
+	fieldSelector   string
+	limit           int
+	failFast        bool
+	excludePatterns []string
+	includePatterns []string
+	chmodExec       []string
+	useIgnoreFiles  bool
+	followSymlinks  bool
+	useShell        bool
+	commandFile     string
+	tty             bool
+	maxConcurrency  int
+	container       string
+	hashAlgorithm   string
+	mirror          bool
+	mirrorDryRun    bool
+	mirrorExclude   []string
+	compress        bool
+	delta           bool
+	chunkAvgSize    string
+	maxFileSize     string
+	cacheDir        string
+	leader          string
+	hubFanout       int
+	agentURL        string
+	agentPath       string
+	force           bool
+	collect         []string
+	serve           string
 	// launch subcommand flags
 	deviceType string
 	image      string
 	dryRun     bool
 	numSlices  int
-	mirror     bool
+	command    string
+	env        []string
+	pvcs       []string
+	buckets    []string
+	subSlice   string
+	noPolicy   bool
+	spot       bool
+	maxRunTime time.Duration
+	restart    string
+	backoff    int32
+	sidecars   []string
+	cpu        string
+	memory     string
+	shmSize    string
 )
 
 var JobSetCmd = &cobra.Command{
@@ -76,14 +140,48 @@ var RunSubcmd = &cobra.Command{
 		}
 
 		opts := run.Options{
-			Kubeconfig:     kubeconfig,
-			Namespace:      namespace,
-			LabelSelector:  labelSelector,
-			UploadSrc:      uploadSrc,
-			UploadDest:     uploadDest,
-			ExcludePattern: excludePattern,
-			Timeout:        timeout,
-			CmdArgs:        cmdArgs,
+			Kubeconfig:      kubeconfig,
+			KubeContext:     kubeContext,
+			QPS:             qps,
+			Burst:           burst,
+			As:              asUser,
+			AsGroups:        asGroups,
+			Namespace:       namespace,
+			LabelSelector:   labelSelector,
+			FieldSelector:   fieldSelector,
+			Limit:           limit,
+			FailFast:        failFast,
+			UploadSrc:       uploadSrc,
+			UploadDest:      uploadDest,
+			ExcludePatterns: excludePatterns,
+			IncludePatterns: includePatterns,
+			ChmodExec:       chmodExec,
+			UseIgnoreFiles:  useIgnoreFiles,
+			FollowSymlinks:  followSymlinks,
+			HashAlgorithm:   hashAlgorithm,
+			Mirror:          mirror,
+			MirrorDryRun:    mirrorDryRun,
+			MirrorExclude:   mirrorExclude,
+			Compress:        compress,
+			Delta:           delta,
+			ChunkAvgSize:    chunkAvgSize,
+			MaxFileSize:     maxFileSize,
+			CacheDir:        cacheDir,
+			Leader:          leader,
+			HubFanout:       hubFanout,
+			AgentURL:        agentURL,
+			AgentPath:       agentPath,
+			Force:           force,
+			Collect:         collect,
+			Serve:           serve,
+			TTY:             tty,
+			MaxConcurrency:  maxConcurrency,
+			Container:       container,
+			Timeout:         timeout,
+			PerPodTimeout:   perPodTimeout,
+			Output:          output,
+			CmdArgs:         cmdArgs,
+			CommandFile:     commandFile,
 		}
 
 		return run.Run(cmd.Context(), opts)
@@ -91,17 +189,92 @@ var RunSubcmd = &cobra.Command{
 }
 
 var LaunchSubcmd = &cobra.Command{
-	Use:   "launch [flags]",
+	Use:   "launch [flags] [-- command...]",
 	Short: "Launch a jobset",
 	Example: `  # Launch a TPU JobSet
   krun jobset launch --name=stoelinga --device-type=tpu-7x-16 --image=python:3.12
 
   # Launch a GPU JobSet
-  krun jobset launch --name=stoelinga --device-type=gpu-l4-1 --image=nvidia/cuda:12.9.1-cudnn-devel-ubuntu24.04`,
+  krun jobset launch --name=stoelinga --device-type=gpu-l4-1 --image=nvidia/cuda:12.9.1-cudnn-devel-ubuntu24.04
+
+  # Launch a CPU-only JobSet
+  krun jobset launch --name=stoelinga --device-type=cpu-n2-standard-8 --image=python:3.12
+
+  # Launch a JobSet running a training entrypoint
+  krun jobset launch --name=stoelinga --image=python:3.12 -- python train.py --epochs 10
+  krun jobset launch --name=stoelinga --image=python:3.12 --command="python train.py --run-name 'first run'"`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		var cmdArgs []string
+		if cmd.ArgsLenAtDash() != -1 {
+			cmdArgs = args[cmd.ArgsLenAtDash():]
+		}
+		if command != "" {
+			if len(cmdArgs) > 0 {
+				return fmt.Errorf("--command and the arguments after -- can not be used together")
+			}
+			var err error
+			cmdArgs, err = SplitCommand(command)
+			if err != nil {
+				return fmt.Errorf("invalid --command: %w", err)
+			}
+		}
+
+		envVars, err := ParseEnv(env)
+		if err != nil {
+			return err
+		}
+		sidecarContainers, err := ParseSidecars(sidecars)
+		if err != nil {
+			return err
+		}
+		var cpuQuantity, memoryQuantity resource.Quantity
+		if cpu != "" {
+			if cpuQuantity, err = resource.ParseQuantity(cpu); err != nil {
+				return fmt.Errorf("invalid --cpu: %w", err)
+			}
+		}
+		if memory != "" {
+			if memoryQuantity, err = resource.ParseQuantity(memory); err != nil {
+				return fmt.Errorf("invalid --memory: %w", err)
+			}
+		}
+		var shmQuantity resource.Quantity
+		if shmSize != "" {
+			if shmQuantity, err = resource.ParseQuantity(shmSize); err != nil {
+				return fmt.Errorf("invalid --shm-size: %w", err)
+			}
+		}
+		pvcVolumes, err := ParseVolumes("pvc", pvcs)
+		if err != nil {
+			return err
+		}
+		gcsVolumes, err := ParseVolumes("gcs", buckets)
+		if err != nil {
+			return err
+		}
 
 		// Create the JobSet
-		js, err := GenerateJobSet(name, namespace, deviceType, image, "sleep infinity", numSlices)
+		js, err := GenerateJobSet(LaunchOptions{
+			Name:             name,
+			Namespace:        namespace,
+			DeviceType:       deviceType,
+			Image:            image,
+			Command:          cmdArgs,
+			NumSlices:        numSlices,
+			Env:              envVars,
+			PVCs:             pvcVolumes,
+			GCSBuckets:       gcsVolumes,
+			SubSlice:         subSlice,
+			NoWorkloadPolicy: noPolicy,
+			Spot:             spot,
+			MaxRunDuration:   maxRunTime,
+			RestartPolicy:    corev1.RestartPolicy(restart),
+			BackoffLimit:     backoff,
+			Sidecars:         sidecarContainers,
+			CPU:              cpuQuantity,
+			Memory:           memoryQuantity,
+			ShmSize:          shmQuantity,
+		})
 		if err != nil {
 			return fmt.Errorf("failed to generate jobset: %w", err)
 		}
@@ -125,7 +298,7 @@ var LaunchSubcmd = &cobra.Command{
 		// Defer error handling for the metrics server
 		defer runtime.HandleCrash()
 
-		config, _, err := clientset.GetClient(kubeconfig)
+		config, _, err := clientset.GetClient(kubeconfig, kubeContext, clientOptions())
 		if err != nil {
 			return err
 		}
@@ -136,6 +309,16 @@ var LaunchSubcmd = &cobra.Command{
 		}
 
 		klog.Infof("Creating JobSet %q in namespace %q with device type %q...", name, namespace, deviceType)
+		// the sub-slice topology sets the size of each slice
+		sliceDeviceType := deviceType
+		if subSlice != "" {
+			sliceDeviceType = deviceType[:strings.LastIndex(deviceType, "-")] + "-" + subSlice
+		}
+		chips, chipsErr := TotalChips(sliceDeviceType, numSlices)
+		nodes, nodesErr := NodeCount(sliceDeviceType, numSlices)
+		if chipsErr == nil && nodesErr == nil {
+			klog.Infof("JobSet %q uses %d chips on %d nodes", name, chips, nodes)
+		}
 		createdJS, err := clientset.JobsetV1alpha2().JobSets(namespace).Create(ctx, js, metav1.CreateOptions{})
 		if err != nil {
 			return fmt.Errorf("failed to create jobset: %w", err)
@@ -148,6 +331,11 @@ var LaunchSubcmd = &cobra.Command{
 
 func init() {
 	JobSetCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
+	JobSetCmd.PersistentFlags().StringVar(&kubeContext, "context", "", "kubeconfig context to use, the current context if empty")
+	JobSetCmd.PersistentFlags().Float32Var(&qps, "qps", clientset.DefaultQPS, "Maximum queries per second to the API server")
+	JobSetCmd.PersistentFlags().IntVar(&burst, "burst", clientset.DefaultBurst, "Maximum burst of queries to the API server")
+	JobSetCmd.PersistentFlags().StringVar(&asUser, "as", "", "User to impersonate for the operation")
+	JobSetCmd.PersistentFlags().StringArrayVar(&asGroups, "as-group", nil, "Group to impersonate for the operation, can be repeated to specify multiple groups")
 	JobSetCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "Kubernetes namespace")
 	JobSetCmd.PersistentFlags().StringVarP(&name, "name", "j", "", "Name of the JobSet")
 
@@ -155,25 +343,192 @@ func init() {
 	JobSetCmd.AddCommand(RunSubcmd)
 	RunSubcmd.Flags().StringVar(&uploadSrc, "upload-src", "", "Local path to folder/file to upload")
 	RunSubcmd.Flags().StringVar(&uploadDest, "upload-dest", "", "Remote path (e.g. /tmp/app)")
-	RunSubcmd.Flags().StringVar(&excludePattern, "exclude", DefaultExclude, "Regex pattern to exclude files when uploading (default excludes all hidden files and folders)")
+	RunSubcmd.Flags().StringArrayVar(&excludePatterns, "exclude", []string{DefaultExclude}, "Regex pattern to exclude files when uploading, can be repeated to exclude any of them (default excludes all hidden files and folders)")
+	RunSubcmd.Flags().StringArrayVar(&chmodExec, "chmod-exec", nil, "Regex pattern of the uploaded files to make executable (e.g. \\.sh$), can be repeated")
+	RunSubcmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Regex pattern to only upload the matching files, can be repeated to include any of them (exclude patterns are applied after)")
+	RunSubcmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Upload the files and directories the symlinks point to instead of the symlinks")
+	RunSubcmd.Flags().BoolVar(&useIgnoreFiles, "use-ignore-file", false, "Skip the files matching the .gitignore and .krunignore (gitignore syntax) in the upload source")
+	RunSubcmd.Flags().StringVar(&hashAlgorithm, "hash", cdc.HashSHA256, "Hash algorithm for the uploaded chunks (sha256 or blake3)")
+	RunSubcmd.Flags().BoolVar(&mirrorDryRun, "mirror-dry-run", false, "Only log the extraneous files that would be deleted in the destination")
+	RunSubcmd.Flags().StringArrayVar(&mirrorExclude, "mirror-exclude", nil, "Regex pattern of the destination paths never deleted by mirroring (e.g. ^logs/), can be repeated")
+	RunSubcmd.Flags().BoolVar(&force, "force", false, "Allow uploading an empty source, deleting all the files in the destination")
+	RunSubcmd.Flags().BoolVar(&compress, "compress", false, "Compress the uploaded chunks that benefit from it, the decision is recorded per chunk")
+	RunSubcmd.Flags().BoolVar(&delta, "delta", false, "Keep the uploaded chunks on the pods and transfer the modified chunks of the next uploads as deltas against their previous version")
+	RunSubcmd.Flags().StringVar(&maxFileSize, "max-file-size", "", "Skip the uploaded files larger than this size (e.g. 1Gi), unlimited if empty")
+	RunSubcmd.Flags().StringVar(&chunkAvgSize, "chunk-avg-size", "", "Average size of the uploaded chunks, a power of two between 64Ki and 8Mi (e.g. 256Ki, 4Mi), defaults to 1Mi")
+	RunSubcmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Directory to keep the chunks of the upload source between runs, only modified files are chunked again (disabled if empty)")
+	RunSubcmd.Flags().StringVar(&leader, "leader", "", "Name of the pod receiving the upload and serving it to the other pods, by default the first ready pod with an IP and enough free disk")
+	RunSubcmd.Flags().IntVar(&hubFanout, "hub-fanout", 32, "Maximum number of pods downloading the upload from the same pod at once, the synced pods serve the next ones, 0 is unlimited")
+	RunSubcmd.Flags().StringVar(&agentURL, "agent-url", "", "URL of the agent binary for the pod architectures without an embedded one, {arch} is replaced by the GOARCH (e.g. https://example.com/krun-agent-fsync-{arch}), the binary must match the SHA-256 sum published at the same URL with the .sha256 suffix")
+	RunSubcmd.Flags().StringVar(&agentPath, "agent-path", cdc.AgentFile, "Absolute path the agent is uploaded to on the pods, change it if /tmp is read-only or shared")
+	RunSubcmd.Flags().StringArrayVar(&collect, "collect", nil, "Remote path to download from every pod after the command, as SRC:DEST (stored in DEST/<pod>, can be repeated)")
+	RunSubcmd.Flags().StringVar(&serve, "serve", "", "Address to stream the command output as server-sent events on /events (e.g. localhost:8080), a port without host listens on the loopback, disabled by default")
 	RunSubcmd.Flags().DurationVar(&timeout, "timeout", 0, "Timeout for the execution")
-	RunSubcmd.Flags().BoolVar(&mirror, "mirror", false, "Mirror destination (delete extraneous files in destination)")
+	RunSubcmd.Flags().DurationVar(&perPodTimeout, "per-pod-timeout", 0, "Timeout for the command on each pod, a pod exceeding it is cancelled without affecting the others")
+	RunSubcmd.Flags().BoolVar(&mirror, "mirror", true, "Mirror destination (delete extraneous files in destination)")
+	RunSubcmd.Flags().IntVar(&maxConcurrency, "max-concurrency", 0, "Maximum number of pods executing the command or receiving the agent at the same time, 0 is unlimited")
+	RunSubcmd.Flags().StringVar(&fieldSelector, "field-selector", "", "Field selector for pods, combined with the label selector (e.g. status.phase=Running)")
+	RunSubcmd.Flags().IntVar(&limit, "limit", 0, "Only act on the first N matching pods sorted by name, 0 is all")
+	RunSubcmd.Flags().BoolVar(&failFast, "fail-fast", false, "Cancel the command on all the pods as soon as it fails on one of them")
+	RunSubcmd.Flags().StringVarP(&output, "output", "o", "text", "Format of the command output, text or json (one object per line and a summary per pod)")
+	RunSubcmd.Flags().StringVarP(&container, "container", "c", "", "Container of the pods to run the command and upload the files, the default container if empty")
+	RunSubcmd.Flags().BoolVar(&tty, "tty", false, "Run the command interactively attached to the terminal, the selector must match exactly one pod")
+	RunSubcmd.Flags().StringVar(&commandFile, "command-file", "", "Local script to run on each pod, it is streamed to 'sh -s' so it does not need to exist in the pods")
 	RunSubcmd.Flags().BoolVar(&useShell, "shell", false, "Wrap command with 'sh -c' to enable shell features like pipes, &&, ||, and cd")
 
 	JobSetCmd.AddCommand(LaunchSubcmd)
-	LaunchSubcmd.Flags().StringVar(&deviceType, "device-type", "tpu-7x-16", "Type of accelerator to launch (e.g. tpu-7x-16, gpu-l4-1)")
+	LaunchSubcmd.Flags().StringVar(&deviceType, "device-type", "tpu-7x-16", "Type of accelerator to launch (e.g. tpu-7x-16, gpu-l4-1), or cpu-<machine-type> for CPU-only workers (e.g. cpu-n2-standard-8)")
 	LaunchSubcmd.Flags().StringVar(&image, "image", "ubuntu:24.04", "Container image to use for the workers")
 	LaunchSubcmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the JobSet yaml without creating it")
 	LaunchSubcmd.Flags().IntVar(&numSlices, "num-slices", 1, "Number of slices (replicas) to launch")
+	LaunchSubcmd.Flags().StringArrayVar(&env, "env", nil, "Environment variable of the workers as KEY=VALUE, can be repeated (overrides DEVICE_TYPE and ACCELERATOR_TYPE)")
+	LaunchSubcmd.Flags().StringArrayVar(&pvcs, "pvc", nil, "PersistentVolumeClaim mounted in the workers as NAME:MOUNTPATH, can be repeated")
+	LaunchSubcmd.Flags().StringArrayVar(&buckets, "gcs", nil, "Cloud Storage bucket mounted in the workers with the GCSFuse CSI driver as BUCKET:MOUNTPATH, can be repeated")
+	LaunchSubcmd.Flags().StringVar(&subSlice, "sub-slice", "", "Topology of the sub-slice of the device type node pool requested by each slice (e.g. 4x4), only for device types supporting sub-slicing")
+	LaunchSubcmd.Flags().BoolVar(&noPolicy, "no-workload-policy", false, "Do not place each multi-VM slice exclusively on a node pool for the device types requiring it")
+	LaunchSubcmd.Flags().BoolVar(&spot, "spot", false, "Schedule the workers on spot VMs, a preempted worker fails its Job unless --backoff-limit allows retries")
+	LaunchSubcmd.Flags().DurationVar(&maxRunTime, "max-run-duration", 0, "Maximum duration of the Jobs of the workers before they are terminated, 0 is unlimited")
+	LaunchSubcmd.Flags().StringVar(&restart, "restart-policy", string(corev1.RestartPolicyNever), "Restart policy of the workers, Never (failed pods are recreated) or OnFailure (failed containers are restarted)")
+	LaunchSubcmd.Flags().Int32Var(&backoff, "backoff-limit", 0, "Number of retries of the failed workers before the Job fails")
+	LaunchSubcmd.Flags().StringArrayVar(&sidecars, "sidecar", nil, "Additional container of the workers as NAME=IMAGE, without accelerators, can be repeated")
+	LaunchSubcmd.Flags().StringVar(&cpu, "cpu", "", "CPU requested and limited for the workload container (e.g. 8, 500m)")
+	LaunchSubcmd.Flags().StringVar(&memory, "memory", "", "Memory requested and limited for the workload container (e.g. 32Gi)")
+	LaunchSubcmd.Flags().StringVar(&shmSize, "shm-size", "", "Size of the memory backed /dev/shm of the workload container (e.g. 16Gi), the container runtime default if empty")
+	LaunchSubcmd.Flags().StringVar(&command, "command", "", "Command of the workers, split like a shell does (defaults to sleep infinity)")
+
+}
+
+// LaunchOptions describes the JobSet to launch
+type LaunchOptions struct {
+	Name      string
+	Namespace string
+	// DeviceType selects the accelerator of the workers (e.g. tpu-7x-16, gpu-l4-1)
+	DeviceType string
+	Image      string
+	// Command of the workers, DefaultCommand if empty
+	Command   []string
+	NumSlices int
+	// Env is added to the environment of the workers, overriding the variables set by krun
+	Env []corev1.EnvVar
+	// PVCs are the PersistentVolumeClaims mounted in the workers
+	PVCs []VolumeSpec
+	// GCSBuckets are the Cloud Storage buckets mounted in the workers with GCSFuse
+	GCSBuckets []VolumeSpec
+	// SubSlice is the topology of the sub-slice requested by each slice in the node pool of the device type, optional
+	SubSlice string
+	// NoWorkloadPolicy skips the exclusive placement of the slices of the device types requiring it
+	NoWorkloadPolicy bool
+	// Spot schedules the workers on spot VMs
+	Spot bool
+	// MaxRunDuration terminates the Jobs running longer than it, 0 is unlimited
+	MaxRunDuration time.Duration
+	// RestartPolicy of the workers, Never if empty
+	RestartPolicy corev1.RestartPolicy
+	// BackoffLimit is the number of retries before a Job fails
+	BackoffLimit int32
+	// Sidecars are added to the workers next to the workload container, without accelerators
+	Sidecars []corev1.Container
+	// CPU and Memory of the workload container, unset if zero
+	CPU    resource.Quantity
+	Memory resource.Quantity
+	// ShmSize mounts a memory backed /dev/shm of this size in the workload container, unset if zero
+	ShmSize resource.Quantity
+}
+
+// ParseSidecars parses the NAME=IMAGE sidecar containers
+func ParseSidecars(specs []string) ([]corev1.Container, error) {
+	var containers []corev1.Container
+	names := map[string]bool{workloadContainer: true}
+	for _, s := range specs {
+		name, image, ok := strings.Cut(s, "=")
+		if !ok || name == "" || image == "" {
+			return nil, fmt.Errorf("invalid --sidecar %q, must be NAME=IMAGE", s)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid --sidecar %q: %s", s, strings.Join(errs, ", "))
+		}
+		if names[name] {
+			return nil, fmt.Errorf("invalid --sidecar %q: duplicate container name %s", s, name)
+		}
+		names[name] = true
+		containers = append(containers, corev1.Container{Name: name, Image: image})
+	}
+	return containers, nil
+}
+
+// ParseEnv parses the KEY=VALUE environment variables
+func ParseEnv(env []string) ([]corev1.EnvVar, error) {
+	var vars []corev1.EnvVar
+	for _, e := range env {
+		key, value, ok := strings.Cut(e, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --env %q, must be KEY=VALUE", e)
+		}
+		if errs := validation.IsEnvVarName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid --env %q: %s", e, strings.Join(errs, ", "))
+		}
+		vars = append(vars, corev1.EnvVar{Name: key, Value: value})
+	}
+	return vars, nil
+}
 
+// mergeEnv returns the defaults with the variables of env replaced or appended
+func mergeEnv(defaults, env []corev1.EnvVar) []corev1.EnvVar {
+	merged := append([]corev1.EnvVar(nil), defaults...)
+	for _, e := range env {
+		found := false
+		for i := range merged {
+			if merged[i].Name == e.Name {
+				merged[i] = e
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, e)
+		}
+	}
+	return merged
 }
 
 // GenerateJobSet creates the K8s JobSet object based on the device-type
-func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, numSlices int) (*jobsetapi.JobSet, error) {
+func GenerateJobSet(opts LaunchOptions) (*jobsetapi.JobSet, error) {
+	command := opts.Command
+	if len(command) == 0 {
+		command = append([]string(nil), DefaultCommand...)
+	}
+
+	if opts.MaxRunDuration < 0 {
+		return nil, fmt.Errorf("the maximum run duration must be positive")
+	}
+	// the deadline of the Jobs is in seconds, 0 is rejected by the API server
+	if opts.MaxRunDuration > 0 && opts.MaxRunDuration < time.Second {
+		return nil, fmt.Errorf("the maximum run duration must be at least 1s, got %v", opts.MaxRunDuration)
+	}
+	restartPolicy := opts.RestartPolicy
+	if restartPolicy == "" {
+		restartPolicy = corev1.RestartPolicyNever
+	}
+	if restartPolicy != corev1.RestartPolicyNever && restartPolicy != corev1.RestartPolicyOnFailure {
+		return nil, fmt.Errorf("unsupported restart policy %q, must be %s or %s", restartPolicy, corev1.RestartPolicyNever, corev1.RestartPolicyOnFailure)
+	}
+	if opts.BackoffLimit < 0 {
+		return nil, fmt.Errorf("the backoff limit must be 0 or positive")
+	}
+	// the Job fails at the first restart of a container otherwise
+	if restartPolicy == corev1.RestartPolicyOnFailure && opts.BackoffLimit == 0 {
+		return nil, fmt.Errorf("restart policy %s requires a positive backoff limit", corev1.RestartPolicyOnFailure)
+	}
 
 	// 1. Get System Characteristics
-	sysChar, err := GetSystemCharacteristics(deviceTypeString)
+	sysChar, err := GetSystemCharacteristics(opts.DeviceType)
 	if err != nil {
+		// explain why a <family>-<topology> device type is not valid
+		if i := strings.LastIndex(opts.DeviceType, "-"); i > 0 && strings.Contains(opts.DeviceType[i+1:], "x") {
+			if topoErr := ValidateTopology(opts.DeviceType[:i], opts.DeviceType[i+1:]); topoErr != nil {
+				return nil, topoErr
+			}
+		}
 		return nil, err
 	}
 
@@ -188,7 +543,7 @@ func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, nu
 		switch sysChar.AcceleratorType {
 		case AcceleratorTypeTPU:
 			nodeSelector[accChar.MachineLabel] = sysChar.Topology
-		case AcceleratorTypeGPU:
+		case AcceleratorTypeGPU, AcceleratorTypeCPU:
 			nodeSelector[accChar.MachineLabel] = sysChar.GCEMachineType
 		}
 	}
@@ -200,6 +555,29 @@ func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, nu
 	if sysChar.AcceleratorType == AcceleratorTypeTPU || sysChar.AcceleratorType == AcceleratorTypeGPU {
 		resourceList[corev1.ResourceName(accChar.ResourceType)] = resource.MustParse(fmt.Sprintf("%d", sysChar.ChipsPerVM))
 	}
+	if opts.CPU.Sign() < 0 || opts.Memory.Sign() < 0 || opts.ShmSize.Sign() < 0 {
+		return nil, fmt.Errorf("the cpu, memory and shared memory size must be positive")
+	}
+	if !opts.CPU.IsZero() {
+		resourceList[corev1.ResourceCPU] = opts.CPU
+	}
+	if !opts.Memory.IsZero() {
+		resourceList[corev1.ResourceMemory] = opts.Memory
+	}
+
+	// A sub-slice runs on less VMs of the node pool of the device type
+	vmsPerSlice := sysChar.VMsPerSlice
+	var annotations map[string]string
+	if opts.SubSlice != "" {
+		sub, err := GetSubSliceCharacteristics(sysChar, opts.SubSlice)
+		if err != nil {
+			return nil, err
+		}
+		vmsPerSlice = sub.VMsPerSlice
+		annotations = map[string]string{
+			subSliceTopologyAnnotation: fmt.Sprintf("cloud.google.com/gke-tpu-slice-%s-id", sub.Topology),
+		}
+	}
 
 	// 3. Construct JobSet
 	// Calculate parallelism and completions
@@ -207,13 +585,13 @@ func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, nu
 	// For GPU/CPU: Parallelism = Completions = VMsPerSlice (usually 1, but can be more for multi-node)
 	// The Python code has vms_per_slice.
 	// If we assume we are launching 1 slice (which seems to be the case for "launch a jobset"), then:
-	numNodes := int32(sysChar.VMsPerSlice)
-	replicas := int32(numSlices)
+	numNodes := int32(vmsPerSlice)
+	replicas := int32(opts.NumSlices)
 
 	jobSet := &jobsetapi.JobSet{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
+			Name:      opts.Name,
+			Namespace: opts.Namespace,
 		},
 		Spec: jobsetapi.JobSetSpec{
 			ReplicatedJobs: []jobsetapi.ReplicatedJob{
@@ -222,32 +600,35 @@ func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, nu
 					Replicas: replicas,
 					Template: batchv1.JobTemplateSpec{
 						Spec: batchv1.JobSpec{
-							Parallelism:  &numNodes,                             // Run on 'numNodes' pods simultaneously
-							Completions:  &numNodes,                             // Job is done when all pods finish
-							BackoffLimit: func(i int32) *int32 { return &i }(0), // Fail fast for this demo
+							Parallelism:  &numNodes, // Run on 'numNodes' pods simultaneously
+							Completions:  &numNodes, // Job is done when all pods finish
+							BackoffLimit: &opts.BackoffLimit,
 							Template: corev1.PodTemplateSpec{
+								ObjectMeta: metav1.ObjectMeta{
+									Annotations: annotations,
+								},
 								Spec: corev1.PodSpec{
-									RestartPolicy: corev1.RestartPolicyNever,
+									RestartPolicy: restartPolicy,
 									NodeSelector:  nodeSelector,
 									Containers: []corev1.Container{
 										{
-											Name:    "workload",
-											Image:   imageName,
-											Command: strings.Split(cmd, " "),
+											Name:    workloadContainer,
+											Image:   opts.Image,
+											Command: command,
 											Resources: corev1.ResourceRequirements{
 												Limits:   resourceList,
 												Requests: resourceList,
 											},
-											Env: []corev1.EnvVar{
+											Env: mergeEnv([]corev1.EnvVar{
 												{
 													Name:  "DEVICE_TYPE",
-													Value: deviceTypeString,
+													Value: opts.DeviceType,
 												},
 												{
 													Name:  "ACCELERATOR_TYPE",
 													Value: string(sysChar.AcceleratorType),
 												},
-											},
+											}, opts.Env),
 										},
 									},
 								},
@@ -258,6 +639,95 @@ func GenerateJobSet(name, namespace, deviceTypeString, imageName, cmd string, nu
 			},
 		},
 	}
+	podTemplate := &jobSet.Spec.ReplicatedJobs[0].Template.Spec.Template
+	addVolumes(podTemplate, opts.PVCs, opts.GCSBuckets)
+	if !opts.ShmSize.IsZero() {
+		addSharedMemory(podTemplate, opts.ShmSize)
+	}
+
+	// The sidecars are appended after the workload, that keeps the accelerators and volumes
+	if len(opts.Sidecars) > 0 {
+		podTemplate.Spec.Containers = append(podTemplate.Spec.Containers, opts.Sidecars...)
+		if podTemplate.Annotations == nil {
+			podTemplate.Annotations = map[string]string{}
+		}
+		podTemplate.Annotations[defaultContainerAnnotation] = workloadContainer
+	}
+
+	// Spot nodes may be tainted to only run workloads tolerating preemption
+	if opts.Spot {
+		podTemplate.Spec.NodeSelector[spotNodeKey] = "true"
+		podTemplate.Spec.Tolerations = append(podTemplate.Spec.Tolerations, corev1.Toleration{
+			Key:      spotNodeKey,
+			Operator: corev1.TolerationOpEqual,
+			Value:    "true",
+			Effect:   corev1.TaintEffectNoSchedule,
+		})
+	}
+	if opts.MaxRunDuration > 0 {
+		seconds := int64(opts.MaxRunDuration.Seconds())
+		jobSet.Spec.ReplicatedJobs[0].Template.Spec.ActiveDeadlineSeconds = &seconds
+	}
+
+	// The VMs of a slice need a compact placement, each slice gets its own node pool
+	if sysChar.RequiresWorkloadPolicy && vmsPerSlice > 1 && !opts.NoWorkloadPolicy {
+		jobSet.Annotations = map[string]string{jobsetapi.ExclusiveKey: nodePoolTopologyKey}
+	}
 
 	return jobSet, nil
 }
+
+// SplitCommand splits the command line in arguments like a POSIX shell does,
+// honoring single quotes, double quotes and backslash escapes. Other shell
+// features like variables or globs are not expanded.
+func SplitCommand(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			current.WriteByte(s[i])
+			inArg = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			current.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// only these characters are escaped inside double quotes
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				current.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inArg = true
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,398 @@
+package jobset
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: nil},
+		{name: "simple", in: "sleep infinity", want: []string{"sleep", "infinity"}},
+		{name: "extra spaces", in: "  python   train.py\t--epochs 10 ", want: []string{"python", "train.py", "--epochs", "10"}},
+		{name: "single quotes", in: `python train.py --run-name 'first run'`, want: []string{"python", "train.py", "--run-name", "first run"}},
+		{name: "double quotes", in: `sh -c "echo \"hi\" && ls $HOME"`, want: []string{"sh", "-c", `echo "hi" && ls $HOME`}},
+		{name: "escaped space", in: `cat my\ file`, want: []string{"cat", "my file"}},
+		{name: "empty argument", in: `echo ''`, want: []string{"echo", ""}},
+		{name: "adjacent quotes", in: `--name='a b'"c d"`, want: []string{"--name=a bc d"}},
+		{name: "unterminated single quote", in: `echo 'hi`, wantErr: true},
+		{name: "unterminated double quote", in: `echo "hi`, wantErr: true},
+		{name: "trailing backslash", in: `echo \`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitCommand(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitCommand(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitCommand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		want    []string
+	}{
+		{name: "default", command: nil, want: []string{"sleep", "infinity"}},
+		{name: "custom", command: []string{"python", "train.py", "--run-name", "first run"}, want: []string{"python", "train.py", "--run-name", "first run"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", Command: tt.command, NumSlices: 1})
+			if err != nil {
+				t.Fatalf("GenerateJobSet failed: %v", err)
+			}
+			containers := js.Spec.ReplicatedJobs[0].Template.Spec.Template.Spec.Containers
+			if len(containers) != 1 {
+				t.Fatalf("Expected one container, got %d", len(containers))
+			}
+			if !reflect.DeepEqual(containers[0].Command, tt.want) {
+				t.Errorf("Container command %q, want %q", containers[0].Command, tt.want)
+			}
+			if len(containers[0].Args) != 0 {
+				t.Errorf("Expected no container args, got %q", containers[0].Args)
+			}
+		})
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     []string
+		want    []corev1.EnvVar
+		wantErr bool
+	}{
+		{name: "empty", env: nil, want: nil},
+		{name: "values", env: []string{"EPOCHS=10", "ARGS=--lr=0.1", "EMPTY="}, want: []corev1.EnvVar{{Name: "EPOCHS", Value: "10"}, {Name: "ARGS", Value: "--lr=0.1"}, {Name: "EMPTY", Value: ""}}},
+		{name: "missing value", env: []string{"EPOCHS"}, wantErr: true},
+		{name: "missing key", env: []string{"=10"}, wantErr: true},
+		{name: "invalid key", env: []string{"MY VAR=10"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEnv(tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEnv(%q) error = %v, wantErr %v", tt.env, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEnv(%q) = %v, want %v", tt.env, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetEnv(t *testing.T) {
+	env, err := ParseEnv([]string{"EPOCHS=10", "DEVICE_TYPE=custom"})
+	if err != nil {
+		t.Fatalf("ParseEnv failed: %v", err)
+	}
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, Env: env})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	got := js.Spec.ReplicatedJobs[0].Template.Spec.Template.Spec.Containers[0].Env
+	want := []corev1.EnvVar{
+		{Name: "DEVICE_TYPE", Value: "custom"},
+		{Name: "ACCELERATOR_TYPE", Value: "GPU"},
+		{Name: "EPOCHS", Value: "10"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Container env %v, want %v", got, want)
+	}
+}
+
+func TestGenerateJobSetSubSlice(t *testing.T) {
+	tests := []struct {
+		name           string
+		deviceType     string
+		subSlice       string
+		wantNodes      int32
+		wantAnnotation string
+		wantErr        bool
+	}{
+		{name: "no sub-slice", deviceType: "tpu-v6e-256", wantNodes: 64},
+		{name: "sub-slice", deviceType: "tpu-v6e-256", subSlice: "4x4", wantNodes: 4, wantAnnotation: "cloud.google.com/gke-tpu-slice-4x4-id"},
+		{name: "rectangular sub-slice", deviceType: "tpu-v6e-256", subSlice: "8x16", wantNodes: 32, wantAnnotation: "cloud.google.com/gke-tpu-slice-8x16-id"},
+		{name: "unsupported device type", deviceType: "tpu-7x-16", subSlice: "2x2x1", wantErr: true},
+		{name: "unsupported sub-slice topology", deviceType: "tpu-v6e-256", subSlice: "2x2", wantErr: true},
+		{name: "sub-slice as large as the slice", deviceType: "tpu-v6e-256", subSlice: "16x16", wantErr: true},
+		{name: "sub-slice larger than the slice", deviceType: "tpu-v6e-32", subSlice: "8x8", wantErr: true},
+		{name: "invalid topology", deviceType: "tpu-v6e-256", subSlice: "foo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: tt.deviceType, Image: "python:3.12", NumSlices: 1, SubSlice: tt.subSlice})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateJobSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			spec := js.Spec.ReplicatedJobs[0].Template.Spec
+			if *spec.Parallelism != tt.wantNodes || *spec.Completions != tt.wantNodes {
+				t.Errorf("Parallelism %d and completions %d, want %d", *spec.Parallelism, *spec.Completions, tt.wantNodes)
+			}
+			if got := spec.Template.Annotations[subSliceTopologyAnnotation]; got != tt.wantAnnotation {
+				t.Errorf("Sub-slice annotation %q, want %q", got, tt.wantAnnotation)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetWorkloadPolicy(t *testing.T) {
+	tests := []struct {
+		name             string
+		deviceType       string
+		noWorkloadPolicy bool
+		want             bool
+	}{
+		{name: "tpu7x multi-VM", deviceType: "tpu-7x-16", want: true},
+		{name: "tpu7x multi-VM disabled", deviceType: "tpu-7x-16", noWorkloadPolicy: true, want: false},
+		{name: "tpu7x single-VM", deviceType: "tpu-7x-8", want: false},
+		{name: "gpu single-VM", deviceType: "gpu-l4-1", want: false},
+		{name: "tpu without policy", deviceType: "tpu-v5p-16", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: tt.deviceType, Image: "python:3.12", NumSlices: 1, NoWorkloadPolicy: tt.noWorkloadPolicy})
+			if err != nil {
+				t.Fatalf("GenerateJobSet failed: %v", err)
+			}
+			got, ok := js.Annotations[jobsetapi.ExclusiveKey]
+			if ok != tt.want {
+				t.Fatalf("Exclusive placement annotation present %v, want %v", ok, tt.want)
+			}
+			if ok && got != "cloud.google.com/gke-nodepool" {
+				t.Errorf("Exclusive placement annotation %q, want cloud.google.com/gke-nodepool", got)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetCPU(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "cpu-n2-standard-8", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	spec := js.Spec.ReplicatedJobs[0].Template.Spec
+	if *spec.Parallelism != 1 {
+		t.Errorf("Expected one worker per slice, got %d", *spec.Parallelism)
+	}
+	container := spec.Template.Spec.Containers[0]
+	for _, resources := range []corev1.ResourceList{container.Resources.Limits, container.Resources.Requests} {
+		for _, name := range []corev1.ResourceName{"nvidia.com/gpu", "google.com/tpu"} {
+			if _, ok := resources[name]; ok {
+				t.Errorf("Expected no %s resources, got %v", name, resources)
+			}
+		}
+	}
+	want := map[string]string{"cloud.google.com/gce-machine-type": "n2-standard-8"}
+	if !reflect.DeepEqual(spec.Template.Spec.NodeSelector, want) {
+		t.Errorf("Node selector %v, want %v", spec.Template.Spec.NodeSelector, want)
+	}
+
+	if _, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "cpu-", Image: "python:3.12", NumSlices: 1}); err == nil {
+		t.Errorf("Expected an error without machine type")
+	}
+}
+
+func TestGenerateJobSetSpot(t *testing.T) {
+	tests := []struct {
+		name           string
+		spot           bool
+		maxRunDuration time.Duration
+	}{
+		{name: "on-demand"},
+		{name: "spot", spot: true},
+		{name: "spot with max run duration", spot: true, maxRunDuration: 4 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, Spot: tt.spot, MaxRunDuration: tt.maxRunDuration})
+			if err != nil {
+				t.Fatalf("GenerateJobSet failed: %v", err)
+			}
+			jobSpec := js.Spec.ReplicatedJobs[0].Template.Spec
+			podSpec := jobSpec.Template.Spec
+			if got := podSpec.NodeSelector["cloud.google.com/gke-spot"] == "true"; got != tt.spot {
+				t.Errorf("Spot node selector present %v, want %v", got, tt.spot)
+			}
+			var tolerated bool
+			for _, toleration := range podSpec.Tolerations {
+				tolerated = tolerated || (toleration.Key == "cloud.google.com/gke-spot" && toleration.Value == "true" && toleration.Effect == corev1.TaintEffectNoSchedule)
+			}
+			if tolerated != tt.spot {
+				t.Errorf("Spot toleration present %v, want %v", tolerated, tt.spot)
+			}
+			if tt.maxRunDuration == 0 {
+				if jobSpec.ActiveDeadlineSeconds != nil {
+					t.Errorf("Expected no active deadline, got %d", *jobSpec.ActiveDeadlineSeconds)
+				}
+			} else if jobSpec.ActiveDeadlineSeconds == nil || *jobSpec.ActiveDeadlineSeconds != int64(tt.maxRunDuration.Seconds()) {
+				t.Errorf("Active deadline %v, want %v", jobSpec.ActiveDeadlineSeconds, tt.maxRunDuration.Seconds())
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetMaxRunDuration(t *testing.T) {
+	for _, d := range []time.Duration{-time.Second, time.Nanosecond, 500 * time.Millisecond} {
+		if _, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, MaxRunDuration: d}); err == nil {
+			t.Errorf("Expected an error for the maximum run duration %v", d)
+		}
+	}
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, MaxRunDuration: time.Second})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	if deadline := js.Spec.ReplicatedJobs[0].Template.Spec.ActiveDeadlineSeconds; deadline == nil || *deadline != 1 {
+		t.Errorf("Expected an active deadline of 1 second, got %v", deadline)
+	}
+}
+
+func TestGenerateJobSetRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		restartPolicy corev1.RestartPolicy
+		backoffLimit  int32
+		wantPolicy    corev1.RestartPolicy
+		wantErr       bool
+	}{
+		{name: "default", wantPolicy: corev1.RestartPolicyNever},
+		{name: "never with retries", restartPolicy: corev1.RestartPolicyNever, backoffLimit: 3, wantPolicy: corev1.RestartPolicyNever},
+		{name: "on failure", restartPolicy: corev1.RestartPolicyOnFailure, backoffLimit: 5, wantPolicy: corev1.RestartPolicyOnFailure},
+		{name: "on failure without retries", restartPolicy: corev1.RestartPolicyOnFailure, wantErr: true},
+		{name: "always", restartPolicy: corev1.RestartPolicyAlways, backoffLimit: 1, wantErr: true},
+		{name: "negative backoff limit", backoffLimit: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, RestartPolicy: tt.restartPolicy, BackoffLimit: tt.backoffLimit})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateJobSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			jobSpec := js.Spec.ReplicatedJobs[0].Template.Spec
+			if jobSpec.Template.Spec.RestartPolicy != tt.wantPolicy {
+				t.Errorf("Restart policy %s, want %s", jobSpec.Template.Spec.RestartPolicy, tt.wantPolicy)
+			}
+			if jobSpec.BackoffLimit == nil || *jobSpec.BackoffLimit != tt.backoffLimit {
+				t.Errorf("Backoff limit %v, want %d", jobSpec.BackoffLimit, tt.backoffLimit)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetSidecars(t *testing.T) {
+	sidecars, err := ParseSidecars([]string{"exporter=prom/node-exporter:v1.8.0", "loader=my-loader:latest"})
+	if err != nil {
+		t.Fatalf("ParseSidecars failed: %v", err)
+	}
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, Sidecars: sidecars})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	tmpl := js.Spec.ReplicatedJobs[0].Template.Spec.Template
+	var names []string
+	for _, c := range tmpl.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	if want := []string{"workload", "exporter", "loader"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Containers %v, want %v", names, want)
+	}
+	if _, ok := tmpl.Spec.Containers[0].Resources.Limits["nvidia.com/gpu"]; !ok {
+		t.Errorf("Expected the accelerators on the workload container, got %v", tmpl.Spec.Containers[0].Resources)
+	}
+	for _, c := range tmpl.Spec.Containers[1:] {
+		if len(c.Resources.Limits) != 0 || len(c.Resources.Requests) != 0 {
+			t.Errorf("Expected no resources on sidecar %s, got %v", c.Name, c.Resources)
+		}
+	}
+	if got := tmpl.Spec.Containers[2].Image; got != "my-loader:latest" {
+		t.Errorf("Sidecar image %s, want my-loader:latest", got)
+	}
+	if got := tmpl.Annotations["kubectl.kubernetes.io/default-container"]; got != "workload" {
+		t.Errorf("Default container %q, want workload", got)
+	}
+}
+
+func TestParseSidecars(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		wantErr bool
+	}{
+		{name: "valid", specs: []string{"exporter=prom/node-exporter:v1.8.0"}},
+		{name: "missing image", specs: []string{"exporter"}, wantErr: true},
+		{name: "invalid name", specs: []string{"My_Exporter=image"}, wantErr: true},
+		{name: "workload name", specs: []string{"workload=image"}, wantErr: true},
+		{name: "duplicate name", specs: []string{"a=image", "a=other"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSidecars(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSidecars(%q) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetCPUMemory(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, CPU: resource.MustParse("8"), Memory: resource.MustParse("32Gi")})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	resources := js.Spec.ReplicatedJobs[0].Template.Spec.Template.Spec.Containers[0].Resources
+	for kind, list := range map[string]corev1.ResourceList{"requests": resources.Requests, "limits": resources.Limits} {
+		if got := list[corev1.ResourceCPU]; got.Cmp(resource.MustParse("8")) != 0 {
+			t.Errorf("CPU %s %s, want 8", kind, got.String())
+		}
+		if got := list[corev1.ResourceMemory]; got.Cmp(resource.MustParse("32Gi")) != 0 {
+			t.Errorf("Memory %s %s, want 32Gi", kind, got.String())
+		}
+		if got := list["nvidia.com/gpu"]; got.Cmp(resource.MustParse("1")) != 0 {
+			t.Errorf("GPU %s %s, want 1", kind, got.String())
+		}
+	}
+
+	// unset by default
+	js, err = GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	resources = js.Spec.ReplicatedJobs[0].Template.Spec.Template.Spec.Containers[0].Resources
+	if _, ok := resources.Requests[corev1.ResourceCPU]; ok {
+		t.Errorf("Expected no cpu request, got %v", resources.Requests)
+	}
+	if _, ok := resources.Requests[corev1.ResourceMemory]; ok {
+		t.Errorf("Expected no memory request, got %v", resources.Requests)
+	}
+}
+
+func TestGenerateJobSetInvalidTopology(t *testing.T) {
+	_, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "tpu-v5p-8x8x10", Image: "python:3.12", NumSlices: 1})
+	want := "invalid topology 8x8x10 for tpu-v5p: the dimensions larger than 4 must be multiples of 4, the nearest valid topology is 8x8x8"
+	if err == nil || err.Error() != want {
+		t.Errorf("GenerateJobSet() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,69 @@
+package jobset
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aojea/krun/pkg/exec"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+)
+
+var (
+	follow        bool
+	since         time.Duration
+	logsContainer string
+)
+
+var LogsSubcmd = &cobra.Command{
+	Use:   "logs [flags]",
+	Short: "Print the logs of the pods of a jobset",
+	Example: `  # Print the logs of all the workers of a JobSet
+  krun jobset logs --name=stoelinga
+
+  # Follow the logs of the last 10 minutes
+  krun jobset logs --name=stoelinga --follow --since=10m`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if name == "" {
+			return fmt.Errorf("you must provide a --name to select the JobSet")
+		}
+		if since < 0 {
+			return fmt.Errorf("--since must be positive")
+		}
+		client, _, err := newClients(kubeconfig, kubeContext)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+		pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: jobsetapi.JobSetNameKey + "=" + name,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get pods: %w", err)
+		}
+		if len(pods.Items) == 0 {
+			klog.Infof("No pods found for JobSet %q", name)
+			return nil
+		}
+		sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+		if err := exec.CheckContainer(pods.Items, logsContainer); err != nil {
+			return err
+		}
+		return exec.StreamLogs(ctx, client, pods.Items, exec.LogOptions{
+			Container: logsContainer,
+			Follow:    follow,
+			Since:     since,
+		})
+	},
+}
+
+func init() {
+	JobSetCmd.AddCommand(LogsSubcmd)
+	LogsSubcmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep streaming the logs")
+	LogsSubcmd.Flags().DurationVar(&since, "since", 0, "Only print the logs newer than a relative duration (e.g. 10m), all the logs if 0")
+	LogsSubcmd.Flags().StringVarP(&logsContainer, "container", "c", "", "Container of the pods to get the logs from, the default container if empty")
+}
@@ -0,0 +1,179 @@
+package jobset
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aojea/krun/pkg/clientset"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+	jobsetclient "sigs.k8s.io/jobset/client-go/clientset/versioned"
+)
+
+// statusPollInterval is the period to refresh the status with --watch
+const statusPollInterval = 5 * time.Second
+
+var watch bool
+
+var StatusSubcmd = &cobra.Command{
+	Use:   "status [flags]",
+	Short: "Show the status of a jobset",
+	Example: `  # Show the status of a JobSet
+  krun jobset status --name=stoelinga
+
+  # Refresh the status until the JobSet completes or fails
+  krun jobset status --name=stoelinga --watch`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if name == "" {
+			return fmt.Errorf("you must provide a --name to select the JobSet")
+		}
+		client, jsClient, err := newClients(kubeconfig, kubeContext)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+		for {
+			terminal, err := printStatus(ctx, os.Stdout, client, jsClient, namespace, name)
+			if err != nil {
+				return err
+			}
+			if !watch || terminal {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(statusPollInterval):
+			}
+		}
+	},
+}
+
+// newClients returns the Kubernetes and JobSet clientsets for the kubeconfig and context
+func newClients(kubeconfig, kubeContext string) (kubernetes.Interface, jobsetclient.Interface, error) {
+	config, client, err := clientset.GetClient(kubeconfig, kubeContext, clientOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	jsClient, err := jobsetclient.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not create jobset client: %v", err)
+	}
+	return client, jsClient, nil
+}
+
+// clientOptions returns the client options of the flags
+func clientOptions() clientset.Options {
+	return clientset.Options{QPS: qps, Burst: burst, As: asUser, AsGroups: asGroups}
+}
+
+// printStatus writes the status of the JobSet and its pods, it returns true
+// if the JobSet reached a terminal state.
+func printStatus(ctx context.Context, w io.Writer, client kubernetes.Interface, jsClient jobsetclient.Interface, namespace, name string) (bool, error) {
+	js, err := jsClient.JobsetV1alpha2().JobSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get jobset: %w", err)
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: jobsetapi.JobSetNameKey + "=" + name,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get pods: %w", err)
+	}
+	if err := formatStatus(w, js, pods.Items); err != nil {
+		return false, err
+	}
+	return js.Status.TerminalState != "", nil
+}
+
+// jobSetDeviceType returns the device type the JobSet was launched with, empty
+// if it was not created by krun.
+func jobSetDeviceType(js *jobsetapi.JobSet) string {
+	for _, rj := range js.Spec.ReplicatedJobs {
+		for _, c := range rj.Template.Spec.Template.Spec.Containers {
+			for _, env := range c.Env {
+				if env.Name == "DEVICE_TYPE" {
+					return env.Value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// podCounts counts the pods of the JobSet by their state
+type podCounts struct {
+	ready, active, succeeded, failed int
+}
+
+func countPods(pods []corev1.Pod) podCounts {
+	var c podCounts
+	for _, pod := range pods {
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			c.succeeded++
+		case corev1.PodFailed:
+			c.failed++
+		case corev1.PodPending, corev1.PodRunning:
+			c.active++
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+					c.ready++
+				}
+			}
+		}
+	}
+	return c
+}
+
+// formatStatus writes the summary of the JobSet and its pods
+func formatStatus(w io.Writer, js *jobsetapi.JobSet, pods []corev1.Pod) error {
+	state := js.Status.TerminalState
+	if state == "" {
+		state = "Running"
+	}
+	_, _ = fmt.Fprintf(w, "JobSet:      %s/%s\n", js.Namespace, js.Name)
+	_, _ = fmt.Fprintf(w, "State:       %s\n", state)
+	if deviceType := jobSetDeviceType(js); deviceType != "" {
+		topology := "unknown"
+		if sysChar, err := GetSystemCharacteristics(deviceType); err == nil {
+			topology = sysChar.Topology
+		} else {
+			klog.V(2).Infof("Unknown device type %q: %v", deviceType, err)
+		}
+		_, _ = fmt.Fprintf(w, "Device type: %s (topology %s)\n", deviceType, topology)
+	}
+
+	statuses := map[string]jobsetapi.ReplicatedJobStatus{}
+	for _, s := range js.Status.ReplicatedJobsStatus {
+		statuses[s.Name] = s
+	}
+	_, _ = fmt.Fprintln(w, "\nReplicated jobs:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tREADY\tACTIVE\tSUCCEEDED\tFAILED")
+	for _, rj := range js.Spec.ReplicatedJobs {
+		s := statuses[rj.Name]
+		_, _ = fmt.Fprintf(tw, "%s\t%d/%d\t%d\t%d\t%d\n", rj.Name, s.Ready, rj.Replicas, s.Active, s.Succeeded, s.Failed)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	c := countPods(pods)
+	_, _ = fmt.Fprintf(w, "\nPods: %d ready, %d active, %d succeeded, %d failed\n", c.ready, c.active, c.succeeded, c.failed)
+	return nil
+}
+
+func init() {
+	JobSetCmd.AddCommand(StatusSubcmd)
+	StatusSubcmd.Flags().BoolVar(&watch, "watch", false, "Refresh the status until the JobSet completes or fails")
+}
@@ -0,0 +1,99 @@
+package jobset
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+	jobsetfake "sigs.k8s.io/jobset/client-go/clientset/versioned/fake"
+)
+
+func newPod(name string, phase corev1.PodPhase, ready bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{jobsetapi.JobSetNameKey: "stoelinga"},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+	if ready {
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	}
+	return pod
+}
+
+func TestFormatStatus(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "tpu-7x-16", Image: "python:3.12", NumSlices: 2})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	js.Status.ReplicatedJobsStatus = []jobsetapi.ReplicatedJobStatus{
+		{Name: "j", Ready: 1, Active: 2, Succeeded: 0, Failed: 0},
+	}
+	pods := []corev1.Pod{
+		*newPod("stoelinga-j-0-0", corev1.PodRunning, true),
+		*newPod("stoelinga-j-0-1", corev1.PodRunning, true),
+		*newPod("stoelinga-j-1-0", corev1.PodPending, false),
+		*newPod("stoelinga-j-1-1", corev1.PodFailed, false),
+	}
+
+	var out strings.Builder
+	if err := formatStatus(&out, js, pods); err != nil {
+		t.Fatalf("formatStatus failed: %v", err)
+	}
+	want := `JobSet:      default/stoelinga
+State:       Running
+Device type: tpu-7x-16 (topology 2x2x2)
+
+Replicated jobs:
+NAME  READY  ACTIVE  SUCCEEDED  FAILED
+j     1/2    2       0          0
+
+Pods: 2 ready, 3 active, 0 succeeded, 1 failed
+`
+	if out.String() != want {
+		t.Errorf("formatStatus() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestPrintStatusTerminal(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	tests := []struct {
+		name          string
+		terminalState string
+		want          bool
+	}{
+		{name: "running", want: false},
+		{name: "completed", terminalState: string(jobsetapi.JobSetCompleted), want: true},
+		{name: "failed", terminalState: string(jobsetapi.JobSetFailed), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := js.DeepCopy()
+			obj.Status.TerminalState = tt.terminalState
+			client := fake.NewClientset(newPod("stoelinga-j-0-0", corev1.PodSucceeded, false))
+			jsClient := jobsetfake.NewClientset(obj)
+
+			var out strings.Builder
+			got, err := printStatus(context.Background(), &out, client, jsClient, "default", "stoelinga")
+			if err != nil {
+				t.Fatalf("printStatus failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("printStatus() terminal = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(out.String(), "1 succeeded") {
+				t.Errorf("Expected the pod counts in the status:\n%s", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package jobset
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// gcsFuseDriver is the CSI driver mounting Cloud Storage buckets on GKE
+	gcsFuseDriver = "gcsfuse.csi.storage.gke.io"
+	// gcsFuseAnnotation injects the gcsfuse sidecar in the pods
+	gcsFuseAnnotation = "gke-gcsfuse/volumes"
+	// shmVolume replaces the default 64MB /dev/shm of the containers
+	shmVolume = "dshm"
+)
+
+// VolumeSpec mounts a volume source (a PVC name or a GCS bucket) in the workers
+type VolumeSpec struct {
+	Source    string
+	MountPath string
+}
+
+// ParseVolumes parses the SOURCE:MOUNTPATH volume arguments of the flag
+func ParseVolumes(flag string, specs []string) ([]VolumeSpec, error) {
+	var volumes []VolumeSpec
+	for _, s := range specs {
+		source, mountPath, ok := strings.Cut(s, ":")
+		if !ok || source == "" || mountPath == "" {
+			return nil, fmt.Errorf("invalid --%s %q, must be SOURCE:MOUNTPATH", flag, s)
+		}
+		if !path.IsAbs(mountPath) {
+			return nil, fmt.Errorf("invalid --%s %q, the mount path must be absolute", flag, s)
+		}
+		volumes = append(volumes, VolumeSpec{Source: source, MountPath: path.Clean(mountPath)})
+	}
+	return volumes, nil
+}
+
+// addVolumes adds the PVC and GCS volumes to the pods, mounted in the first container
+func addVolumes(tmpl *corev1.PodTemplateSpec, pvcs, buckets []VolumeSpec) {
+	container := &tmpl.Spec.Containers[0]
+	for i, v := range pvcs {
+		name := fmt.Sprintf("pvc-%d", i)
+		tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: v.Source},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: v.MountPath})
+	}
+	for i, v := range buckets {
+		name := fmt.Sprintf("gcs-%d", i)
+		tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{
+					Driver:           gcsFuseDriver,
+					VolumeAttributes: map[string]string{"bucketName": v.Source},
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: v.MountPath})
+	}
+	if len(buckets) > 0 {
+		if tmpl.Annotations == nil {
+			tmpl.Annotations = map[string]string{}
+		}
+		tmpl.Annotations[gcsFuseAnnotation] = "true"
+	}
+}
+
+// addSharedMemory mounts a memory backed /dev/shm of the given size in the first container
+func addSharedMemory(tmpl *corev1.PodTemplateSpec, size resource.Quantity) {
+	tmpl.Spec.Volumes = append(tmpl.Spec.Volumes, corev1.Volume{
+		Name: shmVolume,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium:    corev1.StorageMediumMemory,
+				SizeLimit: &size,
+			},
+		},
+	})
+	container := &tmpl.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: shmVolume, MountPath: "/dev/shm"})
+}
@@ -0,0 +1,118 @@
+package jobset
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseVolumes(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []VolumeSpec
+		wantErr bool
+	}{
+		{name: "empty", specs: nil, want: nil},
+		{name: "volumes", specs: []string{"datasets:/data", "ckpt:/mnt/ckpt/"}, want: []VolumeSpec{{Source: "datasets", MountPath: "/data"}, {Source: "ckpt", MountPath: "/mnt/ckpt"}}},
+		{name: "missing mount path", specs: []string{"datasets"}, wantErr: true},
+		{name: "missing source", specs: []string{":/data"}, wantErr: true},
+		{name: "relative mount path", specs: []string{"datasets:data"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVolumes("pvc", tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVolumes(%q) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVolumes(%q) = %v, want %v", tt.specs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetVolumes(t *testing.T) {
+	tests := []struct {
+		name            string
+		pvcs            []VolumeSpec
+		buckets         []VolumeSpec
+		wantVolumes     []corev1.Volume
+		wantMounts      []corev1.VolumeMount
+		wantAnnotations map[string]string
+	}{
+		{
+			name: "no volumes",
+		},
+		{
+			name:    "pvc and gcs",
+			pvcs:    []VolumeSpec{{Source: "datasets", MountPath: "/data"}},
+			buckets: []VolumeSpec{{Source: "my-bucket", MountPath: "/ckpt"}, {Source: "other", MountPath: "/other"}},
+			wantVolumes: []corev1.Volume{
+				{Name: "pvc-0", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "datasets"}}},
+				{Name: "gcs-0", VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{Driver: "gcsfuse.csi.storage.gke.io", VolumeAttributes: map[string]string{"bucketName": "my-bucket"}}}},
+				{Name: "gcs-1", VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{Driver: "gcsfuse.csi.storage.gke.io", VolumeAttributes: map[string]string{"bucketName": "other"}}}},
+			},
+			wantMounts: []corev1.VolumeMount{
+				{Name: "pvc-0", MountPath: "/data"},
+				{Name: "gcs-0", MountPath: "/ckpt"},
+				{Name: "gcs-1", MountPath: "/other"},
+			},
+			wantAnnotations: map[string]string{"gke-gcsfuse/volumes": "true"},
+		},
+		{
+			name: "pvc only",
+			pvcs: []VolumeSpec{{Source: "datasets", MountPath: "/data"}},
+			wantVolumes: []corev1.Volume{
+				{Name: "pvc-0", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "datasets"}}},
+			},
+			wantMounts: []corev1.VolumeMount{{Name: "pvc-0", MountPath: "/data"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "tpu-7x-16", Image: "python:3.12", NumSlices: 1, PVCs: tt.pvcs, GCSBuckets: tt.buckets})
+			if err != nil {
+				t.Fatalf("GenerateJobSet failed: %v", err)
+			}
+			tmpl := js.Spec.ReplicatedJobs[0].Template.Spec.Template
+			if !reflect.DeepEqual(tmpl.Spec.Volumes, tt.wantVolumes) {
+				t.Errorf("Volumes %v, want %v", tmpl.Spec.Volumes, tt.wantVolumes)
+			}
+			if got := tmpl.Spec.Containers[0].VolumeMounts; !reflect.DeepEqual(got, tt.wantMounts) {
+				t.Errorf("Volume mounts %v, want %v", got, tt.wantMounts)
+			}
+			if !reflect.DeepEqual(tmpl.Annotations, tt.wantAnnotations) {
+				t.Errorf("Annotations %v, want %v", tmpl.Annotations, tt.wantAnnotations)
+			}
+		})
+	}
+}
+
+func TestGenerateJobSetSharedMemory(t *testing.T) {
+	js, err := GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1, ShmSize: resource.MustParse("16Gi")})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	tmpl := js.Spec.ReplicatedJobs[0].Template.Spec.Template
+	size := resource.MustParse("16Gi")
+	wantVolumes := []corev1.Volume{{Name: "dshm", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory, SizeLimit: &size}}}}
+	if !reflect.DeepEqual(tmpl.Spec.Volumes, wantVolumes) {
+		t.Errorf("Volumes %v, want %v", tmpl.Spec.Volumes, wantVolumes)
+	}
+	wantMounts := []corev1.VolumeMount{{Name: "dshm", MountPath: "/dev/shm"}}
+	if got := tmpl.Spec.Containers[0].VolumeMounts; !reflect.DeepEqual(got, wantMounts) {
+		t.Errorf("Volume mounts %v, want %v", got, wantMounts)
+	}
+
+	// not mounted by default
+	js, err = GenerateJobSet(LaunchOptions{Name: "stoelinga", Namespace: "default", DeviceType: "gpu-l4-1", Image: "python:3.12", NumSlices: 1})
+	if err != nil {
+		t.Fatalf("GenerateJobSet failed: %v", err)
+	}
+	if volumes := js.Spec.ReplicatedJobs[0].Template.Spec.Template.Spec.Volumes; len(volumes) != 0 {
+		t.Errorf("Expected no volumes, got %v", volumes)
+	}
+}
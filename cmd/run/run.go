@@ -2,30 +2,76 @@ package run
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aojea/krun/internal/assets"
 	"github.com/aojea/krun/pkg/cdc"
 	"github.com/aojea/krun/pkg/clientset"
 	"github.com/aojea/krun/pkg/exec"
+	"github.com/aojea/krun/pkg/files"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 )
 
 // Global variables for flags
 var (
-	kubeconfig     string
-	namespace      string
-	labelSelector  string
-	uploadSrc      string
-	uploadDest     string
-	timeout        time.Duration
-	excludePattern string
-	useShell       bool
+	kubeconfig      string
+	kubeContext     string
+	qps             float32
+	burst           int
+	asUser          string
+	asGroups        []string
+	namespace       string
+	labelSelector   string
+	uploadSrc       string
+	uploadDest      string
+	timeout         time.Duration
+	perPodTimeout   time.Duration
+	output          string
+	fieldSelector   string
+	limit           int
+	failFast        bool
+	excludePatterns []string
+	includePatterns []string
+	chmodExec       []string
+	useIgnoreFiles  bool
+	followSymlinks  bool
+	useShell        bool
+	commandFile     string
+	tty             bool
+	maxConcurrency  int
+	container       string
+	hashAlgorithm   string
+	mirror          bool
+	mirrorDryRun    bool
+	mirrorExclude   []string
+	compress        bool
+	delta           bool
+	chunkAvgSize    string
+	maxFileSize     string
+	cacheDir        string
+	leader          string
+	hubFanout       int
+	agentURL        string
+	agentPath       string
+	force           bool
+	collect         []string
+	serve           string
 )
 
 var RunCmd = &cobra.Command{
@@ -49,14 +95,48 @@ var RunCmd = &cobra.Command{
 			cmdArgs = exec.WrapCommandInShell(cmdArgs)
 		}
 		opts := Options{
-			Kubeconfig:     kubeconfig,
-			Namespace:      namespace,
-			LabelSelector:  labelSelector,
-			UploadSrc:      uploadSrc,
-			UploadDest:     uploadDest,
-			ExcludePattern: excludePattern,
-			Timeout:        timeout,
-			CmdArgs:        cmdArgs,
+			Kubeconfig:      kubeconfig,
+			KubeContext:     kubeContext,
+			QPS:             qps,
+			Burst:           burst,
+			As:              asUser,
+			AsGroups:        asGroups,
+			Namespace:       namespace,
+			LabelSelector:   labelSelector,
+			FieldSelector:   fieldSelector,
+			Limit:           limit,
+			FailFast:        failFast,
+			UploadSrc:       uploadSrc,
+			UploadDest:      uploadDest,
+			ExcludePatterns: excludePatterns,
+			IncludePatterns: includePatterns,
+			ChmodExec:       chmodExec,
+			UseIgnoreFiles:  useIgnoreFiles,
+			FollowSymlinks:  followSymlinks,
+			HashAlgorithm:   hashAlgorithm,
+			Mirror:          mirror,
+			MirrorDryRun:    mirrorDryRun,
+			MirrorExclude:   mirrorExclude,
+			Compress:        compress,
+			Delta:           delta,
+			ChunkAvgSize:    chunkAvgSize,
+			MaxFileSize:     maxFileSize,
+			CacheDir:        cacheDir,
+			Leader:          leader,
+			HubFanout:       hubFanout,
+			AgentURL:        agentURL,
+			AgentPath:       agentPath,
+			Force:           force,
+			Collect:         collect,
+			Serve:           serve,
+			TTY:             tty,
+			MaxConcurrency:  maxConcurrency,
+			Container:       container,
+			Timeout:         timeout,
+			PerPodTimeout:   perPodTimeout,
+			Output:          output,
+			CmdArgs:         cmdArgs,
+			CommandFile:     commandFile,
 		}
 		// Pass the root context from cobra command
 		return Run(cmd.Context(), opts)
@@ -64,36 +144,184 @@ var RunCmd = &cobra.Command{
 }
 
 type Options struct {
-	Kubeconfig     string
-	Namespace      string
-	LabelSelector  string
-	UploadSrc      string
-	UploadDest     string
-	ExcludePattern string
-	Timeout        time.Duration
-	CmdArgs        []string
+	Kubeconfig    string
+	KubeContext   string
+	QPS           float32
+	Burst         int
+	As            string
+	AsGroups      []string
+	Namespace     string
+	LabelSelector string
+	// FieldSelector filters the pods matching the label selector, optional
+	FieldSelector string
+	// Limit only acts on the first pods sorted by name, 0 is all
+	Limit      int
+	UploadSrc  string
+	UploadDest string
+	// ExcludePatterns skip the uploaded files matching any of them
+	ExcludePatterns []string
+	// IncludePatterns only upload the files matching any of them, if set
+	IncludePatterns []string
+	// ChmodExec makes executable the uploaded files matching any of them
+	ChmodExec []string
+	// UseIgnoreFiles skips the files matching the ignore files in the upload source
+	UseIgnoreFiles bool
+	// FollowSymlinks uploads the content the symlinks point to
+	FollowSymlinks bool
+	HashAlgorithm  string
+	// Mirror deletes the extraneous files in the upload destination
+	Mirror       bool
+	MirrorDryRun bool
+	// MirrorExclude protects from mirroring the destination paths matching any of them
+	MirrorExclude []string
+	Compress      bool
+	// Delta keeps the uploaded chunks on the pods and sends the modified ones as deltas
+	Delta bool
+	// ChunkAvgSize is the average size of the uploaded chunks (e.g. 1Mi), empty uses the default
+	ChunkAvgSize string
+	// MaxFileSize skips the uploaded files larger than this size (e.g. 1Gi), unlimited if empty
+	MaxFileSize string
+	// CacheDir keeps the chunks of the upload source between runs, disabled if empty
+	CacheDir string
+	// Leader is the pod receiving the upload and serving it to the others, selected if empty
+	Leader string
+	// HubFanout is the maximum number of pods downloading from the same pod at once, 0 is unlimited
+	HubFanout int
+	// AgentURL downloads the agent for the architectures without an embedded one, disabled if empty
+	AgentURL string
+	// AgentPath is the absolute path the agent is uploaded to, cdc.AgentFile if empty
+	AgentPath string
+	Force     bool
+	// Collect lists SRC:DEST remote paths downloaded from every pod after the command
+	Collect []string
+	// Serve is the address to stream the command output as server-sent events, disabled if empty
+	Serve string
+	// TTY runs the command interactively on a single pod attached to the terminal
+	TTY bool
+	// MaxConcurrency bounds the pods executing the command or receiving the
+	// agent at the same time, 0 is unlimited
+	MaxConcurrency int
+	// Container of the pods to run the command, the default container of the pods if empty
+	Container string
+	Timeout   time.Duration
+	// PerPodTimeout cancels the command of each pod independently, 0 is no timeout
+	PerPodTimeout time.Duration
+	// FailFast cancels the command on all the pods when it fails on one of them
+	FailFast bool
+	// Output is the format of the command output, text if empty
+	Output  string
+	CmdArgs []string
+	// CommandFile is a local script streamed to `sh -s` on each pod instead of CmdArgs
+	CommandFile string
 }
 
 func Run(ctx context.Context, opts Options) error {
 	// Validate inputs
-	if len(opts.CmdArgs) == 0 && opts.UploadSrc == "" {
-		return fmt.Errorf("you must provide either a command (as arguments) or --upload-src (or both)")
+	if len(opts.CmdArgs) == 0 && opts.CommandFile == "" && opts.UploadSrc == "" && len(opts.Collect) == 0 {
+		return fmt.Errorf("you must provide either a command (as arguments), --command-file, --upload-src or --collect")
+	}
+	if opts.CommandFile != "" && len(opts.CmdArgs) > 0 {
+		return fmt.Errorf("--command-file can not be used with a command")
+	}
+	if opts.CommandFile != "" && opts.TTY {
+		return fmt.Errorf("--command-file can not be used with --tty")
 	}
 	if opts.UploadSrc != "" && opts.UploadDest == "" {
 		return fmt.Errorf("if --upload-src is provided, --upload-dest is required")
 	}
+	if opts.PerPodTimeout < 0 {
+		return fmt.Errorf("--per-pod-timeout must be 0 (no timeout) or positive")
+	}
+	if opts.Limit < 0 {
+		return fmt.Errorf("--limit must be 0 (all) or positive")
+	}
+	if opts.MaxConcurrency < 0 {
+		return fmt.Errorf("--max-concurrency must be 0 (unlimited) or positive")
+	}
+	format, err := exec.ParseOutputFormat(opts.Output)
+	if err != nil {
+		return err
+	}
+	if opts.TTY && format != exec.OutputText {
+		return fmt.Errorf("--tty only supports the text output")
+	}
+	if opts.TTY && len(opts.CmdArgs) == 0 {
+		return fmt.Errorf("--tty requires a command")
+	}
+	if opts.TTY && opts.Serve != "" {
+		return fmt.Errorf("--tty and --serve can not be used together")
+	}
+
+	// The script is run by the shell of the pods reading it from stdin
+	var script []byte
+	if opts.CommandFile != "" {
+		script, err = os.ReadFile(opts.CommandFile)
+		if err != nil {
+			return fmt.Errorf("invalid --command-file: %w", err)
+		}
+		opts.CmdArgs = []string{"sh", "-s"}
+	}
+
+	var collects []collectSpec
+	for _, c := range opts.Collect {
+		spec, err := parseCollect(c)
+		if err != nil {
+			return err
+		}
+		collects = append(collects, spec)
+	}
 
 	if opts.LabelSelector == "" {
 		return fmt.Errorf("you must provide a --label-selector to select target pods")
 	}
+	if _, err := fields.ParseSelector(opts.FieldSelector); err != nil {
+		return fmt.Errorf("invalid --field-selector: %w", err)
+	}
 
-	// Compile exclude regex if provided
-	var excludeRegex *regexp.Regexp
-	if opts.ExcludePattern != "" {
-		var err error
-		excludeRegex, err = regexp.Compile(opts.ExcludePattern)
+	// Compile exclude regexes if provided
+	exclude, err := files.CompilePatterns(opts.ExcludePatterns)
+	if err != nil {
+		return fmt.Errorf("invalid --exclude: %w", err)
+	}
+	include, err := files.CompilePatterns(opts.IncludePatterns)
+	if err != nil {
+		return fmt.Errorf("invalid --include: %w", err)
+	}
+	executables, err := files.CompilePatterns(opts.ChmodExec)
+	if err != nil {
+		return fmt.Errorf("invalid --chmod-exec: %w", err)
+	}
+	mirrorExclude, err := files.CompilePatterns(opts.MirrorExclude)
+	if err != nil {
+		return fmt.Errorf("invalid --mirror-exclude: %w", err)
+	}
+	agentPath := opts.AgentPath
+	if agentPath == "" {
+		agentPath = cdc.AgentFile
+	}
+	if err := cdc.ValidateAgentPath(agentPath); err != nil {
+		return fmt.Errorf("invalid --agent-path: %w", err)
+	}
+	var maxFileSize int64
+	if opts.MaxFileSize != "" {
+		q, err := resource.ParseQuantity(opts.MaxFileSize)
+		if err != nil {
+			return fmt.Errorf("invalid --max-file-size: %w", err)
+		}
+		if q.Sign() <= 0 {
+			return fmt.Errorf("invalid --max-file-size: must be positive")
+		}
+		maxFileSize = q.Value()
+	}
+	var chunkerConfig cdc.ChunkerConfig
+	if opts.ChunkAvgSize != "" {
+		q, err := resource.ParseQuantity(opts.ChunkAvgSize)
+		if err != nil {
+			return fmt.Errorf("invalid --chunk-avg-size: %w", err)
+		}
+		chunkerConfig, err = cdc.ChunkerConfigForAverage(uint64(q.Value()))
 		if err != nil {
-			return fmt.Errorf("invalid exclude pattern: %v", err)
+			return fmt.Errorf("invalid --chunk-avg-size: %w", err)
 		}
 	}
 
@@ -109,17 +337,14 @@ func Run(ctx context.Context, opts Options) error {
 	// Defer error handling for the metrics server
 	defer runtime.HandleCrash()
 
-	config, clientset, err := clientset.GetClient(opts.Kubeconfig)
+	config, clientset, err := clientset.GetClient(opts.Kubeconfig, opts.KubeContext, clientset.Options{QPS: opts.QPS, Burst: opts.Burst, As: opts.As, AsGroups: opts.AsGroups})
 	if err != nil {
 		return err
 	}
 
-	klog.V(2).Infof("Listing pods in namespace %q with selector %q", opts.Namespace, opts.LabelSelector)
-	pods, err := clientset.CoreV1().Pods(opts.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: opts.LabelSelector,
-	})
+	pods, err := listPods(ctx, clientset, opts)
 	if err != nil {
-		return fmt.Errorf("failed to get pods: %w", err)
+		return err
 	}
 
 	if len(pods.Items) == 0 {
@@ -127,46 +352,251 @@ func Run(ctx context.Context, opts Options) error {
 		return nil
 	}
 
+	if opts.TTY && len(pods.Items) != 1 {
+		return fmt.Errorf("--tty requires exactly one pod, the selector matched %d", len(pods.Items))
+	}
+
+	if err := exec.CheckContainer(pods.Items, opts.Container); err != nil {
+		return err
+	}
+
+	// The command templates are expanded before running anything so errors fail early
+	commands, err := podCommands(opts.CmdArgs, pods.Items)
+	if err != nil {
+		return err
+	}
+
 	klog.V(2).Infof("Found %d pods. Starting execution...\n", len(pods.Items))
 
 	// 1. Upload Files (SyncPods)
 	if opts.UploadSrc != "" {
-		agentData, err := assets.GetAgentFsyncBinaryForArch()
-		if err != nil {
-			return fmt.Errorf("failed to get agent binary: %w", err)
+		// Each pod gets the agent matching its node architecture
+		agents := assets.AgentFsyncSource{URL: opts.AgentURL}
+		if dir, err := os.UserCacheDir(); err == nil {
+			agents.CacheDir = filepath.Join(dir, "krun", "agents")
 		}
-
-		err = exec.UploadExecutableOnPods(ctx, config, clientset, pods.Items, cdc.AgentFile, agentData)
+		err = cdc.UploadAgent(ctx, config, clientset, pods.Items, opts.Container, agentPath, agents.GetAgentFsyncBinary, opts.MaxConcurrency)
 		if err != nil {
-			return fmt.Errorf("failed to upload executable: %w", err)
+			return fmt.Errorf("failed to upload agent: %w", err)
 		}
 		// Cleanup agent binary
 		defer func() {
 			// Use a new context so cleanup isn't cancelled
 			cleanupCtx := context.Background()
-			_ = exec.RemovePathsFromPods(cleanupCtx, config, clientset, pods.Items, cdc.AgentFile)
+			_ = exec.RemovePathsFromPods(cleanupCtx, config, clientset, pods.Items, opts.Container, agentPath)
 		}()
 
-		err = cdc.SyncPods(ctx, config, clientset, pods.Items, opts.UploadSrc, opts.UploadDest, excludeRegex)
+		syncOpts := cdc.Options{
+			Exclude:        exclude,
+			Include:        include,
+			ChmodExec:      executables,
+			UseIgnoreFiles: opts.UseIgnoreFiles,
+			FollowSymlinks: opts.FollowSymlinks,
+			MaxFileSize:    maxFileSize,
+			Algorithm:      opts.HashAlgorithm,
+			NoMirror:       !opts.Mirror,
+			MirrorDryRun:   opts.MirrorDryRun,
+			MirrorExclude:  mirrorExclude,
+			Compress:       opts.Compress,
+			Delta:          opts.Delta,
+			Chunker:        chunkerConfig,
+			CacheDir:       opts.CacheDir,
+			Force:          opts.Force,
+			Container:      opts.Container,
+			HubFanout:      opts.HubFanout,
+			AgentPath:      agentPath,
+		}
+		if opts.Leader != "" {
+			syncOpts.LeaderSelector = cdc.SelectLeaderByName(opts.Leader)
+		}
+		err = cdc.SyncPods(ctx, config, clientset, pods.Items, opts.UploadSrc, opts.UploadDest, syncOpts)
 		if err != nil {
 			return fmt.Errorf("failed to sync pods: %w", err)
 		}
 	}
 
 	// 2. Execute Command
-	if len(opts.CmdArgs) > 0 {
-		return exec.ExecuteOnPods(ctx, config, clientset, pods.Items, opts.CmdArgs)
+	var execute func() error
+	if opts.TTY {
+		command := opts.CmdArgs
+		if commands != nil {
+			command = commands[pods.Items[0].Name]
+		}
+		if err := exec.ExecInteractive(ctx, config, clientset, pods.Items[0], opts.Container, command, os.Stdin, os.Stdout); err != nil {
+			return err
+		}
+	} else if len(opts.CmdArgs) > 0 {
+		execOpts := exec.Options{
+			MaxConcurrency: opts.MaxConcurrency,
+			Container:      opts.Container,
+			PerPodTimeout:  opts.PerPodTimeout,
+			Format:         format,
+			FailFast:       opts.FailFast,
+			Stdin:          script,
+		}
+		if commands != nil {
+			execOpts.PodCommand = func(pod corev1.Pod) []string { return commands[pod.Name] }
+		}
+		if opts.Serve != "" {
+			events := exec.NewEventServer()
+			stop, err := serveEvents(opts.Serve, events)
+			if err != nil {
+				return err
+			}
+			defer stop()
+			execOpts.Sink = events
+		}
+		execute = func() error {
+			return exec.ExecuteOnPods(ctx, config, clientset, pods.Items, opts.CmdArgs, execOpts)
+		}
+	}
+
+	// 3. Collect Artifacts
+	return executeAndCollect(ctx, config, clientset, pods.Items, opts.Container, collects, execute)
+}
+
+// executeAndCollect runs the command, if any, and collects the artifacts from
+// all the pods, also when the command failed on some of them, unless the
+// context is cancelled. The command and collection errors are joined.
+func executeAndCollect(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, container string, collects []collectSpec, execute func() error) error {
+	var cmdErr error
+	if execute != nil {
+		cmdErr = execute()
+	}
+	if err := ctx.Err(); err != nil {
+		if cmdErr != nil {
+			return cmdErr
+		}
+		return err
+	}
+
+	var errs []error
+	for _, c := range collects {
+		klog.Infof("Collecting %s from %d pods into %s", c.src, len(pods), c.dest)
+		if err := exec.DownloadFromPods(ctx, config, clientset, pods, container, c.src, c.dest); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var collectErr error
+	if len(errs) > 0 {
+		collectErr = fmt.Errorf("failed to collect artifacts: %w", errors.Join(errs...))
+	}
+	return errors.Join(cmdErr, collectErr)
+}
+
+// listPods returns the pods matching the label and field selectors sorted by
+// name, only the first opts.Limit pods if set.
+func listPods(ctx context.Context, client kubernetes.Interface, opts Options) (*corev1.PodList, error) {
+	klog.V(2).Infof("Listing pods in namespace %q with selector %q and field selector %q", opts.Namespace, opts.LabelSelector, opts.FieldSelector)
+	pods, err := client.CoreV1().Pods(opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: opts.LabelSelector,
+		FieldSelector: opts.FieldSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pods: %w", err)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	if opts.Limit > 0 && len(pods.Items) > opts.Limit {
+		klog.V(2).Infof("Limiting the execution to %d of %d pods", opts.Limit, len(pods.Items))
+		pods.Items = pods.Items[:opts.Limit]
+	}
+	return pods, nil
+}
+
+// serveEvents exposes the command output as server-sent events on addr/events
+func serveEvents(addr string, events *exec.EventServer) (func(), error) {
+	addr, err := serveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if ip, ok := listener.Addr().(*net.TCPAddr); ok && !ip.IP.IsLoopback() {
+		klog.Warningf("Streaming the command output without authentication on %s, reachable from other hosts", listener.Addr())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/events", events)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Output server failed: %v", err)
+		}
+	}()
+	klog.Infof("Streaming command output on http://%s/events", listener.Addr())
+	return func() { _ = server.Close() }, nil
+}
+
+// serveAddr returns the address to stream the output on, the loopback if the
+// host is empty since the output is not authenticated and may hold secrets
+func serveAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid --serve address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// collectSpec is a remote path to download from every pod into a local directory
+type collectSpec struct {
+	src  string
+	dest string
+}
+
+// parseCollect parses a SRC:DEST collect argument
+func parseCollect(s string) (collectSpec, error) {
+	src, dest, ok := strings.Cut(s, ":")
+	if !ok || src == "" || dest == "" {
+		return collectSpec{}, fmt.Errorf("invalid --collect %q, expected SRC:DEST", s)
 	}
-	return nil
+	return collectSpec{src: src, dest: dest}, nil
 }
 
 func init() {
 	RunCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
+	RunCmd.PersistentFlags().StringVar(&kubeContext, "context", "", "kubeconfig context to use, the current context if empty")
+	RunCmd.PersistentFlags().Float32Var(&qps, "qps", clientset.DefaultQPS, "Maximum queries per second to the API server")
+	RunCmd.PersistentFlags().IntVar(&burst, "burst", clientset.DefaultBurst, "Maximum burst of queries to the API server")
+	RunCmd.PersistentFlags().StringVar(&asUser, "as", "", "User to impersonate for the operation")
+	RunCmd.PersistentFlags().StringArrayVar(&asGroups, "as-group", nil, "Group to impersonate for the operation, can be repeated to specify multiple groups")
 	RunCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "Kubernetes namespace")
 	RunCmd.Flags().StringVarP(&labelSelector, "label-selector", "l", "", "Label selector for pods (e.g. app=my-app)")
 	RunCmd.Flags().StringVar(&uploadSrc, "upload-src", "", "Local path to folder/file to upload")
 	RunCmd.Flags().StringVar(&uploadDest, "upload-dest", "", "Remote path (e.g. /tmp/app)")
-	RunCmd.Flags().StringVar(&excludePattern, "exclude", "", "Regex pattern to exclude files when uploading")
+	RunCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "Regex pattern to exclude files when uploading, can be repeated to exclude any of them")
+	RunCmd.Flags().StringArrayVar(&chmodExec, "chmod-exec", nil, "Regex pattern of the uploaded files to make executable (e.g. \\.sh$), can be repeated")
+	RunCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "Regex pattern to only upload the matching files, can be repeated to include any of them (exclude patterns are applied after)")
+	RunCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Upload the files and directories the symlinks point to instead of the symlinks")
+	RunCmd.Flags().BoolVar(&useIgnoreFiles, "use-ignore-file", false, "Skip the files matching the .gitignore and .krunignore (gitignore syntax) in the upload source")
+	RunCmd.Flags().StringVar(&hashAlgorithm, "hash", cdc.HashSHA256, "Hash algorithm for the uploaded chunks (sha256 or blake3)")
+	RunCmd.Flags().BoolVar(&mirror, "mirror", true, "Mirror destination (delete extraneous files in destination)")
+	RunCmd.Flags().BoolVar(&mirrorDryRun, "mirror-dry-run", false, "Only log the extraneous files that would be deleted in the destination")
+	RunCmd.Flags().StringArrayVar(&mirrorExclude, "mirror-exclude", nil, "Regex pattern of the destination paths never deleted by mirroring (e.g. ^logs/), can be repeated")
+	RunCmd.Flags().BoolVar(&force, "force", false, "Allow uploading an empty source, deleting all the files in the destination")
+	RunCmd.Flags().BoolVar(&compress, "compress", false, "Compress the uploaded chunks that benefit from it, the decision is recorded per chunk")
+	RunCmd.Flags().BoolVar(&delta, "delta", false, "Keep the uploaded chunks on the pods and transfer the modified chunks of the next uploads as deltas against their previous version")
+	RunCmd.Flags().StringVar(&maxFileSize, "max-file-size", "", "Skip the uploaded files larger than this size (e.g. 1Gi), unlimited if empty")
+	RunCmd.Flags().StringVar(&chunkAvgSize, "chunk-avg-size", "", "Average size of the uploaded chunks, a power of two between 64Ki and 8Mi (e.g. 256Ki, 4Mi), defaults to 1Mi")
+	RunCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Directory to keep the chunks of the upload source between runs, only modified files are chunked again (disabled if empty)")
+	RunCmd.Flags().StringVar(&leader, "leader", "", "Name of the pod receiving the upload and serving it to the other pods, by default the first ready pod with an IP and enough free disk")
+	RunCmd.Flags().IntVar(&hubFanout, "hub-fanout", 32, "Maximum number of pods downloading the upload from the same pod at once, the synced pods serve the next ones, 0 is unlimited")
+	RunCmd.Flags().StringVar(&agentURL, "agent-url", "", "URL of the agent binary for the pod architectures without an embedded one, {arch} is replaced by the GOARCH (e.g. https://example.com/krun-agent-fsync-{arch}), the binary must match the SHA-256 sum published at the same URL with the .sha256 suffix")
+	RunCmd.Flags().StringVar(&agentPath, "agent-path", cdc.AgentFile, "Absolute path the agent is uploaded to on the pods, change it if /tmp is read-only or shared")
+	RunCmd.Flags().StringArrayVar(&collect, "collect", nil, "Remote path to download from every pod after the command, as SRC:DEST (stored in DEST/<pod>, can be repeated)")
+	RunCmd.Flags().StringVar(&serve, "serve", "", "Address to stream the command output as server-sent events on /events (e.g. localhost:8080), a port without host listens on the loopback, disabled by default")
 	RunCmd.Flags().DurationVar(&timeout, "timeout", 0, "Timeout for the execution")
+	RunCmd.Flags().DurationVar(&perPodTimeout, "per-pod-timeout", 0, "Timeout for the command on each pod, a pod exceeding it is cancelled without affecting the others")
+	RunCmd.Flags().IntVar(&maxConcurrency, "max-concurrency", 0, "Maximum number of pods executing the command or receiving the agent at the same time, 0 is unlimited")
+	RunCmd.Flags().StringVar(&fieldSelector, "field-selector", "", "Field selector for pods, combined with the label selector (e.g. status.phase=Running)")
+	RunCmd.Flags().IntVar(&limit, "limit", 0, "Only act on the first N matching pods sorted by name, 0 is all")
+	RunCmd.Flags().BoolVar(&failFast, "fail-fast", false, "Cancel the command on all the pods as soon as it fails on one of them")
+	RunCmd.Flags().StringVarP(&output, "output", "o", "text", "Format of the command output, text or json (one object per line and a summary per pod)")
+	RunCmd.Flags().StringVarP(&container, "container", "c", "", "Container of the pods to run the command and upload the files, the default container if empty")
+	RunCmd.Flags().BoolVar(&tty, "tty", false, "Run the command interactively attached to the terminal, the selector must match exactly one pod")
+	RunCmd.Flags().StringVar(&commandFile, "command-file", "", "Local script to run on each pod, it is streamed to 'sh -s' so it does not need to exist in the pods")
 	RunCmd.Flags().BoolVar(&useShell, "shell", false, "Wrap command with 'sh -c' to enable shell features like pipes, &&, ||, and cd")
 }
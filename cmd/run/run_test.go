@@ -0,0 +1,170 @@
+package run
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aojea/krun/pkg/exec"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestListPodsSelectors(t *testing.T) {
+	tests := []struct {
+		name          string
+		labelSelector string
+		fieldSelector string
+	}{
+		{name: "label selector", labelSelector: "app=backend"},
+		{name: "label and field selectors", labelSelector: "app=backend", fieldSelector: "spec.nodeName=node-1,status.phase=Running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			var got metav1.ListOptions
+			client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+				got.LabelSelector = restrictions.Labels.String()
+				got.FieldSelector = restrictions.Fields.String()
+				return false, nil, nil
+			})
+
+			opts := Options{Namespace: "default", LabelSelector: tt.labelSelector, FieldSelector: tt.fieldSelector}
+			if _, err := listPods(context.Background(), client, opts); err != nil {
+				t.Fatalf("listPods failed: %v", err)
+			}
+			if got.LabelSelector != tt.labelSelector {
+				t.Errorf("Label selector %q, want %q", got.LabelSelector, tt.labelSelector)
+			}
+			if got.FieldSelector != tt.fieldSelector {
+				t.Errorf("Field selector %q, want %q", got.FieldSelector, tt.fieldSelector)
+			}
+		})
+	}
+}
+
+func TestListPodsLimit(t *testing.T) {
+	var objects []runtime.Object
+	for _, name := range []string{"pod-c", "pod-a", "pod-d", "pod-b"} {
+		objects = append(objects, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "backend"}}})
+	}
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{name: "all", limit: 0, want: []string{"pod-a", "pod-b", "pod-c", "pod-d"}},
+		{name: "first two", limit: 2, want: []string{"pod-a", "pod-b"}},
+		{name: "more than matched", limit: 10, want: []string{"pod-a", "pod-b", "pod-c", "pod-d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(objects...)
+			opts := Options{Namespace: "default", LabelSelector: "app=backend", Limit: tt.limit}
+			pods, err := listPods(context.Background(), client, opts)
+			if err != nil {
+				t.Fatalf("listPods failed: %v", err)
+			}
+			var got []string
+			for _, p := range pods.Items {
+				got = append(got, p.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pods %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestExecuteAndCollectCommandFailure checks the artifacts are collected from
+// all the pods when the command fails on one of them.
+func TestExecuteAndCollectCommandFailure(t *testing.T) {
+	originalExecCmd := exec.ExecCmd
+	defer func() { exec.ExecCmd = originalExecCmd }()
+	exec.ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		if command[0] != "tar" {
+			if pod.Name == "pod-1" {
+				return errors.New("command failed")
+			}
+			return nil
+		}
+		tw := tar.NewWriter(options.Stdout)
+		data := []byte("results of " + pod.Name)
+		if err := tw.WriteHeader(&tar.Header{Name: "results.txt", Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+
+	var pods []corev1.Pod
+	for _, name := range []string{"pod-0", "pod-1", "pod-2"} {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "main"}}},
+		})
+	}
+	ctx := context.Background()
+	dest := t.TempDir()
+	collects := []collectSpec{{src: "/tmp/results.txt", dest: dest}}
+	execute := func() error {
+		return exec.ExecuteOnPods(ctx, nil, nil, pods, []string{"run-tests"}, exec.Options{})
+	}
+
+	err := executeAndCollect(ctx, nil, nil, pods, "", collects, execute)
+	if err == nil || !strings.Contains(err.Error(), "command failed") {
+		t.Fatalf("Expected the command error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "failed to collect artifacts") {
+		t.Errorf("Expected no collection error, got %v", err)
+	}
+	for _, pod := range pods {
+		got, err := os.ReadFile(filepath.Join(dest, pod.Name, "results.txt"))
+		if err != nil {
+			t.Errorf("Expected the artifacts of %s collected: %v", pod.Name, err)
+			continue
+		}
+		if want := "results of " + pod.Name; string(got) != want {
+			t.Errorf("Artifacts of %s %q, want %q", pod.Name, got, want)
+		}
+	}
+}
+
+func TestServeAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: ":8080", want: "localhost:8080"},
+		{addr: "localhost:8080", want: "localhost:8080"},
+		{addr: "0.0.0.0:8080", want: "0.0.0.0:8080"},
+		{addr: "[::1]:0", want: "[::1]:0"},
+		{addr: "8080", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := serveAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serveAddr(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("serveAddr(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
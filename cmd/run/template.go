@@ -0,0 +1,83 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	jobsetapi "sigs.k8s.io/jobset/api/jobset/v1alpha2"
+)
+
+// PodTemplateData are the pod fields available in the command templates,
+// e.g. `python train.py --rank {{.Index}}`
+type PodTemplateData struct {
+	Name      string
+	Namespace string
+	Node      string
+	IP        string
+	// Index is the completion index of the pod in its indexed Job
+	Index string
+	// JobIndex is the index of the Job of the pod in its JobSet replicated job
+	JobIndex string
+	Labels   map[string]string
+}
+
+func newPodTemplateData(pod corev1.Pod) PodTemplateData {
+	index, ok := pod.Labels[batchv1.JobCompletionIndexAnnotation]
+	if !ok {
+		index = pod.Annotations[batchv1.JobCompletionIndexAnnotation]
+	}
+	return PodTemplateData{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Node:      pod.Spec.NodeName,
+		IP:        pod.Status.PodIP,
+		Index:     index,
+		JobIndex:  pod.Labels[jobsetapi.JobIndexKey],
+		Labels:    pod.Labels,
+	}
+}
+
+// podCommands expands the Go templates of the command arguments for each pod,
+// it returns nil if the command has no templates.
+func podCommands(args []string, pods []corev1.Pod) (map[string][]string, error) {
+	templates := make([]*template.Template, len(args))
+	hasTemplates := false
+	for i, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			continue
+		}
+		tmpl, err := template.New("command").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command template %q: %w", arg, err)
+		}
+		templates[i] = tmpl
+		hasTemplates = true
+	}
+	if !hasTemplates {
+		return nil, nil
+	}
+
+	commands := make(map[string][]string, len(pods))
+	for _, pod := range pods {
+		data := newPodTemplateData(pod)
+		command := make([]string, len(args))
+		for i, arg := range args {
+			if templates[i] == nil {
+				command[i] = arg
+				continue
+			}
+			var buf bytes.Buffer
+			if err := templates[i].Execute(&buf, data); err != nil {
+				return nil, fmt.Errorf("failed to expand the command template %q for pod %s: %w", arg, pod.Name, err)
+			}
+			command[i] = buf.String()
+		}
+		commands[pod.Name] = command
+	}
+	return commands, nil
+}
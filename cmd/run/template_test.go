@@ -0,0 +1,78 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodCommands(t *testing.T) {
+	pods := []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "stoelinga-workers-0-0", Namespace: "ml", Labels: map[string]string{
+				"batch.kubernetes.io/job-completion-index": "0",
+				"jobset.sigs.k8s.io/job-index":             "0",
+			}},
+			Spec: corev1.PodSpec{NodeName: "node-a"},
+		},
+		{
+			// older clusters only set the annotation
+			ObjectMeta: metav1.ObjectMeta{Name: "stoelinga-workers-0-1", Namespace: "ml",
+				Labels:      map[string]string{"jobset.sigs.k8s.io/job-index": "0"},
+				Annotations: map[string]string{"batch.kubernetes.io/job-completion-index": "1"},
+			},
+			Spec: corev1.PodSpec{NodeName: "node-b"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "no templates",
+			args: []string{"python", "train.py", "--rank", "0"},
+		},
+		{
+			name: "index",
+			args: []string{"python", "train.py", "--rank", "{{.Index}}"},
+			want: map[string][]string{
+				"stoelinga-workers-0-0": {"python", "train.py", "--rank", "0"},
+				"stoelinga-workers-0-1": {"python", "train.py", "--rank", "1"},
+			},
+		},
+		{
+			name: "shell command",
+			args: []string{"sh", "-c", "echo {{.Name}} on {{.Node}} in {{.Namespace}} job {{.JobIndex}}"},
+			want: map[string][]string{
+				"stoelinga-workers-0-0": {"sh", "-c", "echo stoelinga-workers-0-0 on node-a in ml job 0"},
+				"stoelinga-workers-0-1": {"sh", "-c", "echo stoelinga-workers-0-1 on node-b in ml job 0"},
+			},
+		},
+		{
+			name:    "invalid template",
+			args:    []string{"echo", "{{.Index"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			args:    []string{"echo", "{{.Rank}}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podCommands(tt.args, pods)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podCommands() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podCommands() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,26 +1,78 @@
 package assets
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"fmt"
-	"runtime"
+	"strings"
 )
 
 //go:embed krun-agent-fsync-amd64
 var agentFsyncBinaryAmd64 []byte
 
+//go:embed krun-agent-fsync-amd64.sha256
+var agentFsyncSumAmd64 string
+
 //go:embed krun-agent-fsync-arm64
 var agentFsyncBinaryArm64 []byte
 
-func GetAgentFsyncBinaryForArch() ([]byte, error) {
-	arch := runtime.GOARCH
+//go:embed krun-agent-fsync-arm64.sha256
+var agentFsyncSumArm64 string
+
+// GetAgentFsyncBinary returns the agent binary for the given GOARCH
+func GetAgentFsyncBinary(arch string) ([]byte, error) {
+	data, _, err := GetAgentFsyncBinaryWithSum(arch)
+	return data, err
+}
+
+// GetAgentFsyncBinaryWithSum returns the agent binary for the given GOARCH and
+// its expected SHA-256 sum, the binary is verified against the sum.
+func GetAgentFsyncBinaryWithSum(arch string) ([]byte, string, error) {
+	data, sum, err := agentFsync(arch)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verify(data, sum); err != nil {
+		return nil, "", fmt.Errorf("embedded agent binary for %s is corrupted: %w", arch, err)
+	}
+	return data, sum, nil
+}
+
+// VerifyAgentFsyncBinary checks the data matches the SHA-256 sum of the
+// embedded agent binary for the given GOARCH
+func VerifyAgentFsyncBinary(arch string, data []byte) error {
+	_, sum, err := agentFsync(arch)
+	if err != nil {
+		return err
+	}
+	return verify(data, sum)
+}
 
+// agentFsync returns the embedded agent binary and sum, generated by `make agent-fsync`
+func agentFsync(arch string) ([]byte, string, error) {
+	var data []byte
+	var sumFile string
 	switch arch {
 	case "amd64":
-		return agentFsyncBinaryAmd64, nil
+		data, sumFile = agentFsyncBinaryAmd64, agentFsyncSumAmd64
 	case "arm64":
-		return agentFsyncBinaryArm64, nil
+		data, sumFile = agentFsyncBinaryArm64, agentFsyncSumArm64
 	default:
-		return nil, fmt.Errorf("unsupported architecture: %s", arch)
+		return nil, "", fmt.Errorf("unsupported architecture: %s", arch)
+	}
+	// sha256sum output: "<sum>  <file>"
+	fields := strings.Fields(sumFile)
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("missing SHA-256 sum of the agent binary for %s", arch)
+	}
+	return data, fields[0], nil
+}
+
+func verify(data []byte, want string) error {
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("SHA-256 mismatch: got %s, want %s", got, want)
 	}
+	return nil
 }
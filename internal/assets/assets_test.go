@@ -0,0 +1,36 @@
+package assets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyAgentFsyncBinary(t *testing.T) {
+	for _, arch := range []string{"amd64", "arm64"} {
+		t.Run(arch, func(t *testing.T) {
+			data, sum, err := GetAgentFsyncBinaryWithSum(arch)
+			if err != nil {
+				t.Fatalf("GetAgentFsyncBinaryWithSum failed: %v", err)
+			}
+			if len(sum) != 64 {
+				t.Errorf("Expected a hex encoded SHA-256 sum, got %q", sum)
+			}
+			if err := VerifyAgentFsyncBinary(arch, data); err != nil {
+				t.Errorf("Expected the embedded binary to verify: %v", err)
+			}
+
+			tampered := append([]byte(nil), data...)
+			tampered[len(tampered)/2] ^= 0xff
+			if err := VerifyAgentFsyncBinary(arch, tampered); err == nil || !strings.Contains(err.Error(), "mismatch") {
+				t.Errorf("Expected the tampered binary to fail verification, got %v", err)
+			}
+			if err := VerifyAgentFsyncBinary(arch, data[:len(data)-1]); err == nil {
+				t.Errorf("Expected the truncated binary to fail verification")
+			}
+		})
+	}
+
+	if err := VerifyAgentFsyncBinary("s390x", nil); err == nil {
+		t.Errorf("Expected an unsupported architecture to fail verification")
+	}
+}
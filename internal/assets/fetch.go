@@ -0,0 +1,148 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ArchPlaceholder is replaced by the GOARCH in the URL of AgentFsyncSource
+const ArchPlaceholder = "{arch}"
+
+// fetchTimeout bounds the download of an agent binary
+const fetchTimeout = 5 * time.Minute
+
+// AgentFsyncSource returns the embedded agent binaries, the architectures
+// without one are downloaded from URL and kept in CacheDir. The downloaded
+// binaries are verified against the SHA-256 sum published in URL.sha256.
+type AgentFsyncSource struct {
+	// URL of the agent binary, ArchPlaceholder is replaced by the GOARCH. Its
+	// sum is downloaded from the same URL with the .sha256 suffix. Only the
+	// embedded binaries are available if empty.
+	URL string
+	// CacheDir keeps the downloaded binaries between runs, disabled if empty
+	CacheDir string
+
+	// fetch downloads the url, fetchURL if nil
+	fetch func(url string) ([]byte, error)
+}
+
+// GetAgentFsyncBinary returns the agent binary for the given GOARCH, the
+// embedded one if it exists
+func (s AgentFsyncSource) GetAgentFsyncBinary(arch string) ([]byte, error) {
+	data, err := GetAgentFsyncBinary(arch)
+	if err == nil || s.URL == "" {
+		return data, err
+	}
+	if _, _, archErr := agentFsync(arch); archErr == nil {
+		// the embedded binary is corrupted, do not replace it silently
+		return nil, err
+	}
+
+	url := strings.ReplaceAll(s.URL, ArchPlaceholder, arch)
+	fetch := s.fetch
+	if fetch == nil {
+		fetch = fetchURL
+	}
+	// the binary is executed on the pods, it must match the sum published next to it
+	sum, err := fetchSum(fetch, url+".sha256")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the SHA-256 sum of the agent binary for %s: %w", arch, err)
+	}
+
+	cachePath := ""
+	if s.CacheDir != "" {
+		// the sum identifies the binary, a new version is downloaded again
+		cachePath = filepath.Join(s.CacheDir, fmt.Sprintf("krun-agent-fsync-%s-%s", arch, sum))
+		if data, err := os.ReadFile(cachePath); err == nil {
+			if err := verify(data, sum); err == nil {
+				klog.V(2).Infof("Using the cached agent binary %s", cachePath)
+				return data, nil
+			}
+			klog.Warningf("Ignoring the corrupted cached agent binary %s", cachePath)
+		}
+	}
+
+	klog.Infof("No embedded agent binary for %s, downloading it from %s", arch, url)
+	data, err = fetch(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the agent binary for %s: %w", arch, err)
+	}
+	if err := verify(data, sum); err != nil {
+		return nil, fmt.Errorf("agent binary for %s downloaded from %s does not match its sum: %w", arch, url, err)
+	}
+
+	// The cache is an optimization, failing to store it does not fail the upload
+	if cachePath != "" {
+		if err := writeCache(cachePath, data); err != nil {
+			klog.Warningf("Failed to cache the agent binary: %v", err)
+		}
+	}
+	return data, nil
+}
+
+// fetchSum downloads the hex encoded SHA-256 sum in the sha256sum format
+func fetchSum(fetch func(url string) ([]byte, error), url string) (string, error) {
+	data, err := fetch(url)
+	if err != nil {
+		return "", err
+	}
+	// sha256sum output: "<sum>  <file>"
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty sum in %s", url)
+	}
+	sum := strings.ToLower(fields[0])
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 sum %q in %s", fields[0], url)
+	}
+	return sum, nil
+}
+
+// fetchURL downloads the url with an HTTP GET
+func fetchURL(url string) ([]byte, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// writeCache stores the binary in path, renamed into place so a concurrent
+// reader never gets a partial binary
+func writeCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sumOf returns the sha256sum output of the data
+func sumOf(data []byte, name string) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+}
+
+// fakeFetch serves the files, the urls not found fail
+func fakeFetch(files map[string][]byte, fetched *[]string) func(url string) ([]byte, error) {
+	return func(url string) ([]byte, error) {
+		*fetched = append(*fetched, url)
+		data, ok := files[url]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return data, nil
+	}
+}
+
+func TestAgentFsyncSource(t *testing.T) {
+	embedded, err := GetAgentFsyncBinary("amd64")
+	if err != nil {
+		t.Fatalf("GetAgentFsyncBinary failed: %v", err)
+	}
+	agent := []byte("agent-s390x")
+	url := "https://example.com/krun-agent-fsync-s390x"
+
+	tests := []struct {
+		name      string
+		url       string
+		arch      string
+		files     map[string][]byte
+		want      []byte
+		wantFetch []string
+		wantErr   bool
+	}{
+		{
+			name: "embedded binary is not downloaded",
+			url:  "https://example.com/krun-agent-fsync-{arch}",
+			arch: "amd64",
+			want: embedded,
+		},
+		{
+			name:      "missing binary is downloaded",
+			url:       "https://example.com/krun-agent-fsync-{arch}",
+			arch:      "s390x",
+			files:     map[string][]byte{url: agent, url + ".sha256": sumOf(agent, "krun-agent-fsync-s390x")},
+			want:      agent,
+			wantFetch: []string{url + ".sha256", url},
+		},
+		{
+			name:    "no url",
+			arch:    "s390x",
+			wantErr: true,
+		},
+		{
+			name:      "download error",
+			url:       "https://example.com/krun-agent-fsync-{arch}",
+			arch:      "s390x",
+			files:     map[string][]byte{url + ".sha256": sumOf(agent, "krun-agent-fsync-s390x")},
+			wantFetch: []string{url + ".sha256", url},
+			wantErr:   true,
+		},
+		{
+			name:      "missing sum",
+			url:       "https://example.com/krun-agent-fsync-{arch}",
+			arch:      "s390x",
+			files:     map[string][]byte{url: agent},
+			wantFetch: []string{url + ".sha256"},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid sum",
+			url:       "https://example.com/krun-agent-fsync-{arch}",
+			arch:      "s390x",
+			files:     map[string][]byte{url: agent, url + ".sha256": []byte("not-a-sum  krun-agent-fsync-s390x")},
+			wantFetch: []string{url + ".sha256"},
+			wantErr:   true,
+		},
+		{
+			name:      "binary does not match the sum",
+			url:       "https://example.com/krun-agent-fsync-{arch}",
+			arch:      "s390x",
+			files:     map[string][]byte{url: []byte("tampered"), url + ".sha256": sumOf(agent, "krun-agent-fsync-s390x")},
+			wantFetch: []string{url + ".sha256", url},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetched []string
+			cacheDir := t.TempDir()
+			source := AgentFsyncSource{
+				URL:      tt.url,
+				CacheDir: cacheDir,
+				fetch:    fakeFetch(tt.files, &fetched),
+			}
+			got, err := source.GetAgentFsyncBinary(tt.arch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAgentFsyncBinary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Expected %d bytes, got %d", len(tt.want), len(got))
+			}
+			if strings.Join(fetched, ",") != strings.Join(tt.wantFetch, ",") {
+				t.Errorf("Expected to download %v, got %v", tt.wantFetch, fetched)
+			}
+			if cached, _ := os.ReadDir(cacheDir); tt.wantErr && len(cached) > 0 {
+				t.Errorf("Expected nothing cached after a failure, got %v", cached)
+			}
+		})
+	}
+}
+
+func TestAgentFsyncSourceCache(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "agents")
+	url := "https://example.com/latest/krun-agent-fsync-riscv64"
+	files := map[string][]byte{
+		url:             []byte("agent"),
+		url + ".sha256": sumOf([]byte("agent"), "krun-agent-fsync-riscv64"),
+	}
+	var fetched []string
+	source := AgentFsyncSource{
+		URL:      "https://example.com/latest/krun-agent-fsync-{arch}",
+		CacheDir: cacheDir,
+		fetch:    fakeFetch(files, &fetched),
+	}
+	get := func(want string) {
+		t.Helper()
+		got, err := source.GetAgentFsyncBinary("riscv64")
+		if err != nil {
+			t.Fatalf("GetAgentFsyncBinary failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected the binary %q, got %q", want, got)
+		}
+	}
+	downloads := func() int {
+		n := 0
+		for _, u := range fetched {
+			if u == url {
+				n++
+			}
+		}
+		return n
+	}
+
+	get("agent")
+	get("agent")
+	if n := downloads(); n != 1 {
+		t.Errorf("Expected the binary to be downloaded once and then read from the cache, got %d downloads", n)
+	}
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "krun-agent-fsync-riscv64-*"))
+	if err != nil || len(cached) != 1 {
+		t.Fatalf("Expected the binary in the cache, got %v: %v", cached, err)
+	}
+	if data, err := os.ReadFile(cached[0]); err != nil || string(data) != "agent" {
+		t.Errorf("Expected the downloaded binary in the cache, got %q: %v", data, err)
+	}
+
+	// a corrupted cache is downloaded again
+	if err := os.WriteFile(cached[0], []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt the cache: %v", err)
+	}
+	get("agent")
+	if n := downloads(); n != 2 {
+		t.Errorf("Expected the corrupted cache to be downloaded again, got %d downloads", n)
+	}
+
+	// a new version published in the same url is downloaded again
+	files[url] = []byte("agent-v2")
+	files[url+".sha256"] = sumOf([]byte("agent-v2"), "krun-agent-fsync-riscv64")
+	get("agent-v2")
+	if n := downloads(); n != 3 {
+		t.Errorf("Expected the new version to be downloaded, got %d downloads", n)
+	}
+}
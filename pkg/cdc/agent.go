@@ -0,0 +1,199 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
+)
+
+// AgentBinaryFunc returns the agent binary for a GOARCH
+type AgentBinaryFunc func(arch string) ([]byte, error)
+
+// UploadAgent detects the architecture of every pod and uploads the agent
+// binary matching it to agentPath, AgentFile if empty, so pods on mixed-arch
+// nodes can sync together. It fails before uploading anything if an
+// architecture has no agent binary. At most maxConcurrency pods are processed
+// at once, 0 is unlimited.
+func UploadAgent(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pods []corev1.Pod, container, agentPath string, binaryForArch AgentBinaryFunc, maxConcurrency int) error {
+	t := KubeTransport{Config: config, Client: client, Container: container}
+	return UploadAgentToTargets(ctx, t, PodTargets(pods), agentPath, binaryForArch, maxConcurrency)
+}
+
+// UploadAgentToTargets uploads the agent binary matching the architecture of every target
+func UploadAgentToTargets(ctx context.Context, t Transport, targets []Target, agentPath string, binaryForArch AgentBinaryFunc, maxConcurrency int) error {
+	if agentPath == "" {
+		agentPath = AgentFile
+	}
+	if err := ValidateAgentPath(agentPath); err != nil {
+		return err
+	}
+
+	// Group targets by architecture
+	groups := make(map[string][]Target)
+	var mu sync.Mutex
+	errs := forEach(ctx, len(targets), maxConcurrency, func(i int) error {
+		arch, err := targetArch(ctx, t, targets[i])
+		if err != nil {
+			return fmt.Errorf("failed to detect architecture of %s: %w", targets[i].Name, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		groups[arch] = append(groups[arch], targets[i])
+		return nil
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	archs := make([]string, 0, len(groups))
+	for arch := range groups {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	binaries := make(map[string][]byte, len(groups))
+	for _, arch := range archs {
+		data, err := binaryForArch(arch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("no agent binary for architecture %s (%s): %w", arch, targetNames(groups[arch]), err))
+			continue
+		}
+		binaries[arch] = data
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if len(archs) > 1 {
+		klog.Infof("Targets span multiple architectures %v, uploading an agent per architecture", archs)
+	}
+
+	type upload struct {
+		target Target
+		arch   string
+	}
+	var uploads []upload
+	for _, arch := range archs {
+		for _, target := range groups[arch] {
+			uploads = append(uploads, upload{target: target, arch: arch})
+		}
+	}
+	errs = forEach(ctx, len(uploads), maxConcurrency, func(i int) error {
+		u := uploads[i]
+		if err := uploadAgentToTarget(ctx, t, u.target, agentPath, binaries[u.arch]); err != nil {
+			return fmt.Errorf("failed to upload %s agent to %s: %w", u.arch, u.target.Name, err)
+		}
+		return nil
+	})
+	return errors.Join(errs...)
+}
+
+// forEach runs fn for the indexes up to n in parallel, at most maxConcurrency
+// at once if set, and returns the errors. The indexes not started when the
+// context is done fail with the context error.
+func forEach(ctx context.Context, n, maxConcurrency int, fn func(i int) error) []error {
+	var sem chan struct{}
+	if maxConcurrency > 0 {
+		sem = make(chan struct{}, maxConcurrency)
+	}
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("%d operations not started: %w", n-i, ctx.Err()))
+			mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := fn(i); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// targetArch returns the GOARCH of the target using `uname -m`
+func targetArch(ctx context.Context, t Transport, target Target) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	err := t.Exec(ctx, target, []string{"uname", "-m"}, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return "", fmt.Errorf("exec error: %v (stderr: %s)", err, stderr.String())
+	}
+	machine := strings.TrimSpace(stdout.String())
+	switch machine {
+	case "x86_64", "amd64":
+		return "amd64", nil
+	case "aarch64", "arm64":
+		return "arm64", nil
+	case "armv8l":
+		// a 32-bit userland on a 64-bit kernel can not run the arm64 agent
+		return "", fmt.Errorf("unsupported architecture %s: 32-bit ARM userland", machine)
+	case "":
+		return "", fmt.Errorf("empty uname output")
+	default:
+		return machine, nil
+	}
+}
+
+// uploadAgentToTarget writes the agent to agentPath and verifies its SHA-256 sum
+// on the target, the verification is skipped if the target has no sha256sum.
+func uploadAgentToTarget(ctx context.Context, t Transport, target Target, agentPath string, data []byte) error {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	quoted := shellQuote([]string{agentPath})
+	cmd := []string{"sh", "-c", fmt.Sprintf("mkdir -p %s && cat > %s && chmod +x %s && { sha256sum %s 2>/dev/null || true; }",
+		shellQuote([]string{path.Dir(agentPath)}), quoted, quoted, quoted)}
+	err := t.Exec(ctx, target, cmd, remotecommand.StreamOptions{
+		Stdin:  bytes.NewReader(data),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("stdout: %s stderr: %s: %w", stdout.String(), stderr.String(), err)
+	}
+
+	// sha256sum output: "<sum>  <file>"
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		klog.V(2).Infof("No sha256sum on %s, the uploaded agent is not verified", target.Name)
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if want := hex.EncodeToString(sum[:]); fields[0] != want {
+		return fmt.Errorf("uploaded agent is corrupted: SHA-256 %s, want %s", fields[0], want)
+	}
+	return nil
+}
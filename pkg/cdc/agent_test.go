@@ -0,0 +1,228 @@
+package cdc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestUploadAgentMixedArch(t *testing.T) {
+	binaries := map[string][]byte{
+		"amd64": []byte("agent-amd64"),
+		"arm64": []byte("agent-arm64"),
+	}
+	binaryForArch := func(arch string) ([]byte, error) {
+		data, ok := binaries[arch]
+		if !ok {
+			return nil, fmt.Errorf("unsupported architecture: %s", arch)
+		}
+		return data, nil
+	}
+
+	tests := []struct {
+		name     string
+		machines map[string]string // pod name -> uname -m
+		want     map[string]string // pod name -> uploaded binary
+		wantErr  string
+	}{
+		{
+			name:     "single arch",
+			machines: map[string]string{"pod-0": "x86_64", "pod-1": "x86_64"},
+			want:     map[string]string{"pod-0": "agent-amd64", "pod-1": "agent-amd64"},
+		},
+		{
+			name:     "mixed arch",
+			machines: map[string]string{"pod-0": "x86_64", "pod-1": "aarch64", "pod-2": "arm64"},
+			want:     map[string]string{"pod-0": "agent-amd64", "pod-1": "agent-arm64", "pod-2": "agent-arm64"},
+		},
+		{
+			name:     "unsupported arch",
+			machines: map[string]string{"pod-0": "x86_64", "pod-1": "s390x"},
+			wantErr:  "no agent binary for architecture s390x (pod-1)",
+		},
+		{
+			name:     "32-bit ARM userland",
+			machines: map[string]string{"pod-0": "aarch64", "pod-1": "armv8l"},
+			wantErr:  "unsupported architecture armv8l",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExecCmd := ExecCmd
+			defer func() { ExecCmd = originalExecCmd }()
+
+			var mu sync.Mutex
+			uploaded := map[string]string{}
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				if cmd[0] == "uname" {
+					_, _ = fmt.Fprintln(options.Stdout, tt.machines[pod.Name])
+					return nil
+				}
+				if !strings.Contains(strings.Join(cmd, " "), AgentFile) {
+					return fmt.Errorf("unexpected command %v", cmd)
+				}
+				data, err := io.ReadAll(options.Stdin)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				uploaded[pod.Name] = string(data)
+				mu.Unlock()
+				return nil
+			}
+
+			var pods []corev1.Pod
+			for name := range tt.machines {
+				pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+
+			err := UploadAgent(context.Background(), nil, nil, pods, "", "", binaryForArch, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if len(uploaded) != 0 {
+					t.Errorf("Expected no upload when an architecture is unsupported, got %v", uploaded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UploadAgent failed: %v", err)
+			}
+			if len(uploaded) != len(tt.want) {
+				t.Fatalf("Uploaded to %d pods, want %d", len(uploaded), len(tt.want))
+			}
+			for pod, want := range tt.want {
+				if uploaded[pod] != want {
+					t.Errorf("Pod %s got %q, want %q", pod, uploaded[pod], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadAgentChecksum(t *testing.T) {
+	binaryForArch := func(arch string) ([]byte, error) {
+		return []byte("agent-" + arch), nil
+	}
+	sum := sha256.Sum256([]byte("agent-amd64"))
+	goodSum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		stdout  string // output of the upload command
+		wantErr bool
+	}{
+		{name: "matching sum", stdout: goodSum + "  " + AgentFile + "\n"},
+		{name: "corrupted upload", stdout: strings.Repeat("0", 64) + "  " + AgentFile + "\n", wantErr: true},
+		{name: "no sha256sum", stdout: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalExecCmd := ExecCmd
+			defer func() { ExecCmd = originalExecCmd }()
+
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				if cmd[0] == "uname" {
+					_, _ = fmt.Fprintln(options.Stdout, "x86_64")
+					return nil
+				}
+				if !strings.Contains(strings.Join(cmd, " "), "sha256sum '"+AgentFile+"'") {
+					return fmt.Errorf("unexpected command %v", cmd)
+				}
+				if _, err := io.Copy(io.Discard, options.Stdin); err != nil {
+					return err
+				}
+				_, err := io.WriteString(options.Stdout, tt.stdout)
+				return err
+			}
+
+			pods := []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "pod-0"}}}
+			err := UploadAgent(context.Background(), nil, nil, pods, "", "", binaryForArch, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadAgentPath(t *testing.T) {
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var uploadCmd string
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		if cmd[0] == "uname" {
+			_, _ = fmt.Fprintln(options.Stdout, "x86_64")
+			return nil
+		}
+		uploadCmd = strings.Join(cmd, " ")
+		_, err := io.Copy(io.Discard, options.Stdin)
+		return err
+	}
+	binaryForArch := func(arch string) ([]byte, error) {
+		return []byte("agent"), nil
+	}
+	pods := []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "pod-0"}}}
+
+	if err := UploadAgent(context.Background(), nil, nil, pods, "", "/var/run/krun agent", binaryForArch, 0); err != nil {
+		t.Fatalf("UploadAgent failed: %v", err)
+	}
+	if !strings.Contains(uploadCmd, "cat > '/var/run/krun agent'") || strings.Contains(uploadCmd, AgentFile) {
+		t.Errorf("Expected the agent to be uploaded to the configured path, got %q", uploadCmd)
+	}
+	if err := UploadAgent(context.Background(), nil, nil, pods, "", "agent", binaryForArch, 0); err == nil {
+		t.Errorf("Expected a relative agent path to fail")
+	}
+}
+
+func TestUploadAgentMaxConcurrency(t *testing.T) {
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	const maxConcurrency = 2
+	var running, peak atomic.Int32
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if cmd[0] == "uname" {
+			_, err := fmt.Fprintln(options.Stdout, "x86_64")
+			return err
+		}
+		_, err := io.Copy(io.Discard, options.Stdin)
+		return err
+	}
+
+	var pods []corev1.Pod
+	for i := 0; i < 8; i++ {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)}})
+	}
+	binaryForArch := func(arch string) ([]byte, error) { return []byte("agent-" + arch), nil }
+	if err := UploadAgent(context.Background(), nil, nil, pods, "", "", binaryForArch, maxConcurrency); err != nil {
+		t.Fatalf("UploadAgent failed: %v", err)
+	}
+	if got := peak.Load(); got > maxConcurrency {
+		t.Errorf("Expected at most %d pods at once, got %d", maxConcurrency, got)
+	}
+}
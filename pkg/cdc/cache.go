@@ -0,0 +1,152 @@
+package cdc
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// CacheChunksDir is the folder of the cache directory storing the chunks
+const CacheChunksDir = "chunks"
+
+// manifestCache remembers the chunks of every entry of a source tarball, so
+// the entries not modified since the previous run are not chunked again.
+// Chunks only depend on the content of their entry when the cache is used,
+// the stream is split at the entry boundaries.
+type manifestCache struct {
+	// Chunker, Algorithm and Compress produced the cached chunks,
+	// the cache is invalid if any of them changes.
+	Chunker   ChunkerConfig `json:"chunker"`
+	Algorithm string        `json:"algorithm"`
+	Compress  bool          `json:"compress"`
+	// Entries by their name in the tarball
+	Entries map[string]cacheEntry `json:"entries"`
+}
+
+type cacheEntry struct {
+	// Fingerprint identifies the version of the entry
+	Fingerprint string      `json:"fingerprint"`
+	Chunks      []ChunkInfo `json:"chunks"`
+}
+
+// entryFingerprint identifies an entry by its metadata, the content is assumed
+// unchanged if the size and modification time are the same.
+func entryFingerprint(hdr *tar.Header) string {
+	return fmt.Sprintf("%c:%d:%d:%o:%d:%d:%s", hdr.Typeflag, hdr.Size, hdr.ModTime.UnixNano(), hdr.Mode, hdr.Uid, hdr.Gid, hdr.Linkname)
+}
+
+// cachePath returns the cache file of the source inside cacheDir
+func cachePath(cacheDir, src string) (string, error) {
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(cacheDir, "manifest-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadCache returns the cache of the source, an empty cache is returned if it
+// does not exist or was generated with different parameters.
+func loadCache(path string, cfg ChunkerConfig, opts Options) *manifestCache {
+	empty := &manifestCache{
+		Chunker:   cfg,
+		Algorithm: normalizeAlgorithm(opts.Algorithm),
+		Compress:  opts.Compress,
+		Entries:   map[string]cacheEntry{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to read manifest cache %s: %v", path, err)
+		}
+		return empty
+	}
+	var c manifestCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		klog.Warningf("Ignoring corrupted manifest cache %s: %v", path, err)
+		return empty
+	}
+	if c.Chunker != empty.Chunker || c.Algorithm != empty.Algorithm || c.Compress != empty.Compress || c.Entries == nil {
+		klog.V(2).Infof("Manifest cache %s was generated with different parameters, ignoring it", path)
+		return empty
+	}
+	return &c
+}
+
+// lookup returns the cached chunks of the entry if it did not change and all
+// its chunks are still in chunksDir.
+func (c *manifestCache) lookup(hdr *tar.Header, chunksDir string) ([]ChunkInfo, bool) {
+	entry, ok := c.Entries[hdr.Name]
+	if !ok || entry.Fingerprint != entryFingerprint(hdr) {
+		return nil, false
+	}
+	for _, chunk := range entry.Chunks {
+		if _, err := os.Stat(filepath.Join(chunksDir, chunk.Hash)); err != nil {
+			return nil, false
+		}
+	}
+	return entry.Chunks, true
+}
+
+// save writes the cache atomically
+func (c *manifestCache) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneCache removes the chunks of cacheDir not referenced by any cached source
+func pruneCache(cacheDir string) error {
+	caches, err := filepath.Glob(filepath.Join(cacheDir, "manifest-*.json"))
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, path := range caches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var c manifestCache
+		if err := json.Unmarshal(data, &c); err != nil {
+			// a corrupted cache does not protect its chunks
+			klog.Warningf("Ignoring corrupted manifest cache %s: %v", path, err)
+			continue
+		}
+		for _, entry := range c.Entries {
+			for _, chunk := range entry.Chunks {
+				referenced[chunk.Hash] = true
+			}
+		}
+	}
+
+	chunksDir := filepath.Join(cacheDir, CacheChunksDir)
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if referenced[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(chunksDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package cdc
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aojea/krun/pkg/files"
+)
+
+// rewrittenChunks returns the chunk files modified after since
+func rewrittenChunks(t *testing.T, chunksDir string, since time.Time) map[string]bool {
+	t.Helper()
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil {
+		t.Fatalf("Failed to read chunks dir: %v", err)
+	}
+	rewritten := map[string]bool{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatalf("Failed to stat chunk: %v", err)
+		}
+		if info.ModTime().After(since) {
+			rewritten[e.Name()] = true
+		}
+	}
+	return rewritten
+}
+
+// ageChunks sets the modification time of all the chunk files in the past
+func ageChunks(t *testing.T, chunksDir string, past time.Time) {
+	t.Helper()
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil {
+		t.Fatalf("Failed to read chunks dir: %v", err)
+	}
+	for _, e := range entries {
+		if err := os.Chtimes(filepath.Join(chunksDir, e.Name()), past, past); err != nil {
+			t.Fatalf("Failed to age chunk: %v", err)
+		}
+	}
+}
+
+// extractManifest rebuilds the tarball from the chunks and extracts it
+func extractManifest(t *testing.T, m Manifest, chunksDir string) string {
+	t.Helper()
+	var stream bytes.Buffer
+	for _, c := range m.Chunks {
+		data, err := os.ReadFile(filepath.Join(chunksDir, c.Hash))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		stream.Write(data)
+	}
+	dest := t.TempDir()
+	if err := files.ExtractTar(&stream, dest); err != nil {
+		t.Fatalf("Failed to extract the reconstructed tarball: %v", err)
+	}
+	return dest
+}
+
+func TestGenerateManifestCache(t *testing.T) {
+	srcDir := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		data := make([]byte, 300*1024)
+		_, _ = r.Read(data)
+		if err := os.WriteFile(filepath.Join(srcDir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	small, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	cacheDir := t.TempDir()
+	chunksDir := filepath.Join(cacheDir, CacheChunksDir)
+	if err := os.MkdirAll(chunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	opts := Options{Chunker: small, CacheDir: cacheDir}
+
+	first, err := GenerateManifest(srcDir, chunksDir, opts)
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	// Modify one file
+	past := time.Now().Add(-time.Hour)
+	ageChunks(t, chunksDir, past)
+	modified := make([]byte, 300*1024)
+	_, _ = r.Read(modified)
+	if err := os.WriteFile(filepath.Join(srcDir, "b.bin"), modified, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Chtimes(filepath.Join(srcDir, "b.bin"), time.Now().Add(time.Hour), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to touch file: %v", err)
+	}
+
+	second, err := GenerateManifest(srcDir, chunksDir, opts)
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	cacheFile, err := cachePath(cacheDir, srcDir)
+	if err != nil {
+		t.Fatalf("cachePath failed: %v", err)
+	}
+	cache := loadCache(cacheFile, small, opts)
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		if len(cache.Entries[name].Chunks) == 0 {
+			t.Fatalf("Expected the cache to have the chunks of %s", name)
+		}
+	}
+
+	// Only the modified file, and the end of the archive, are chunked again
+	want := map[string]bool{second.Chunks[len(second.Chunks)-1].Hash: true}
+	for _, c := range cache.Entries["b.bin"].Chunks {
+		want[c.Hash] = true
+	}
+	got := rewrittenChunks(t, chunksDir, past.Add(time.Minute))
+	if len(got) != len(want) {
+		t.Errorf("Expected %d chunks recomputed, got %d", len(want), len(got))
+	}
+	for hash := range got {
+		if !want[hash] {
+			t.Errorf("Chunk %s of an unmodified file was recomputed", hash)
+		}
+	}
+	if len(first.Chunks) == 0 || first.Chunks[0].Hash != second.Chunks[0].Hash {
+		t.Errorf("Expected the chunks of the unmodified files to be reused")
+	}
+
+	// The manifest still reconstructs the source
+	dest := extractManifest(t, second, chunksDir)
+	got2, err := os.ReadFile(filepath.Join(dest, "b.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read extracted file: %v", err)
+	}
+	if !bytes.Equal(got2, modified) {
+		t.Errorf("Reconstructed file differs from the source")
+	}
+
+	// Changing the chunker invalidates the cache
+	ageChunks(t, chunksDir, past)
+	other, err := ChunkerConfigForAverage(128 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	opts.Chunker = other
+	third, err := GenerateManifest(srcDir, chunksDir, opts)
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	rewritten := rewrittenChunks(t, chunksDir, past.Add(time.Minute))
+	for _, c := range third.Chunks {
+		if !rewritten[c.Hash] {
+			t.Errorf("Chunk %s was reused with a different chunker", c.Hash)
+		}
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	cacheDir := t.TempDir()
+	chunksDir := filepath.Join(cacheDir, CacheChunksDir)
+	if err := os.MkdirAll(chunksDir, 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chunksDir, "stale"), []byte("stale"), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	m, err := GenerateManifest(srcDir, chunksDir, Options{CacheDir: cacheDir})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if err := pruneCache(cacheDir); err != nil {
+		t.Fatalf("pruneCache failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(chunksDir, "stale")); !os.IsNotExist(err) {
+		t.Errorf("Expected the unreferenced chunk to be removed, got %v", err)
+	}
+	// The chunk of the end of the archive is not cached, the entries are kept
+	for _, c := range m.Chunks[:len(m.Chunks)-1] {
+		if _, err := os.Stat(filepath.Join(chunksDir, c.Hash)); err != nil {
+			t.Errorf("Expected cached chunk %s to be kept: %v", c.Hash, err)
+		}
+	}
+}
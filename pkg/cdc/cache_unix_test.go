@@ -0,0 +1,39 @@
+//go:build unix
+
+package cdc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestChunksDirForSharedCache checks a run does not prune the chunks of
+// another run using the same cache, they are pruned once both are done.
+func TestChunksDirForSharedCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	opts := Options{CacheDir: cacheDir}
+	chunksDir, doneFirst, err := chunksDirFor(opts)
+	if err != nil {
+		t.Fatalf("chunksDirFor failed: %v", err)
+	}
+	_, doneSecond, err := chunksDirFor(opts)
+	if err != nil {
+		t.Fatalf("chunksDirFor failed: %v", err)
+	}
+
+	// the first run generated a chunk not recorded in its cache yet
+	chunk := filepath.Join(chunksDir, "in-flight")
+	if err := os.WriteFile(chunk, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	doneSecond()
+	if _, err := os.Stat(chunk); err != nil {
+		t.Fatalf("Expected the chunk of the running sync to be kept: %v", err)
+	}
+
+	doneFirst()
+	if _, err := os.Stat(chunk); !os.IsNotExist(err) {
+		t.Errorf("Expected the unreferenced chunk to be pruned by the last run, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package cdc
+
+// cacheLock does not lock the cache directory, the runs sharing it are not
+// protected from the pruning of the others.
+type cacheLock struct{}
+
+func lockCache(cacheDir string) (*cacheLock, error) {
+	return &cacheLock{}, nil
+}
+
+func (l *cacheLock) tryExclusive() bool {
+	return true
+}
+
+func (l *cacheLock) unlock() {}
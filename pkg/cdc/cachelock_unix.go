@@ -0,0 +1,38 @@
+//go:build unix
+
+package cdc
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// cacheLock is held by the runs using the cache directory, the chunks are only
+// pruned by the last run.
+type cacheLock struct {
+	f *os.File
+}
+
+// lockCache takes a shared lock on cacheDir until unlock is called
+func lockCache(cacheDir string) (*cacheLock, error) {
+	f, err := os.OpenFile(filepath.Join(cacheDir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &cacheLock{f: f}, nil
+}
+
+// tryExclusive upgrades to an exclusive lock, false if other runs hold the cache
+func (l *cacheLock) tryExclusive() bool {
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
+
+// unlock releases the lock
+func (l *cacheLock) unlock() {
+	_ = l.f.Close()
+}
@@ -0,0 +1,212 @@
+package cdc
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/restic/chunker"
+)
+
+// DefaultPolynomial is the irreducible polynomial used by the rolling hash
+const DefaultPolynomial = 0x3DA3358B4DC173
+
+// ChunkerConfig defines the content defined chunking boundaries.
+// It is recorded in the manifest so the same data always produces the same chunks.
+type ChunkerConfig struct {
+	Polynomial  uint64 `json:"polynomial"`
+	MinSize     uint   `json:"minSize"`
+	MaxSize     uint   `json:"maxSize"`
+	AverageBits int    `json:"averageBits"`
+}
+
+// DefaultChunkerConfig returns the restic chunker defaults, chunks of 1MiB on average
+func DefaultChunkerConfig() ChunkerConfig {
+	return ChunkerConfig{
+		Polynomial:  DefaultPolynomial,
+		MinSize:     chunker.MinSize,
+		MaxSize:     chunker.MaxSize,
+		AverageBits: 20,
+	}
+}
+
+// MaxAverageChunkSize bounds the average chunk size, the chunker buffers a
+// maximum size chunk of 8 times the average per writer.
+const MaxAverageChunkSize = 8 * 1024 * 1024
+
+// ChunkerConfigForAverage returns a config producing chunks of avgSize bytes on average,
+// avgSize must be a power of two. Boundaries keep the default ratios: min avg/2, max avg*8.
+func ChunkerConfigForAverage(avgSize uint64) (ChunkerConfig, error) {
+	if avgSize < 64*1024 || avgSize > MaxAverageChunkSize || avgSize&(avgSize-1) != 0 {
+		return ChunkerConfig{}, fmt.Errorf("average chunk size %d must be a power of two between 64KiB and 8MiB", avgSize)
+	}
+	return ChunkerConfig{
+		Polynomial:  DefaultPolynomial,
+		MinSize:     uint(avgSize / 2),
+		MaxSize:     uint(avgSize * 8),
+		AverageBits: bits.TrailingZeros64(avgSize),
+	}, nil
+}
+
+// orDefault returns the default config if c is the zero value
+func (c ChunkerConfig) orDefault() ChunkerConfig {
+	if c == (ChunkerConfig{}) {
+		return DefaultChunkerConfig()
+	}
+	return c
+}
+
+func (c ChunkerConfig) validate() error {
+	if !chunker.Pol(c.Polynomial).Irreducible() {
+		return fmt.Errorf("chunker polynomial %#x is not irreducible", c.Polynomial)
+	}
+	if c.MinSize == 0 || c.MinSize > c.MaxSize {
+		return fmt.Errorf("invalid chunk size boundaries min %d max %d", c.MinSize, c.MaxSize)
+	}
+	if c.AverageBits <= 0 || c.AverageBits >= 64 {
+		return fmt.Errorf("invalid chunker average bits %d", c.AverageBits)
+	}
+	return nil
+}
+
+// segmentWriter chunks the tarball written to it, the stream is split in segments
+// chunked independently. Segments of entries found in the cache are not chunked,
+// their cached chunks are reported instead.
+type segmentWriter struct {
+	cfg       ChunkerConfig
+	chunksDir string
+	cache     *manifestCache
+	buf       []byte
+	jobs      chan<- chunkJob
+	results   chan<- chunkResult
+	abort     <-chan struct{}
+
+	// index of the next chunk in the stream
+	index int
+	// current segment, pw is nil if its chunks come from the cache
+	current *segment
+	pw      *io.PipeWriter
+	done    chan error
+
+	// segments of the tarball entries
+	segments []*segment
+	cached   int
+	chunked  int
+}
+
+// segment is the range of chunks of a tarball entry
+type segment struct {
+	name        string
+	fingerprint string
+	start, end  int
+}
+
+func newSegmentWriter(cfg ChunkerConfig, chunksDir string, cache *manifestCache, jobs chan<- chunkJob, results chan<- chunkResult, abort <-chan struct{}) *segmentWriter {
+	return &segmentWriter{
+		cfg:       cfg,
+		chunksDir: chunksDir,
+		cache:     cache,
+		buf:       make([]byte, cfg.MaxSize),
+		jobs:      jobs,
+		results:   results,
+		abort:     abort,
+	}
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	if s.pw == nil {
+		// the chunks of the segment are already known
+		return len(p), nil
+	}
+	return s.pw.Write(p)
+}
+
+// nextEntry ends the current segment and starts the one of the tarball entry
+func (s *segmentWriter) nextEntry(hdr *tar.Header) error {
+	if err := s.endSegment(); err != nil {
+		return err
+	}
+	s.startSegment(hdr)
+	return nil
+}
+
+// startSegment reuses the cached chunks of the entry or starts chunking it
+func (s *segmentWriter) startSegment(hdr *tar.Header) {
+	s.current = &segment{start: s.index}
+	if hdr == nil {
+		// the stream without entries or the end of the archive are not cached
+		s.startChunker()
+		return
+	}
+	s.current.name = hdr.Name
+	s.current.fingerprint = entryFingerprint(hdr)
+	s.segments = append(s.segments, s.current)
+
+	chunks, ok := s.cache.lookup(hdr, s.chunksDir)
+	if !ok {
+		s.chunked++
+		s.startChunker()
+		return
+	}
+	s.cached++
+	for _, chunk := range chunks {
+		s.results <- chunkResult{index: s.index, info: chunk}
+		s.index++
+	}
+}
+
+// startChunker chunks the data written until the end of the segment
+func (s *segmentWriter) startChunker() {
+	pr, pw := io.Pipe()
+	s.pw = pw
+	s.done = make(chan error, 1)
+	go func() {
+		err := s.chunk(pr)
+		if err != nil {
+			// fail the writes of the tarball
+			_ = pr.CloseWithError(err)
+		}
+		s.done <- err
+	}()
+}
+
+func (s *segmentWriter) chunk(r io.Reader) error {
+	chk := chunker.NewWithBoundaries(r, chunker.Pol(s.cfg.Polynomial), s.cfg.MinSize, s.cfg.MaxSize)
+	chk.SetAverageBits(s.cfg.AverageBits)
+	for {
+		chunk, err := chk.Next(s.buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The chunker reuses the buffer
+		data := make([]byte, len(chunk.Data))
+		copy(data, chunk.Data)
+		select {
+		case s.jobs <- chunkJob{index: s.index, data: data}:
+			s.index++
+		case <-s.abort:
+			return errors.New("chunking aborted")
+		}
+	}
+}
+
+// endSegment waits until the data of the current segment is chunked
+func (s *segmentWriter) endSegment() error {
+	if s.current == nil {
+		return nil
+	}
+	var err error
+	if s.pw != nil {
+		_ = s.pw.Close()
+		err = <-s.done
+		s.pw = nil
+	}
+	s.current.end = s.index
+	s.current = nil
+	return err
+}
@@ -0,0 +1,34 @@
+package cdc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+const (
+	// CodecGzip marks chunks stored gzip compressed, chunks without codec are stored as is
+	CodecGzip = "gzip"
+	// codecPAXRecord carries the chunk codec in the ingest tar stream (sync with agent/fsync/codec.go)
+	codecPAXRecord = "KRUN.codec"
+	// minCompressionRatio is the maximum compressed/original size ratio to store a chunk compressed,
+	// chunks that do not compress well (images, archives, ...) are stored as is.
+	minCompressionRatio = 0.9
+)
+
+// compressChunk returns the data to store for the chunk and the codec used,
+// compression is only applied when it saves enough space.
+func compressChunk(data []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, "", fmt.Errorf("failed to compress chunk: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to compress chunk: %w", err)
+	}
+	if float64(buf.Len()) > float64(len(data))*minCompressionRatio {
+		return data, "", nil
+	}
+	return buf.Bytes(), CodecGzip, nil
+}
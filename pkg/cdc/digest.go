@@ -0,0 +1,90 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
+)
+
+// digestResult is the output of `agent -mode digest` (sync with agent/fsync/digest.go)
+type digestResult struct {
+	Digest string `json:"digest"`
+}
+
+// manifestDigest identifies the content described by the manifest
+func manifestDigest(m Manifest) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// digestArgs returns the agent flags recording the digest once the manifest is applied.
+// A dry run or disabled mirroring leaves the extraneous files in the destination,
+// the digest is not recorded so the next mirroring sync is not skipped.
+func (o Options) digestArgs(digest string) []string {
+	if digest == "" || o.NoMirror || o.MirrorDryRun {
+		return nil
+	}
+	return []string{"-manifest-digest", digest}
+}
+
+// remoteDigest runs `agent -mode digest` on the target and returns the digest
+// of the manifest applied in remoteDir, empty if there is none.
+func remoteDigest(ctx context.Context, t Transport, target Target, agentPath, remoteDir string) (string, error) {
+	cmd := []string{agentPath, "-mode", "digest", "-dir", remoteDir}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	err := t.Exec(ctx, target, cmd, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return "", fmt.Errorf("exec error: %v (stderr: %s)", err, stderr.String())
+	}
+
+	var result digestResult
+	if err := json.NewDecoder(&stdout).Decode(&result); err != nil {
+		return "", fmt.Errorf("bad response: %v", err)
+	}
+	return result.Digest, nil
+}
+
+// upToDate reports whether all the targets already applied the manifest with the digest.
+// Failing to get the digest of a target is not an error, the target is synced.
+func upToDate(ctx context.Context, t Transport, targets []Target, agentPath, remoteDir, digest string) bool {
+	if digest == "" {
+		return false
+	}
+	var wg sync.WaitGroup
+	results := make([]bool, len(targets))
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			got, err := remoteDigest(ctx, t, target, agentPath, remoteDir)
+			if err != nil {
+				klog.V(2).Infof("Failed to get the manifest digest of %s: %v", target.Name, err)
+				return
+			}
+			results[i] = got == digest
+		}(i, target)
+	}
+	wg.Wait()
+	for _, ok := range results {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
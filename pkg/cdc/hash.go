@@ -0,0 +1,45 @@
+package cdc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// Supported chunk hash algorithms (sync with agent/fsync/hash.go)
+const (
+	// HashSHA256 is the default algorithm, manifests without algorithm use it
+	HashSHA256 = "sha256"
+	// HashBLAKE3 is considerably faster than SHA-256 on large datasets
+	HashBLAKE3 = "blake3"
+)
+
+// normalizeAlgorithm returns the algorithm name, applying the default
+func normalizeAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return HashSHA256
+	}
+	return algorithm
+}
+
+// newHasher returns the hash used to address the chunks
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch normalizeAlgorithm(algorithm) {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+// hashChunk returns the hex encoded hash of the chunk data
+func hashChunk(h hash.Hash, data []byte) string {
+	h.Reset()
+	_, _ = h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
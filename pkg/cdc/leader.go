@@ -0,0 +1,128 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
+)
+
+// LeaderSelector picks the target that receives the local files and serves them to the other targets,
+// SyncTargets passes only the targets with an address when there are several.
+type LeaderSelector func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error)
+
+// SelectFirstLeader selects the first target of the list
+func SelectFirstLeader(_ context.Context, _ Transport, targets []Target, _ string, _ Manifest) (Target, error) {
+	if len(targets) == 0 {
+		return Target{}, fmt.Errorf("no targets to select a leader from")
+	}
+	return targets[0], nil
+}
+
+// SelectLeaderByName returns a selector of the target with the given name
+func SelectLeaderByName(name string) LeaderSelector {
+	return func(_ context.Context, _ Transport, targets []Target, _ string, _ Manifest) (Target, error) {
+		for _, target := range targets {
+			if target.Name == name {
+				return target, nil
+			}
+		}
+		return Target{}, fmt.Errorf("%s can not be the leader, it must be one of the targets with an address", name)
+	}
+}
+
+// SelectLeaderByFreeDisk selects the first target, in list order, with enough free disk
+// in remoteDir to store the chunk cache and the reconstructed files of the manifest.
+// The agent must be in AgentFile, SyncTargets defaults to SelectLeaderByFreeDiskAgent
+// with the AgentPath of the options.
+func SelectLeaderByFreeDisk(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+	return SelectLeaderByFreeDiskAgent(AgentFile)(ctx, t, targets, remoteDir, m)
+}
+
+// SelectLeaderByFreeDiskAgent returns SelectLeaderByFreeDisk with the agent in agentPath
+func SelectLeaderByFreeDiskAgent(agentPath string) LeaderSelector {
+	return func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+		return selectLeaderByFreeDisk(ctx, t, targets, agentPath, remoteDir, m)
+	}
+}
+
+func selectLeaderByFreeDisk(ctx context.Context, t Transport, targets []Target, agentPath, remoteDir string, m Manifest) (Target, error) {
+	required := requiredSpace(m)
+	var errs []error
+	for _, target := range targets {
+		free, err := freeSpace(ctx, t, target, agentPath, remoteDir)
+		if err != nil {
+			klog.Warningf("Failed to get free disk space on %s: %v", target.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", target.Name, err))
+			continue
+		}
+		if free < required {
+			klog.V(2).Infof("%s has %d bytes free, %d required", target.Name, free, required)
+			errs = append(errs, fmt.Errorf("%s: %d bytes free, %d required", target.Name, free, required))
+			continue
+		}
+		return target, nil
+	}
+	return Target{}, fmt.Errorf("no target has %d bytes free in %s to be the leader: %w", required, remoteDir, errors.Join(errs...))
+}
+
+// leaderCandidates returns the targets with an address, the peers can not download from
+// the others. The ready targets go first, otherwise the list order is kept.
+func leaderCandidates(targets []Target) []Target {
+	var ready, notReady []Target
+	for _, target := range targets {
+		if target.Address == "" {
+			klog.V(2).Infof("%s has no address, it can not be the leader", target.Name)
+			continue
+		}
+		if target.Ready {
+			ready = append(ready, target)
+		} else {
+			notReady = append(notReady, target)
+		}
+	}
+	return append(ready, notReady...)
+}
+
+// requiredSpace is an upper bound of the disk used on the leader:
+// the unique chunks plus the files reconstructed from them.
+func requiredSpace(m Manifest) uint64 {
+	var total, unique uint64
+	seen := make(map[string]bool)
+	for _, chunk := range m.Chunks {
+		total += uint64(chunk.Size)
+		if !seen[chunk.Hash] {
+			seen[chunk.Hash] = true
+			// compressed chunks are stored encoded
+			unique += uint64(chunk.storedSize())
+		}
+	}
+	return total + unique
+}
+
+// freeSpace runs `agent -mode statfs` on the target
+func freeSpace(ctx context.Context, t Transport, target Target, agentPath, remoteDir string) (uint64, error) {
+	cmd := []string{agentPath, "-mode", "statfs", "-dir", remoteDir}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	err := t.Exec(ctx, target, cmd, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("exec error: %v (stderr: %s)", err, stderr.String())
+	}
+
+	var result struct {
+		Free uint64 `json:"free"`
+	}
+	if err := json.NewDecoder(&stdout).Decode(&result); err != nil {
+		return 0, fmt.Errorf("bad response: %v", err)
+	}
+	return result.Free, nil
+}
@@ -0,0 +1,56 @@
+package cdc
+
+import (
+	"k8s.io/klog/v2"
+)
+
+// Phase of the upload reported by the progress callback
+type Phase string
+
+const (
+	// PhaseChunking splits the local files into chunks
+	PhaseChunking Phase = "chunking"
+	// PhaseChecking asks the leader which chunks it is missing
+	PhaseChecking Phase = "checking"
+	// PhaseUploading sends the missing chunks and the manifest to the leader
+	PhaseUploading Phase = "uploading"
+)
+
+// Progress is the state of the current phase of the upload
+type Progress struct {
+	Phase Phase
+	// Done and Total count the chunks of the phase, Total is 0 while unknown
+	Done  int
+	Total int
+	// Bytes is the size of the chunks done, the bytes sent to the leader when uploading
+	Bytes uint64
+}
+
+// ProgressFunc receives the progress of the upload, every phase starts with
+// Done 0 and the counts never decrease within a phase. It is not called
+// concurrently and must not block.
+type ProgressFunc func(Progress)
+
+// LogProgress is the default ProgressFunc, it logs the start of every phase
+func LogProgress(p Progress) {
+	if p.Done > 0 {
+		klog.V(4).Infof("%s: %d/%d chunks, %d bytes", p.Phase, p.Done, p.Total, p.Bytes)
+		return
+	}
+	switch p.Phase {
+	case PhaseChunking:
+		klog.Info("Chunking local files...")
+	case PhaseChecking:
+		klog.Info("Checking missing chunks on leader...")
+	case PhaseUploading:
+		klog.Infof("Leader missing %d chunks, uploading data...", p.Total)
+	}
+}
+
+// progress returns the configured ProgressFunc, LogProgress by default
+func (o Options) progress() ProgressFunc {
+	if o.Progress != nil {
+		return o.Progress
+	}
+	return LogProgress
+}
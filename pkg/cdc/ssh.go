@@ -0,0 +1,72 @@
+package cdc
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
+)
+
+// sshCommand is the ssh client binary, it allows faking the hosts in tests
+var sshCommand = "ssh"
+
+// SSHTransport runs the commands on hosts with the ssh client, so the
+// hosts, users, keys and ports of the ssh configuration apply.
+type SSHTransport struct {
+	// Args are extra arguments of the ssh client, e.g. []string{"-i", "key"}
+	Args []string
+}
+
+// SSHTarget returns the target of the ssh destination, [user@]host, the
+// other hosts download the files from host.
+func SSHTarget(destination string) Target {
+	host := destination
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		host = destination[i+1:]
+	}
+	return Target{Name: destination, Address: host, Ready: true}
+}
+
+// SSHTargets returns the targets of the ssh destinations
+func SSHTargets(destinations []string) []Target {
+	targets := make([]Target, 0, len(destinations))
+	for _, d := range destinations {
+		targets = append(targets, SSHTarget(d))
+	}
+	return targets
+}
+
+// Exec runs the command on the host of the target, the ssh client exits
+// when the context is cancelled.
+func (s SSHTransport) Exec(ctx context.Context, target Target, cmd []string, options remotecommand.StreamOptions) error {
+	// never prompt for passwords, the commands are not interactive
+	args := []string{"-o", "BatchMode=yes"}
+	if options.Tty {
+		args = append(args, "-t")
+	} else {
+		args = append(args, "-T")
+	}
+	args = append(args, s.Args...)
+	args = append(args, "--", target.Name, shellQuote(cmd))
+	klog.V(4).Infof("Executing command %v on host %s", cmd, target.Name)
+
+	c := exec.CommandContext(ctx, sshCommand, args...)
+	c.Stdin = options.Stdin
+	c.Stdout = options.Stdout
+	c.Stderr = options.Stderr
+	// do not wait for a stdin that is never closed once ssh exits
+	c.WaitDelay = time.Second
+	return c.Run()
+}
+
+// shellQuote joins the command quoting every argument, ssh runs it with the remote shell
+func shellQuote(cmd []string) string {
+	quoted := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,82 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestSSHTarget(t *testing.T) {
+	tests := []struct {
+		destination string
+		wantAddress string
+	}{
+		{destination: "host", wantAddress: "host"},
+		{destination: "user@host", wantAddress: "host"},
+		{destination: "user@10.0.0.1", wantAddress: "10.0.0.1"},
+		{destination: "user@fd00::1", wantAddress: "fd00::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			target := SSHTarget(tt.destination)
+			if target.Name != tt.destination || target.Address != tt.wantAddress || !target.Ready {
+				t.Errorf("SSHTarget(%q) = %+v, want address %s", tt.destination, target, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestSSHTransport(t *testing.T) {
+	// the fake ssh client runs the remote command with the local shell
+	dir := t.TempDir()
+	script := `#!/bin/sh
+while [ "$1" != "--" ]; do echo "option $1" >&2; shift; done
+echo "destination $2" >&2
+exec sh -c "$3"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write the fake ssh: %v", err)
+	}
+	originalSSH := sshCommand
+	defer func() { sshCommand = originalSSH }()
+	sshCommand = filepath.Join(dir, "ssh")
+
+	tests := []struct {
+		name       string
+		cmd        []string
+		stdin      string
+		wantStdout string
+		wantErr    bool
+	}{
+		{name: "quoted arguments", cmd: []string{"printf", "%s|", "it's", "a b", "$HOME"}, wantStdout: "it's|a b|$HOME|"},
+		{name: "stdin", cmd: []string{"cat"}, stdin: "hello", wantStdout: "hello"},
+		{name: "exit status", cmd: []string{"false"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			options := remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}
+			if tt.stdin != "" {
+				options.Stdin = strings.NewReader(tt.stdin)
+			}
+			transport := SSHTransport{Args: []string{"-p", "2222"}}
+			err := transport.Exec(context.Background(), SSHTarget("user@host"), tt.cmd, options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exec() error = %v, wantErr %v (stderr: %s)", err, tt.wantErr, stderr.String())
+			}
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("Expected stdout %q, got %q", tt.wantStdout, stdout.String())
+			}
+			for _, want := range []string{"option BatchMode=yes", "option -T", "option 2222", "destination user@host"} {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("Expected the ssh client to get %q, got %q", want, stderr.String())
+				}
+			}
+		})
+	}
+}
@@ -4,20 +4,20 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"sync"
 
 	"github.com/aojea/krun/pkg/exec"
 	"github.com/aojea/krun/pkg/files"
 
-	"github.com/restic/chunker"
-
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -32,48 +32,250 @@ const (
 )
 
 type Manifest struct {
-	Chunks []ChunkInfo `json:"chunks"`
+	// Algorithm used to hash the chunks, empty means sha256
+	Algorithm string `json:"algorithm,omitempty"`
+	// Chunker used to split the data
+	Chunker *ChunkerConfig `json:"chunker,omitempty"`
+	Chunks  []ChunkInfo    `json:"chunks"`
 }
 
 type ChunkInfo struct {
+	// Hash and Size always refer to the uncompressed content
 	Hash string `json:"hash"`
 	Size uint   `json:"size"`
-	Data []byte `json:"-"` // Local optimization only
+	// Codec used to store the chunk, empty means uncompressed
+	Codec string `json:"codec,omitempty"`
+	// StoredSize is the size of the encoded chunk, only set when Codec is set
+	StoredSize uint   `json:"storedSize,omitempty"`
+	Data       []byte `json:"-"` // Local optimization only
+}
+
+// storedSize is the size of the chunk file on disk
+func (c ChunkInfo) storedSize() uint {
+	if c.Codec != "" {
+		return c.StoredSize
+	}
+	return c.Size
+}
+
+// validate checks the manifest is internally consistent, a hash referenced
+// more than once must always describe the same chunk (sync with agent/fsync/main.go).
+func (m Manifest) validate() error {
+	seen := make(map[string]ChunkInfo, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		prev, ok := seen[chunk.Hash]
+		if !ok {
+			seen[chunk.Hash] = chunk
+			continue
+		}
+		if prev.Size != chunk.Size || prev.Codec != chunk.Codec || prev.StoredSize != chunk.StoredSize {
+			return fmt.Errorf("chunk %d with hash %s conflicts with a previous reference: size %d (stored %d, codec %q) vs size %d (stored %d, codec %q)",
+				i, chunk.Hash, chunk.Size, chunk.StoredSize, chunk.Codec, prev.Size, prev.StoredSize, prev.Codec)
+		}
+	}
+	return nil
 }
 
-// ExecCmd allows mocking the remote execution in tests
+// ManifestStats summarizes how much data the deduplication of the chunks saves
+type ManifestStats struct {
+	// TotalBytes is the size of the data described by the manifest
+	TotalBytes uint64
+	Chunks     int
+	// UniqueChunks and UniqueBytes count each hash once
+	UniqueChunks int
+	UniqueBytes  uint64
+}
+
+// DedupRatio is the ratio between the total and the unique bytes, 1 means no duplicates
+func (s ManifestStats) DedupRatio() float64 {
+	if s.UniqueBytes == 0 {
+		return 1
+	}
+	return float64(s.TotalBytes) / float64(s.UniqueBytes)
+}
+
+func (s ManifestStats) String() string {
+	return fmt.Sprintf("%d chunks (%d unique), %d bytes (%d unique), dedup ratio %.2f",
+		s.Chunks, s.UniqueChunks, s.TotalBytes, s.UniqueBytes, s.DedupRatio())
+}
+
+// Stats returns the deduplication statistics of the manifest
+func (m Manifest) Stats() ManifestStats {
+	stats := ManifestStats{Chunks: len(m.Chunks)}
+	seen := make(map[string]bool, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		stats.TotalBytes += uint64(chunk.Size)
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+		stats.UniqueChunks++
+		stats.UniqueBytes += uint64(chunk.Size)
+	}
+	return stats
+}
+
+// Options configures how the local files are chunked and synchronized
+type Options struct {
+	// Exclude skips the files whose relative path matches any pattern
+	Exclude files.Patterns
+	// Chunker configures the chunk boundaries, defaults to DefaultChunkerConfig
+	Chunker ChunkerConfig
+	// HashWorkers is the number of chunks hashed and stored in parallel, defaults to GOMAXPROCS
+	HashWorkers int
+	// CacheDir stores the chunks of the source entries between runs so the
+	// unmodified entries are not chunked again, disabled if empty.
+	CacheDir string
+	// Include only uploads the files whose relative path matches any pattern, if set.
+	// Exclude is applied after Include.
+	Include files.Patterns
+	// ChmodExec makes executable the files whose relative path matches any pattern
+	ChmodExec files.Patterns
+	// UseIgnoreFiles skips the files matching the .gitignore and .krunignore in the source root
+	UseIgnoreFiles bool
+	// FollowSymlinks uploads the content the symlinks point to instead of the symlinks
+	FollowSymlinks bool
+	// MaxFileSize skips the files larger than this size in bytes, unlimited if 0
+	MaxFileSize int64
+	// Algorithm used to hash the chunks (sha256 or blake3), defaults to sha256
+	Algorithm string
+	// LeaderSelector picks the leader in SyncTargets, defaults to SelectLeaderByFreeDisk
+	LeaderSelector LeaderSelector
+	// HubFanout is the number of peers each hub serves at once in SyncTargets, the
+	// synced peers serve the next ones when there are more. 0 serves all the
+	// peers from the leader.
+	HubFanout int
+	// NoMirror keeps the extraneous files in the destination, they are deleted by default
+	NoMirror bool
+	// MirrorDryRun only logs the extraneous files the destination would delete
+	MirrorDryRun bool
+	// MirrorExclude protects from deletion the destination paths matching any
+	// pattern, matched against the path relative to the destination
+	MirrorExclude files.Patterns
+	// Force allows mirroring an empty source, the agents refuse to clear
+	// a non empty destination otherwise.
+	Force bool
+	// AgentPath is the absolute path of the agent on the targets, defaults to AgentFile
+	AgentPath string
+	// Container runs the agent in the named container of the pods in SyncPods and
+	// SyncLocalToLeader, the default container of the pods if empty
+	Container string
+	// Compress stores with gzip the chunks that compress well, the decision is
+	// recorded per chunk in the manifest.
+	Compress bool
+	// Progress receives the progress of the chunking and the upload to the leader,
+	// defaults to LogProgress
+	Progress ProgressFunc
+	// Delta keeps the chunks on the targets as bases of the next sync, the peers
+	// download the modified chunks as deltas against their previous version.
+	// The compressed chunks are always transferred whole.
+	Delta bool
+}
+
+// agentPath returns the path of the agent on the targets, AgentFile by default
+func (o Options) agentPath() string {
+	if o.AgentPath != "" {
+		return o.AgentPath
+	}
+	return AgentFile
+}
+
+// deltaArgs returns the agent arguments of the delta mode
+func (o Options) deltaArgs() []string {
+	if !o.Delta {
+		return nil
+	}
+	return []string{"-delta"}
+}
+
+// ValidateAgentPath checks the agent path is absolute, the commands do not
+// depend on the working directory of the targets
+func ValidateAgentPath(agentPath string) error {
+	if !path.IsAbs(agentPath) || path.Clean(agentPath) == "/" {
+		return fmt.Errorf("invalid agent path %q: must be an absolute path to a file", agentPath)
+	}
+	return nil
+}
+
+// mirrorArgs returns the agent flags controlling the deletion of extraneous files
+func (o Options) mirrorArgs() []string {
+	var args []string
+	if o.NoMirror {
+		return []string{"-mirror=false"}
+	}
+	if o.MirrorDryRun {
+		args = append(args, "-dry-run")
+	}
+	for _, re := range o.MirrorExclude {
+		args = append(args, "-mirror-exclude", re.String())
+	}
+	if o.Force {
+		args = append(args, "-force")
+	}
+	return args
+}
+
+// ExecCmd runs the commands of the KubeTransport, it allows mocking the remote execution in tests
 var ExecCmd = exec.ExecCmd
 
+// generateManifest allows counting the local chunking passes in tests
+var generateManifest = GenerateManifest
+
 // SyncLocalToLeader uploads changed chunks to the leader using kubectl exec
-func SyncLocalToLeader(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, srcPath, remoteDir string, exclude *regexp.Regexp, cleanup bool) error {
-	klog.Info("Chunking local files...")
+func SyncLocalToLeader(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, srcPath, remoteDir string, opts Options, cleanup bool) error {
+	t := KubeTransport{Config: config, Client: client, Container: opts.Container}
+	return SyncLocalToTarget(ctx, t, PodTarget(pod), srcPath, remoteDir, opts, cleanup)
+}
 
-	// Create temp dir for chunks
-	tmpDir, err := os.MkdirTemp("", "krun-chunks-*")
+// SyncLocalToTarget uploads changed chunks to the target using the transport
+func SyncLocalToTarget(ctx context.Context, t Transport, target Target, srcPath, remoteDir string, opts Options, cleanup bool) error {
+	if err := ValidateAgentPath(opts.agentPath()); err != nil {
+		return err
+	}
+	chunksDir, done, err := chunksDirFor(opts)
 	if err != nil {
-		return fmt.Errorf("failed to create temp dir: %w", err)
+		return err
 	}
-	defer func() { _ = os.RemoveAll(tmpDir) }()
+	defer done()
 
 	// Generate Local Manifest & Chunks
-	manifest, err := GenerateManifest(srcPath, exclude, tmpDir)
+	manifest, err := generateManifest(srcPath, chunksDir, opts)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Local data split into %s", manifest.Stats())
+
+	digest, err := manifestDigest(manifest)
 	if err != nil {
 		return err
 	}
-	klog.Infof("Local data split into %d chunks", len(manifest.Chunks))
+	if upToDate(ctx, t, []Target{target}, opts.agentPath(), remoteDir, digest) {
+		klog.Infof("%s already has the manifest, nothing to do", target.Name)
+		return nil
+	}
+
+	return syncManifestToLeader(ctx, t, target, remoteDir, manifest, chunksDir, opts, cleanup)
+}
+
+// syncManifestToLeader uploads the chunks missing on the leader followed by the manifest
+func syncManifestToLeader(ctx context.Context, t Transport, leader Target, remoteDir string, manifest Manifest, chunksDir string, opts Options, cleanup bool) error {
+	progress := opts.progress()
+	stats := manifest.Stats()
 
 	// Check diff with Leader (Exec "check")
-	klog.Info("Checking missing chunks on leader...")
-	missingHashes, err := checkRemote(ctx, config, client, pod, remoteDir, manifest)
+	progress(Progress{Phase: PhaseChecking, Total: stats.UniqueChunks})
+	missingHashes, err := checkRemote(ctx, t, leader, opts.agentPath(), remoteDir, manifest)
 	if err != nil {
 		return fmt.Errorf("remote check failed: %w", err)
 	}
-	klog.Infof("Leader missing %d chunks", len(missingHashes))
+	if stats.UniqueChunks > 0 {
+		progress(Progress{Phase: PhaseChecking, Done: stats.UniqueChunks, Total: stats.UniqueChunks, Bytes: stats.UniqueBytes})
+	}
 
 	// Upload Missing Chunks + Manifest (Exec "ingest")
 	if len(missingHashes) > 0 || true { // Always upload manifest at least
-		klog.Info("Uploading data...")
-		err := ingestRemote(ctx, config, client, pod, remoteDir, missingHashes, tmpDir, manifest, cleanup)
+		progress(Progress{Phase: PhaseUploading, Total: len(missingHashes)})
+		err := ingestRemote(ctx, t, leader, remoteDir, missingHashes, chunksDir, manifest, opts, cleanup)
 		if err != nil {
 			return fmt.Errorf("remote ingest failed: %w", err)
 		}
@@ -82,61 +284,244 @@ func SyncLocalToLeader(ctx context.Context, config *rest.Config, client *kuberne
 	return nil
 }
 
-func GenerateManifest(src string, exclude *regexp.Regexp, chunksDir string) (Manifest, error) {
-	// Create a pipe to feed the Tar stream into the Chunker without allocating memory
-	pr, pw := io.Pipe()
+// chunksDirFor returns the directory to store the local chunks, the cache if
+// configured or a temporary directory, and the function to call once they are uploaded.
+func chunksDirFor(opts Options) (string, func(), error) {
+	if opts.CacheDir == "" {
+		tmpDir, err := os.MkdirTemp("", "krun-chunks-*")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		return tmpDir, func() { _ = os.RemoveAll(tmpDir) }, nil
+	}
+	// The chunks are kept in the cache to be reused by the next runs
+	chunksDir := filepath.Join(opts.CacheDir, CacheChunksDir)
+	if err := os.MkdirAll(chunksDir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	// the runs sharing the cache do not prune the chunks of the others, those
+	// chunks may not be recorded in their cache yet
+	lock, err := lockCache(opts.CacheDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to lock cache dir: %w", err)
+	}
+	return chunksDir, func() {
+		defer lock.unlock()
+		if !lock.tryExclusive() {
+			klog.V(2).Infof("Cache %s in use by another run, not pruning it", opts.CacheDir)
+			return
+		}
+		if err := pruneCache(opts.CacheDir); err != nil {
+			klog.Warningf("Failed to prune the cache: %v", err)
+		}
+	}, nil
+}
+
+// GenerateManifest splits the tarball of src into content defined chunks,
+// stores them in chunksDir named by their hash and returns the ordered manifest.
+// The chunks are hashed and stored by a pool of workers while the chunker reads the
+// stream, the manifest order is the stream order regardless of the workers scheduling.
+// With a CacheDir the stream is split at the tarball entries and the entries not
+// modified since the previous run reuse their chunks, that must be in chunksDir.
+func GenerateManifest(src, chunksDir string, opts Options) (Manifest, error) {
+	if _, err := newHasher(opts.Algorithm); err != nil {
+		return Manifest{}, err
+	}
+	cfg := opts.Chunker.orDefault()
+	if err := cfg.validate(); err != nil {
+		return Manifest{}, err
+	}
+	workers := opts.HashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var cache *manifestCache
+	var cacheFile string
+	if opts.CacheDir != "" {
+		var err error
+		cacheFile, err = cachePath(opts.CacheDir, src)
+		if err != nil {
+			return Manifest{}, err
+		}
+		cache = loadCache(cacheFile, cfg, opts)
+	}
+
+	// The channels are bounded so at most 2*workers chunks are kept in memory
+	jobs := make(chan chunkJob, workers)
+	results := make(chan chunkResult, workers)
+	abort := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// hash.Hash is not safe for concurrent use, each worker has its own
+			hasher, _ := newHasher(opts.Algorithm)
+			for job := range jobs {
+				info, err := storeChunk(hasher, job.data, chunksDir, opts.Compress)
+				results <- chunkResult{index: job.index, info: info, err: err}
+			}
+		}()
+	}
+
+	// The tarball is written to the segment writer that feeds the chunker
+	sw := newSegmentWriter(cfg, chunksDir, cache, jobs, results, abort)
+	chunkErr := make(chan error, 1)
+	wg.Add(1)
 	go func() {
-		defer func() { _ = pw.Close() }()
-		if err := files.MakeTar(src, pw, exclude); err != nil {
-			_ = pw.CloseWithError(err)
+		defer wg.Done()
+		defer close(jobs)
+		tarOpts := files.TarOptions{Include: opts.Include, Exclude: opts.Exclude, UseIgnoreFiles: opts.UseIgnoreFiles, ChmodExec: opts.ChmodExec, FollowSymlinks: opts.FollowSymlinks, MaxFileSize: opts.MaxFileSize}
+		if cache != nil {
+			tarOpts.OnEntry = sw.nextEntry
 		}
+		sw.startSegment(nil)
+		err := files.MakeTar(src, sw, tarOpts)
+		if ferr := sw.endSegment(); err == nil {
+			err = ferr
+		}
+		chunkErr <- err
 	}()
 
-	chk := chunker.New(pr, chunker.Pol(0x3DA3358B4DC173))
-	buf := make([]byte, chunker.MaxSize)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-	m := Manifest{}
+	m := Manifest{Algorithm: normalizeAlgorithm(opts.Algorithm), Chunker: &cfg}
+	var storeErr error
+	// The total is unknown until the whole stream is chunked
+	done := Progress{Phase: PhaseChunking}
+	progress := opts.progress()
+	progress(done)
+	for r := range results {
+		if storeErr != nil {
+			continue
+		}
+		if r.err != nil {
+			storeErr = r.err
+			close(abort)
+			continue
+		}
+		for len(m.Chunks) <= r.index {
+			m.Chunks = append(m.Chunks, ChunkInfo{})
+		}
+		m.Chunks[r.index] = r.info
+		done.Done++
+		done.Bytes += uint64(r.info.Size)
+		progress(done)
+	}
+	if storeErr != nil {
+		return m, storeErr
+	}
+	if err := <-chunkErr; err != nil {
+		return m, err
+	}
+	if err := m.validate(); err != nil {
+		return m, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if done.Done > 0 {
+		done.Total = done.Done
+		progress(done)
+	}
 
-	for {
-		chunk, err := chk.Next(buf)
-		if err == io.EOF {
-			break
+	if cache != nil {
+		klog.V(2).Infof("Reused the chunks of %d entries from the cache, chunked %d entries", sw.cached, sw.chunked)
+		newCache := &manifestCache{
+			Chunker:   cache.Chunker,
+			Algorithm: cache.Algorithm,
+			Compress:  cache.Compress,
+			Entries:   make(map[string]cacheEntry, len(sw.segments)),
 		}
-		if err != nil {
-			return m, err
+		for _, seg := range sw.segments {
+			newCache.Entries[seg.name] = cacheEntry{
+				Fingerprint: seg.fingerprint,
+				Chunks:      append([]ChunkInfo(nil), m.Chunks[seg.start:seg.end]...),
+			}
 		}
+		// The cache is an optimization, failing to store it does not fail the upload
+		if err := newCache.save(cacheFile); err != nil {
+			klog.Warningf("Failed to save manifest cache: %v", err)
+		}
+	}
+	return m, nil
+}
 
-		sha := sha256.Sum256(chunk.Data)
-		hash := hex.EncodeToString(sha[:])
+// chunkJob is a chunk pending to be hashed, index is its position in the stream
+type chunkJob struct {
+	index int
+	data  []byte
+}
+
+type chunkResult struct {
+	index int
+	info  ChunkInfo
+	err   error
+}
 
-		// Store data in disk for retrieval
-		chunkPath := filepath.Join(chunksDir, hash)
-		if err := os.WriteFile(chunkPath, chunk.Data, 0644); err != nil {
-			return m, fmt.Errorf("failed to save chunk %s: %w", hash, err)
+// storeChunk hashes the chunk and stores it in chunksDir, compressed if it is worth it
+func storeChunk(hasher hash.Hash, chunk []byte, chunksDir string, compress bool) (ChunkInfo, error) {
+	// The hash is always computed over the uncompressed content
+	hash := hashChunk(hasher, chunk)
+	info := ChunkInfo{
+		Hash: hash,
+		Size: uint(len(chunk)),
+	}
+
+	data := chunk
+	if compress {
+		var err error
+		data, info.Codec, err = compressChunk(chunk)
+		if err != nil {
+			return info, err
+		}
+		if info.Codec != "" {
+			info.StoredSize = uint(len(data))
 		}
+	}
 
-		m.Chunks = append(m.Chunks, ChunkInfo{
-			Hash: hash,
-			Size: chunk.Length,
-		})
+	// Store data in disk for retrieval, repeated chunks may be written by
+	// several workers at the same time so the file is renamed into place
+	tmp, err := os.CreateTemp(chunksDir, hash+".tmp")
+	if err != nil {
+		return info, fmt.Errorf("failed to save chunk %s: %w", hash, err)
 	}
-	return m, nil
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return info, fmt.Errorf("failed to save chunk %s: %w", hash, err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return info, fmt.Errorf("failed to save chunk %s: %w", hash, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		_ = os.Remove(tmp.Name())
+		return info, fmt.Errorf("failed to save chunk %s: %w", hash, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(chunksDir, hash)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return info, fmt.Errorf("failed to save chunk %s: %w", hash, err)
+	}
+	return info, nil
 }
 
-// checkRemote runs `agent -mode check` on the pod
-func checkRemote(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, remoteDir string, m Manifest) ([]string, error) {
+// checkRemote runs `agent -mode check` on the target
+func checkRemote(ctx context.Context, t Transport, target Target, agentPath, remoteDir string, m Manifest) ([]string, error) {
 	manifestJSON, err := json.Marshal(m)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
 	}
 
-	cmd := []string{AgentFile, "-mode", "check", "-dir", remoteDir}
+	cmd := []string{agentPath, "-mode", "check", "-dir", remoteDir}
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
 	// Standard Exec
-	err = ExecCmd(ctx, config, client, pod, cmd, remotecommand.StreamOptions{
+	err = t.Exec(ctx, target, cmd, remotecommand.StreamOptions{
 		Stdin:  bytes.NewReader(manifestJSON),
 		Stdout: &stdout,
 		Stderr: &stderr,
@@ -153,61 +538,101 @@ func checkRemote(ctx context.Context, config *rest.Config, client *kubernetes.Cl
 }
 
 // ingestRemote runs `agent -mode ingest` and pipes a tarball of chunks
-func ingestRemote(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, remoteDir string, missing []string, chunksDir string, m Manifest, cleanup bool) error {
+func ingestRemote(ctx context.Context, t Transport, target Target, remoteDir string, missing []string, chunksDir string, m Manifest, opts Options, cleanup bool) error {
+	digest, err := manifestDigest(m)
+	if err != nil {
+		return err
+	}
+
 	// use a pipe to avoid allocating memory
 	pr, pw := io.Pipe()
-
+	writeErr := make(chan error, 1)
 	go func() {
-		defer func() { _ = pw.Close() }()
-		tw := tar.NewWriter(pw)
-		defer func() { _ = tw.Close() }()
-
-		// Add Missing Chunks
-		for _, hash := range missing {
-			// Read from disk
-			data, err := os.ReadFile(filepath.Join(chunksDir, hash))
-			if err != nil {
-				return
-			}
+		err := writeIngestTar(pw, missing, chunksDir, m, opts)
+		// a failed write must not reach the agent as a complete tarball
+		_ = pw.CloseWithError(err)
+		writeErr <- err
+	}()
 
-			header := &tar.Header{
-				Name: hash, // Flat structure for chunks
-				Size: int64(len(data)),
-				Mode: 0644,
-			}
-			if err := tw.WriteHeader(header); err != nil {
-				return
-			}
-			if _, err := tw.Write(data); err != nil {
-				return
-			}
+	cmd := []string{opts.agentPath(), "-mode", "ingest", "-dir", remoteDir, "-hash", normalizeAlgorithm(m.Algorithm)}
+	if cleanup {
+		cmd = append(cmd, "-cleanup")
+	}
+	cmd = append(cmd, opts.mirrorArgs()...)
+	cmd = append(cmd, opts.deltaArgs()...)
+	cmd = append(cmd, opts.digestArgs(digest)...)
+	err = t.Exec(ctx, target, cmd, remotecommand.StreamOptions{
+		Stdin:  pr,
+		Stdout: io.Discard,
+		Stderr: os.Stderr,
+	})
+	// unblock the writer if the agent stopped reading, that is not an error
+	// of the tarball
+	_ = pr.Close()
+	if werr := <-writeErr; werr != nil && err == nil && !errors.Is(werr, io.ErrClosedPipe) {
+		err = werr
+	}
+	return err
+}
+
+// writeIngestTar writes the missing chunks and the manifest, the last entry,
+// as the tarball read by `agent -mode ingest`. The tarball is only completed
+// if all the entries are written.
+func writeIngestTar(w io.Writer, missing []string, chunksDir string, m Manifest, opts Options) error {
+	tw := tar.NewWriter(w)
+
+	// The agent needs the codec to verify the chunks before the manifest arrives
+	codecs := map[string]string{}
+	for _, c := range m.Chunks {
+		if c.Codec != "" {
+			codecs[c.Hash] = c.Codec
 		}
+	}
 
-		// Add Manifest (ALWAYS add this last or ensure it's included so Hub can serve it)
-		manifestBytes, err := json.Marshal(m)
+	// Add Missing Chunks
+	progress := opts.progress()
+	uploaded := Progress{Phase: PhaseUploading, Total: len(missing)}
+	for _, hash := range missing {
+		// Read from disk
+		data, err := os.ReadFile(filepath.Join(chunksDir, hash))
 		if err != nil {
-			return
+			return fmt.Errorf("failed to read chunk %s: %w", hash, err)
 		}
+
 		header := &tar.Header{
-			Name: ManifestFile,
-			Size: int64(len(manifestBytes)),
+			Name: hash, // Flat structure for chunks
+			Size: int64(len(data)),
 			Mode: 0644,
 		}
+		if codec, ok := codecs[hash]; ok {
+			header.PAXRecords = map[string]string{codecPAXRecord: codec}
+		}
 		if err := tw.WriteHeader(header); err != nil {
-			return
+			return fmt.Errorf("failed to send chunk %s: %w", hash, err)
 		}
-		if _, err := tw.Write(manifestBytes); err != nil {
-			return
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("failed to send chunk %s: %w", hash, err)
 		}
-	}()
+		uploaded.Done++
+		uploaded.Bytes += uint64(len(data))
+		progress(uploaded)
+	}
 
-	cmd := []string{AgentFile, "-mode", "ingest", "-dir", remoteDir}
-	if cleanup {
-		cmd = append(cmd, "-cleanup")
+	// Add Manifest (ALWAYS add this last or ensure it's included so Hub can serve it)
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
 	}
-	return ExecCmd(ctx, config, client, pod, cmd, remotecommand.StreamOptions{
-		Stdin:  pr,
-		Stdout: io.Discard,
-		Stderr: os.Stderr,
-	})
+	header := &tar.Header{
+		Name: ManifestFile,
+		Size: int64(len(manifestBytes)),
+		Mode: 0644,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to send manifest: %w", err)
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		return fmt.Errorf("failed to send manifest: %w", err)
+	}
+	return tw.Close()
 }
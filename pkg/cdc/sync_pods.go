@@ -3,11 +3,11 @@ package cdc
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
 
@@ -18,29 +18,80 @@ import (
 	"k8s.io/klog/v2"
 )
 
-// SyncPods synchronizes files to a set of pods using a Leader-Follower (Hub-Peer) approach.
-// 1. Syncs local files to the first pod (Leader).
-// 2. Starts a Hub on the Leader.
-// 3. Peers download from the Hub.
-func SyncPods(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pods []corev1.Pod, srcPath, remoteDir string, exclude *regexp.Regexp) error {
+// SyncPods synchronizes files to a set of pods using kubectl exec, see SyncTargets.
+func SyncPods(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pods []corev1.Pod, srcPath, remoteDir string, opts Options) error {
 	if len(pods) == 0 {
 		return fmt.Errorf("no pods to sync")
 	}
+	t := KubeTransport{Config: config, Client: client, Container: opts.Container}
+	return SyncTargets(ctx, t, PodTargets(pods), srcPath, remoteDir, opts)
+}
+
+// SyncTargets synchronizes files to a set of targets using a Leader-Follower (Hub-Peer) approach.
+// 1. Syncs local files to the target selected as Leader (by default the first with an address
+// and enough free disk, the ready targets first).
+// 2. Starts a Hub on the Leader.
+// 3. Peers download from the Hub.
+func SyncTargets(ctx context.Context, t Transport, targets []Target, srcPath, remoteDir string, opts Options) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets to sync")
+	}
+	if err := ValidateAgentPath(opts.agentPath()); err != nil {
+		return err
+	}
+
+	chunksDir, done, err := chunksDirFor(opts)
+	if err != nil {
+		return err
+	}
+	defer done()
 
-	leader := pods[0]
-	klog.Infof("Selected leader pod: %s", leader.Name)
+	// The chunks are generated once, the leader ingests them from the same
+	// directory and the peers download them from the leader.
+	manifest, err := generateManifest(srcPath, chunksDir, opts)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Local data split into %s", manifest.Stats())
+
+	digest, err := manifestDigest(manifest)
+	if err != nil {
+		return err
+	}
+	if upToDate(ctx, t, targets, opts.agentPath(), remoteDir, digest) {
+		klog.Info("All targets already have the manifest, nothing to do")
+		return nil
+	}
+
+	selectLeader := opts.LeaderSelector
+	if selectLeader == nil {
+		selectLeader = SelectLeaderByFreeDiskAgent(opts.agentPath())
+	}
+	// A single target only ingests the files, otherwise the leader serves them
+	candidates := targets
+	if len(targets) > 1 {
+		candidates = leaderCandidates(targets)
+		if len(candidates) == 0 {
+			return fmt.Errorf("failed to select leader: no target has an address to serve the others")
+		}
+	}
+	leader, err := selectLeader(ctx, t, candidates, remoteDir, manifest)
+	if err != nil {
+		return fmt.Errorf("failed to select leader: %w", err)
+	}
+	klog.Infof("Selected leader: %s", leader.Name)
 
-	// If there is only one pod, we can cleanup the artifacts immediately after ingest
-	// If there are multiple pods, we need to keep the artifacts for the peers to download,
+	// If there is only one target, we can cleanup the artifacts immediately after ingest
+	// If there are multiple targets, we need to keep the artifacts for the peers to download,
 	// and the Hub will cleanup on exit.
-	cleanupLeader := len(pods) == 1
+	cleanupLeader := len(targets) == 1
 
 	klog.Info("Syncing to leader...")
-	if err := SyncLocalToLeader(ctx, config, client, leader, srcPath, remoteDir, exclude, cleanupLeader); err != nil {
+	if err := syncManifestToLeader(ctx, t, leader, remoteDir, manifest, chunksDir, opts, cleanupLeader); err != nil {
 		return fmt.Errorf("failed to sync to leader: %w", err)
 	}
 
-	if len(pods) == 1 {
+	if len(targets) == 1 {
 		return nil
 	}
 
@@ -65,9 +116,10 @@ func SyncPods(ctx context.Context, config *rest.Config, client *kubernetes.Clien
 			}
 		}()
 		// Use port 0 to let OS assign a free port
-		cmd := []string{AgentFile, "-mode", "hub", "-dir", remoteDir, "-tracker-port", "0"}
+		cmd := []string{opts.agentPath(), "-mode", "hub", "-dir", remoteDir, "-tracker-port", "0", "-hash", normalizeAlgorithm(opts.Algorithm)}
+		cmd = append(cmd, opts.deltaArgs()...)
 		// We expect this to block until context is cancelled OR stdin is closed
-		_ = ExecCmd(hubCtx, config, client, leader, cmd, remotecommand.StreamOptions{
+		_ = t.Exec(hubCtx, leader, cmd, remotecommand.StreamOptions{
 			Stdin:  stdinReader,
 			Stdout: pw,
 			Stderr: os.Stderr,
@@ -80,64 +132,206 @@ func SyncPods(ctx context.Context, config *rest.Config, client *kubernetes.Clien
 	}()
 
 	// Read Hub Output to find the port
-	// "Hub listening on :38573"
-	scanner := bufio.NewScanner(pr)
-	var hubPort string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "Hub listening on") {
-			parts := strings.Split(line, ":")
-			if len(parts) > 1 {
-				hubPort = parts[len(parts)-1]
-				klog.Infof("Hub started on port %s", hubPort)
-				break
-			}
-		}
-	}
+	// "Hub listening on [::]:38573"
+	host, hubPort, err := scanHubAddr(pr)
 	// Consume remaining output in background to avoid blocking
 	go func() {
 		_, _ = io.Copy(io.Discard, pr)
 	}()
-
-	if hubPort == "" {
-		return fmt.Errorf("failed to get hub port")
+	if err != nil {
+		return fmt.Errorf("failed to get hub port: %w", err)
 	}
+	klog.Infof("Hub started on %s port %s", host, hubPort)
 
-	// Get Leader IP
-	leaderIP := leader.Status.PodIP
-	if leaderIP == "" {
-		return fmt.Errorf("leader pod %s has no IP", leader.Name)
+	// Get Leader address
+	if leader.Address == "" {
+		return fmt.Errorf("leader %s has no address", leader.Name)
 	}
-	hubURL := fmt.Sprintf("http://%s", net.JoinHostPort(leaderIP, hubPort))
+	hubURL := fmt.Sprintf("http://%s", net.JoinHostPort(leader.Address, hubPort))
 
 	// Run Peers
-	peers := pods[1:]
-	klog.Infof("Starting sync on %d peers...", len(peers))
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(peers))
-
-	for _, peer := range peers {
-		wg.Add(1)
-		go func(p corev1.Pod) {
-			defer wg.Done()
-			cmd := []string{AgentFile, "-mode", "peer", "-dir", remoteDir, "-tracker", hubURL, "-cleanup"}
-			// This Exec should block until peer is done
-			if err := ExecCmd(ctx, config, client, p, cmd, remotecommand.StreamOptions{
-				Stdout: os.Stdout,
-				Stderr: os.Stderr,
-			}); err != nil {
-				errCh <- fmt.Errorf("peer %s failed: %w", p.Name, err)
-			}
-		}(peer)
+	peers := make([]Target, 0, len(targets)-1)
+	for _, target := range targets {
+		if target.Namespace != leader.Namespace || target.Name != leader.Name {
+			peers = append(peers, target)
+		}
+	}
+	ps := peerSync{transport: t, remoteDir: remoteDir, digest: digest, opts: opts}
+	if err := ps.run(ctx, peers, hubURL); err != nil {
+		return err
 	}
 
-	wg.Wait()
-	close(errCh)
+	klog.Info("Sync completed successfully")
+	return nil
+}
+
+// peerSync runs the agent in peer mode on the targets
+type peerSync struct {
+	transport Transport
+	remoteDir string
+	digest    string
+	opts      Options
+}
 
-	if len(errCh) > 0 {
-		return <-errCh // Return first error
+// peerResult is the outcome of a peer sync, hubURL is set if the peer serves the files
+type peerResult struct {
+	target Target
+	hubURL string
+	err    error
+}
+
+// run syncs the peers from the leader hub. With more peers than HubFanout they
+// are synced in waves, every hub serving at most HubFanout peers of a wave, and
+// the peers of a wave serve the files as hubs to the next waves so the leader
+// uplink does not limit the sync of many peers. The other peers complete even
+// if some fail, all the failures are reported.
+func (ps peerSync) run(ctx context.Context, peers []Target, leaderURL string) error {
+	fanout := ps.opts.HubFanout
+	if fanout <= 0 || fanout > len(peers) {
+		fanout = len(peers)
 	}
 
-	klog.Info("SyncPods completed successfully")
+	// The peers serving as hubs exit once their stdin is closed
+	serveCtx, stopServing := context.WithCancel(ctx)
+	var serving sync.WaitGroup
+	var stdinWriters []*io.PipeWriter
+	defer func() {
+		for _, w := range stdinWriters {
+			_ = w.Close()
+		}
+		stopServing()
+		serving.Wait()
+	}()
+
+	hubs := []string{leaderURL}
+	var errs []error
+	for remaining := peers; len(remaining) > 0; {
+		wave := remaining[:min(len(remaining), len(hubs)*fanout)]
+		remaining = remaining[len(wave):]
+		klog.Infof("Starting sync on %d peers from %d hubs...", len(wave), len(hubs))
+
+		results := make(chan peerResult, len(wave))
+		for i, p := range wave {
+			// the leader is the fallback of the peers served by other hubs
+			trackers := []string{hubs[i%len(hubs)]}
+			if trackers[0] != leaderURL {
+				trackers = append(trackers, leaderURL)
+			}
+			// the peers only serve the files if more peers follow
+			if len(remaining) == 0 || p.Address == "" {
+				go func() {
+					results <- peerResult{target: p, err: ps.sync(ctx, p, trackers)}
+				}()
+				continue
+			}
+			stdinReader, stdinWriter := io.Pipe()
+			stdinWriters = append(stdinWriters, stdinWriter)
+			serving.Add(1)
+			go func() {
+				defer serving.Done()
+				ps.serve(serveCtx, p, trackers, stdinReader, results)
+			}()
+		}
+
+		for range wave {
+			res := <-results
+			switch {
+			case res.err != nil:
+				klog.Errorf("Peer %s failed: %v", res.target.Name, res.err)
+				errs = append(errs, fmt.Errorf("peer %s failed: %w", res.target.Name, res.err))
+			case res.hubURL != "":
+				klog.Infof("Peer %s synced, serving the next peers on %s", res.target.Name, res.hubURL)
+				hubs = append(hubs, res.hubURL)
+			default:
+				klog.Infof("Peer %s synced", res.target.Name)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d peers failed: %w", len(errs), len(peers), errors.Join(errs...))
+	}
 	return nil
 }
+
+// cmd returns the agent command syncing the peer from the trackers
+func (ps peerSync) cmd(trackers []string) []string {
+	cmd := []string{ps.opts.agentPath(), "-mode", "peer", "-dir", ps.remoteDir, "-tracker", strings.Join(trackers, ",")}
+	cmd = append(cmd, ps.opts.mirrorArgs()...)
+	cmd = append(cmd, ps.opts.deltaArgs()...)
+	return append(cmd, ps.opts.digestArgs(ps.digest)...)
+}
+
+// sync blocks until the peer is synced
+func (ps peerSync) sync(ctx context.Context, p Target, trackers []string) error {
+	cmd := append(ps.cmd(trackers), "-cleanup")
+	return ps.transport.Exec(ctx, p, cmd, remotecommand.StreamOptions{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+}
+
+// serve syncs the peer and then serves the files from it as a hub until stdin
+// is closed. The result is sent once the peer is serving or failed.
+func (ps peerSync) serve(ctx context.Context, p Target, trackers []string, stdin io.Reader, results chan<- peerResult) {
+	// Use port 0 to let OS assign a free port, the hub cleans up on exit
+	cmd := append(ps.cmd(trackers), "-serve", "-tracker-port", "0", "-hash", normalizeAlgorithm(ps.opts.Algorithm))
+
+	pr, pw := io.Pipe()
+	execErr := make(chan error, 1)
+	go func() {
+		execErr <- ps.transport.Exec(ctx, p, cmd, remotecommand.StreamOptions{
+			Stdin:  stdin,
+			Stdout: pw,
+			Stderr: os.Stderr,
+		})
+		_ = pw.Close()
+	}()
+
+	_, port, err := scanHubAddr(pr)
+	// Consume remaining output in background to avoid blocking
+	go func() {
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	if err != nil {
+		// the peer exited before serving, its error explains why
+		if exitErr := <-execErr; exitErr != nil {
+			err = exitErr
+		}
+		results <- peerResult{target: p, err: err}
+		return
+	}
+	results <- peerResult{target: p, hubURL: fmt.Sprintf("http://%s", net.JoinHostPort(p.Address, port))}
+	<-execErr
+}
+
+// hubListeningPrefix precedes the listener address printed by the hub
+const hubListeningPrefix = "Hub listening on "
+
+// scanHubAddr reads the hub output until it prints the address it listens on
+func scanHubAddr(r io.Reader) (string, string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, hubListeningPrefix) {
+			return parseHubAddr(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("hub exited before listening")
+}
+
+// parseHubAddr returns the host and port of the hub from its listening line,
+// the host may be an IPv6 address like in "Hub listening on [::]:38573".
+func parseHubAddr(line string) (string, string, error) {
+	addr := strings.TrimSpace(strings.TrimPrefix(line, hubListeningPrefix))
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid hub address %q: %w", addr, err)
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("invalid hub address %q: missing port", addr)
+	}
+	return host, port, nil
+}
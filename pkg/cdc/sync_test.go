@@ -1,10 +1,15 @@
 package cdc
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -12,6 +17,8 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/aojea/krun/pkg/files"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -32,7 +39,7 @@ func TestSyncLocalToLeader(t *testing.T) {
 	originalExecCmd := ExecCmd
 	defer func() { ExecCmd = originalExecCmd }()
 
-	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, cmd []string, options remotecommand.StreamOptions) error {
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
 		execCallCount++
 		mode := ""
 		// Parse mode from cmd
@@ -68,7 +75,7 @@ func TestSyncLocalToLeader(t *testing.T) {
 	pod := corev1.Pod{}
 	pod.Name = "test-pod"
 
-	err = SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", nil, false)
+	err = SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", Options{}, false)
 	if err != nil {
 		t.Fatalf("SyncLocalToLeader failed: %v", err)
 	}
@@ -102,7 +109,7 @@ func TestSyncPods(t *testing.T) {
 	var mu sync.Mutex
 	execHistory := []string{}
 
-	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, cmd []string, options remotecommand.StreamOptions) error {
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
 		mode := ""
 		for i, arg := range cmd {
 			if arg == "-mode" && i+1 < len(cmd) {
@@ -145,6 +152,11 @@ func TestSyncPods(t *testing.T) {
 			return nil
 		}
 
+		if mode == "statfs" {
+			_, _ = fmt.Fprintln(options.Stdout, `{"free": 1099511627776}`)
+			return nil
+		}
+
 		return nil
 	}
 
@@ -154,7 +166,7 @@ func TestSyncPods(t *testing.T) {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
-	err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", nil)
+	err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{})
 	if err != nil {
 		t.Fatalf("SyncPods failed: %v", err)
 	}
@@ -199,7 +211,7 @@ func TestGenerateManifest(t *testing.T) {
 	}
 
 	// 2. Run GenerateManifest
-	manifest, err := GenerateManifest(srcDir, nil, chunksDir)
+	manifest, err := GenerateManifest(srcDir, chunksDir, Options{})
 	if err != nil {
 		t.Fatalf("GenerateManifest failed: %v", err)
 	}
@@ -223,8 +235,8 @@ func TestGenerateManifest(t *testing.T) {
 	}
 	// Run again with exclusion
 	chunksDir2 := t.TempDir()
-	exclude := regexp.MustCompile(`ignore\.me`)
-	manifest2, err := GenerateManifest(srcDir, exclude, chunksDir2)
+	exclude := files.Patterns{regexp.MustCompile(`ignore\.me`)}
+	manifest2, err := GenerateManifest(srcDir, chunksDir2, Options{Exclude: exclude})
 	if err != nil {
 		t.Fatalf("GenerateManifest with exclusion failed: %v", err)
 	}
@@ -233,3 +245,1266 @@ func TestGenerateManifest(t *testing.T) {
 		t.Errorf("Expected same number of chunks with exclusion (got %d vs %d)", len(manifest2.Chunks), len(manifest.Chunks))
 	}
 }
+
+func TestGenerateManifestAlgorithm(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	sha, err := GenerateManifest(srcDir, t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if sha.Algorithm != HashSHA256 {
+		t.Errorf("Expected default algorithm %s, got %s", HashSHA256, sha.Algorithm)
+	}
+
+	blake, err := GenerateManifest(srcDir, t.TempDir(), Options{Algorithm: HashBLAKE3})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	if blake.Algorithm != HashBLAKE3 {
+		t.Errorf("Expected algorithm %s, got %s", HashBLAKE3, blake.Algorithm)
+	}
+	if len(sha.Chunks) != len(blake.Chunks) {
+		t.Fatalf("Expected the same chunks, got %d and %d", len(sha.Chunks), len(blake.Chunks))
+	}
+	for i := range sha.Chunks {
+		if sha.Chunks[i].Hash == blake.Chunks[i].Hash {
+			t.Errorf("Expected different hashes for chunk %d", i)
+		}
+	}
+
+	if _, err := GenerateManifest(srcDir, t.TempDir(), Options{Algorithm: "md5"}); err == nil {
+		t.Error("Expected unsupported algorithm to fail")
+	}
+}
+
+func TestGenerateManifestCompression(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "text.txt"), bytes.Repeat([]byte("compressible "), 100000), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	plainDir := t.TempDir()
+	plain, err := GenerateManifest(srcDir, plainDir, Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	compressedDir := t.TempDir()
+	compressed, err := GenerateManifest(srcDir, compressedDir, Options{Compress: true})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	if len(plain.Chunks) != len(compressed.Chunks) {
+		t.Fatalf("Expected the same chunks, got %d and %d", len(plain.Chunks), len(compressed.Chunks))
+	}
+	for i, c := range compressed.Chunks {
+		// Hashes are computed over the uncompressed content
+		if c.Hash != plain.Chunks[i].Hash || c.Size != plain.Chunks[i].Size {
+			t.Errorf("Chunk %d differs from the uncompressed manifest: %+v vs %+v", i, c, plain.Chunks[i])
+		}
+		if plain.Chunks[i].Codec != "" {
+			t.Errorf("Expected no codec without compression, got %q", plain.Chunks[i].Codec)
+		}
+		if c.Codec != CodecGzip {
+			t.Fatalf("Expected compressible chunk %d to use %s, got %q", i, CodecGzip, c.Codec)
+		}
+
+		stored, err := os.ReadFile(filepath.Join(compressedDir, c.Hash))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		if uint(len(stored)) != c.StoredSize || c.StoredSize >= c.Size {
+			t.Errorf("Unexpected stored size %d for chunk of %d bytes (file %d bytes)", c.StoredSize, c.Size, len(stored))
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			t.Fatalf("Failed to decode chunk: %v", err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Failed to decode chunk: %v", err)
+		}
+		original, err := os.ReadFile(filepath.Join(plainDir, c.Hash))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		if !bytes.Equal(data, original) {
+			t.Errorf("Decoded chunk %d does not match the original content", i)
+		}
+	}
+}
+
+func TestSyncPodsLeaderByFreeDisk(t *testing.T) {
+	pods := []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-0"},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-1"},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.2"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-2"},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.3"},
+		},
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte(strings.Repeat("data", 1024)), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	tests := []struct {
+		name       string
+		freeSpace  map[string]int
+		wantLeader string
+		wantErr    bool
+	}{
+		{
+			name:       "first pod has enough space",
+			freeSpace:  map[string]int{"pod-0": 1 << 30, "pod-1": 1 << 30, "pod-2": 1 << 30},
+			wantLeader: "pod-0",
+		},
+		{
+			name:       "first pod is full",
+			freeSpace:  map[string]int{"pod-0": 10, "pod-1": 1 << 30, "pod-2": 1 << 30},
+			wantLeader: "pod-1",
+		},
+		{
+			name:      "all pods are full",
+			freeSpace: map[string]int{"pod-0": 10, "pod-1": 10, "pod-2": 10},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var hubPod string
+			var peerPods []string
+
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				mode := ""
+				for i, arg := range cmd {
+					if arg == "-mode" && i+1 < len(cmd) {
+						mode = cmd[i+1]
+					}
+				}
+				switch mode {
+				case "statfs":
+					_, _ = fmt.Fprintf(options.Stdout, `{"free": %d}`+"\n", tt.freeSpace[pod.Name])
+				case "check":
+					_ = json.NewEncoder(options.Stdout).Encode([]string{})
+				case "hub":
+					mu.Lock()
+					hubPod = pod.Name
+					mu.Unlock()
+					_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+					<-ctx.Done()
+				case "peer":
+					mu.Lock()
+					peerPods = append(peerPods, pod.Name)
+					mu.Unlock()
+				}
+				return nil
+			}
+
+			err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SyncPods() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if hubPod != tt.wantLeader {
+				t.Errorf("Expected hub on leader %s, got %s", tt.wantLeader, hubPod)
+			}
+			if len(peerPods) != len(pods)-1 {
+				t.Errorf("Expected %d peers, got %v", len(pods)-1, peerPods)
+			}
+			for _, p := range peerPods {
+				if p == tt.wantLeader {
+					t.Errorf("Leader %s should not run as peer", p)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []ChunkInfo
+		wantErr bool
+	}{
+		{
+			name:   "unique chunks",
+			chunks: []ChunkInfo{{Hash: "a", Size: 1}, {Hash: "b", Size: 2}},
+		},
+		{
+			name:   "repeated chunk",
+			chunks: []ChunkInfo{{Hash: "a", Size: 1}, {Hash: "b", Size: 2}, {Hash: "a", Size: 1}},
+		},
+		{
+			name:    "conflicting size",
+			chunks:  []ChunkInfo{{Hash: "a", Size: 1}, {Hash: "a", Size: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "conflicting codec",
+			chunks:  []ChunkInfo{{Hash: "a", Size: 10}, {Hash: "a", Size: 10, Codec: CodecGzip, StoredSize: 5}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Manifest{Chunks: tt.chunks}.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateManifestChunkSize(t *testing.T) {
+	srcDir := t.TempDir()
+	data := make([]byte, 8*1024*1024)
+	if _, err := rand.New(rand.NewSource(1)).Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "random.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	small, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	smallManifest, err := GenerateManifest(srcDir, t.TempDir(), Options{Chunker: small})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+	defaultManifest, err := GenerateManifest(srcDir, t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	if len(smallManifest.Chunks) <= 2*len(defaultManifest.Chunks) {
+		t.Errorf("Expected many more chunks with a 64KiB average, got %d vs %d", len(smallManifest.Chunks), len(defaultManifest.Chunks))
+	}
+	if smallManifest.Chunker == nil || *smallManifest.Chunker != small {
+		t.Errorf("Expected the manifest to record %+v, got %+v", small, smallManifest.Chunker)
+	}
+	if defaultManifest.Chunker == nil || *defaultManifest.Chunker != DefaultChunkerConfig() {
+		t.Errorf("Expected the manifest to record the default chunker, got %+v", defaultManifest.Chunker)
+	}
+
+	var smallTotal, defaultTotal uint
+	for _, c := range smallManifest.Chunks {
+		if c.Size > small.MaxSize {
+			t.Errorf("Chunk %s of %d bytes exceeds the max size %d", c.Hash, c.Size, small.MaxSize)
+		}
+		smallTotal += c.Size
+	}
+	for _, c := range defaultManifest.Chunks {
+		defaultTotal += c.Size
+	}
+	if smallTotal != defaultTotal {
+		t.Errorf("Expected the same stream size, got %d and %d", smallTotal, defaultTotal)
+	}
+
+	if _, err := ChunkerConfigForAverage(MaxAverageChunkSize); err != nil {
+		t.Errorf("Expected the maximum average size to be valid: %v", err)
+	}
+	// 1<<61 overflows the maximum size of 8 times the average
+	for _, avg := range []uint64{0, 1000, 3 * 1024 * 1024, 16 * 1024 * 1024, 1 << 30, 1 << 61, 1 << 63} {
+		if _, err := ChunkerConfigForAverage(avg); err == nil {
+			t.Errorf("Expected error for average size %d", avg)
+		}
+	}
+}
+
+// writeRandomTree creates files with random and repeated content to get
+// many chunks, some of them referenced several times.
+func writeRandomTree(t testing.TB, dir string, n int, size int) {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, size)
+	for i := 0; i < n; i++ {
+		// every other file repeats the previous content
+		if i%2 == 0 {
+			if _, err := r.Read(data); err != nil {
+				t.Fatalf("Failed to generate data: %v", err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.bin", i)), data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+}
+
+func TestGenerateManifestParallel(t *testing.T) {
+	srcDir := t.TempDir()
+	writeRandomTree(t, srcDir, 8, 2*1024*1024)
+	small, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			serialDir := t.TempDir()
+			serial, err := GenerateManifest(srcDir, serialDir, Options{Chunker: small, Compress: compress, HashWorkers: 1})
+			if err != nil {
+				t.Fatalf("GenerateManifest failed: %v", err)
+			}
+			parallelDir := t.TempDir()
+			parallel, err := GenerateManifest(srcDir, parallelDir, Options{Chunker: small, Compress: compress, HashWorkers: 8})
+			if err != nil {
+				t.Fatalf("GenerateManifest failed: %v", err)
+			}
+
+			serialJSON, _ := json.Marshal(serial)
+			parallelJSON, _ := json.Marshal(parallel)
+			if !bytes.Equal(serialJSON, parallelJSON) {
+				t.Fatalf("Parallel manifest differs from the serial one")
+			}
+
+			entries, err := os.ReadDir(parallelDir)
+			if err != nil {
+				t.Fatalf("Failed to read chunks dir: %v", err)
+			}
+			unique := map[string]bool{}
+			for _, c := range parallel.Chunks {
+				unique[c.Hash] = true
+			}
+			if len(entries) != len(unique) {
+				t.Errorf("Expected %d chunk files, got %d", len(unique), len(entries))
+			}
+			for _, c := range parallel.Chunks {
+				got, err := os.ReadFile(filepath.Join(parallelDir, c.Hash))
+				if err != nil {
+					t.Fatalf("Failed to read chunk: %v", err)
+				}
+				want, err := os.ReadFile(filepath.Join(serialDir, c.Hash))
+				if err != nil {
+					t.Fatalf("Failed to read chunk: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("Chunk %s differs from the serial one", c.Hash)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGenerateManifest(b *testing.B) {
+	srcDir := b.TempDir()
+	writeRandomTree(b, srcDir, 16, 4*1024*1024)
+
+	for _, workers := range []int{1, 4, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(16 * 4 * 1024 * 1024)
+			for i := 0; i < b.N; i++ {
+				if _, err := GenerateManifest(srcDir, b.TempDir(), Options{HashWorkers: workers}); err != nil {
+					b.Fatalf("GenerateManifest failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestStats(t *testing.T) {
+	srcDir := t.TempDir()
+	data := make([]byte, 2*1024*1024)
+	if _, err := rand.New(rand.NewSource(1)).Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	// The same content three times
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	small, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+	m, err := GenerateManifest(srcDir, t.TempDir(), Options{Chunker: small})
+	if err != nil {
+		t.Fatalf("GenerateManifest failed: %v", err)
+	}
+
+	stats := m.Stats()
+	if stats.Chunks != len(m.Chunks) {
+		t.Errorf("Expected %d chunks, got %d", len(m.Chunks), stats.Chunks)
+	}
+	// The tarball has the data three times plus the headers
+	if stats.TotalBytes < 3*uint64(len(data)) {
+		t.Errorf("Expected at least %d total bytes, got %d", 3*len(data), stats.TotalBytes)
+	}
+	if stats.UniqueBytes >= stats.TotalBytes || stats.UniqueChunks >= stats.Chunks {
+		t.Errorf("Expected duplicated chunks, got %s", stats)
+	}
+	if ratio := stats.DedupRatio(); ratio < 2 {
+		t.Errorf("Expected a dedup ratio of almost 3, got %.2f", ratio)
+	}
+
+	// Counts on a known manifest
+	known := Manifest{Chunks: []ChunkInfo{{Hash: "a", Size: 10}, {Hash: "b", Size: 5}, {Hash: "a", Size: 10}}}
+	want := ManifestStats{TotalBytes: 25, Chunks: 3, UniqueChunks: 2, UniqueBytes: 15}
+	if got := known.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if got := (Manifest{}).Stats().DedupRatio(); got != 1 {
+		t.Errorf("Expected a ratio of 1 for an empty manifest, got %v", got)
+	}
+}
+
+func TestSyncLocalToLeaderUnchanged(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	// Mock agent remembering the digest of the applied manifest
+	var applied string
+	modes := map[string]int{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode, digest := "", ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+			if arg == "-manifest-digest" && i+1 < len(cmd) {
+				digest = cmd[i+1]
+			}
+		}
+		modes[mode]++
+
+		switch mode {
+		case "digest":
+			return json.NewEncoder(options.Stdout).Encode(digestResult{Digest: applied})
+		case "check":
+			_, _ = io.Copy(io.Discard, options.Stdin)
+			return json.NewEncoder(options.Stdout).Encode([]string{})
+		case "ingest":
+			_, _ = io.Copy(io.Discard, options.Stdin)
+			applied = digest
+		}
+		return nil
+	}
+
+	pod := corev1.Pod{}
+	pod.Name = "test-pod"
+	runSync := func() {
+		t.Helper()
+		if err := SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", Options{}, false); err != nil {
+			t.Fatalf("SyncLocalToLeader failed: %v", err)
+		}
+	}
+
+	runSync()
+	if modes["ingest"] != 1 || applied == "" {
+		t.Fatalf("Expected the first sync to ingest the manifest, got %v (digest %q)", modes, applied)
+	}
+
+	// Nothing changed, only the digest is queried
+	modes = map[string]int{}
+	runSync()
+	if modes["ingest"] != 0 || modes["check"] != 0 {
+		t.Errorf("Expected no check or ingest calls for an unchanged source, got %v", modes)
+	}
+
+	// A modified source is synced again
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello again"), 0644); err != nil {
+		t.Fatalf("Failed to modify test file: %v", err)
+	}
+	modes = map[string]int{}
+	runSync()
+	if modes["ingest"] != 1 {
+		t.Errorf("Expected the modified source to be ingested, got %v", modes)
+	}
+}
+
+func TestSyncLocalToLeaderIncremental(t *testing.T) {
+	srcDir := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	for _, name := range []string{"a.bin", "b.bin"} {
+		data := make([]byte, 1<<20)
+		_, _ = r.Read(data)
+		if err := os.WriteFile(filepath.Join(srcDir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "config.txt"), []byte("lr=0.1"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	chunker, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	// Mock agent storing the chunks of the ingested manifests
+	stored := map[string]bool{}
+	var chunks, missing int
+	var ingested int64
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+		}
+		switch mode {
+		case "digest":
+			return json.NewEncoder(options.Stdout).Encode(digestResult{})
+		case "check":
+			var m Manifest
+			if err := json.NewDecoder(options.Stdin).Decode(&m); err != nil {
+				return err
+			}
+			hashes := []string{}
+			for _, c := range m.Chunks {
+				if !stored[c.Hash] {
+					hashes = append(hashes, c.Hash)
+				}
+				stored[c.Hash] = true
+			}
+			chunks, missing = len(m.Chunks), len(hashes)
+			return json.NewEncoder(options.Stdout).Encode(hashes)
+		case "ingest":
+			n, err := io.Copy(io.Discard, options.Stdin)
+			ingested = n
+			return err
+		}
+		return nil
+	}
+
+	pod := corev1.Pod{}
+	pod.Name = "test-pod"
+	runSync := func() {
+		t.Helper()
+		if err := SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", Options{Chunker: chunker}, false); err != nil {
+			t.Fatalf("SyncLocalToLeader failed: %v", err)
+		}
+	}
+
+	runSync()
+	if missing != chunks || chunks < 10 {
+		t.Fatalf("Expected the first sync to upload all the chunks, %d missing of %d", missing, chunks)
+	}
+	firstIngested := ingested
+
+	// Only the chunks of the modified file are uploaded again
+	if err := os.WriteFile(filepath.Join(srcDir, "config.txt"), []byte("lr=0.01"), 0644); err != nil {
+		t.Fatalf("Failed to modify test file: %v", err)
+	}
+	runSync()
+	if missing == 0 || missing > 2 {
+		t.Errorf("Expected only the modified chunks to be uploaded, %d missing of %d", missing, chunks)
+	}
+	if ingested*4 > firstIngested {
+		t.Errorf("Expected the second upload to be much smaller, %d bytes after %d bytes", ingested, firstIngested)
+	}
+}
+
+func TestSyncLocalToLeaderMirror(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	tests := []struct {
+		name       string
+		opts       Options
+		wantArgs   []string
+		wantDigest bool
+	}{
+		{name: "mirror", opts: Options{}, wantDigest: true},
+		{name: "no mirror", opts: Options{NoMirror: true}, wantArgs: []string{"-mirror=false"}},
+		{name: "dry run", opts: Options{MirrorDryRun: true}, wantArgs: []string{"-dry-run"}},
+		{name: "mirror exclude", opts: Options{MirrorExclude: files.Patterns{regexp.MustCompile(`^logs/`)}}, wantArgs: []string{"-mirror-exclude ^logs/"}, wantDigest: true},
+		{name: "no mirror ignores the exclude", opts: Options{NoMirror: true, MirrorExclude: files.Patterns{regexp.MustCompile(`^logs/`)}}, wantArgs: []string{"-mirror=false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ingestCmd []string
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				mode := ""
+				for i, arg := range cmd {
+					if arg == "-mode" && i+1 < len(cmd) {
+						mode = cmd[i+1]
+					}
+				}
+				switch mode {
+				case "digest":
+					return json.NewEncoder(options.Stdout).Encode(digestResult{})
+				case "check":
+					_, _ = io.Copy(io.Discard, options.Stdin)
+					return json.NewEncoder(options.Stdout).Encode([]string{})
+				case "ingest":
+					ingestCmd = cmd
+					_, _ = io.Copy(io.Discard, options.Stdin)
+				}
+				return nil
+			}
+
+			pod := corev1.Pod{}
+			pod.Name = "test-pod"
+			if err := SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", tt.opts, false); err != nil {
+				t.Fatalf("SyncLocalToLeader failed: %v", err)
+			}
+			args := strings.Join(ingestCmd, " ")
+			for _, arg := range []string{"-mirror=false", "-dry-run", "-mirror-exclude ^logs/"} {
+				want := false
+				for _, w := range tt.wantArgs {
+					want = want || w == arg
+				}
+				if strings.Contains(args, arg) != want {
+					t.Errorf("Ingest command %q, expected %s: %v", args, arg, want)
+				}
+			}
+			if strings.Contains(args, "-manifest-digest") != tt.wantDigest {
+				t.Errorf("Ingest command %q, expected the digest to be recorded: %v", args, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestParseHubAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{name: "any address", line: "Hub listening on :38573", wantPort: "38573"},
+		{name: "IPv4", line: "Hub listening on 0.0.0.0:38573", wantHost: "0.0.0.0", wantPort: "38573"},
+		{name: "IPv6", line: "Hub listening on [::]:38573", wantHost: "::", wantPort: "38573"},
+		{name: "IPv6 address", line: "Hub listening on [fd00::1]:80\n", wantHost: "fd00::1", wantPort: "80"},
+		{name: "IPv6 without brackets", line: "Hub listening on fd00::1:80", wantErr: true},
+		{name: "missing port", line: "Hub listening on 10.0.0.1", wantErr: true},
+		{name: "empty port", line: "Hub listening on 10.0.0.1:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, err := parseHubAddr(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHubAddr(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("parseHubAddr(%q) = %q, %q, want %q, %q", tt.line, host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestSyncPodsIPv6(t *testing.T) {
+	pods := []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-0"},
+			Status:     corev1.PodStatus{PodIP: "fd00::1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-1"},
+			Status:     corev1.PodStatus{PodIP: "fd00::2"},
+		},
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	var trackers []string
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+		}
+		switch mode {
+		case "hub":
+			_, _ = fmt.Fprintln(options.Stdout, "Hub listening on [::]:38573")
+			<-ctx.Done()
+		case "check":
+			_ = json.NewEncoder(options.Stdout).Encode([]string{})
+		case "statfs":
+			_, _ = fmt.Fprintln(options.Stdout, `{"free": 1099511627776}`)
+		case "peer":
+			for i, arg := range cmd {
+				if arg == "-tracker" && i+1 < len(cmd) {
+					mu.Lock()
+					trackers = append(trackers, cmd[i+1])
+					mu.Unlock()
+				}
+			}
+		}
+		return nil
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	leader := func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+		return targets[0], nil
+	}
+	if err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{LeaderSelector: leader}); err != nil {
+		t.Fatalf("SyncPods failed: %v", err)
+	}
+	if len(trackers) != 1 || trackers[0] != "http://[fd00::1]:38573" {
+		t.Errorf("Expected the peer to use the hub on the leader IPv6 address, got %v", trackers)
+	}
+}
+
+func TestSyncPodsPeerErrors(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 5; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)},
+			Status:     corev1.PodStatus{PodIP: fmt.Sprintf("10.0.0.%d", i+1)},
+		})
+	}
+	// pod-0 is the leader, the peers fail for different reasons
+	peerErrors := map[string]error{
+		"pod-1": errors.New("no space left on device"),
+		"pod-3": errors.New("connection refused"),
+		"pod-4": errors.New("digest mismatch"),
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	var synced []string
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+		}
+		switch mode {
+		case "hub":
+			_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+			<-ctx.Done()
+		case "check":
+			_ = json.NewEncoder(options.Stdout).Encode([]string{})
+		case "peer":
+			if err := peerErrors[pod.Name]; err != nil {
+				return err
+			}
+			mu.Lock()
+			synced = append(synced, pod.Name)
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	leader := func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+		return targets[0], nil
+	}
+	err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{LeaderSelector: leader})
+	if err == nil {
+		t.Fatal("Expected SyncPods to fail")
+	}
+	if !strings.Contains(err.Error(), "3 of 4 peers failed") {
+		t.Errorf("Expected the number of failed peers in %q", err)
+	}
+	for name, peerErr := range peerErrors {
+		if !errors.Is(err, peerErr) {
+			t.Errorf("Expected the error of peer %s in %q", name, err)
+		}
+	}
+	if len(synced) != 1 || synced[0] != "pod-2" {
+		t.Errorf("Expected the successful peer to complete, got %v", synced)
+	}
+}
+
+func TestSyncPodsChunksOnce(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 4; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)},
+			Status:     corev1.PodStatus{PodIP: fmt.Sprintf("10.0.0.%d", i+1)},
+		})
+	}
+
+	originalExecCmd := ExecCmd
+	originalGenerateManifest := generateManifest
+	defer func() {
+		ExecCmd = originalExecCmd
+		generateManifest = originalGenerateManifest
+	}()
+
+	var chunkings int
+	var chunksDirs []string
+	generateManifest = func(src, chunksDir string, opts Options) (Manifest, error) {
+		chunkings++
+		chunksDirs = append(chunksDirs, chunksDir)
+		return GenerateManifest(src, chunksDir, opts)
+	}
+	var ingested int
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+		}
+		switch mode {
+		case "hub":
+			_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+			<-ctx.Done()
+		case "check":
+			// every chunk is missing on the leader
+			var m Manifest
+			if err := json.NewDecoder(options.Stdin).Decode(&m); err != nil {
+				return err
+			}
+			var missing []string
+			for _, c := range m.Chunks {
+				missing = append(missing, c.Hash)
+			}
+			return json.NewEncoder(options.Stdout).Encode(missing)
+		case "ingest":
+			// the chunks are read from the directory chunked before
+			tr := tar.NewReader(options.Stdin)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if hdr.Name != ManifestFile {
+					ingested++
+				}
+			}
+		}
+		return nil
+	}
+
+	srcDir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(filepath.Join(srcDir, fmt.Sprintf("file-%d.txt", i)), []byte(fmt.Sprintf("data %d", i)), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	leader := func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+		return targets[0], nil
+	}
+	if err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{LeaderSelector: leader}); err != nil {
+		t.Fatalf("SyncPods failed: %v", err)
+	}
+	if chunkings != 1 {
+		t.Errorf("Expected the files to be chunked once, got %d chunking passes in %v", chunkings, chunksDirs)
+	}
+	if ingested == 0 {
+		t.Error("Expected the leader to ingest the local chunks")
+	}
+}
+
+func TestSyncPodsLeaderCandidates(t *testing.T) {
+	ready := []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	notReady := []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse}}
+	pod := func(name, ip string, conditions []corev1.PodCondition) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     corev1.PodStatus{PodIP: ip, Conditions: conditions},
+		}
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	tests := []struct {
+		name       string
+		pods       []corev1.Pod
+		selector   LeaderSelector
+		wantLeader string
+		wantErr    bool
+	}{
+		{
+			name:       "pod without IP is skipped",
+			pods:       []corev1.Pod{pod("pod-0", "", ready), pod("pod-1", "10.0.0.2", ready), pod("pod-2", "10.0.0.3", ready)},
+			wantLeader: "pod-1",
+		},
+		{
+			name:       "ready pods go first",
+			pods:       []corev1.Pod{pod("pod-0", "10.0.0.1", notReady), pod("pod-1", "10.0.0.2", nil), pod("pod-2", "10.0.0.3", ready)},
+			wantLeader: "pod-2",
+		},
+		{
+			name:       "not ready pod with IP",
+			pods:       []corev1.Pod{pod("pod-0", "", ready), pod("pod-1", "10.0.0.2", notReady)},
+			wantLeader: "pod-1",
+		},
+		{
+			name:       "explicit leader",
+			pods:       []corev1.Pod{pod("pod-0", "10.0.0.1", ready), pod("pod-1", "10.0.0.2", ready), pod("pod-2", "10.0.0.3", ready)},
+			selector:   SelectLeaderByName("pod-2"),
+			wantLeader: "pod-2",
+		},
+		{
+			name:     "explicit leader without IP",
+			pods:     []corev1.Pod{pod("pod-0", "10.0.0.1", ready), pod("pod-1", "", ready)},
+			selector: SelectLeaderByName("pod-1"),
+			wantErr:  true,
+		},
+		{
+			name:     "explicit leader not found",
+			pods:     []corev1.Pod{pod("pod-0", "10.0.0.1", ready), pod("pod-1", "10.0.0.2", ready)},
+			selector: SelectLeaderByName("pod-9"),
+			wantErr:  true,
+		},
+		{
+			name:    "no pod with IP",
+			pods:    []corev1.Pod{pod("pod-0", "", ready), pod("pod-1", "", ready)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var hubPod, ingestPod string
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				mode := ""
+				for i, arg := range cmd {
+					if arg == "-mode" && i+1 < len(cmd) {
+						mode = cmd[i+1]
+					}
+				}
+				switch mode {
+				case "statfs":
+					_, _ = fmt.Fprintln(options.Stdout, `{"free": 1099511627776}`)
+				case "check":
+					_ = json.NewEncoder(options.Stdout).Encode([]string{})
+				case "ingest":
+					mu.Lock()
+					ingestPod = pod.Name
+					mu.Unlock()
+				case "hub":
+					mu.Lock()
+					hubPod = pod.Name
+					mu.Unlock()
+					_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+					<-ctx.Done()
+				}
+				return nil
+			}
+
+			err := SyncPods(context.Background(), nil, nil, tt.pods, srcDir, "/remote/path", Options{LeaderSelector: tt.selector})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SyncPods() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ingestPod != tt.wantLeader || hubPod != tt.wantLeader {
+				t.Errorf("Expected leader %s, got ingest on %s and hub on %s", tt.wantLeader, ingestPod, hubPod)
+			}
+		})
+	}
+}
+
+func TestSyncPodsHubFanout(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i <= 20; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%02d", i)},
+			Status:     corev1.PodStatus{PodIP: fmt.Sprintf("10.0.0.%d", i+1)},
+		})
+	}
+	const fanout = 3
+	leaderURL := "http://10.0.0.1:12345"
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	trackers := map[string][]string{}
+	var servers, stopped int
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		serve := false
+		var tracker string
+		for i, arg := range cmd {
+			switch {
+			case arg == "-mode" && i+1 < len(cmd):
+				mode = cmd[i+1]
+			case arg == "-tracker" && i+1 < len(cmd):
+				tracker = cmd[i+1]
+			case arg == "-serve":
+				serve = true
+			}
+		}
+		switch mode {
+		case "hub":
+			_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+			<-ctx.Done()
+		case "check":
+			_ = json.NewEncoder(options.Stdout).Encode([]string{})
+		case "peer":
+			mu.Lock()
+			trackers[pod.Name] = strings.Split(tracker, ",")
+			if serve {
+				servers++
+			}
+			mu.Unlock()
+			if !serve {
+				return nil
+			}
+			// serve until stdin is closed
+			_, _ = fmt.Fprintln(options.Stdout, "Hub listening on [::]:8000")
+			_, _ = io.Copy(io.Discard, options.Stdin)
+			mu.Lock()
+			stopped++
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	leader := func(ctx context.Context, t Transport, targets []Target, remoteDir string, m Manifest) (Target, error) {
+		return targets[0], nil
+	}
+	if err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{LeaderSelector: leader, HubFanout: fanout}); err != nil {
+		t.Fatalf("SyncPods failed: %v", err)
+	}
+
+	// 3 peers from the leader, then 12 from 4 hubs, then the last 5 from 16 hubs
+	if len(trackers) != len(pods)-1 {
+		t.Fatalf("Expected %d peers synced, got %d", len(pods)-1, len(trackers))
+	}
+	if servers != 15 {
+		t.Errorf("Expected 15 peers serving as hubs, got %d", servers)
+	}
+	if stopped != servers {
+		t.Errorf("Expected the %d serving peers to stop, %d stopped", servers, stopped)
+	}
+	hubLoad := map[string]int{}
+	for name, tr := range trackers {
+		hubLoad[tr[0]]++
+		if tr[0] == leaderURL {
+			continue
+		}
+		if len(tr) != 2 || tr[1] != leaderURL {
+			t.Errorf("Expected peer %s to fall back to the leader, got trackers %v", name, tr)
+		}
+		if !strings.HasPrefix(tr[0], "http://10.0.0.") || !strings.HasSuffix(tr[0], ":8000") {
+			t.Errorf("Expected peer %s to download from another peer, got %s", name, tr[0])
+		}
+	}
+	// every hub serves at most fanout peers on each of the 3 waves
+	if len(hubLoad) <= 1 {
+		t.Errorf("Expected the peers to download from more than one hub, got %v", hubLoad)
+	}
+	for hub, load := range hubLoad {
+		if load > 3*fanout {
+			t.Errorf("Expected hub %s to serve at most %d peers, got %d", hub, 3*fanout, load)
+		}
+	}
+}
+
+func TestSyncLocalToLeaderProgress(t *testing.T) {
+	srcDir := t.TempDir()
+	data := make([]byte, 1024*1024)
+	if _, err := rand.New(rand.NewSource(1)).Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "random.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	chunker, err := ChunkerConfigForAverage(64 * 1024)
+	if err != nil {
+		t.Fatalf("ChunkerConfigForAverage failed: %v", err)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	// the leader misses every other chunk
+	var missing []string
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		mode := ""
+		for i, arg := range cmd {
+			if arg == "-mode" && i+1 < len(cmd) {
+				mode = cmd[i+1]
+			}
+		}
+		switch mode {
+		case "digest":
+			return json.NewEncoder(options.Stdout).Encode(digestResult{})
+		case "check":
+			var m Manifest
+			if err := json.NewDecoder(options.Stdin).Decode(&m); err != nil {
+				return err
+			}
+			for i, chunk := range m.Chunks {
+				if i%2 == 0 {
+					missing = append(missing, chunk.Hash)
+				}
+			}
+			return json.NewEncoder(options.Stdout).Encode(missing)
+		case "ingest":
+			_, _ = io.Copy(io.Discard, options.Stdin)
+		}
+		return nil
+	}
+
+	var reports []Progress
+	opts := Options{Chunker: chunker, Progress: func(p Progress) { reports = append(reports, p) }}
+	pod := corev1.Pod{}
+	pod.Name = "test-pod"
+	if err := SyncLocalToLeader(context.Background(), nil, nil, pod, srcDir, "/remote/path", opts, false); err != nil {
+		t.Fatalf("SyncLocalToLeader failed: %v", err)
+	}
+
+	phases := []Phase{PhaseChunking, PhaseChecking, PhaseUploading}
+	last := map[Phase]Progress{}
+	next := 0
+	for i, p := range reports {
+		prev, started := last[p.Phase]
+		if !started {
+			if next >= len(phases) || p.Phase != phases[next] {
+				t.Fatalf("Report %d: unexpected phase %s, expected the phases in order %v", i, p.Phase, phases)
+			}
+			if p.Done != 0 || p.Bytes != 0 {
+				t.Errorf("Report %d: phase %s started with progress %+v", i, p.Phase, p)
+			}
+			next++
+		} else {
+			if p.Phase != phases[next-1] {
+				t.Fatalf("Report %d: phase %s reported after phase %s", i, p.Phase, phases[next-1])
+			}
+			if p.Done < prev.Done || p.Bytes < prev.Bytes || (prev.Total > 0 && p.Total != prev.Total) {
+				t.Errorf("Report %d: progress went from %+v to %+v", i, prev, p)
+			}
+		}
+		last[p.Phase] = p
+	}
+	if next != len(phases) {
+		t.Fatalf("Expected the phases %v, got %d reports: %+v", phases, len(reports), reports)
+	}
+
+	chunking := last[PhaseChunking]
+	if chunking.Done < 8 || chunking.Done != chunking.Total || chunking.Bytes < uint64(len(data)) {
+		t.Errorf("Expected the chunking to complete with all the data, got %+v", chunking)
+	}
+	uploading := last[PhaseUploading]
+	if uploading.Total != len(missing) || uploading.Done != uploading.Total || uploading.Bytes == 0 {
+		t.Errorf("Expected the upload of the %d missing chunks to complete, got %+v", len(missing), uploading)
+	}
+}
+
+func TestSyncPodsAgentPath(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	var pods []corev1.Pod
+	for i := 0; i < 3; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)},
+			Status:     corev1.PodStatus{PodIP: fmt.Sprintf("10.0.0.%d", i+1)},
+		})
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	tests := []struct {
+		name      string
+		agentPath string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: AgentFile},
+		{name: "configured", agentPath: "/var/run/krun/agent", want: "/var/run/krun/agent"},
+		{name: "relative", agentPath: "krun-agent", wantErr: true},
+		{name: "root", agentPath: "/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			modes := map[string]string{} // mode -> binary
+			ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+				mode := ""
+				for i, arg := range cmd {
+					if arg == "-mode" && i+1 < len(cmd) {
+						mode = cmd[i+1]
+					}
+				}
+				mu.Lock()
+				modes[mode] = cmd[0]
+				mu.Unlock()
+				switch mode {
+				case "digest":
+					return json.NewEncoder(options.Stdout).Encode(digestResult{})
+				case "statfs":
+					_, _ = fmt.Fprintln(options.Stdout, `{"free": 1099511627776}`)
+				case "check":
+					_ = json.NewEncoder(options.Stdout).Encode([]string{})
+				case "ingest":
+					_, _ = io.Copy(io.Discard, options.Stdin)
+				case "hub":
+					_, _ = fmt.Fprintln(options.Stdout, "Hub listening on :12345")
+					<-ctx.Done()
+				}
+				return nil
+			}
+
+			err := SyncPods(context.Background(), nil, nil, pods, srcDir, "/remote/path", Options{AgentPath: tt.agentPath})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SyncPods() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(modes) != 0 {
+					t.Errorf("Expected no command with an invalid agent path, got %v", modes)
+				}
+				return
+			}
+			for _, mode := range []string{"digest", "statfs", "check", "ingest", "hub", "peer"} {
+				if got, ok := modes[mode]; !ok || got != tt.want {
+					t.Errorf("Expected the %s command to run %s, got %q", mode, tt.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package cdc
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Target is a host running the agent, a pod or a machine reached over SSH
+type Target struct {
+	// Name identifies the target in the Transport, the pod name or the ssh destination
+	Name string
+	// Namespace of the pod, empty for the other targets
+	Namespace string
+	// Address the other targets download the files from when it serves them,
+	// a target without it can not be the leader nor serve the peers.
+	Address string
+	// Ready targets are preferred as leader
+	Ready bool
+
+	// pod is the pod of the target for the KubeTransport
+	pod *corev1.Pod
+}
+
+// Transport runs the agent commands on the targets
+type Transport interface {
+	// Exec runs the command on the target streaming the options, it blocks until the command exits
+	Exec(ctx context.Context, target Target, cmd []string, options remotecommand.StreamOptions) error
+}
+
+// KubeTransport runs the commands on the pods with kubectl exec
+type KubeTransport struct {
+	Config *rest.Config
+	Client *kubernetes.Clientset
+	// Container runs the commands in the named container, the default container of the pods if empty
+	Container string
+}
+
+// Exec runs the command in the pod of the target
+func (k KubeTransport) Exec(ctx context.Context, target Target, cmd []string, options remotecommand.StreamOptions) error {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: target.Name, Namespace: target.Namespace}}
+	if target.pod != nil {
+		pod = *target.pod
+	}
+	return ExecCmd(ctx, k.Config, k.Client, pod, k.Container, cmd, options)
+}
+
+// PodTarget returns the target of the pod for the KubeTransport
+func PodTarget(pod corev1.Pod) Target {
+	return Target{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Address:   pod.Status.PodIP,
+		Ready:     podReady(pod),
+		pod:       &pod,
+	}
+}
+
+// PodTargets returns the targets of the pods for the KubeTransport
+func PodTargets(pods []corev1.Pod) []Target {
+	targets := make([]Target, 0, len(pods))
+	for _, pod := range pods {
+		targets = append(targets, PodTarget(pod))
+	}
+	return targets
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func targetNames(targets []Target) string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, ",")
+}
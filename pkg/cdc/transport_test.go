@@ -0,0 +1,228 @@
+package cdc
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// memTransport answers the agent commands in memory
+type memTransport struct {
+	mu       sync.Mutex
+	ingested map[string][]string // target -> ingested tar entries
+	hubs     []string
+	trackers map[string]string // peer -> trackers
+}
+
+func (m *memTransport) Exec(ctx context.Context, target Target, cmd []string, options remotecommand.StreamOptions) error {
+	args := map[string]string{}
+	for i := 1; i+1 < len(cmd); i++ {
+		if strings.HasPrefix(cmd[i], "-") {
+			args[cmd[i]] = cmd[i+1]
+		}
+	}
+	switch args["-mode"] {
+	case "digest":
+		return json.NewEncoder(options.Stdout).Encode(digestResult{})
+	case "statfs":
+		_, err := fmt.Fprintln(options.Stdout, `{"free": 1099511627776}`)
+		return err
+	case "check":
+		var manifest Manifest
+		if err := json.NewDecoder(options.Stdin).Decode(&manifest); err != nil {
+			return err
+		}
+		missing := []string{}
+		for _, chunk := range manifest.Chunks {
+			missing = append(missing, chunk.Hash)
+		}
+		return json.NewEncoder(options.Stdout).Encode(missing)
+	case "ingest":
+		tr := tar.NewReader(options.Stdin)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			m.mu.Lock()
+			m.ingested[target.Name] = append(m.ingested[target.Name], hdr.Name)
+			m.mu.Unlock()
+		}
+	case "hub":
+		m.mu.Lock()
+		m.hubs = append(m.hubs, target.Name)
+		m.mu.Unlock()
+		if _, err := fmt.Fprintln(options.Stdout, "Hub listening on [::]:12345"); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	case "peer":
+		m.mu.Lock()
+		m.trackers[target.Name] = args["-tracker"]
+		m.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unexpected command %v on %s", cmd, target.Name)
+}
+
+func TestSyncTargetsTransport(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// the kubectl exec transport is not used
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		return errors.New("unexpected kubectl exec")
+	}
+
+	transport := &memTransport{ingested: map[string][]string{}, trackers: map[string]string{}}
+	targets := SSHTargets([]string{"user@10.0.0.1", "user@10.0.0.2", "10.0.0.3"})
+	if err := SyncTargets(context.Background(), transport, targets, srcDir, "/remote/path", Options{}); err != nil {
+		t.Fatalf("SyncTargets failed: %v", err)
+	}
+
+	leader := "user@10.0.0.1"
+	if len(transport.hubs) != 1 || transport.hubs[0] != leader {
+		t.Errorf("Expected the hub to run on %s, got %v", leader, transport.hubs)
+	}
+	if len(transport.ingested) != 1 {
+		t.Fatalf("Expected only the leader to ingest, got %v", transport.ingested)
+	}
+	entries := transport.ingested[leader]
+	if len(entries) < 2 || entries[len(entries)-1] != ManifestFile {
+		t.Errorf("Expected the leader to ingest the chunks and the manifest, got %v", entries)
+	}
+	want := map[string]string{
+		"user@10.0.0.2": "http://10.0.0.1:12345",
+		"10.0.0.3":      "http://10.0.0.1:12345",
+	}
+	if len(transport.trackers) != len(want) {
+		t.Errorf("Expected %d peers, got %v", len(want), transport.trackers)
+	}
+	for peer, tracker := range want {
+		if got := transport.trackers[peer]; got != tracker {
+			t.Errorf("Expected peer %s to download from %s, got %q", peer, tracker, got)
+		}
+	}
+}
+
+func TestPodTarget(t *testing.T) {
+	pod := corev1.Pod{}
+	pod.Name = "pod-0"
+	pod.Namespace = "ns"
+	pod.Status.PodIP = "10.0.0.1"
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	pod.Spec.Containers = []corev1.Container{{Name: "main"}}
+
+	target := PodTarget(pod)
+	if target.Name != "pod-0" || target.Namespace != "ns" || target.Address != "10.0.0.1" || !target.Ready {
+		t.Errorf("Unexpected target %+v", target)
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+	var got corev1.Pod
+	var gotContainer string
+	ExecCmd = func(ctx context.Context, config *rest.Config, client *kubernetes.Clientset, pod corev1.Pod, container string, cmd []string, options remotecommand.StreamOptions) error {
+		got = pod
+		gotContainer = container
+		return nil
+	}
+	// the pod is passed whole so kubectl exec can check its containers
+	if err := (KubeTransport{Container: "main"}).Exec(context.Background(), target, []string{"true"}, remotecommand.StreamOptions{}); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if got.Name != "pod-0" || got.Namespace != "ns" || len(got.Spec.Containers) != 1 || gotContainer != "main" {
+		t.Errorf("Expected the command on pod ns/pod-0 container main, got %s/%s container %q", got.Namespace, got.Name, gotContainer)
+	}
+}
+
+// deltaTransport records the modes of the agent commands run with -delta
+type deltaTransport struct {
+	*memTransport
+	mu    sync.Mutex
+	modes map[string]bool
+}
+
+func (d *deltaTransport) Exec(ctx context.Context, target Target, cmd []string, options remotecommand.StreamOptions) error {
+	for i, arg := range cmd {
+		if arg == "-mode" && i+1 < len(cmd) && slices.Contains(cmd, "-delta") {
+			d.mu.Lock()
+			d.modes[cmd[i+1]] = true
+			d.mu.Unlock()
+		}
+	}
+	return d.memTransport.Exec(ctx, target, cmd, options)
+}
+
+func TestSyncTargetsDelta(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	targets := SSHTargets([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+
+	for _, delta := range []bool{false, true} {
+		transport := &deltaTransport{
+			memTransport: &memTransport{ingested: map[string][]string{}, trackers: map[string]string{}},
+			modes:        map[string]bool{},
+		}
+		if err := SyncTargets(context.Background(), transport, targets, srcDir, "/remote/path", Options{Delta: delta}); err != nil {
+			t.Fatalf("SyncTargets with delta %v failed: %v", delta, err)
+		}
+		for _, mode := range []string{"ingest", "hub", "peer"} {
+			if transport.modes[mode] != delta {
+				t.Errorf("Expected the %s command with delta %v to have -delta %v", mode, delta, !transport.modes[mode])
+			}
+		}
+	}
+}
+
+func TestIngestRemoteUnreadableChunk(t *testing.T) {
+	chunksDir := t.TempDir()
+	var m Manifest
+	for _, data := range []string{"first chunk", "second chunk"} {
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+		if err := os.WriteFile(filepath.Join(chunksDir, hash), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write chunk: %v", err)
+		}
+		m.Chunks = append(m.Chunks, ChunkInfo{Hash: hash, Size: uint(len(data))})
+	}
+	// the second chunk can not be read
+	if err := os.Remove(filepath.Join(chunksDir, m.Chunks[1].Hash)); err != nil {
+		t.Fatalf("Failed to remove chunk: %v", err)
+	}
+
+	transport := &memTransport{ingested: map[string][]string{}, trackers: map[string]string{}}
+	target := SSHTargets([]string{"user@10.0.0.1"})[0]
+	missing := []string{m.Chunks[0].Hash, m.Chunks[1].Hash}
+	err := ingestRemote(context.Background(), transport, target, "/remote/path", missing, chunksDir, m, Options{}, false)
+	if err == nil || !strings.Contains(err.Error(), m.Chunks[1].Hash) {
+		t.Fatalf("Expected an error reading chunk %s, got %v", m.Chunks[1].Hash, err)
+	}
+	if entries := transport.ingested[target.Name]; slices.Contains(entries, ManifestFile) {
+		t.Errorf("Expected the manifest not to be ingested, got %v", entries)
+	}
+}
@@ -11,35 +11,99 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
-// GetClient returns a clientset for the given kubeconfig
+// The client-go defaults of 5 QPS and 10 burst throttle the exec and upload
+// requests when fanning out to hundreds of pods.
+const (
+	DefaultQPS   = 100
+	DefaultBurst = 200
+)
+
+// inClusterConfig is a variable so it can be mocked in tests
+var inClusterConfig = rest.InClusterConfig
+
+// Options tunes the client configuration
+type Options struct {
+	// QPS is the maximum queries per second to the API server, DefaultQPS if 0
+	QPS float32
+	// Burst is the maximum burst of queries to the API server, DefaultBurst if 0
+	Burst int
+	// As is the user to impersonate, like kubectl --as
+	As string
+	// AsGroups are the groups to impersonate, they require a user
+	AsGroups []string
+}
+
+// GetClient returns a clientset for the given kubeconfig and context
 // If kubeconfig is empty, it will use the default kubeconfig
-// preferring the environment variable.
-func GetClient(kubeconfig string) (*rest.Config, *kubernetes.Clientset, error) {
+// preferring the environment variable, and the in-cluster
+// configuration when running inside a pod without context.
+// If kubeContext is empty, it uses the current context of the kubeconfig.
+func GetClient(kubeconfig, kubeContext string, opts Options) (*rest.Config, *kubernetes.Clientset, error) {
+	if opts.QPS < 0 || opts.Burst < 0 {
+		return nil, nil, fmt.Errorf("the qps and burst must be positive")
+	}
+	if len(opts.AsGroups) > 0 && opts.As == "" {
+		return nil, nil, fmt.Errorf("impersonating groups requires a user to impersonate")
+	}
+	config, err := loadConfig(kubeconfig, kubeContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.QPS = DefaultQPS
+	if opts.QPS > 0 {
+		config.QPS = opts.QPS
+	}
+	config.Burst = DefaultBurst
+	if opts.Burst > 0 {
+		config.Burst = opts.Burst
+	}
+	if opts.As != "" {
+		config.Impersonate = rest.ImpersonationConfig{UserName: opts.As, Groups: opts.AsGroups}
+	}
+	return newClientset(config)
+}
+
+func loadConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
 	if kubeconfig != "" {
-		return getClientset(kubeconfig)
+		return getConfig(kubeconfig, kubeContext)
 	}
 
 	// Use environment variable first
 	if kubeconfig = os.Getenv("KUBECONFIG"); kubeconfig != "" {
-		return getClientset(kubeconfig)
+		return getConfig(kubeconfig, kubeContext)
+	}
+
+	// running in a pod
+	if kubeContext == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != "" {
+		config, err := inClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("can not create in-cluster configuration: %v", err)
+		}
+		return config, nil
 	}
 
 	// fall back to the default kubeconfig
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = filepath.Join(home, ".kube", "config")
 	}
-	return getClientset(kubeconfig)
+	return getConfig(kubeconfig, kubeContext)
 }
 
-func getClientset(kubeconfig string) (*rest.Config, *kubernetes.Clientset, error) {
+func getConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
 	if kubeconfig == "" {
-		return nil, nil, fmt.Errorf("kubeconfig is empty")
+		return nil, fmt.Errorf("kubeconfig is empty")
 	}
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
 	if err != nil {
-		return nil, nil, fmt.Errorf("can not create client-go configuration: %v", err)
+		return nil, fmt.Errorf("can not create client-go configuration: %v", err)
 	}
+	return config, nil
+}
 
+func newClientset(config *rest.Config) (*rest.Config, *kubernetes.Clientset, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can not create client-go client: %v", err)
@@ -0,0 +1,188 @@
+package clientset
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestGetClientInCluster(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("KUBECONFIG", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	called := false
+	inClusterConfig = func() (*rest.Config, error) {
+		called = true
+		return &rest.Config{Host: "https://10.96.0.1:443"}, nil
+	}
+	defer func() { inClusterConfig = rest.InClusterConfig }()
+
+	config, client, err := GetClient("", "", Options{})
+	if err != nil {
+		t.Fatalf("GetClient failed: %v", err)
+	}
+	if !called {
+		t.Errorf("Expected the in-cluster configuration to be used")
+	}
+	if config.Host != "https://10.96.0.1:443" || client == nil {
+		t.Errorf("Unexpected configuration %+v", config)
+	}
+}
+
+func TestGetClientInClusterError(t *testing.T) {
+	t.Setenv("KUBECONFIG", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	inClusterConfig = func() (*rest.Config, error) {
+		return nil, fmt.Errorf("open /var/run/secrets/kubernetes.io/serviceaccount/token: no such file or directory")
+	}
+	defer func() { inClusterConfig = rest.InClusterConfig }()
+
+	if _, _, err := GetClient("", "", Options{}); err == nil {
+		t.Errorf("Expected an error without the service account token")
+	}
+}
+
+func TestGetClientOutOfCluster(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("KUBECONFIG", "")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	inClusterConfig = func() (*rest.Config, error) {
+		t.Errorf("Unexpected use of the in-cluster configuration")
+		return nil, fmt.Errorf("not in a cluster")
+	}
+	defer func() { inClusterConfig = rest.InClusterConfig }()
+
+	// the default kubeconfig does not exist
+	if _, _, err := GetClient("", "", Options{}); err == nil {
+		t.Errorf("Expected an error without kubeconfig")
+	}
+}
+
+const twoContextsKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: cluster-a
+  cluster:
+    server: https://a.example.com
+- name: cluster-b
+  cluster:
+    server: https://b.example.com
+users:
+- name: user
+  user:
+    token: secret
+contexts:
+- name: context-a
+  context:
+    cluster: cluster-a
+    user: user
+- name: context-b
+  context:
+    cluster: cluster-b
+    user: user
+current-context: context-a
+`
+
+func TestGetClientContext(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(twoContextsKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		context  string
+		wantHost string
+		wantErr  bool
+	}{
+		{name: "current context", context: "", wantHost: "https://a.example.com"},
+		{name: "explicit current context", context: "context-a", wantHost: "https://a.example.com"},
+		{name: "other context", context: "context-b", wantHost: "https://b.example.com"},
+		{name: "unknown context", context: "context-c", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _, err := GetClient(kubeconfig, tt.context, Options{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && config.Host != tt.wantHost {
+				t.Errorf("GetClient() host = %s, want %s", config.Host, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestGetClientRateLimits(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(twoContextsKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		wantQPS   float32
+		wantBurst int
+		wantErr   bool
+	}{
+		{name: "defaults", opts: Options{}, wantQPS: DefaultQPS, wantBurst: DefaultBurst},
+		{name: "custom", opts: Options{QPS: 500, Burst: 1000}, wantQPS: 500, wantBurst: 1000},
+		{name: "negative", opts: Options{QPS: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _, err := GetClient(kubeconfig, "", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (config.QPS != tt.wantQPS || config.Burst != tt.wantBurst) {
+				t.Errorf("GetClient() qps = %v burst = %d, want qps = %v burst = %d", config.QPS, config.Burst, tt.wantQPS, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestGetClientImpersonation(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(twoContextsKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    rest.ImpersonationConfig
+		wantErr bool
+	}{
+		{name: "no impersonation", opts: Options{}},
+		{name: "user", opts: Options{As: "jane"}, want: rest.ImpersonationConfig{UserName: "jane"}},
+		{name: "user and groups", opts: Options{As: "jane", AsGroups: []string{"ml", "system:authenticated"}}, want: rest.ImpersonationConfig{UserName: "jane", Groups: []string{"ml", "system:authenticated"}}},
+		{name: "groups without user", opts: Options{AsGroups: []string{"ml"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _, err := GetClient(kubeconfig, "", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(config.Impersonate, tt.want) {
+				t.Errorf("GetClient() impersonate = %+v, want %+v", config.Impersonate, tt.want)
+			}
+		})
+	}
+}
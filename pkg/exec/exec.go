@@ -7,9 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/aojea/krun/pkg/files"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
@@ -32,7 +39,29 @@ func WrapCommandInShell(commandArgs []string) []string {
 	return []string{"sh", "-c", strings.Join(commandArgs, " ")}
 }
 
-func ExecuteOnPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, commandArgs []string) error {
+// Options configures the execution of a command on the pods
+type Options struct {
+	// Sink receives the output lines in addition to the console, optional
+	Sink OutputSink
+	// MaxConcurrency bounds the pods executing the command at the same time, 0 is unlimited
+	MaxConcurrency int
+	// Container runs the command in the named container, the default container of the pods if empty
+	Container string
+	// PerPodTimeout cancels the command of a pod running longer than it without
+	// affecting the other pods, 0 is no timeout
+	PerPodTimeout time.Duration
+	// Format of the console output, text if empty
+	Format OutputFormat
+	// FailFast cancels the command on all the pods when it fails on one of them
+	FailFast bool
+	// PodCommand returns the command to run on each pod, the command of
+	// ExecuteOnPods is used for all the pods if nil
+	PodCommand func(pod corev1.Pod) []string
+	// Stdin is sent to the command of every pod, optional
+	Stdin []byte
+}
+
+func ExecuteOnPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, commandArgs []string, opts Options) error {
 	klog.V(2).Infof("Found %d pods. Starting execution...\n", len(pods))
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -40,11 +69,31 @@ func ExecuteOnPods(ctx context.Context, config *rest.Config, clientset *kubernet
 	// do not block on logging
 	logCh := make(chan logEntry, 1000)
 	loggerDone := make(chan struct{})
-	go logger(logCh, loggerDone)
+	go logger(logCh, loggerDone, opts.Sink, opts.Format)
+
+	// limit the concurrent requests to the apiserver, if set
+	var sem chan struct{}
+	if opts.MaxConcurrency > 0 {
+		sem = make(chan struct{}, opts.MaxConcurrency)
+	}
+
+	// the first error cancels the other pods on fail fast
+	var failOnce sync.Once
+	var failErr error
+
+	// outcome of the command on each pod, for the summary
+	var resultsMu sync.Mutex
+	results := make(map[string]error, len(pods))
 
 	// each pod is processed in a separate goroutine
 	var wg sync.WaitGroup
 	for i, pod := range pods {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
 		if ctx.Err() != nil {
 			klog.Infof("Context done, cancelling remaining %d operations... %v", len(pods)-i, ctx.Err())
 			break
@@ -52,25 +101,65 @@ func ExecuteOnPods(ctx context.Context, config *rest.Config, clientset *kubernet
 		wg.Add(1)
 		go func(p corev1.Pod) {
 			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
 			prefix := fmt.Sprintf("[%s]", p.Name)
 
 			if len(commandArgs) > 0 {
+				podCtx := ctx
+				if opts.PerPodTimeout > 0 {
+					var podCancel context.CancelFunc
+					podCtx, podCancel = context.WithTimeout(ctx, opts.PerPodTimeout)
+					defer podCancel()
+				}
+
 				// Prepare pipes for output
 				prOut, pwOut := io.Pipe()
 				prErr, pwErr := io.Pipe()
 
-				// Start Log Processors
-				go logStream(ctx, prOut, logCh, prefix, os.Stdout)
-				go logStream(ctx, prErr, logCh, prefix, os.Stderr)
+				// Start Log Processors, the JSON lines are all printed on stdout
+				var errOut io.Writer = os.Stderr
+				if opts.Format == OutputJSON {
+					errOut = os.Stdout
+				}
+				go logStream(podCtx, prOut, logCh, p.Name, prefix, streamStdout, os.Stdout)
+				go logStream(podCtx, prErr, logCh, p.Name, prefix, streamStderr, errOut)
 
 				// Execute
-				err := ExecCmd(ctx, config, clientset, p, commandArgs, remotecommand.StreamOptions{Stdout: pwOut, Stderr: pwErr})
+				command := commandArgs
+				if opts.PodCommand != nil {
+					command = opts.PodCommand(p)
+				}
+				streamOpts := remotecommand.StreamOptions{Stdout: pwOut, Stderr: pwErr}
+				if opts.Stdin != nil {
+					streamOpts.Stdin = bytes.NewReader(opts.Stdin)
+				}
+				err := ExecCmd(podCtx, config, clientset, p, opts.Container, command, streamOpts)
 
 				_ = pwOut.Close()
 				_ = pwErr.Close()
 
-				if err != nil {
-					logCh <- logEntry{prefix: prefix, text: fmt.Sprintf("Command Error: %v", err), out: os.Stderr}
+				if err != nil && ctx.Err() == nil && errors.Is(podCtx.Err(), context.DeadlineExceeded) {
+					err = fmt.Errorf("timed out after %v: %w", opts.PerPodTimeout, err)
+				}
+				// the pods interrupted by the cancellation are not recorded as failed
+				if err == nil || ctx.Err() == nil {
+					resultsMu.Lock()
+					results[p.Name] = err
+					resultsMu.Unlock()
+				}
+				if opts.Format == OutputJSON {
+					logCh <- logEntry{pod: p.Name, summary: newOutputSummary(p.Name, err), out: os.Stdout}
+				} else if err != nil {
+					logCh <- logEntry{pod: p.Name, prefix: prefix, stream: streamStderr, text: fmt.Sprintf("Command Error: %v", err), out: os.Stderr}
+				}
+				if err != nil && opts.FailFast {
+					failOnce.Do(func() {
+						klog.Infof("Command failed on pod %s, cancelling the other pods: %v", p.Name, err)
+						failErr = fmt.Errorf("command failed on pod %s: %w", p.Name, err)
+						cancel()
+					})
 				}
 			}
 		}(pod)
@@ -81,15 +170,110 @@ func ExecuteOnPods(ctx context.Context, config *rest.Config, clientset *kubernet
 	// wait for logger to finish
 	<-loggerDone
 
+	if len(commandArgs) == 0 {
+		return ctx.Err()
+	}
+	// the JSON output already has a summary per pod
+	summary := summarize(pods, results)
+	if opts.Format != OutputJSON {
+		_, _ = fmt.Fprintln(os.Stderr, summary)
+	}
+
+	if failErr != nil {
+		return failErr
+	}
 	if ctx.Err() != nil {
 		klog.Infof("Context done, cancelling remaining operations... %v", ctx.Err())
 		return ctx.Err()
 	}
+	if len(summary.failed) > 0 {
+		return fmt.Errorf("command failed on %d of %d pods: %s", len(summary.failed), summary.total, strings.Join(summary.failed, ", "))
+	}
+	return nil
+}
+
+// execSummary aggregates the outcome of the command on the pods
+type execSummary struct {
+	total     int
+	succeeded int
+	// failed are the names of the pods where the command failed, sorted
+	failed []string
+	// cancelled are the pods not run or interrupted by the cancellation
+	cancelled int
+}
+
+func summarize(pods []corev1.Pod, results map[string]error) execSummary {
+	s := execSummary{total: len(pods)}
+	for _, pod := range pods {
+		err, ok := results[pod.Name]
+		switch {
+		case !ok:
+			s.cancelled++
+		case err != nil:
+			s.failed = append(s.failed, pod.Name)
+		default:
+			s.succeeded++
+		}
+	}
+	sort.Strings(s.failed)
+	return s
+}
+
+func (s execSummary) String() string {
+	out := fmt.Sprintf("%d/%d succeeded, %d failed", s.succeeded, s.total, len(s.failed))
+	if s.cancelled > 0 {
+		out += fmt.Sprintf(", %d cancelled", s.cancelled)
+	}
+	if len(s.failed) > 0 {
+		out += ": " + strings.Join(s.failed, ", ")
+	}
+	return out
+}
+
+// CheckContainer verifies the container exists in all the pods, an empty container
+// selects the default container of each pod and is always valid.
+func CheckContainer(pods []corev1.Pod, container string) error {
+	if container == "" {
+		return nil
+	}
+	for _, pod := range pods {
+		found := false
+		for _, c := range pod.Spec.Containers {
+			if c.Name == container {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, 0, len(pod.Spec.Containers))
+			for _, c := range pod.Spec.Containers {
+				names = append(names, c.Name)
+			}
+			return fmt.Errorf("container %q not found in pod %s/%s, available containers: %s", container, pod.Namespace, pod.Name, strings.Join(names, ", "))
+		}
+	}
 	return nil
 }
 
-func ExecCmd(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, command []string, options remotecommand.StreamOptions) error {
-	klog.V(4).Infof("Executing command %v on pod %s/%s", command, pod.Namespace, pod.Name)
+// ExecCmd runs the command on the pod streaming the options, it allows mocking the remote execution in tests
+var ExecCmd = execCmd
+
+func execCmd(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+	klog.V(4).Infof("Executing command %v on pod %s/%s container %q", command, pod.Namespace, pod.Name, container)
+	if err := CheckContainer([]corev1.Pod{pod}, container); err != nil {
+		return err
+	}
+	exec, err := remotecommand.NewWebSocketExecutor(config, "GET", execURL(clientset, pod, container, command, options).String())
+	if err != nil {
+		return err
+	}
+
+	return exec.StreamWithContext(ctx, options)
+}
+
+// execURL returns the exec subresource URL of the pod for the command and streams,
+// an empty container selects the default container of the pod.
+func execURL(clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) *url.URL {
 	req := clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(pod.Name).
@@ -97,24 +281,19 @@ func ExecCmd(ctx context.Context, config *rest.Config, clientset *kubernetes.Cli
 		SubResource("exec")
 
 	option := &corev1.PodExecOptions{
-		Command: command,
-		Stdin:   options.Stdin != nil,
-		Stdout:  options.Stdout != nil,
-		Stderr:  options.Stderr != nil,
-		TTY:     options.Tty,
+		Container: container,
+		Command:   command,
+		Stdin:     options.Stdin != nil,
+		Stdout:    options.Stdout != nil,
+		Stderr:    options.Stderr != nil,
+		TTY:       options.Tty,
 	}
 
 	req.VersionedParams(option, scheme.ParameterCodec)
-
-	exec, err := remotecommand.NewWebSocketExecutor(config, "GET", req.URL().String())
-	if err != nil {
-		return err
-	}
-
-	return exec.StreamWithContext(ctx, options)
+	return req.URL()
 }
 
-func UploadExecutableOnPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, filePath string, filedata []byte) error {
+func UploadExecutableOnPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, container, filePath string, filedata []byte) error {
 	var mu sync.Mutex
 	var allErrors []error
 	var wg sync.WaitGroup
@@ -125,7 +304,7 @@ func UploadExecutableOnPods(ctx context.Context, config *rest.Config, clientset
 			var stdout bytes.Buffer
 			var stderr bytes.Buffer
 			cmd := []string{"sh", "-c", fmt.Sprintf("cat > %s && chmod +x %s", filePath, filePath)}
-			err := ExecCmd(ctx, config, clientset, p, cmd, remotecommand.StreamOptions{
+			err := ExecCmd(ctx, config, clientset, p, container, cmd, remotecommand.StreamOptions{
 				Stdin:  bytes.NewReader(filedata),
 				Stdout: &stdout,
 				Stderr: &stderr,
@@ -143,7 +322,7 @@ func UploadExecutableOnPods(ctx context.Context, config *rest.Config, clientset
 }
 
 // RemovePathsFromPods removes a list of paths from a list of pods using rm -rf
-func RemovePathsFromPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, paths ...string) error {
+func RemovePathsFromPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, container string, paths ...string) error {
 	if len(paths) == 0 {
 		return nil
 	}
@@ -158,7 +337,7 @@ func RemovePathsFromPods(ctx context.Context, config *rest.Config, clientset *ku
 			var stderr bytes.Buffer
 			// rm -rf path1 path2 ...
 			cmd := append([]string{"rm", "-rf"}, paths...)
-			err := ExecCmd(ctx, config, clientset, p, cmd, remotecommand.StreamOptions{
+			err := ExecCmd(ctx, config, clientset, p, container, cmd, remotecommand.StreamOptions{
 				Stdout: &stdout,
 				Stderr: &stderr,
 			})
@@ -173,11 +352,66 @@ func RemovePathsFromPods(ctx context.Context, config *rest.Config, clientset *ku
 	return errors.Join(allErrors...)
 }
 
-func logStream(ctx context.Context, r io.Reader, ch chan<- logEntry, prefix string, out io.Writer) {
+// DownloadFromPods copies srcPath from every pod into destDir/<pod name>/<base of srcPath>
+// streaming a tarball created in the pod. All pods are attempted, the failures are joined.
+func DownloadFromPods(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pods []corev1.Pod, container, srcPath, destDir string) error {
+	var mu sync.Mutex
+	var allErrors []error
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(p corev1.Pod) {
+			defer wg.Done()
+			podDir := filepath.Join(destDir, p.Name)
+			err := downloadFromPod(ctx, config, clientset, p, container, srcPath, podDir)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				allErrors = append(allErrors, fmt.Errorf("failed to download %s from pod %s: %w", srcPath, p.Name, err))
+				return
+			}
+			klog.V(2).Infof("Downloaded %s from pod %s to %s", srcPath, p.Name, podDir)
+		}(pod)
+	}
+	wg.Wait()
+	return errors.Join(allErrors...)
+}
+
+func downloadFromPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container, srcPath, destDir string) error {
+	// use a pipe to extract the tarball while it is streamed
+	pr, pw := io.Pipe()
+	extractErr := make(chan error, 1)
+	go func() {
+		err := files.ExtractTar(pr, destDir)
+		// unblock the stream if the extraction failed
+		_ = pr.CloseWithError(err)
+		extractErr <- err
+	}()
+
+	var stderr bytes.Buffer
+	cleanPath := path.Clean(srcPath)
+	cmd := []string{"tar", "cf", "-", "-C", path.Dir(cleanPath), path.Base(cleanPath)}
+	err := ExecCmd(ctx, config, clientset, pod, container, cmd, remotecommand.StreamOptions{
+		Stdout: pw,
+		Stderr: &stderr,
+	})
+	_ = pw.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("stderr: %s: %w", stderr.String(), err)
+	}
+	return <-extractErr
+}
+
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+func logStream(ctx context.Context, r io.Reader, ch chan<- logEntry, pod, prefix, stream string, out io.Writer) {
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		select {
-		case ch <- logEntry{prefix: prefix, text: scanner.Text(), out: out}:
+		case ch <- logEntry{pod: pod, prefix: prefix, stream: stream, text: scanner.Text(), ts: time.Now(), out: out}:
 		case <-ctx.Done():
 			return
 		}
@@ -185,14 +419,34 @@ func logStream(ctx context.Context, r io.Reader, ch chan<- logEntry, prefix stri
 }
 
 type logEntry struct {
+	pod    string
 	prefix string
+	stream string
 	text   string
+	ts     time.Time
 	out    io.Writer
+	// summary is the result of the command on the pod, only in the JSON format
+	summary *OutputSummary
 }
 
-func logger(ch <-chan logEntry, done chan<- struct{}) {
+func logger(ch <-chan logEntry, done chan<- struct{}, sink OutputSink, format OutputFormat) {
 	for entry := range ch {
-		_, _ = fmt.Fprintf(entry.out, "%s %s\n", entry.prefix, entry.text)
+		if format == OutputJSON {
+			data, err := marshalEntry(entry)
+			if err != nil {
+				klog.Errorf("Failed to encode output of pod %s: %v", entry.pod, err)
+			} else {
+				_, _ = fmt.Fprintf(entry.out, "%s\n", data)
+			}
+		} else {
+			_, _ = fmt.Fprintf(entry.out, "%s %s\n", entry.prefix, entry.text)
+		}
+		if entry.summary != nil {
+			continue
+		}
+		if sink != nil {
+			sink.WriteLine(entry.pod, entry.stream, entry.text)
+		}
 	}
 	done <- struct{}{}
 }
@@ -1,8 +1,22 @@
 package exec
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
 func TestWrapCommandInShell(t *testing.T) {
@@ -52,3 +66,331 @@ func TestWrapCommandInShell(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteOnPodsMaxConcurrency(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 20; i++ {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)}})
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	tests := []struct {
+		name           string
+		maxConcurrency int
+	}{
+		{name: "bounded", maxConcurrency: 3},
+		{name: "unlimited", maxConcurrency: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, maxRunning, calls atomic.Int32
+			ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+				calls.Add(1)
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			}
+
+			err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{MaxConcurrency: tt.maxConcurrency})
+			if err != nil {
+				t.Fatalf("ExecuteOnPods failed: %v", err)
+			}
+			if calls.Load() != int32(len(pods)) {
+				t.Errorf("Expected %d exec calls, got %d", len(pods), calls.Load())
+			}
+			if tt.maxConcurrency > 0 && maxRunning.Load() > int32(tt.maxConcurrency) {
+				t.Errorf("Expected at most %d concurrent exec calls, got %d", tt.maxConcurrency, maxRunning.Load())
+			}
+			if tt.maxConcurrency == 0 && maxRunning.Load() <= 3 {
+				t.Errorf("Expected the executions to run concurrently without a limit, got at most %d", maxRunning.Load())
+			}
+		})
+	}
+}
+
+func TestExecuteOnPodsContainer(t *testing.T) {
+	pods := []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default"}}}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var got string
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		got = container
+		return nil
+	}
+	if err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{Container: "sidecar"}); err != nil {
+		t.Fatalf("ExecuteOnPods failed: %v", err)
+	}
+	if got != "sidecar" {
+		t.Errorf("Expected the command to run in container sidecar, got %q", got)
+	}
+
+	// The exec request selects the container
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: "https://localhost:6443"})
+	if err != nil {
+		t.Fatalf("Failed to create clientset: %v", err)
+	}
+	u := execURL(clientset, pods[0], "sidecar", []string{"true"}, remotecommand.StreamOptions{})
+	if u.Query().Get("container") != "sidecar" {
+		t.Errorf("Expected container=sidecar in the exec request %s", u)
+	}
+	u = execURL(clientset, pods[0], "", []string{"true"}, remotecommand.StreamOptions{})
+	if u.Query().Has("container") {
+		t.Errorf("Expected no container in the exec request %s", u)
+	}
+}
+
+func TestExecuteOnPodsPodCommand(t *testing.T) {
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"}},
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	got := map[string]string{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got[pod.Name] = strings.Join(command, " ")
+		return nil
+	}
+	opts := Options{PodCommand: func(pod corev1.Pod) []string { return []string{"echo", pod.Name} }}
+	if err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"echo"}, opts); err != nil {
+		t.Fatalf("ExecuteOnPods failed: %v", err)
+	}
+	want := map[string]string{"pod-0": "echo pod-0", "pod-1": "echo pod-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Commands %v, want %v", got, want)
+	}
+}
+
+func TestExecuteOnPodsStdin(t *testing.T) {
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default"}},
+	}
+	script := "set -e\ncd /app\necho $(hostname)\n"
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	got := map[string]string{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		if options.Stdin == nil {
+			return fmt.Errorf("missing stdin")
+		}
+		data, err := io.ReadAll(options.Stdin)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got[pod.Name] = strings.Join(command, " ") + ":" + string(data)
+		return nil
+	}
+	if err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"sh", "-s"}, Options{Stdin: []byte(script)}); err != nil {
+		t.Fatalf("ExecuteOnPods failed: %v", err)
+	}
+	// every pod reads the whole script
+	want := map[string]string{"pod-0": "sh -s:" + script, "pod-1": "sh -s:" + script}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Commands %v, want %v", got, want)
+	}
+}
+
+func TestCheckContainer(t *testing.T) {
+	pod := func(name string, containers ...string) corev1.Pod {
+		p := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		for _, c := range containers {
+			p.Spec.Containers = append(p.Spec.Containers, corev1.Container{Name: c})
+		}
+		return p
+	}
+	tests := []struct {
+		name      string
+		pods      []corev1.Pod
+		container string
+		wantErr   bool
+	}{
+		{
+			name: "default container",
+			pods: []corev1.Pod{pod("pod-0", "main")},
+		},
+		{
+			name:      "existing container",
+			pods:      []corev1.Pod{pod("pod-0", "main", "sidecar"), pod("pod-1", "sidecar")},
+			container: "sidecar",
+		},
+		{
+			name:      "missing container",
+			pods:      []corev1.Pod{pod("pod-0", "main", "sidecar"), pod("pod-1", "main")},
+			container: "sidecar",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckContainer(tt.pods, tt.container)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecuteOnPodsPerPodTimeout(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 3; i++ {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)}})
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	results := map[string]error{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		var err error
+		if pod.Name == "pod-1" {
+			// hung pod
+			<-ctx.Done()
+			err = ctx.Err()
+		} else {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		mu.Lock()
+		results[pod.Name] = err
+		mu.Unlock()
+		return err
+	}
+
+	start := time.Now()
+	err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{PerPodTimeout: 200 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "command failed on 1 of 3 pods: pod-1") {
+		t.Fatalf("Expected ExecuteOnPods to report the timed out pod, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the hung pod to be cancelled by its timeout, took %v", elapsed)
+	}
+	for _, pod := range pods {
+		got, ok := results[pod.Name]
+		if !ok {
+			t.Fatalf("Expected pod %s to execute the command", pod.Name)
+		}
+		if pod.Name == "pod-1" {
+			if !errors.Is(got, context.DeadlineExceeded) {
+				t.Errorf("Expected pod %s to be cancelled by its timeout, got %v", pod.Name, got)
+			}
+		} else if got != nil {
+			t.Errorf("Expected pod %s to succeed, got %v", pod.Name, got)
+		}
+	}
+}
+
+func TestExecuteOnPodsFailFast(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 4; i++ {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)}})
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	errFailed := errors.New("command terminated with exit code 1")
+	var mu sync.Mutex
+	results := map[string]error{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		var err error
+		if pod.Name == "pod-2" {
+			err = errFailed
+		} else {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(10 * time.Second):
+			}
+		}
+		mu.Lock()
+		results[pod.Name] = err
+		mu.Unlock()
+		return err
+	}
+
+	start := time.Now()
+	err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{FailFast: true})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Expected the error of the failed pod, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the other pods to be cancelled, took %v", elapsed)
+	}
+	for _, pod := range pods {
+		if pod.Name == "pod-2" {
+			continue
+		}
+		if got := results[pod.Name]; !errors.Is(got, context.Canceled) {
+			t.Errorf("Expected pod %s to be cancelled, got %v", pod.Name, got)
+		}
+	}
+}
+
+func TestExecuteOnPodsSummary(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 10; i++ {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i)}})
+	}
+	failed := map[string]bool{"pod-3": true, "pod-7": true, "pod-8": true}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var mu sync.Mutex
+	results := map[string]error{}
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		var err error
+		if failed[pod.Name] {
+			err = errors.New("command terminated with exit code 1")
+		}
+		mu.Lock()
+		results[pod.Name] = err
+		mu.Unlock()
+		return err
+	}
+
+	err := ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{})
+	if err == nil || !strings.Contains(err.Error(), "command failed on 3 of 10 pods: pod-3, pod-7, pod-8") {
+		t.Fatalf("Expected ExecuteOnPods to report the failed pods, got %v", err)
+	}
+
+	summary := summarize(pods, results)
+	if summary.total != 10 || summary.succeeded != 7 || len(summary.failed) != 3 || summary.cancelled != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if got, want := summary.String(), "7/10 succeeded, 3 failed: pod-3, pod-7, pod-8"; got != want {
+		t.Errorf("Expected summary %q, got %q", want, got)
+	}
+
+	// the pods without result were cancelled before running the command
+	delete(results, "pod-0")
+	if got, want := summarize(pods, results).String(), "6/10 succeeded, 3 failed, 1 cancelled: pod-3, pod-7, pod-8"; got != want {
+		t.Errorf("Expected summary %q, got %q", want, got)
+	}
+}
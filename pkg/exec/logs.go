@@ -0,0 +1,74 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// LogOptions configures the streaming of the pod logs
+type LogOptions struct {
+	// Container to get the logs from, the default container of the pods if empty
+	Container string
+	// Follow keeps streaming the logs until the context is done
+	Follow bool
+	// Since only returns the logs newer than this duration, all the logs if 0
+	Since time.Duration
+	// Sink receives the log lines in addition to the console, optional
+	Sink OutputSink
+}
+
+// StreamLogs prints the logs of all the pods prefixed by the pod name
+func StreamLogs(ctx context.Context, clientset kubernetes.Interface, pods []corev1.Pod, opts LogOptions) error {
+	logCh := make(chan logEntry, 1000)
+	loggerDone := make(chan struct{})
+	go logger(logCh, loggerDone, opts.Sink, OutputText)
+
+	logOpts := &corev1.PodLogOptions{
+		Container: opts.Container,
+		Follow:    opts.Follow,
+	}
+	if opts.Since > 0 {
+		seconds := int64(opts.Since.Seconds())
+		logOpts.SinceSeconds = &seconds
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(p corev1.Pod) {
+			defer wg.Done()
+			klog.V(4).Infof("Streaming logs of pod %s/%s", p.Namespace, p.Name)
+			stream, err := clientset.CoreV1().Pods(p.Namespace).GetLogs(p.Name, logOpts).Stream(ctx)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("pod %s: %w", p.Name, err))
+				mu.Unlock()
+				return
+			}
+			defer stream.Close()
+			logStream(ctx, stream, logCh, p.Name, fmt.Sprintf("[%s]", p.Name), streamStdout, os.Stdout)
+		}(pod)
+	}
+
+	wg.Wait()
+	close(logCh)
+	<-loggerDone
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to get logs: %w", errors.Join(errs...))
+	}
+	if ctx.Err() != nil && !opts.Follow {
+		return ctx.Err()
+	}
+	return nil
+}
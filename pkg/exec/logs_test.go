@@ -0,0 +1,58 @@
+package exec
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestStreamLogs(t *testing.T) {
+	var pods []corev1.Pod
+	for _, name := range []string{"pod-0", "pod-1"} {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}})
+	}
+	client := fake.NewClientset()
+	sink := &recordingSink{}
+
+	opts := LogOptions{Container: "workload", Since: 5 * time.Minute, Sink: sink}
+	if err := StreamLogs(context.Background(), client, pods, opts); err != nil {
+		t.Fatalf("StreamLogs failed: %v", err)
+	}
+
+	// the fake clientset returns "fake logs" for every pod
+	sort.Strings(sink.lines)
+	if got, want := strings.Join(sink.lines, ","), "pod-0/stdout: fake logs,pod-1/stdout: fake logs"; got != want {
+		t.Errorf("Sink received %q, want %q", got, want)
+	}
+
+	var requests int
+	for _, action := range client.Actions() {
+		if !action.Matches("get", "pods") || action.GetSubresource() != "log" {
+			continue
+		}
+		requests++
+		logOpts, ok := action.(k8stesting.GenericAction).GetValue().(*corev1.PodLogOptions)
+		if !ok {
+			t.Fatalf("Unexpected log request %v", action)
+		}
+		if logOpts.Container != "workload" {
+			t.Errorf("Expected the logs of container workload, got %q", logOpts.Container)
+		}
+		if logOpts.SinceSeconds == nil || *logOpts.SinceSeconds != 300 {
+			t.Errorf("Expected the logs since 300 seconds, got %v", logOpts.SinceSeconds)
+		}
+		if logOpts.Follow {
+			t.Errorf("Expected the logs not to be followed")
+		}
+	}
+	if requests != len(pods) {
+		t.Errorf("Expected %d log requests, got %d", len(pods), requests)
+	}
+}
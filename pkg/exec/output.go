@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// OutputFormat is the format of the command output printed on the console
+type OutputFormat string
+
+const (
+	// OutputText prefixes every line with the name of the pod
+	OutputText OutputFormat = "text"
+	// OutputJSON prints a JSON object per line and a summary object per pod
+	OutputJSON OutputFormat = "json"
+)
+
+// ParseOutputFormat validates the output format, empty is text
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch OutputFormat(s) {
+	case "", OutputText:
+		return OutputText, nil
+	case OutputJSON:
+		return OutputJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported output format %q, must be %q or %q", s, OutputText, OutputJSON)
+	}
+}
+
+// OutputLine is a line of command output in the JSON format
+type OutputLine struct {
+	Pod    string    `json:"pod"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+	Ts     time.Time `json:"ts"`
+}
+
+// OutputSummary is the result of the command on a pod in the JSON format
+type OutputSummary struct {
+	Pod      string `json:"pod"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// newOutputSummary returns the summary of the command on the pod, the exit code
+// is -1 if the command did not run to completion.
+func newOutputSummary(pod string, err error) *OutputSummary {
+	summary := &OutputSummary{Pod: pod}
+	if err == nil {
+		return summary
+	}
+	summary.Error = err.Error()
+	summary.ExitCode = -1
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		summary.ExitCode = exitErr.ExitStatus()
+	}
+	return summary
+}
+
+// marshalEntry returns the JSON line of the log entry
+func marshalEntry(entry logEntry) ([]byte, error) {
+	if entry.summary != nil {
+		return json.Marshal(entry.summary)
+	}
+	return json.Marshal(OutputLine{Pod: entry.pod, Stream: entry.stream, Text: entry.text, Ts: entry.ts})
+}
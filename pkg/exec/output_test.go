@@ -0,0 +1,122 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestExecuteOnPodsJSONOutput(t *testing.T) {
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-0"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-1"}},
+	}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		_, _ = fmt.Fprintf(options.Stdout, "hello from %s\n", pod.Name)
+		_, _ = fmt.Fprintf(options.Stderr, "warning from %s\n", pod.Name)
+		if pod.Name == "pod-1" {
+			return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 3"), Code: 3}
+		}
+		return nil
+	}
+
+	// capture the console output
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = originalStdout }()
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+
+	err = ExecuteOnPods(context.Background(), nil, nil, pods, []string{"true"}, Options{Format: OutputJSON})
+	os.Stdout = originalStdout
+	_ = w.Close()
+	data := <-output
+	if err == nil {
+		t.Fatalf("Expected ExecuteOnPods to fail on pod-1")
+	}
+
+	lines := map[string]OutputLine{}
+	summaries := map[string]OutputSummary{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var fields map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		if _, ok := fields["exitCode"]; ok {
+			var s OutputSummary
+			if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+				t.Fatalf("Invalid summary %q: %v", scanner.Text(), err)
+			}
+			summaries[s.Pod] = s
+			continue
+		}
+		var l OutputLine
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatalf("Invalid output line %q: %v", scanner.Text(), err)
+		}
+		if l.Ts.IsZero() {
+			t.Errorf("Expected a timestamp in %q", scanner.Text())
+		}
+		lines[l.Pod+"/"+l.Stream] = l
+	}
+
+	for _, pod := range pods {
+		if got, want := lines[pod.Name+"/stdout"].Text, "hello from "+pod.Name; got != want {
+			t.Errorf("stdout of %s = %q, want %q", pod.Name, got, want)
+		}
+		if got, want := lines[pod.Name+"/stderr"].Text, "warning from "+pod.Name; got != want {
+			t.Errorf("stderr of %s = %q, want %q", pod.Name, got, want)
+		}
+	}
+	if s, ok := summaries["pod-0"]; !ok || s.ExitCode != 0 || s.Error != "" {
+		t.Errorf("Unexpected summary of pod-0: %+v", s)
+	}
+	if s, ok := summaries["pod-1"]; !ok || s.ExitCode != 3 || s.Error == "" {
+		t.Errorf("Unexpected summary of pod-1: %+v", s)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    OutputFormat
+		wantErr bool
+	}{
+		{in: "", want: OutputText},
+		{in: "text", want: OutputText},
+		{in: "json", want: OutputJSON},
+		{in: "yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOutputFormat(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseOutputFormat(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseOutputFormat(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// OutputSink receives the command output lines of every pod
+type OutputSink interface {
+	WriteLine(pod, stream, line string)
+}
+
+// OutputEvent is a line of command output published to the UI clients
+type OutputEvent struct {
+	Pod    string `json:"pod"`
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// EventServer fans out the command output to the connected clients as server-sent events.
+// Slow clients do not block the execution, events are dropped when their buffer is full.
+type EventServer struct {
+	mu      sync.Mutex
+	clients map[chan OutputEvent]struct{}
+}
+
+// NewEventServer returns an EventServer without clients
+func NewEventServer() *EventServer {
+	return &EventServer{clients: make(map[chan OutputEvent]struct{})}
+}
+
+// WriteLine publishes the output line to all the connected clients
+func (s *EventServer) WriteLine(pod, stream, line string) {
+	event := OutputEvent{Pod: pod, Stream: stream, Line: line}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- event:
+		default:
+			klog.V(4).Infof("Dropping output event for slow client")
+		}
+	}
+}
+
+// ServeHTTP streams the output events until the client disconnects
+func (s *EventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan OutputEvent, 1000)
+	s.mu.Lock()
+	s.clients[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
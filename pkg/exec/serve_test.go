@@ -0,0 +1,87 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventServer(t *testing.T) {
+	events := NewEventServer()
+	ts := httptest.NewServer(events)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	// The client is registered once the headers are received
+	want := []OutputEvent{
+		{Pod: "pod-0", Stream: streamStdout, Line: "hello"},
+		{Pod: "pod-1", Stream: streamStderr, Line: "error: boom"},
+	}
+	for _, e := range want {
+		events.WriteLine(e.Pod, e.Stream, e.Line)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var got []OutputEvent
+	for len(got) < len(want) && scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			t.Fatalf("Unexpected line %q", line)
+		}
+		var e OutputEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("Failed to decode event %q: %v", data, err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Received %d events, want %d: %v", len(got), len(want), scanner.Err())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+type recordingSink struct {
+	lines []string
+}
+
+func (r *recordingSink) WriteLine(pod, stream, line string) {
+	r.lines = append(r.lines, pod+"/"+stream+": "+line)
+}
+
+func TestLoggerSink(t *testing.T) {
+	var out strings.Builder
+	sink := &recordingSink{}
+	ch := make(chan logEntry, 2)
+	done := make(chan struct{}, 1)
+	ch <- logEntry{pod: "pod-0", prefix: "[pod-0]", stream: streamStdout, text: "hello", out: &out}
+	ch <- logEntry{pod: "pod-1", prefix: "[pod-1]", stream: streamStderr, text: "boom", out: &out}
+	close(ch)
+	logger(ch, done, sink, OutputText)
+	<-done
+
+	if got, want := out.String(), "[pod-0] hello\n[pod-1] boom\n"; got != want {
+		t.Errorf("Console output %q, want %q", got, want)
+	}
+	if got, want := strings.Join(sink.lines, ","), "pod-0/stdout: hello,pod-1/stderr: boom"; got != want {
+		t.Errorf("Sink received %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"golang.org/x/term"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// ExecInteractive runs the command on a single pod attached to a TTY, streaming stdin
+// and writing the terminal output to stdout. If stdin is a terminal it is put in raw
+// mode during the session so the keystrokes are sent as typed.
+func ExecInteractive(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod corev1.Pod, container string, command []string, stdin io.Reader, stdout io.Writer) error {
+	options := remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		// the TTY merges stderr into stdout
+		Tty: true,
+	}
+
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fd := int(f.Fd())
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to set the terminal in raw mode: %w", err)
+		}
+		defer func() { _ = term.Restore(fd, state) }()
+
+		if queue, err := newSizeQueue(func() (int, int, error) { return term.GetSize(fd) }); err == nil {
+			defer queue.stop()
+			options.TerminalSizeQueue = queue
+		}
+	}
+
+	return ExecCmd(ctx, config, clientset, pod, container, command, options)
+}
+
+// sizeQueue reports the terminal size and its changes to the remote terminal
+// until the session ends
+type sizeQueue struct {
+	// getSize returns the width and height of the terminal
+	getSize func() (int, int, error)
+	size    chan remotecommand.TerminalSize
+	resize  chan os.Signal
+	done    chan struct{}
+}
+
+// newSizeQueue queues the current size of the terminal and watches its resizes
+func newSizeQueue(getSize func() (int, int, error)) (*sizeQueue, error) {
+	q := &sizeQueue{
+		getSize: getSize,
+		size:    make(chan remotecommand.TerminalSize, 1),
+		resize:  make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	if err := q.push(); err != nil {
+		return nil, err
+	}
+	notifyResize(q.resize)
+	go q.watch()
+	return q, nil
+}
+
+// push queues the current size, replacing the one not read yet
+func (q *sizeQueue) push() error {
+	width, height, err := q.getSize()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-q.size:
+	default:
+	}
+	q.size <- remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}
+	return nil
+}
+
+func (q *sizeQueue) watch() {
+	for {
+		select {
+		case <-q.resize:
+			_ = q.push()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// stop ends the updates once the session finished
+func (q *sizeQueue) stop() {
+	signal.Stop(q.resize)
+	close(q.done)
+}
+
+// Next blocks until the terminal size changes, nil stops the updates when the session ends
+func (q *sizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-q.size:
+		return &size
+	case <-q.done:
+		return nil
+	}
+}
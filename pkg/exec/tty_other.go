@@ -0,0 +1,8 @@
+//go:build !unix
+
+package exec
+
+import "os"
+
+// notifyResize does nothing, the terminal resizes are not signaled
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,108 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestExecInteractive(t *testing.T) {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-0", Namespace: "default"}}
+
+	originalExecCmd := ExecCmd
+	defer func() { ExecCmd = originalExecCmd }()
+
+	var got remotecommand.StreamOptions
+	var received bytes.Buffer
+	ExecCmd = func(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, p corev1.Pod, container string, command []string, options remotecommand.StreamOptions) error {
+		got = options
+		// echo the input like a remote shell
+		if _, err := io.Copy(io.MultiWriter(&received, options.Stdout), options.Stdin); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	var stdout bytes.Buffer
+	if err := ExecInteractive(context.Background(), nil, nil, pod, "", []string{"sh"}, strings.NewReader("ls\nexit\n"), &stdout); err != nil {
+		t.Fatalf("ExecInteractive failed: %v", err)
+	}
+	if !got.Tty {
+		t.Error("Expected the session to use a TTY")
+	}
+	if got.Stderr != nil {
+		t.Error("Expected no stderr stream, the TTY merges it into stdout")
+	}
+	if received.String() != "ls\nexit\n" || stdout.String() != "ls\nexit\n" {
+		t.Errorf("Expected stdin to be streamed, received %q and wrote %q", received.String(), stdout.String())
+	}
+
+	// The exec request asks the API server for a TTY and stdin
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: "https://localhost:6443"})
+	if err != nil {
+		t.Fatalf("Failed to create clientset: %v", err)
+	}
+	u := execURL(clientset, pod, "", []string{"sh"}, got)
+	query := u.Query()
+	for _, param := range []string{"tty", "stdin", "stdout"} {
+		if query.Get(param) != "true" {
+			t.Errorf("Expected %s=true in the exec request %s", param, u)
+		}
+	}
+	if query.Get("stderr") == "true" {
+		t.Errorf("Expected no stderr in the exec request %s", u)
+	}
+	if !strings.HasSuffix(u.Path, "/namespaces/default/pods/pod-0/exec") {
+		t.Errorf("Unexpected exec path %s", u.Path)
+	}
+}
+
+func TestSizeQueue(t *testing.T) {
+	var mu sync.Mutex
+	width, height := 80, 24
+	q, err := newSizeQueue(func() (int, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return width, height, nil
+	})
+	if err != nil {
+		t.Fatalf("newSizeQueue failed: %v", err)
+	}
+
+	if size := q.Next(); size == nil || size.Width != 80 || size.Height != 24 {
+		t.Fatalf("Expected the initial size 80x24, got %v", size)
+	}
+
+	// the terminal is resized
+	mu.Lock()
+	width, height = 120, 40
+	mu.Unlock()
+	q.resize <- os.Interrupt
+	if size := q.Next(); size == nil || size.Width != 120 || size.Height != 40 {
+		t.Fatalf("Expected the new size 120x40, got %v", size)
+	}
+
+	// the session ends
+	next := make(chan *remotecommand.TerminalSize)
+	go func() { next <- q.Next() }()
+	q.stop()
+	select {
+	case size := <-next:
+		if size != nil {
+			t.Errorf("Expected no size after the session ends, got %v", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next did not return after the session ended")
+	}
+}
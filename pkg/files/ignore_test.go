@@ -0,0 +1,97 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{name: "extension at root", patterns: []string{"*.log"}, path: "debug.log", want: true},
+		{name: "extension nested", patterns: []string{"*.log"}, path: "logs/app/debug.log", want: true},
+		{name: "extension no match", patterns: []string{"*.log"}, path: "debug.log.txt", want: false},
+		{name: "directory only", patterns: []string{"build/"}, path: "build", isDir: true, want: true},
+		{name: "directory only nested", patterns: []string{"build/"}, path: "pkg/build", isDir: true, want: true},
+		{name: "directory only skips files", patterns: []string{"build/"}, path: "build", want: false},
+		{name: "anchored", patterns: []string{"/dist"}, path: "dist", isDir: true, want: true},
+		{name: "anchored nested", patterns: []string{"/dist"}, path: "web/dist", isDir: true, want: false},
+		{name: "middle slash anchors", patterns: []string{"doc/*.txt"}, path: "doc/notes.txt", want: true},
+		{name: "middle slash anchors nested", patterns: []string{"doc/*.txt"}, path: "src/doc/notes.txt", want: false},
+		{name: "star does not cross directories", patterns: []string{"doc/*.txt"}, path: "doc/a/notes.txt", want: false},
+		{name: "double star", patterns: []string{"**/cache"}, path: "a/b/cache", isDir: true, want: true},
+		{name: "double star middle", patterns: []string{"a/**/b"}, path: "a/x/y/b", want: true},
+		{name: "double star zero dirs", patterns: []string{"a/**/b"}, path: "a/b", want: true},
+		{name: "trailing double star", patterns: []string{"out/**"}, path: "out/x/y", want: true},
+		{name: "question mark", patterns: []string{"file?.txt"}, path: "file1.txt", want: true},
+		{name: "character class", patterns: []string{"*.py[co]"}, path: "mod.pyc", want: true},
+		{name: "negated character class", patterns: []string{"v[!0-9]"}, path: "v1", want: false},
+		{name: "negation", patterns: []string{"*.log", "!keep.log"}, path: "keep.log", want: false},
+		{name: "negation order", patterns: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "comments and blanks", patterns: []string{"# *.log", "", "   "}, path: "debug.log", want: false},
+		{name: "escaped hash", patterns: []string{`\#notes`}, path: "#notes", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ignore := &Ignore{}
+			for _, p := range tt.patterns {
+				if err := ignore.AddPattern(p); err != nil {
+					t.Fatalf("AddPattern(%q) failed: %v", p, err)
+				}
+			}
+			if got := ignore.Match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeTarIgnoreFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	for name, content := range map[string]string{
+		".krunignore":     "# build outputs\n*.log\nbuild/\n!keep.log\n",
+		".gitignore":      "/secrets\n",
+		"main.py":         "main",
+		"debug.log":       "log",
+		"keep.log":        "log",
+		"pkg/app.log":     "log",
+		"pkg/mod.py":      "mod",
+		"build/out.bin":   "bin",
+		"pkg/build/x.o":   "obj",
+		"secrets/key.pem": "key",
+	} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := MakeTar(srcDir, &buf, TarOptions{UseIgnoreFiles: true}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+	want := []string{".gitignore", ".krunignore", "keep.log", "main.py", "pkg", "pkg/mod.py"}
+	if got := tarEntries(t, &buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("MakeTar entries %v, want %v", got, want)
+	}
+
+	// The ignore files are only honored when enabled
+	buf.Reset()
+	if err := MakeTar(srcDir, &buf, TarOptions{}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+	if got := tarEntries(t, &buf); len(got) <= len(want) {
+		t.Errorf("Expected all the files without ignore files, got %v", got)
+	}
+}
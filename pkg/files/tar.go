@@ -2,14 +2,74 @@ package files
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
 )
 
-// MakeTar walks the source and writes a tarball to the writer
-func MakeTar(srcPath string, writer io.Writer, excludeRegex *regexp.Regexp) error {
+// Patterns matches a path if any of its regular expressions matches it
+type Patterns []*regexp.Regexp
+
+// CompilePatterns compiles the regular expressions, empty expressions are ignored
+func CompilePatterns(exprs []string) (Patterns, error) {
+	var patterns Patterns
+	for _, expr := range exprs {
+		if expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// MatchString reports whether any of the patterns matches s
+func (p Patterns) MatchString(s string) bool {
+	for _, re := range p {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// TarOptions selects the files added to the tarball by their path relative to the source
+type TarOptions struct {
+	// Include only adds the files matching any pattern, and their parent directories, if set
+	Include Patterns
+	// Exclude skips the paths matching any pattern, it is applied after Include.
+	// Excluded directories are skipped with all their content.
+	Exclude Patterns
+	// UseIgnoreFiles skips the paths matching the IgnoreFiles in the source root
+	UseIgnoreFiles bool
+	// FollowSymlinks adds the content of the files and directories the symlinks
+	// point to instead of the symlinks, the symlinks creating a loop are skipped.
+	FollowSymlinks bool
+	// MaxFileSize skips the regular files larger than this size in bytes, unlimited if 0
+	MaxFileSize int64
+	// ChmodExec adds the execute bit to the regular files matching any pattern,
+	// for sources that do not preserve it like some mounted volumes.
+	ChmodExec Patterns
+	// OnEntry is called before writing each entry, once the previous entry is
+	// completely written, so the output can be split at the entry boundaries.
+	// It is called with a nil header before writing the end of the archive.
+	OnEntry func(header *tar.Header) error
+}
+
+// MakeTar walks the source and writes a tarball to the writer.
+// The entries are sorted by their full relative path, so the same tree always
+// produces the same tarball and the chunk boundaries are stable between runs.
+func MakeTar(srcPath string, writer io.Writer, opts TarOptions) error {
 	absSrcPath, err := filepath.Abs(filepath.Clean(srcPath))
 	if err != nil {
 		return err
@@ -30,55 +90,183 @@ func MakeTar(srcPath string, writer io.Writer, excludeRegex *regexp.Regexp) erro
 		baseDir = filepath.Dir(absSrcPath)
 	}
 
+	var ignore *Ignore
+	if opts.UseIgnoreFiles {
+		ignore, err = LoadIgnoreFiles(baseDir)
+		if err != nil {
+			return fmt.Errorf("failed to load ignore files: %w", err)
+		}
+	}
+
 	tw := tar.NewWriter(writer)
 	defer tw.Close() //nolint:errcheck
 
-	return filepath.Walk(absSrcPath, func(file string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	writeHeader := func(header *tar.Header) error {
+		if opts.OnEntry != nil {
+			// Write the padding of the previous entry so it is not part of the next one
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if err := opts.OnEntry(header); err != nil {
+				return err
+			}
 		}
+		return tw.WriteHeader(header)
+	}
 
-		// Rebase the path so it's relative to the upload root
-		relPath, err := filepath.Rel(baseDir, file)
-		if err != nil {
-			return err
-		}
+	// The entries are collected and written sorted by their full path, not in
+	// the walk order, so the same tree always produces the same tarball.
+	type entry struct {
+		path    string
+		relPath string
+		fi      os.FileInfo
+	}
+	var entries []entry
 
-		// If we are uploading a directory, the walk starts with the directory itself.
-		// Its relative path is ".". We skip adding a tar entry for "." to avoid
-		// messing with the destination root permissions or creating a "./" folder.
-		if relPath == "." {
-			return nil
+	// With include patterns the directories are only added as parents of included files
+	addedDirs := make(map[string]bool)
+	addParents := func(relPath string) error {
+		for dir := filepath.Dir(relPath); dir != "." && !addedDirs[dir]; dir = filepath.Dir(dir) {
+			path := filepath.Join(baseDir, dir)
+			stat := os.Lstat
+			if opts.FollowSymlinks {
+				stat = os.Stat
+			}
+			fi, err := stat(path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{path: path, relPath: dir, fi: fi})
+			addedDirs[dir] = true
 		}
+		return nil
+	}
+
+	// walk adds the entries of the tree, relRoot is the path of root relative
+	// to the upload root, it differs from the real path inside followed symlinks.
+	// following holds the real paths of the symlinked directories being walked.
+	var walk func(root, relRoot string, following map[string]bool) error
+	walk = func(root, relRoot string, following map[string]bool) error {
+		return filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Rebase the path so it's relative to the upload root
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			relPath := filepath.Join(relRoot, rel)
+
+			// If we are uploading a directory, the walk starts with the directory itself.
+			// Its relative path is ".". We skip adding a tar entry for "." to avoid
+			// messing with the destination root permissions or creating a "./" folder.
+			if relPath == "." {
+				return nil
+			}
+
+			if opts.Exclude.MatchString(relPath) || ignore.Match(filepath.ToSlash(relPath), fi.IsDir()) {
+				// If it matches and is a directory, skip the whole tree
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				// If it's a file, just skip adding it
+				return nil
+			}
+
+			if opts.FollowSymlinks && fi.Mode()&os.ModeSymlink != 0 {
+				target, err := filepath.EvalSymlinks(file)
+				if err != nil {
+					klog.Warningf("Skipping broken symlink %s: %v", relPath, err)
+					return nil
+				}
+				targetInfo, err := os.Stat(target)
+				if err != nil {
+					return err
+				}
+				if targetInfo.IsDir() {
+					// a directory containing the symlink would be walked forever
+					dir, err := filepath.EvalSymlinks(filepath.Dir(file))
+					if err != nil {
+						return err
+					}
+					if following[target] || dir == target || strings.HasPrefix(dir, target+string(filepath.Separator)) {
+						klog.Warningf("Skipping symlink %s to %s, it creates a loop", relPath, target)
+						return nil
+					}
+					followed := maps.Clone(following)
+					followed[target] = true
+					return walk(target, relPath, followed)
+				}
+				fi = targetInfo
+			}
+
+			// Sockets, fifos and devices can not be extracted, and reading a fifo blocks
+			if fi.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0 {
+				klog.Warningf("Skipping special file %s", relPath)
+				return nil
+			}
+
+			if opts.MaxFileSize > 0 && fi.Mode().IsRegular() && fi.Size() > opts.MaxFileSize {
+				klog.Warningf("Skipping file %s, its size %d is larger than the maximum %d", relPath, fi.Size(), opts.MaxFileSize)
+				return nil
+			}
 
-		if excludeRegex != nil && excludeRegex.MatchString(relPath) {
-			// If it matches and is a directory, skip the whole tree
-			if fi.IsDir() {
-				return filepath.SkipDir
+			if len(opts.Include) > 0 {
+				// Directories are walked, they are added once a file inside is included
+				if fi.IsDir() || !opts.Include.MatchString(relPath) {
+					return nil
+				}
+				if err := addParents(relPath); err != nil {
+					return err
+				}
 			}
-			// If it's a file, just skip adding it
+			entries = append(entries, entry{path: file, relPath: relPath, fi: fi})
 			return nil
-		}
+		})
+	}
+	relRoot, err := filepath.Rel(baseDir, absSrcPath)
+	if err != nil {
+		return err
+	}
+	if err := walk(absSrcPath, relRoot, map[string]bool{}); err != nil {
+		return err
+	}
 
-		// Create header
-		header, err := tar.FileInfoHeader(fi, fi.Name())
+	// The parents sort before their content
+	sort.Slice(entries, func(i, j int) bool {
+		return filepath.ToSlash(entries[i].relPath) < filepath.ToSlash(entries[j].relPath)
+	})
+
+	writeEntry := func(e entry) error {
+		var link string
+		if e.fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(e.path)
+			if err != nil {
+				return err
+			}
+			link = target
+		}
+		header, err := tar.FileInfoHeader(e.fi, link)
 		if err != nil {
 			return err
 		}
+		header.Name = e.relPath
 
-		header.Name = relPath
-
-		// Ensure binaries are executable (simple heuristic: if we are uploading, preserve local mode)
-		// header.Mode is already populated by FileInfoHeader from local file
-		if err := tw.WriteHeader(header); err != nil {
+		// header.Mode is already populated by FileInfoHeader from the local file
+		if e.fi.Mode().IsRegular() && opts.ChmodExec.MatchString(e.relPath) {
+			header.Mode |= 0111
+		}
+		if err := writeHeader(header); err != nil {
 			return err
 		}
 
-		if !fi.Mode().IsRegular() {
+		if !e.fi.Mode().IsRegular() {
 			return nil
 		}
 
-		f, err := os.Open(file)
+		f, err := os.Open(e.path)
 		if err != nil {
 			return err
 		}
@@ -86,5 +274,67 @@ func MakeTar(srcPath string, writer io.Writer, excludeRegex *regexp.Regexp) erro
 
 		_, err = io.Copy(tw, f)
 		return err
-	})
+	}
+	for _, e := range entries {
+		if err := writeEntry(e); err != nil {
+			return err
+		}
+	}
+	if opts.OnEntry != nil {
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := opts.OnEntry(nil); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ExtractTar writes the directories and regular files of the tarball into destDir.
+// Entries escaping destDir are rejected, symlinks and special files are skipped
+// so nothing can be written outside the destination.
+func ExtractTar(reader io.Reader, destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destDir, header.Name)
+		rel, err := filepath.Rel(destDir, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q in tarball", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
 }
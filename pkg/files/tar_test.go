@@ -0,0 +1,343 @@
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMakeTarExtractTar(t *testing.T) {
+	srcDir := t.TempDir()
+	srcFiles := map[string]string{
+		"out/model.bin":        "weights",
+		"out/logs/metrics.txt": "loss=0.1",
+	}
+	for name, content := range srcFiles {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := MakeTar(filepath.Join(srcDir, "out"), &buf, TarOptions{}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+
+	destDir := filepath.Join(t.TempDir(), "pod-0")
+	if err := ExtractTar(&buf, destDir); err != nil {
+		t.Fatalf("ExtractTar failed: %v", err)
+	}
+	// MakeTar strips the directory name
+	for name, content := range srcFiles {
+		got, err := os.ReadFile(filepath.Join(destDir, name[len("out/"):]))
+		if err != nil {
+			t.Fatalf("Failed to read extracted file: %v", err)
+		}
+		if string(got) != content {
+			t.Errorf("Extracted %s = %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestExtractTarRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{name: "parent", entry: "../evil.txt"},
+		{name: "nested parent", entry: "a/../../evil.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tar.Header{Name: tt.entry, Mode: 0644, Size: 4}); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			if _, err := tw.Write([]byte("evil")); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Failed to close tar writer: %v", err)
+			}
+
+			root := t.TempDir()
+			destDir := filepath.Join(root, "dest")
+			if err := ExtractTar(&buf, destDir); err == nil {
+				t.Fatal("Expected ExtractTar to reject the entry")
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil.txt")); !os.IsNotExist(err) {
+				t.Errorf("Entry was written outside the destination")
+			}
+		})
+	}
+}
+
+func TestMakeTarExcludePatterns(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, name := range []string{
+		"main.py",
+		"pkg/model.py",
+		"pkg/__pycache__/model.cpython-312.pyc",
+		".git/HEAD",
+		".venv/bin/python",
+		"data/.cache/blob",
+	} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{
+			name: "no patterns",
+			want: []string{".git", ".git/HEAD", ".venv", ".venv/bin", ".venv/bin/python", "data", "data/.cache", "data/.cache/blob", "main.py", "pkg", "pkg/__pycache__", "pkg/__pycache__/model.cpython-312.pyc", "pkg/model.py"},
+		},
+		{
+			name:     "unrelated patterns",
+			patterns: []string{`^\.git$`, `__pycache__`, `^\.venv$`},
+			want:     []string{"data", "data/.cache", "data/.cache/blob", "main.py", "pkg", "pkg/model.py"},
+		},
+		{
+			name:     "overlapping patterns",
+			patterns: []string{`(^|/)\.`, `^\.git$`, `\.pyc$`, `__pycache__`},
+			want:     []string{"data", "main.py", "pkg", "pkg/model.py"},
+		},
+		{
+			name:     "empty patterns are ignored",
+			patterns: []string{"", `(^|/)\.`},
+			want:     []string{"data", "main.py", "pkg", "pkg/__pycache__", "pkg/__pycache__/model.cpython-312.pyc", "pkg/model.py"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exclude, err := CompilePatterns(tt.patterns)
+			if err != nil {
+				t.Fatalf("CompilePatterns failed: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := MakeTar(srcDir, &buf, TarOptions{Exclude: exclude}); err != nil {
+				t.Fatalf("MakeTar failed: %v", err)
+			}
+			if got := tarEntries(t, &buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MakeTar entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := CompilePatterns([]string{"("}); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+}
+
+func tarEntries(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var entries []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		entries = append(entries, header.Name)
+	}
+}
+
+func TestMakeTarIncludePatterns(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, name := range []string{
+		"train.py",
+		"README.md",
+		"src/model.py",
+		"src/weights.bin",
+		"src/tests/test_model.py",
+		"data/raw/input.csv",
+	} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "include only",
+			include: []string{`\.py$`},
+			want:    []string{"src", "src/model.py", "src/tests", "src/tests/test_model.py", "train.py"},
+		},
+		{
+			name:    "exclude only",
+			exclude: []string{`^data$`, `\.bin$`},
+			want:    []string{"README.md", "src", "src/model.py", "src/tests", "src/tests/test_model.py", "train.py"},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{`\.py$`, `\.csv$`},
+			exclude: []string{`(^|/)tests$`},
+			want:    []string{"data", "data/raw", "data/raw/input.csv", "src", "src/model.py", "train.py"},
+		},
+		{
+			name:    "exclude applied after include",
+			include: []string{`\.py$`},
+			exclude: []string{`^train\.py$`},
+			want:    []string{"src", "src/model.py", "src/tests", "src/tests/test_model.py"},
+		},
+		{
+			name:    "nothing included",
+			include: []string{`\.go$`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			include, err := CompilePatterns(tt.include)
+			if err != nil {
+				t.Fatalf("CompilePatterns failed: %v", err)
+			}
+			exclude, err := CompilePatterns(tt.exclude)
+			if err != nil {
+				t.Fatalf("CompilePatterns failed: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := MakeTar(srcDir, &buf, TarOptions{Include: include, Exclude: exclude}); err != nil {
+				t.Fatalf("MakeTar failed: %v", err)
+			}
+			if got := tarEntries(t, &buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MakeTar entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeTarChmodExec(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, name := range []string{"bin/start.sh", "bin/lib/setup.sh", "train.py"} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	chmodExec, err := CompilePatterns([]string{`\.sh$`})
+	if err != nil {
+		t.Fatalf("CompilePatterns failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := MakeTar(srcDir, &buf, TarOptions{ChmodExec: chmodExec}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+	// execute bits of the regular files
+	want := map[string]int64{
+		"bin/lib/setup.sh": 0111,
+		"bin/start.sh":     0111,
+		"train.py":         0,
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if mode := header.Mode & 0111; mode != want[header.Name] {
+			t.Errorf("Entry %s execute bits %o, want %o", header.Name, mode, want[header.Name])
+		}
+	}
+}
+
+func TestMakeTarDeterministic(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, name := range []string{"a/b/c.txt", "a.txt", "a/z.txt", "b-c/d.txt", "b/e.txt"} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	var first, second bytes.Buffer
+	if err := MakeTar(srcDir, &first, TarOptions{}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+	if err := MakeTar(srcDir, &second, TarOptions{}); err != nil {
+		t.Fatalf("MakeTar failed: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("The tarballs of the same tree are different")
+	}
+
+	// sorted by full path, not in the walk order
+	want := []string{"a", "a.txt", "a/b", "a/b/c.txt", "a/z.txt", "b", "b-c", "b-c/d.txt", "b/e.txt"}
+	if got := tarEntries(t, &first); !reflect.DeepEqual(got, want) {
+		t.Errorf("MakeTar entries %v, want %v", got, want)
+	}
+}
+
+func TestMakeTarMaxFileSize(t *testing.T) {
+	srcDir := t.TempDir()
+	for name, size := range map[string]int{"train.py": 100, "core": 4096, "data/small.csv": 1024, "data/large.csv": 1025} {
+		p := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		maxFileSize int64
+		want        []string
+	}{
+		{name: "unlimited", want: []string{"core", "data", "data/large.csv", "data/small.csv", "train.py"}},
+		{name: "limit", maxFileSize: 1024, want: []string{"data", "data/small.csv", "train.py"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := MakeTar(srcDir, &buf, TarOptions{MaxFileSize: tt.maxFileSize}); err != nil {
+				t.Fatalf("MakeTar failed: %v", err)
+			}
+			if got := tarEntries(t, &buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MakeTar entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+//go:build unix
+
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMakeTarSkipsSpecialFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "train.py"), []byte("print()"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(srcDir, "events.fifo"), 0644); err != nil {
+		t.Fatalf("Failed to create fifo: %v", err)
+	}
+
+	for _, include := range [][]string{nil, {`\.(fifo|py)$`}} {
+		patterns, err := CompilePatterns(include)
+		if err != nil {
+			t.Fatalf("CompilePatterns failed: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := MakeTar(srcDir, &buf, TarOptions{Include: patterns}); err != nil {
+			t.Fatalf("MakeTar failed: %v", err)
+		}
+		if got, want := tarEntries(t, &buf), []string{"train.py"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("MakeTar entries %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMakeTarSymlinks(t *testing.T) {
+	shared := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(shared, "raw"), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, "raw", "input.csv"), []byte("a,b"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "train.py"), []byte("print()"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	for link, target := range map[string]string{
+		"data":     shared,
+		"main.py":  "train.py",
+		"loop":     ".",
+		"missing":  "nowhere",
+		"raw-loop": filepath.Join(shared, "raw"),
+	} {
+		if err := os.Symlink(target, filepath.Join(srcDir, link)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	// a symlink to its own parent inside the followed directory
+	if err := os.Symlink("..", filepath.Join(shared, "raw", "parent")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+		want   map[string]string
+	}{
+		{
+			name: "store symlinks",
+			want: map[string]string{
+				"data":     "-> " + shared,
+				"loop":     "-> .",
+				"main.py":  "-> train.py",
+				"missing":  "-> nowhere",
+				"raw-loop": "-> " + filepath.Join(shared, "raw"),
+				"train.py": "print()",
+			},
+		},
+		{
+			name:   "follow symlinks",
+			follow: true,
+			want: map[string]string{
+				"data":               "",
+				"data/raw":           "",
+				"data/raw/input.csv": "a,b",
+				"main.py":            "print()",
+				"raw-loop":           "",
+				"raw-loop/input.csv": "a,b",
+				"train.py":           "print()",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := MakeTar(srcDir, &buf, TarOptions{FollowSymlinks: tt.follow}); err != nil {
+				t.Fatalf("MakeTar failed: %v", err)
+			}
+			got := map[string]string{}
+			tr := tar.NewReader(&buf)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to read tar: %v", err)
+				}
+				switch header.Typeflag {
+				case tar.TypeSymlink:
+					got[header.Name] = "-> " + header.Linkname
+				case tar.TypeReg:
+					data, err := io.ReadAll(tr)
+					if err != nil {
+						t.Fatalf("Failed to read entry: %v", err)
+					}
+					got[header.Name] = string(data)
+				default:
+					got[header.Name] = ""
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MakeTar entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeTarMutualSymlinks(t *testing.T) {
+	srcDir := t.TempDir()
+	for dir, link := range map[string]string{"a": "../b", "b": "../a"} {
+		if err := os.MkdirAll(filepath.Join(srcDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(srcDir, dir, "file"), []byte(dir), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err := os.Symlink(link, filepath.Join(srcDir, dir, "to"+filepath.Base(link))); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- MakeTar(srcDir, &buf, TarOptions{FollowSymlinks: true})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("MakeTar failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("MakeTar did not return, the symlinks were followed in a loop")
+	}
+
+	got := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		got[header.Name] = true
+	}
+	for _, name := range []string{"a/file", "b/file", "a/tob/file", "b/toa/file"} {
+		if !got[name] {
+			t.Errorf("Expected %s in the tar, got %v", name, got)
+		}
+	}
+}